@@ -1,5 +1,11 @@
 package common
 
+import (
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
 // CommandID command id type
 type CommandID int
 
@@ -8,18 +14,50 @@ const (
 	LOGIN CommandID = iota
 	// LOGOUT used to indicate the client to log itself out
 	LOGOUT
-	// KILL used to indicate a client to terminate its reading loop
+	// KILL used to refuse the LOGIN of a client, logged in clients are killed
+	// by closing the Kill channel of their WELCOME
 	KILL
 	// READING typically every 25ms each connected device sends a payload of 40 bytes reading message
 	READING
 	// READING sent by the server after a succesfull login
 	WELCOME
+	// DOWNLINK sent by the server to a logged in device, its Body is a
+	// downlink frame the device client writes to the connection
+	DOWNLINK
+	// ACK sent by a device client when the device acknowledges a downlink, its
+	// Body is the ack frame
+	ACK
 )
 
 // Command is used to send data between clients and server core
 type Command struct {
-	ID              CommandID
-	Sender          uint64
+	ID     CommandID
+	Sender uint64
+	// Session identifies the connection of the sender, the core assigns it on
+	// WELCOME and the device sends it back on LOGOUT
+	Session         uint64
 	CallbackChannel chan Command
-	Body            []byte
+	// Kill is sent on WELCOME, the core closes it when the session must
+	// terminate. Unlike a KILL command it can not be dropped.
+	Kill <-chan struct{}
+	Body []byte
+	// Protocol version of the sender of a READING command, 0 when it is not
+	// known and the version is told by the Body
+	Protocol int
+	// Logger of the connection sending a LOGIN command, its records carry the
+	// connection ID, remote address and IMEI
+	Logger *logging.Logger
+	// Conn describes the connection sending a LOGIN command
+	Conn *ConnInfo
+	// Reason why the sender of a LOGOUT command disconnected
+	Reason string
+}
+
+// ConnInfo describes the connection of a device, the device client keeps
+// BytesRead up to date until the connection is closed.
+type ConnInfo struct {
+	Remote      string
+	ConnectedAt time.Time
+	// BytesRead from the connection, updated atomically
+	BytesRead uint64
 }
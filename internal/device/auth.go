@@ -0,0 +1,104 @@
+package device
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Authenticated logins.
+//
+// When the server requires authentication it answers the IMEI frame with a
+// random challenge, and the device must send back its response before
+// anything else, the V2Marker included:
+//
+//	| Field     | Size | Notes                                              |
+//	| --------- | ---- | -------------------------------------------------- |
+//	| Challenge | 16   | random bytes sent by the server                    |
+//	| Response  | 32   | HMAC-SHA256 of the challenge and the IMEI, 8 bytes |
+//	|           |      | BE, keyed with the secret of the device            |
+const (
+	ChallengeSize = 16
+	ResponseSize  = sha256.Size
+)
+
+// AuthResult is the outcome of an authenticated login.
+type AuthResult int
+
+const (
+	// AuthOK means the device proved it knows its secret.
+	AuthOK AuthResult = iota
+	// AuthUnknownDevice means there is no secret for the IMEI.
+	AuthUnknownDevice
+	// AuthBadResponse means the response does not match the secret.
+	AuthBadResponse
+	// AuthNoResponse means the device did not send its response in time.
+	AuthNoResponse
+)
+
+func (r AuthResult) String() string {
+	switch r {
+	case AuthOK:
+		return "ok"
+	case AuthUnknownDevice:
+		return "unknown-device"
+	case AuthBadResponse:
+		return "bad-response"
+	case AuthNoResponse:
+		return "no-response"
+	}
+	return fmt.Sprintf("AuthResult(%d)", int(r))
+}
+
+// Authenticator holds the secrets of the devices allowed to log in.
+type Authenticator interface {
+	// Secret returns the secret of imei, ok is unset for unknown devices.
+	Secret(imei uint64) (secret []byte, ok bool)
+	// Authenticated is called with the outcome of every authenticated login.
+	Authenticated(imei uint64, result AuthResult)
+}
+
+// AuthResponse returns the response of a device with the given secret and
+// imei to challenge.
+func AuthResponse(secret []byte, imei uint64, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(challenge)
+	var imeiBytes [8]byte
+	binary.BigEndian.PutUint64(imeiBytes[:], imei)
+	mac.Write(imeiBytes[:])
+	return mac.Sum(nil)
+}
+
+// RequireAuthentication makes the client challenge the device right after its
+// IMEI frame, the login is rejected unless its response matches the secret
+// found in auth.
+func (c *Client) RequireAuthentication(auth Authenticator) {
+	c.auth = auth
+}
+
+// authenticate challenges the device logging in with imei.
+func (c *Client) authenticate(imei uint64) (AuthResult, error) {
+	var challenge [ChallengeSize]byte
+	if _, err := rand.Read(challenge[:]); err != nil {
+		return AuthNoResponse, fmt.Errorf("generating challenge, %v", err)
+	}
+	if _, err := c.conn.Write(challenge[:]); err != nil {
+		return AuthNoResponse, fmt.Errorf("sending challenge, %v", err)
+	}
+	var response [ResponseSize]byte
+	if _, err := c.frames.readFrame(response[:]); err != nil {
+		return AuthNoResponse, fmt.Errorf("reading challenge response, %w", err)
+	}
+	// unknown devices are challenged as well, so they can not be told apart
+	// from known devices sending a bad response
+	secret, ok := c.auth.Secret(imei)
+	if !ok {
+		return AuthUnknownDevice, fmt.Errorf("no secret for IMEI %d", imei)
+	}
+	if !hmac.Equal(response[:], AuthResponse(secret, imei, challenge[:])) {
+		return AuthBadResponse, fmt.Errorf("bad challenge response of IMEI %d", imei)
+	}
+	return AuthOK, nil
+}
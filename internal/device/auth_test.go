@@ -0,0 +1,87 @@
+package device
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/common"
+)
+
+// testAuthenticator knows the secret of one device and records the results.
+type testAuthenticator struct {
+	imei    uint64
+	secret  []byte
+	results []AuthResult
+}
+
+func (a *testAuthenticator) Secret(imei uint64) ([]byte, bool) {
+	return a.secret, imei == a.imei
+}
+
+func (a *testAuthenticator) Authenticated(imei uint64, result AuthResult) {
+	a.results = append(a.results, result)
+}
+
+func TestClient_Authenticate(t *testing.T) {
+	const imei = 490154203237518
+	tests := map[string]struct {
+		imei     uint64
+		secret   []byte
+		expected AuthResult
+	}{
+		"ok":             {imei, []byte("s3cr3t"), AuthOK},
+		"bad response":   {imei, []byte("guessed"), AuthBadResponse},
+		"unknown device": {448324242329542, []byte("s3cr3t"), AuthUnknownDevice},
+	}
+	for name, tt := range tests {
+		server, dev := net.Pipe()
+		client, err := NewClient(server, make(chan common.Command), time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.RequireAuthentication(&testAuthenticator{imei: imei, secret: []byte("s3cr3t")})
+		go func() {
+			var challenge [ChallengeSize]byte
+			if _, err := io.ReadFull(dev, challenge[:]); err != nil {
+				return
+			}
+			dev.Write(AuthResponse(tt.secret, tt.imei, challenge[:]))
+		}()
+
+		result, err := client.authenticate(tt.imei)
+		if result != tt.expected {
+			t.Errorf("%s: expected %v got %v", name, tt.expected, result)
+		}
+		if (err == nil) != (tt.expected == AuthOK) {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+		server.Close()
+		dev.Close()
+	}
+}
+
+func TestClient_Authenticate_NoResponse(t *testing.T) {
+	server, dev := net.Pipe()
+	defer dev.Close()
+	client, err := NewClient(server, make(chan common.Command), time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &testAuthenticator{imei: 490154203237518, secret: []byte("s3cr3t")}
+	client.RequireAuthentication(auth)
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	go func() {
+		dev.Write([]byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8})
+		var challenge [ChallengeSize]byte
+		io.ReadFull(dev, challenge[:])
+	}()
+
+	if err := client.receiveLoginMessage(); err == nil {
+		t.Error("expected the login to be rejected")
+	}
+	if len(auth.results) != 1 || auth.results[0] != AuthNoResponse {
+		t.Errorf("expected a single %v result got %v", AuthNoResponse, auth.results)
+	}
+}
@@ -1,58 +1,293 @@
 package device
 
 import (
-	"log"
+	"crypto/tls"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/logging"
 )
 
+// SimulatorConfig holds the settings of a simulated device.
+type SimulatorConfig struct {
+	// ServerAddress (host:port) of the thermomatic server.
+	ServerAddress string
+	// IMEI of the device.
+	IMEI string
+	// NumReadings is the number of readings to send, 0 sends readings forever.
+	NumReadings uint
+	// ReadingRate is the interval between readings of Randomatic.
+	ReadingRate time.Duration
+	// Protocol version spoken by the device, ProtocolV1 or ProtocolV2.
+	Protocol uint
+	// TLS connects to the server over TLS when it is not nil.
+	TLS *tls.Config
+	// Secret answers the login challenge of servers which require
+	// authentication, empty when they do not.
+	Secret string
+}
+
 // Randomatic implements a simple TCP client that sends `n` random readings after login
-func Randomatic(clientServerAddress *string, clientImei *string, numReadings *uint, readingRate *uint) {
-	baseClient(clientServerAddress, clientImei, time.Duration(*readingRate)*time.Millisecond, time.Nanosecond, numReadings)
+func Randomatic(cfg SimulatorConfig) {
+	baseClient(cfg, cfg.ReadingRate, time.Nanosecond)
 }
 
 // Slowmatic implements a client that will be send be disconected by the server  because it takes more than 2 seconds between msgs
-func Slowmatic(clientServerAddress *string, clientImei *string, numReadings *uint) {
-	baseClient(clientServerAddress, clientImei, 3*time.Second, time.Nanosecond, numReadings)
+func Slowmatic(cfg SimulatorConfig) {
+	baseClient(cfg, 3*time.Second, time.Nanosecond)
 }
 
 // TooSlowToPlayWithGrownups implements a client that is too slow to send the initial login message, so the server will disconnect the connection
-func TooSlowToPlayWithGrownups(clientServerAddress *string, clientImei *string, numReadings *uint) {
-	baseClient(clientServerAddress, clientImei, time.Second, 2*time.Second, numReadings)
+func TooSlowToPlayWithGrownups(cfg SimulatorConfig) {
+	baseClient(cfg, time.Second, 2*time.Second)
+}
+
+func baseClient(cfg SimulatorConfig, readingRate time.Duration, sleepBeforeLogin time.Duration) {
+	if cfg.Protocol != ProtocolV1 && cfg.Protocol != ProtocolV2 {
+		logging.Error(fmt.Sprintf("unknown protocol version %d, it could be %d or %d", cfg.Protocol, ProtocolV1, ProtocolV2))
+		os.Exit(1)
+	}
+	sim := &simulator{
+		address:          cfg.ServerAddress,
+		imei:             cfg.IMEI,
+		protocol:         int(cfg.Protocol),
+		tlsConfig:        cfg.TLS,
+		secret:           secretBytes(cfg.Secret),
+		sleepBeforeLogin: sleepBeforeLogin,
+		readingRate:      int64(readingRate),
+		rebootDelay:      rebootDelay,
+		log:              logging.Default().With(logging.F("imei", cfg.IMEI)),
+	}
+	if err := sim.run(cfg.NumReadings); err != nil {
+		sim.log.Error("simulating device", logging.F("err", err))
+		os.Exit(1)
+	}
+}
+
+func secretBytes(secret string) []byte {
+	if secret == "" {
+		return nil
+	}
+	return []byte(secret)
+}
+
+// rebootDelay is how long a simulated device is offline when rebooting.
+const rebootDelay = time.Second
+
+// simulator is a simulated device which sends random readings and applies the
+// downlink commands sent by the server.
+type simulator struct {
+	address          string
+	imei             string
+	protocol         int
+	tlsConfig        *tls.Config
+	secret           []byte
+	sleepBeforeLogin time.Duration
+	rebootDelay      time.Duration
+	// readingRate is the interval between readings in nanoseconds, it is
+	// updated atomically by SetReadingInterval commands
+	readingRate int64
+	// clockOffset is the difference with the server clock in nanoseconds set
+	// by TimeSync commands, updated atomically
+	clockOffset int64
+	// sequence is the number of readings sent, v2 readings carry it
+	sequence uint32
+	// writeMux serializes the readings and the acks written to the connection
+	writeMux sync.Mutex
+	log      *logging.Logger
+}
+
+// run sends numReadings readings, or readings forever if numReadings is 0,
+// reconnecting whenever the server requests a reboot.
+func (s *simulator) run(numReadings uint) error {
+	sent := uint(0)
+	for {
+		conn, err := s.login()
+		if err != nil {
+			return err
+		}
+		reboot := make(chan struct{})
+		go s.receiveDownlinks(conn, reboot)
+
+		sent, err = s.sendReadings(conn, sent, numReadings, reboot)
+		conn.Close()
+		select {
+		case <-reboot:
+			s.log.Info("rebooting")
+			time.Sleep(s.rebootDelay)
+		default:
+			return err
+		}
+	}
 }
 
-func baseClient(clientServerAddress *string, clientImei *string, readingRate time.Duration, sleepBeforeLogin time.Duration, numReadings *uint) {
-	log.Printf("Connecting to %s", *clientServerAddress)
-	conn, err := net.Dial("tcp", *clientServerAddress)
+func (s *simulator) login() (net.Conn, error) {
+	s.log.Info("connecting", logging.F("server", s.address))
+	conn, err := s.dial()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer conn.Close()
 
-	log.Printf("DEBUG: converting imei %s to bytes", *clientImei)
-	imeiBytes, err := common.ImeiStringToBytes(clientImei)
+	imeiBytes, err := common.ImeiStringToBytes(&s.imei)
 	if err != nil {
-		log.Fatal(err)
+		conn.Close()
+		return nil, err
+	}
+	s.log.Debug("sending login")
+	time.Sleep(s.sleepBeforeLogin)
+	login := imeiBytes[:]
+	if s.protocol == ProtocolV2 && s.secret == nil {
+		login = append(login, V2Marker)
 	}
-	log.Printf("DEBUG: sending login imei %v to server", imeiBytes)
-	time.Sleep(sleepBeforeLogin)
-	n, err := conn.Write(imeiBytes[:])
+	n, err := conn.Write(login)
 	if err != nil {
-		log.Fatalf("Error trying to send IMEI %v", err)
+		conn.Close()
+		return nil, fmt.Errorf("Error trying to send IMEI %v", err)
 	}
+	s.log.Debug("login sent", logging.F("bytes", n))
+	if s.secret != nil {
+		if err := s.answerChallenge(conn, imeiBytes[:]); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
 
-	log.Printf("DEBUG: %d bytes sent", n)
-	for i := uint(0); i < *numReadings || *numReadings == 0; i++ {
-		randomReading := CreateRandReadingBytes()
-		log.Printf("DEBUG: [%d] sending reading %v to server", i, randomReading)
-		n, err := conn.Write(randomReading[:])
-		log.Printf("DEBUG: [%d] %d bytes sent", i, n)
+// answerChallenge sends the response to the challenge of the server, followed
+// by V2Marker for v2 devices.
+func (s *simulator) answerChallenge(conn net.Conn, imeiBytes []byte) error {
+	imei, err := decodeIMEI(imeiBytes)
+	if err != nil {
+		return err
+	}
+	var challenge [ChallengeSize]byte
+	if _, err := io.ReadFull(conn, challenge[:]); err != nil {
+		return fmt.Errorf("Error trying to read the challenge %v", err)
+	}
+	response := AuthResponse(s.secret, imei, challenge[:])
+	if s.protocol == ProtocolV2 {
+		response = append(response, V2Marker)
+	}
+	if _, err := conn.Write(response); err != nil {
+		return fmt.Errorf("Error trying to send the challenge response %v", err)
+	}
+	s.log.Debug("challenge response sent")
+	return nil
+}
+
+func (s *simulator) dial() (net.Conn, error) {
+	if s.tlsConfig == nil {
+		return net.Dial("tcp", s.address)
+	}
+	conn, err := tls.Dial("tcp", s.address, s.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// sendReadings sends readings until numReadings were sent in total or reboot
+// is closed, it returns the total number of readings sent.
+func (s *simulator) sendReadings(conn net.Conn, sent uint, numReadings uint, reboot <-chan struct{}) (uint, error) {
+	for ; sent < numReadings || numReadings == 0; sent++ {
+		select {
+		case <-reboot:
+			return sent, nil
+		default:
+		}
+		randomReading := s.nextReading()
+		n, err := s.write(conn, randomReading)
+		s.log.Debug("reading sent", logging.F("reading", int(sent)), logging.F("bytes", n))
 		if err != nil {
-			log.Fatalf("Error trying to send reading %v", err)
+			return sent, fmt.Errorf("Error trying to send reading %v", err)
 		}
-		time.Sleep(readingRate)
+		time.Sleep(time.Duration(atomic.LoadInt64(&s.readingRate)))
 	}
+	return sent, nil
+}
 
+// nextReading returns the next random reading to send, v2 readings have every
+// optional field.
+func (s *simulator) nextReading() []byte {
+	payload := CreateRandReadingBytes()
+	if s.protocol != ProtocolV2 {
+		return payload[:]
+	}
+	var reading Reading
+	reading.Decode(payload[:])
+	s.sequence++
+	reading.Sequence = s.sequence
+	reading.DeviceEpoch = time.Now().UnixNano() + atomic.LoadInt64(&s.clockOffset)
+	reading.Humidity = randFloat(humidityMin, humidityMax)
+	reading.SignalStrength = int8(randFloat(-120, -40))
+	reading.Fields = FieldSequence | FieldDeviceEpoch | FieldHumidity | FieldSignalStrength
+	return AppendFrameV2(nil, AppendPayloadV2(nil, &reading))
+}
+
+// ackFrame returns the ack frame as sent in the protocol of the simulator.
+func (s *simulator) ackFrame(ack Ack) []byte {
+	frame := ack.Encode()
+	if s.protocol != ProtocolV2 {
+		return frame[:]
+	}
+	return AppendFrameV2(nil, frame[:])
+}
+
+func (s *simulator) write(conn net.Conn, b []byte) (int, error) {
+	s.writeMux.Lock()
+	defer s.writeMux.Unlock()
+	return conn.Write(b)
+}
+
+// receiveDownlinks applies and acknowledges the downlink commands received
+// from conn until it is closed. It closes reboot after acknowledging a Reboot.
+func (s *simulator) receiveDownlinks(conn net.Conn, reboot chan<- struct{}) {
+	frames := newFrameReader(conn)
+	var frame [DownlinkFrameSize]byte
+	for {
+		if _, err := frames.readFrame(frame[:]); err != nil {
+			return
+		}
+		var d Downlink
+		if !d.Decode(frame[:]) {
+			s.log.Warn("unknown downlink frame", logging.F("frame", fmt.Sprint(frame)))
+			continue
+		}
+		ack := Ack{ID: d.ID, Status: s.apply(d)}
+		s.log.Debug("downlink applied", logging.F("command", d.ID), logging.F("type", d.Type), logging.F("arg", d.Arg),
+			logging.F("status", ack.Status))
+		if _, err := s.write(conn, s.ackFrame(ack)); err != nil {
+			s.log.Error("sending ack", logging.F("command", d.ID), logging.F("err", err))
+			return
+		}
+		if d.Type == Reboot && ack.Status == AckOK {
+			close(reboot)
+			return
+		}
+	}
+}
+
+// apply applies the downlink command d.
+func (s *simulator) apply(d Downlink) AckStatus {
+	switch d.Type {
+	case SetReadingInterval:
+		if d.Arg <= 0 {
+			return AckFailed
+		}
+		atomic.StoreInt64(&s.readingRate, int64(time.Duration(d.Arg)*time.Millisecond))
+		return AckOK
+	case TimeSync:
+		atomic.StoreInt64(&s.clockOffset, d.Arg-time.Now().UnixNano())
+		return AckOK
+	case Reboot:
+		return AckOK
+	}
+	return AckUnsupported
 }
@@ -0,0 +1,133 @@
+package device
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// acceptDevice accepts the connection of a simulated device and reads its
+// login message.
+func acceptDevice(t *testing.T, ln net.Listener) (net.Conn, *frameReader) {
+	t.Helper()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	frames := newFrameReader(conn)
+	var login [15]byte
+	if _, err := frames.readFrame(login[:]); err != nil {
+		t.Fatalf("expected a login message, %v", err)
+	}
+	return conn, frames
+}
+
+// nextAck skips readings until an ack frame is received.
+func nextAck(t *testing.T, frames *frameReader) Ack {
+	t.Helper()
+	var frame [AckFrameSize]byte
+	for {
+		if _, err := frames.readFrame(frame[:]); err != nil {
+			t.Fatalf("expected an ack, %v", err)
+		}
+		var ack Ack
+		if ack.Decode(frame[:]) {
+			return ack
+		}
+	}
+}
+
+func TestSimulator_Downlinks(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	sim := &simulator{
+		address:     ln.Addr().String(),
+		imei:        "490154203237518",
+		readingRate: int64(time.Millisecond),
+		log:         logging.Default(),
+	}
+	go sim.run(0)
+
+	conn, frames := acceptDevice(t, ln)
+	defer conn.Close()
+
+	for _, d := range []Downlink{
+		{Type: SetReadingInterval, ID: 1, Arg: 5},
+		{Type: TimeSync, ID: 2, Arg: time.Now().Add(time.Hour).UnixNano()},
+		{Type: DownlinkType(42), ID: 3},
+	} {
+		frame := d.Encode()
+		conn.Write(frame[:])
+		ack := nextAck(t, frames)
+		expected := AckOK
+		if d.ID == 3 {
+			expected = AckUnsupported
+		}
+		if ack.ID != d.ID || ack.Status != expected {
+			t.Errorf("expected ack %d %v got %+v", d.ID, expected, ack)
+		}
+	}
+	if rate := time.Duration(atomic.LoadInt64(&sim.readingRate)); rate != 5*time.Millisecond {
+		t.Errorf("expected reading rate 5ms got %v", rate)
+	}
+	if offset := time.Duration(atomic.LoadInt64(&sim.clockOffset)); offset < 59*time.Minute {
+		t.Errorf("expected clock offset of about 1h got %v", offset)
+	}
+
+	// a reboot closes the connection and logs in again
+	reboot := Downlink{Type: Reboot, ID: 4}
+	frame := reboot.Encode()
+	conn.Write(frame[:])
+	if ack := nextAck(t, frames); ack.ID != 4 || ack.Status != AckOK {
+		t.Errorf("expected reboot ack got %+v", ack)
+	}
+	rebooted, _ := acceptDevice(t, ln)
+	rebooted.Close()
+}
+
+func TestSimulator_ProtocolV2(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	sim := &simulator{
+		address:     ln.Addr().String(),
+		imei:        "490154203237518",
+		protocol:    ProtocolV2,
+		readingRate: int64(time.Millisecond),
+		log:         logging.Default(),
+	}
+	go sim.run(2)
+
+	conn, frames := acceptDevice(t, ln)
+	defer conn.Close()
+	if b, err := frames.peekByte(); err != nil || b != V2Marker {
+		t.Fatalf("expected the v2 marker after the IMEI got %d, %v", b, err)
+	}
+	frames.consume(1)
+
+	var payload [MaxPayloadSize]byte
+	for sequence := uint32(1); sequence <= 2; sequence++ {
+		n, err := frames.readSizedFrame(payload[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reading Reading
+		if !reading.Decode(payload[:n]) {
+			t.Fatalf("expected a valid v2 reading got %v", payload[:n])
+		}
+		if reading.Sequence != sequence || !reading.Fields.Has(FieldDeviceEpoch|FieldHumidity|FieldSignalStrength) {
+			t.Errorf("unexpected reading %+v", reading)
+		}
+	}
+}
@@ -1,24 +1,52 @@
 package device
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/logging"
 )
 
 // Client is used to handle a client connection
 type Client struct {
 	imei     uint64
+	session  uint64
 	conn     net.Conn
 	outbound chan<- common.Command
 	inbound  chan common.Command
-	now      func() time.Time
+	// kill is closed by the core when the session must terminate
+	kill   <-chan struct{}
+	now    func() time.Time
+	frames *frameReader
+	killed int32
+	// info describes the connection, it is sent to the core on LOGIN
+	info *common.ConnInfo
+	// log is the logger of the connection, it gets the IMEI and the session of
+	// the device once they are known
+	log *logging.Logger
+	// auth is set when logins must be authenticated
+	auth Authenticator
+	// onLogin is called once the core welcomes the device, if set
+	onLogin func()
+	// onLoginRefused is called when the core refuses the login, if set
+	onLoginRefused func()
+	// onLoginTimeout is called when the device does not log in in time, if set
+	onLoginTimeout func()
+	// version is the protocol version of the device, 0 until its first
+	// reading is received
+	version int
 }
 
+// inboundBuffer is the capacity of the channel used by the core to send
+// commands to a Client, so the core never blocks sending them.
+const inboundBuffer = 4
+
 // NewClient allocates a Client
 func NewClient(conn net.Conn, outbound chan<- common.Command, now func() time.Time) (*Client, error) {
 
@@ -26,128 +54,313 @@ func NewClient(conn net.Conn, outbound chan<- common.Command, now func() time.Ti
 		conn:     conn,
 		outbound: outbound,
 		now:      now,
+		frames:   newFrameReader(conn),
+		log:      logging.Default().With(logging.F("remote", conn.RemoteAddr().String())),
+		info:     &common.ConnInfo{Remote: conn.RemoteAddr().String(), ConnectedAt: now()},
 	}
+	client.frames.connBytesRead = &client.info.BytesRead
 	return client, nil
 }
 
+// SetLogger replaces the logger of the connection, which by default only
+// carries its remote address.
+func (c *Client) SetLogger(l *logging.Logger) {
+	c.log = l
+}
+
+// OnLogin makes the client call fn once the device is logged in.
+func (c *Client) OnLogin(fn func()) {
+	c.onLogin = fn
+}
+
+// OnLoginRefused makes the client call fn when the core refuses the login of
+// the device, which then closes the connection.
+func (c *Client) OnLoginRefused(fn func()) {
+	c.onLoginRefused = fn
+}
+
+// OnLoginTimeout makes the client call fn when the device does not complete
+// its login, the TLS handshake and the authentication included, before the
+// read deadline of the connection.
+func (c *Client) OnLoginTimeout(fn func()) {
+	c.onLoginTimeout = fn
+}
+
+// CountBytesRead makes the client add every byte read from the connection to
+// counter, atomically.
+func (c *Client) CountBytesRead(counter *uint64) {
+	c.frames.bytesRead = counter
+}
+
+// Reasons of a LOGOUT command, why the connection of the device finished.
+const (
+	// LogoutTimeout is sent when the device did not send a reading in time.
+	LogoutTimeout = "timeout"
+	// LogoutEOF is sent when the device closed the connection.
+	LogoutEOF = "eof"
+	// LogoutKill is sent when the core closed the connection with KILL.
+	LogoutKill = "kill"
+	// LogoutInvalidPayload is sent when the device sent a frame which does not
+	// follow the protocol.
+	LogoutInvalidPayload = "invalid-payload"
+	// LogoutError is sent when reading from the connection failed.
+	LogoutError = "error"
+)
+
 // Close terminates a connection to core.
-func (c *Client) logout() error {
+func (c *Client) logout(reason string) error {
 
 	c.outbound <- common.Command{
-		ID:     common.LOGOUT,
-		Sender: c.imei,
+		ID:      common.LOGOUT,
+		Sender:  c.imei,
+		Session: c.session,
+		Reason:  reason,
 	}
+	c.log.Event("logout", logging.F("reason", reason))
 	return nil
 }
 
 func (c *Client) receiveLoginMessage() error {
-	log.Println("DEBUG: receiveLoginMessage start")
 	var loginMsg [15]byte
-	n, err := c.conn.Read(loginMsg[:])
-	if err != nil || n < 15 {
-		return fmt.Errorf("ERR trying to read IMEI, bytes read: %d, err: %v", n, err)
+	n, err := c.frames.readFrame(loginMsg[:])
+	if err != nil {
+		return fmt.Errorf("reading IMEI, bytes read: %d, %w", n, err)
 	}
 
 	imei, err := decodeIMEI(loginMsg[:])
 	if err != nil {
-		return fmt.Errorf("ERR decoding IMEI bytes %v ", err)
+		return fmt.Errorf("decoding IMEI bytes, %v", err)
+	}
+	c.log = c.log.With(logging.F("imei", imei))
+	if err := verifyPeerIMEI(c.conn, imei); err != nil {
+		return fmt.Errorf("rejecting login, %v", err)
+	}
+	if c.auth != nil {
+		result, err := c.authenticate(imei)
+		c.auth.Authenticated(imei, result)
+		if err != nil {
+			c.log.WarnEvent("auth-"+result.String(), logging.F("err", err))
+			return fmt.Errorf("authenticating, %w", err)
+		}
 	}
 	c.imei = imei
-	c.inbound = make(chan common.Command)
+	c.inbound = make(chan common.Command, inboundBuffer)
 
+	c.log.Event("login")
 	c.outbound <- common.Command{
 		ID:              common.LOGIN,
 		Sender:          c.imei,
 		CallbackChannel: c.inbound,
+		Logger:          c.log,
+		Conn:            c.info,
 	}
 
 	cmd := <-c.inbound
 	switch cmd.ID {
 	case common.WELCOME:
-		log.Printf("Server accepted client connection")
+		c.session = cmd.Session
+		c.kill = cmd.Kill
+		c.log = c.log.With(logging.F("session", c.session))
+		c.log.Event("welcome")
+		if cmd.CallbackChannel != nil {
+			// next commands go straight to the core worker owning this device
+			c.outbound = cmd.CallbackChannel
+		}
+		if c.onLogin != nil {
+			c.onLogin()
+		}
 	case common.KILL:
-		return fmt.Errorf("Server sent KILL cmd to connected device %d", c.imei)
+		c.log.Event("kill")
+		if c.onLoginRefused != nil {
+			c.onLoginRefused()
+		}
+		return errKilled
 	}
-
-	log.Println("DEBUG: receiveLoginMessage END")
 	return nil
 }
 
-func (c *Client) receiveReadingsLoop() {
-	var payload [40]byte
-	log.Print("DEBUG starting receiveReadingsLoop")
+// watchInbound handles the commands the core sends to a logged in device
+// until done is closed. Closing the kill channel closes the connection, which
+// makes the blocked read of receiveReadingsLoop return right away. DOWNLINK
+// commands are written to the connection, watchInbound is its only writer.
+func (c *Client) watchInbound(done <-chan struct{}) {
 	for {
-
+		// a pending kill wins over the queued downlinks
+		select {
+		case <-c.kill:
+			c.closeKilled()
+			return
+		default:
+		}
 		select {
+		case <-c.kill:
+			c.closeKilled()
+			return
 		case cmd := <-c.inbound:
-			if cmd.ID == common.KILL {
-				log.Printf("Server sent KILL cmd to connected device %d", c.imei)
-				break
+			if cmd.ID == common.DOWNLINK {
+				if err := c.writeDownlink(cmd.Body); err != nil {
+					c.log.Error("sending downlink", logging.F("err", err))
+				}
 			}
-		default:
-			//Continue receiveReadings loop
+		case <-done:
+			return
 		}
-		err := c.nextReading(payload[:])
+	}
+}
+
+func (c *Client) closeKilled() {
+	c.log.Event("kill")
+	atomic.StoreInt32(&c.killed, 1)
+	c.conn.Close()
+}
+
+// downlinkWriteTimeout bounds how long writing a downlink frame may block.
+const downlinkWriteTimeout = 2 * time.Second
+
+func (c *Client) writeDownlink(frame []byte) error {
+	if err := c.conn.SetWriteDeadline(c.now().Add(downlinkWriteTimeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *Client) wasKilled() bool {
+	return atomic.LoadInt32(&c.killed) == 1
+}
+
+func (c *Client) receiveReadingsLoop() {
+	var payload [MaxPayloadSize]byte
+	done := make(chan struct{})
+	defer close(done)
+	go c.watchInbound(done)
+
+	for {
+		n, err := c.nextReading(payload[:])
 		if err != nil {
-			log.Printf("ERR during reading %v", err)
-			c.logout()
+			var reason string
+			switch {
+			case c.wasKilled():
+				reason = LogoutKill
+				c.log.Debug("connection closed by the server")
+			case isTimeout(err):
+				reason = LogoutTimeout
+				c.log.WarnEvent("timeout", logging.F("err", err))
+			case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+				reason = LogoutEOF
+				c.log.Debug("connection closed by the device")
+			case errors.Is(err, errFrameTooBig):
+				reason = LogoutInvalidPayload
+				c.log.Warn("invalid frame", logging.F("err", err))
+			default:
+				reason = LogoutError
+				c.log.Warn("reading failed", logging.F("err", err))
+			}
+			c.logout(reason)
 			break
 		}
 
-		payloadCopy := make([]byte, len(payload))
-		copy(payloadCopy, payload[:])
+		payloadCopy := make([]byte, n)
+		copy(payloadCopy, payload[:n])
+		id := common.READING
+		if n == AckFrameSize && IsAckFrame(payloadCopy) {
+			id = common.ACK
+		}
 		c.outbound <- common.Command{
-			ID:     common.READING,
-			Sender: c.imei,
-			Body:   payloadCopy,
+			ID:       id,
+			Sender:   c.imei,
+			Session:  c.session,
+			Body:     payloadCopy,
+			Protocol: c.version,
 		}
 
 	}
-	log.Println("DEBUG receiveReadingsLoop exit")
-
 }
 
-func (c *Client) nextReading(payload []byte) error {
+// nextReading reads the next payload into payload, which must be at least
+// MaxPayloadSize bytes long for v2 devices, and returns its length. The protocol
+// version of the device is negotiated on the first call.
+func (c *Client) nextReading(payload []byte) (int, error) {
 	err := c.conn.SetReadDeadline(c.now().Add(time.Second * 2))
 	if err != nil {
-		return err
+		return 0, err
 
 	}
-	n, err := c.conn.Read(payload[:])
+	if c.version == 0 {
+		if err := c.negotiateVersion(); err != nil {
+			return 0, fmt.Errorf("negotiating the protocol version, %w", err)
+		}
+	}
+	if c.version == ProtocolV2 {
+		n, err := c.frames.readSizedFrame(payload)
+		if err != nil {
+			return n, fmt.Errorf("reading v2 frame, %w", err)
+		}
+		return n, nil
+	}
+	// frames may arrive split across several reads, or several of them in a
+	// single read, readFrame takes care of both cases
+	n, err := c.frames.readFrame(payload[:40])
 	if err != nil {
-		return err
+		return n, fmt.Errorf("read only %d of %d bytes for the reading payload, %w", n, 40, err)
 	}
-	//TODO is possible to read less bytes , we should use manual buffer or an buf reader
-	// but we have an open review discution about usage of custom reading loop, or do not follow
-	// requirements constraints/hints see https://github.com/rilopez/thermomatic/pull/18#discussion_r466581202
-	if n != 40 {
-		err := fmt.Errorf("WARN read only %d bytes, expected 40 for reading payloads", n)
+
+	return n, nil
+}
+
+// negotiateVersion tells v2 devices, which send V2Marker right after their
+// IMEI, from v1 devices, which send their first reading instead.
+func (c *Client) negotiateVersion() error {
+	b, err := c.frames.peekByte()
+	if err != nil {
 		return err
 	}
-
+	c.version = ProtocolV1
+	if b == V2Marker {
+		c.frames.consume(1)
+		c.version = ProtocolV2
+	}
+	c.log.Debug("protocol negotiated", logging.F("version", c.version))
 	return nil
 }
 
+// Read logs the device in and relays its readings to the core until the
+// connection is closed.
 func (c *Client) Read(wg *sync.WaitGroup) {
-	log.Println("DEBUG starting client Read")
 	defer func() {
 		err := c.conn.Close()
-		if err != nil {
-			log.Printf("ERR trying to close the connection %v", err)
+		if err != nil && !c.wasKilled() {
+			c.log.Error("closing the connection", logging.F("err", err))
 		}
-		log.Println("DEBUG client connection closed")
+		c.log.Event("close")
 		wg.Done()
 	}()
 
 	if c.imei == 0 {
 		err := c.receiveLoginMessage()
-		if err != nil {
-			log.Printf("%v", err)
+		switch {
+		case err == nil:
+		case err == errKilled:
+			return
+		case isTimeout(err):
+			if c.onLoginTimeout != nil {
+				c.onLoginTimeout()
+			}
+			c.log.WarnEvent("timeout", logging.F("err", err))
+			return
+		default:
+			c.log.Warn("login failed", logging.F("err", err))
 			return
 		}
-
 	}
 	c.receiveReadingsLoop()
-	log.Print("DEBUG client Read exit")
+}
+
+// errKilled is returned by receiveLoginMessage when the core rejects the login.
+var errKilled = errors.New("killed by the server")
 
+// isTimeout reports whether err was caused by a read deadline.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
@@ -68,3 +68,203 @@ func TestRead(t *testing.T) {
 		}
 	}
 }
+
+func TestClient_NextReading_PartialSegments(t *testing.T) {
+	server, device := net.Pipe()
+	defer server.Close()
+	defer device.Close()
+
+	client, err := NewClient(server, make(chan common.Command), time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPayload := CreateRandReadingBytes()
+	go func() {
+		// one reading split in three segments
+		device.Write(expectedPayload[:7])
+		device.Write(expectedPayload[7:33])
+		device.Write(expectedPayload[33:])
+	}()
+
+	var payload [40]byte
+	if _, err := client.nextReading(payload[:]); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if payload != expectedPayload {
+		t.Errorf("expected payload %v got %v", expectedPayload, payload)
+	}
+}
+
+func TestClient_NextReading_Timeout(t *testing.T) {
+	server, device := net.Pipe()
+	defer server.Close()
+	defer device.Close()
+
+	// a clock two seconds in the past makes the read deadline expire right away
+	past := func() time.Time { return time.Now().Add(-2 * time.Second) }
+	client, err := NewClient(server, make(chan common.Command), past)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go device.Write([]byte{1, 2, 3})
+
+	var payload [40]byte
+	if _, err := client.nextReading(payload[:]); err == nil {
+		t.Error("expected a timeout error reading a partial payload")
+	}
+}
+
+func TestClient_RelaysDownlinksAndAcks(t *testing.T) {
+	server, dev := net.Pipe()
+	defer dev.Close()
+
+	outbound := make(chan common.Command, 1)
+	client, err := NewClient(server, outbound, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.imei = 490154203237518
+	client.session = 7
+	client.inbound = make(chan common.Command, inboundBuffer)
+	kill := make(chan struct{})
+	client.kill = kill
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go client.Read(&wg)
+
+	downlink := Downlink{Type: Reboot, ID: 9}
+	frame := downlink.Encode()
+	client.inbound <- common.Command{ID: common.DOWNLINK, Body: frame[:]}
+	var received [DownlinkFrameSize]byte
+	if _, err := newFrameReader(dev).readFrame(received[:]); err != nil {
+		t.Fatal(err)
+	}
+	if received != frame {
+		t.Errorf("expected downlink frame %v got %v", frame, received)
+	}
+
+	ack := Ack{ID: 9, Status: AckOK}
+	ackFrame := ack.Encode()
+	dev.Write(ackFrame[:])
+	cmd := <-outbound
+	if cmd.ID != common.ACK || cmd.Session != 7 || !bytes.Equal(cmd.Body, ackFrame[:]) {
+		t.Errorf("expected the ack to be forwarded got %+v", cmd)
+	}
+
+	dev.Close()
+	if cmd := <-outbound; cmd.ID != common.LOGOUT {
+		t.Errorf("expected LOGOUT got %v", cmd.ID)
+	}
+	wg.Wait()
+}
+
+func TestClient_NextReading_NegotiatesV2(t *testing.T) {
+	server, dev := net.Pipe()
+	defer server.Close()
+	defer dev.Close()
+
+	client, err := NewClient(server, make(chan common.Command), time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := AppendPayloadV2(nil, &testReadingV2)
+	go func() {
+		// the version byte follows the IMEI, which was already read
+		dev.Write([]byte{V2Marker})
+		dev.Write(AppendFrameV2(nil, payload))
+	}()
+
+	var received [MaxPayloadSize]byte
+	n, err := client.nextReading(received[:])
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if client.version != ProtocolV2 {
+		t.Errorf("expected protocol v2 got v%d", client.version)
+	}
+	if string(received[:n]) != string(payload) {
+		t.Errorf("expected payload %v got %v", payload, received[:n])
+	}
+}
+
+func TestClient_NextReading_DefaultsToV1(t *testing.T) {
+	server, dev := net.Pipe()
+	defer server.Close()
+	defer dev.Close()
+
+	client, err := NewClient(server, make(chan common.Command), time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := CreateRandReadingBytes()
+	go dev.Write(expected[:])
+
+	var received [MaxPayloadSize]byte
+	n, err := client.nextReading(received[:])
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if client.version != ProtocolV1 || n != len(expected) || string(received[:n]) != string(expected[:]) {
+		t.Errorf("expected v1 payload %v got v%d %v", expected, client.version, received[:n])
+	}
+}
+
+func TestClient_KillTerminatesSession(t *testing.T) {
+	server, dev := net.Pipe()
+	defer dev.Close()
+
+	outbound := make(chan common.Command, 1)
+	client, err := NewClient(server, outbound, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.imei = 490154203237518
+	client.session = 7
+	client.inbound = make(chan common.Command, inboundBuffer)
+	kill := make(chan struct{})
+	client.kill = kill
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go client.Read(&wg)
+
+	// the device keeps sending readings, KILL must still end the session
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		reading := CreateRandReadingBytes()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := dev.Write(reading[:]); err != nil {
+				return
+			}
+		}
+	}()
+	// the downlinks queued behind it do not delay the kill
+	close(kill)
+	for i := 0; i < inboundBuffer; i++ {
+		client.inbound <- common.Command{ID: common.DOWNLINK, Body: []byte{0}}
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case cmd := <-outbound:
+			if cmd.ID != common.LOGOUT {
+				continue
+			}
+			if cmd.Reason != LogoutKill {
+				t.Errorf("expected the %s reason got %q", LogoutKill, cmd.Reason)
+			}
+			wg.Wait()
+			return
+		case <-timeout:
+			t.Fatal("expected KILL to terminate the session")
+		}
+	}
+}
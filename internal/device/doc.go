@@ -4,5 +4,10 @@ Main exported symbols
    - Client
    - Reading
    - Automated clients (Randomatic, Slowmatic,TooSlowToPlayWithGrownups)
+   - Downlink and Ack frames, sent by the server to a device and back
+   - Protocol v1 and v2 framing, see protocol.go
+   - Authenticated logins (Authenticator, AuthResponse), see auth.go
+   - Reading validation rules (Rules, RejectReason), see rules.go
+   - Load tests running a fleet of simulated devices (RunLoad), see loadgen.go
 */
 package device
@@ -0,0 +1,168 @@
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Downlink frames are sent by the server to a logged in device over the same
+// TCP connection, they are DownlinkFrameSize bytes long:
+//
+//	| Field    | Start Index | Size | Notes                                  |
+//	| -------- | ----------- | ---- | -------------------------------------- |
+//	| Magic    | 0           | 1    | downlinkMagic                          |
+//	| Version  | 1           | 1    | DownlinkVersion                        |
+//	| Type     | 2           | 1    | DownlinkType                           |
+//	| Reserved | 3           | 1    | zero                                   |
+//	| ID       | 4           | 4    | command id, echoed by the ack, BE      |
+//	| Arg      | 8           | 8    | argument of the command, int64 BE      |
+//
+// The device answers every downlink with an ack frame. Ack frames have the size
+// of a v1 reading payload so they fit in the upload stream, v2 devices send them
+// as the payload of a v2 frame. They start with ackMarker, a NaN which is never
+// decoded as a valid reading:
+//
+//	| Field    | Start Index | Size | Notes                                  |
+//	| -------- | ----------- | ---- | -------------------------------------- |
+//	| Marker   | 0           | 8    | ackMarker                              |
+//	| Version  | 8           | 1    | DownlinkVersion                        |
+//	| Status   | 9           | 1    | AckStatus                              |
+//	| ID       | 10          | 4    | id of the acknowledged command, BE     |
+//	| Padding  | 14          | 26   | zero                                   |
+const (
+	// DownlinkVersion is the version of the downlink and ack frame formats.
+	DownlinkVersion = 1
+	// DownlinkFrameSize is the size of a downlink frame.
+	DownlinkFrameSize = 16
+	// AckFrameSize is the size of an ack frame, the same of a reading payload.
+	AckFrameSize = 40
+
+	downlinkMagic = 0xD1
+	ackMarker     = 0x7FF8AC4B00000000
+)
+
+// DownlinkType is the kind of command sent to a device.
+type DownlinkType uint8
+
+const (
+	// SetReadingInterval changes the interval between readings to Arg milliseconds.
+	SetReadingInterval DownlinkType = iota + 1
+	// Reboot makes the device reconnect.
+	Reboot
+	// TimeSync sets the device clock to Arg, nanoseconds since the unix epoch.
+	TimeSync
+)
+
+// ParseDownlinkType parses set-reading-interval, reboot or time-sync.
+func ParseDownlinkType(s string) (DownlinkType, error) {
+	for t := SetReadingInterval; t <= TimeSync; t++ {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown downlink command %q, it could be set-reading-interval, reboot or time-sync", s)
+}
+
+func (t DownlinkType) String() string {
+	switch t {
+	case SetReadingInterval:
+		return "set-reading-interval"
+	case Reboot:
+		return "reboot"
+	case TimeSync:
+		return "time-sync"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// Downlink is a command sent by the server to a device.
+type Downlink struct {
+	Type DownlinkType
+	ID   uint32
+	Arg  int64
+}
+
+// Encode returns the downlink frame of d.
+func (d *Downlink) Encode() [DownlinkFrameSize]byte {
+	var b [DownlinkFrameSize]byte
+	b[0] = downlinkMagic
+	b[1] = DownlinkVersion
+	b[2] = byte(d.Type)
+	binary.BigEndian.PutUint32(b[4:], d.ID)
+	binary.BigEndian.PutUint64(b[8:], uint64(d.Arg))
+	return b
+}
+
+// Decode decodes the downlink frame in b into d, ok is unset if b is not a
+// downlink frame of a supported version. Unknown command types are decoded, so
+// the device can acknowledge them as unsupported.
+//
+// Decode panics if b isn't at least DownlinkFrameSize bytes long.
+func (d *Downlink) Decode(b []byte) (ok bool) {
+	_ = b[DownlinkFrameSize-1]
+	if b[0] != downlinkMagic || b[1] != DownlinkVersion {
+		return false
+	}
+	d.Type = DownlinkType(b[2])
+	d.ID = binary.BigEndian.Uint32(b[4:])
+	d.Arg = int64(binary.BigEndian.Uint64(b[8:]))
+	return true
+}
+
+// AckStatus is the result of a downlink command reported by the device.
+type AckStatus uint8
+
+const (
+	// AckOK means the command was applied.
+	AckOK AckStatus = iota
+	// AckUnsupported means the device does not know the command.
+	AckUnsupported
+	// AckFailed means the command could not be applied.
+	AckFailed
+)
+
+func (s AckStatus) String() string {
+	switch s {
+	case AckOK:
+		return "ok"
+	case AckUnsupported:
+		return "unsupported"
+	case AckFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+// Ack acknowledges the downlink command with the same ID.
+type Ack struct {
+	ID     uint32
+	Status AckStatus
+}
+
+// Encode returns the ack frame of a.
+func (a *Ack) Encode() [AckFrameSize]byte {
+	var b [AckFrameSize]byte
+	binary.BigEndian.PutUint64(b[0:], ackMarker)
+	b[8] = DownlinkVersion
+	b[9] = byte(a.Status)
+	binary.BigEndian.PutUint32(b[10:], a.ID)
+	return b
+}
+
+// Decode decodes the ack frame in b into a, ok is unset if b is not an ack
+// frame. It panics if b isn't at least AckFrameSize bytes long.
+func (a *Ack) Decode(b []byte) (ok bool) {
+	if !IsAckFrame(b) || b[8] != DownlinkVersion {
+		return false
+	}
+	a.Status = AckStatus(b[9])
+	a.ID = binary.BigEndian.Uint32(b[10:])
+	return true
+}
+
+// IsAckFrame reports whether the frame b, received where a reading payload is
+// expected, is an ack frame.
+func IsAckFrame(b []byte) bool {
+	_ = b[AckFrameSize-1]
+	return binary.BigEndian.Uint64(b[0:]) == ackMarker
+}
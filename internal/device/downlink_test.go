@@ -0,0 +1,61 @@
+package device
+
+import (
+	"testing"
+)
+
+func TestDownlink_EncodeDecode(t *testing.T) {
+	expected := Downlink{Type: SetReadingInterval, ID: 4242, Arg: -1500}
+	frame := expected.Encode()
+
+	var d Downlink
+	if !d.Decode(frame[:]) {
+		t.Fatalf("expected %v to be decoded", frame)
+	}
+	if d != expected {
+		t.Errorf("expected %+v got %+v", expected, d)
+	}
+
+	frame[1] = DownlinkVersion + 1
+	if d.Decode(frame[:]) {
+		t.Error("expected a frame of an unknown version not to be decoded")
+	}
+}
+
+func TestAck_EncodeDecode(t *testing.T) {
+	expected := Ack{ID: 4242, Status: AckUnsupported}
+	frame := expected.Encode()
+	if !IsAckFrame(frame[:]) {
+		t.Fatalf("expected %v to be an ack frame", frame)
+	}
+
+	var ack Ack
+	if !ack.Decode(frame[:]) {
+		t.Fatalf("expected %v to be decoded", frame)
+	}
+	if ack != expected {
+		t.Errorf("expected %+v got %+v", expected, ack)
+	}
+
+	// an ack is never mistaken for a reading, and the other way around
+	var reading Reading
+	if reading.Decode(frame[:]) {
+		t.Error("expected an ack frame not to be a valid reading")
+	}
+	payload := CreateRandReadingBytes()
+	if IsAckFrame(payload[:]) {
+		t.Error("expected a reading not to be an ack frame")
+	}
+}
+
+func TestParseDownlinkType(t *testing.T) {
+	for _, expected := range []DownlinkType{SetReadingInterval, Reboot, TimeSync} {
+		parsed, err := ParseDownlinkType(expected.String())
+		if err != nil || parsed != expected {
+			t.Errorf("expected %v parsing %q got %v, %v", expected, expected.String(), parsed, err)
+		}
+	}
+	if _, err := ParseDownlinkType("self-destruct"); err == nil {
+		t.Error("expected an error parsing an unknown command")
+	}
+}
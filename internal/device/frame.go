@@ -0,0 +1,156 @@
+package device
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// frameBufferSize is the size of the receive buffer used by frameReader. It is
+// big enough to hold a login message plus a hundred reading payloads, so a
+// single conn.Read usually drains whatever the kernel has queued for us.
+const frameBufferSize = 4096
+
+// frameReader accumulates exact, fixed-size frames from an io.Reader.
+//
+// TCP is a stream protocol: a 40 byte reading may arrive split across several
+// segments, and several readings may arrive in a single segment. frameReader
+// hides both cases behind readFrame, which returns only once len(dst) bytes have
+// been received.
+//
+// frameReader does NOT allocate after construction; its buffer lives inside the
+// struct so it is allocated only once per connection.
+type frameReader struct {
+	r     io.Reader
+	buf   [frameBufferSize]byte
+	start int // index of the first unread byte in buf
+	end   int // index after the last received byte in buf
+	// bytesRead counts the bytes read from r atomically, if not nil
+	bytesRead *uint64
+	// connBytesRead counts them too, it is the counter of the connection
+	// while bytesRead is usually shared with other connections
+	connBytesRead *uint64
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: r}
+}
+
+// buffered returns the number of received bytes not yet consumed by readFrame.
+func (f *frameReader) buffered() int {
+	return f.end - f.start
+}
+
+// readFrame fills dst with the next len(dst) bytes of the stream.
+//
+// Bytes already buffered by a previous read are consumed first, then the
+// underlying reader is read as many times as needed. Any read deadline set on the
+// underlying connection keeps applying to each of those reads.
+//
+// If the stream ends before a full frame has been received readFrame returns
+// io.ErrUnexpectedEOF, or io.EOF when no byte of the frame was received at all.
+// In both cases the partial frame stays buffered. readFrame panics if len(dst)
+// is bigger than frameBufferSize.
+func (f *frameReader) readFrame(dst []byte) (n int, err error) {
+	size := len(dst)
+	if size > len(f.buf) {
+		panic("frameReader: frame bigger than the receive buffer")
+	}
+	if err := f.ensure(size); err != nil {
+		return f.buffered(), err
+	}
+	n = copy(dst, f.buf[f.start:f.start+size])
+	f.consume(n)
+	return n, nil
+}
+
+// errFrameTooBig is returned by readSizedFrame when the length of a frame
+// exceeds its destination.
+var errFrameTooBig = errors.New("frameReader: frame bigger than the destination")
+
+// readSizedFrame reads the next frame prefixed by its length, as 2 bytes BE,
+// into dst and returns its length. The length prefix is not copied to dst.
+//
+// It fails with errFrameTooBig if the frame does not fit in dst, the stream
+// can not be read any further in such case. Other errors are the ones of
+// readFrame, and the partial frame stays buffered as well.
+func (f *frameReader) readSizedFrame(dst []byte) (n int, err error) {
+	if err := f.ensure(2); err != nil {
+		return 0, err
+	}
+	size := int(f.buf[f.start])<<8 | int(f.buf[f.start+1])
+	if size > len(dst) || 2+size > len(f.buf) {
+		return 0, errFrameTooBig
+	}
+	if err := f.ensure(2 + size); err != nil {
+		return 0, err
+	}
+	f.consume(2)
+	n = copy(dst, f.buf[f.start:f.start+size])
+	f.consume(n)
+	return n, nil
+}
+
+// peekByte returns the next byte of the stream without consuming it.
+func (f *frameReader) peekByte() (byte, error) {
+	if err := f.ensure(1); err != nil {
+		return 0, err
+	}
+	return f.buf[f.start], nil
+}
+
+// ensure reads from the underlying reader until at least size bytes are
+// buffered. size must not be bigger than frameBufferSize.
+func (f *frameReader) ensure(size int) error {
+	for f.buffered() < size {
+		if f.start > 0 && len(f.buf)-f.start < size {
+			// not enough room after start, move the partial frame to the front
+			f.end = copy(f.buf[:], f.buf[f.start:f.end])
+			f.start = 0
+		}
+		if err := f.fill(); err != nil {
+			if err == io.EOF && f.buffered() > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// consume discards the next n buffered bytes.
+func (f *frameReader) consume(n int) {
+	f.start += n
+	if f.start == f.end {
+		f.start, f.end = 0, 0
+	}
+}
+
+// maxConsecutiveEmptyReads is the number of (0, nil) reads tolerated before
+// giving up, same as bufio does.
+const maxConsecutiveEmptyReads = 100
+
+// fill reads once into the free tail of the buffer.
+func (f *frameReader) fill() error {
+	for i := 0; i < maxConsecutiveEmptyReads; i++ {
+		n, err := f.r.Read(f.buf[f.end:])
+		if n < 0 || n > len(f.buf)-f.end {
+			return io.ErrShortBuffer
+		}
+		f.end += n
+		if n > 0 && f.bytesRead != nil {
+			atomic.AddUint64(f.bytesRead, uint64(n))
+		}
+		if n > 0 && f.connBytesRead != nil {
+			atomic.AddUint64(f.connBytesRead, uint64(n))
+		}
+		if n > 0 {
+			// data takes precedence over errors, they will be reported by the next read
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return io.ErrNoProgress
+}
@@ -0,0 +1,219 @@
+package device
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"testing"
+	"testing/iotest"
+
+	"github.com/spin-org/thermomatic/internal/common"
+)
+
+// chunkedReader returns the data of b in reads of at most the sizes in chunks,
+// cycling through them, to simulate how TCP may split a stream in segments.
+type chunkedReader struct {
+	b      []byte
+	chunks []int
+	i      int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	size := len(p)
+	if len(r.chunks) > 0 {
+		chunk := r.chunks[r.i%len(r.chunks)]
+		r.i++
+		if chunk < size {
+			size = chunk
+		}
+	}
+	n := copy(p[:size], r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+func TestFrameReader_ReadFrame_ShortReads(t *testing.T) {
+	imei := []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}
+	reading := NewPayload(38, 10, 21.033643, -89.5969049, 45)
+	stream := append(append([]byte{}, imei...), reading[:]...)
+
+	frames := newFrameReader(iotest.OneByteReader(bytes.NewReader(stream)))
+
+	var loginMsg [15]byte
+	if _, err := frames.readFrame(loginMsg[:]); err != nil {
+		t.Fatalf("unexpected error reading the login frame %v", err)
+	}
+	if !bytes.Equal(loginMsg[:], imei) {
+		t.Errorf("expected login frame %v got %v", imei, loginMsg)
+	}
+
+	var payload [40]byte
+	if _, err := frames.readFrame(payload[:]); err != nil {
+		t.Fatalf("unexpected error reading the reading frame %v", err)
+	}
+	if payload != reading {
+		t.Errorf("expected reading frame %v got %v", reading, payload)
+	}
+}
+
+func TestFrameReader_ReadFrame_ManyFramesInOneRead(t *testing.T) {
+	var stream []byte
+	expected := make([][40]byte, 10)
+	for i := range expected {
+		expected[i] = CreateRandReadingBytes()
+		stream = append(stream, expected[i][:]...)
+	}
+	reader := &countingReader{r: bytes.NewReader(stream)}
+	frames := newFrameReader(reader)
+
+	var payload [40]byte
+	for i := range expected {
+		if _, err := frames.readFrame(payload[:]); err != nil {
+			t.Fatalf("unexpected error reading frame %d %v", i, err)
+		}
+		if payload != expected[i] {
+			t.Errorf("frame %d: expected %v got %v", i, expected[i], payload)
+		}
+	}
+	if reader.reads != 1 {
+		t.Errorf("expected all the frames to be received with 1 read, got %d reads", reader.reads)
+	}
+}
+
+func TestFrameReader_ReadFrame_UnexpectedEOF(t *testing.T) {
+	frames := newFrameReader(bytes.NewReader(make([]byte, 60)))
+
+	var payload [40]byte
+	if _, err := frames.readFrame(payload[:]); err != nil {
+		t.Fatalf("unexpected error reading the first frame %v", err)
+	}
+	n, err := frames.readFrame(payload[:])
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF got %v", err)
+	}
+	if n != 20 {
+		t.Errorf("expected 20 bytes of a partial frame got %d", n)
+	}
+}
+
+func TestFrameReader_ReadFrame_EOF(t *testing.T) {
+	frames := newFrameReader(bytes.NewReader(nil))
+
+	var payload [40]byte
+	if _, err := frames.readFrame(payload[:]); err != io.EOF {
+		t.Errorf("expected io.EOF got %v", err)
+	}
+}
+
+func TestFrameReader_ReadFrame_PanicFrameBiggerThanBuffer(t *testing.T) {
+	frames := newFrameReader(bytes.NewReader(nil))
+
+	tooBig := make([]byte, frameBufferSize+1)
+	common.ShouldPanic(t, func() {
+		_, _ = frames.readFrame(tooBig)
+	})
+}
+
+func TestFrameReader_ReadSizedFrame(t *testing.T) {
+	first := AppendPayloadV2(nil, &Reading{Temperature: 1})
+	second := AppendPayloadV2(nil, &Reading{Temperature: 2, Humidity: 50, Fields: FieldHumidity})
+	stream := append([]byte{V2Marker}, AppendFrameV2(AppendFrameV2(nil, first), second)...)
+	frames := newFrameReader(&chunkedReader{b: stream, chunks: []int{1, 3, 7}})
+
+	if b, err := frames.peekByte(); err != nil || b != V2Marker {
+		t.Fatalf("expected to peek %d got %d, %v", V2Marker, b, err)
+	}
+	frames.consume(1)
+	var payload [MaxPayloadSize]byte
+	for _, expected := range [][]byte{first, second} {
+		n, err := frames.readSizedFrame(payload[:])
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !bytes.Equal(payload[:n], expected) {
+			t.Errorf("expected frame %v got %v", expected, payload[:n])
+		}
+	}
+	if _, err := frames.readSizedFrame(payload[:]); err != io.EOF {
+		t.Errorf("expected io.EOF got %v", err)
+	}
+}
+
+func TestFrameReader_ReadSizedFrame_TooBig(t *testing.T) {
+	frames := newFrameReader(bytes.NewReader(AppendFrameV2(nil, make([]byte, 41))))
+	var payload [40]byte
+	if _, err := frames.readSizedFrame(payload[:]); err != errFrameTooBig {
+		t.Errorf("expected errFrameTooBig got %v", err)
+	}
+}
+
+func TestFrameReader_ReadFrame_Allocations(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	reading := CreateRandReadingBytes()
+	reader := &chunkedReader{b: bytes.Repeat(reading[:], 100), chunks: []int{7, 33, 40, 81}}
+	frames := newFrameReader(reader)
+	var payload [40]byte
+	var start, end runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&start)
+
+	for i := 0; i < 100; i++ {
+		_, _ = frames.readFrame(payload[:])
+	}
+
+	runtime.ReadMemStats(&end)
+	alloc := end.TotalAlloc - start.TotalAlloc
+	if alloc > 0 {
+		t.Errorf("readFrame should NOT allocate under any condition, it allocated %d bytes", alloc)
+	}
+}
+
+func FuzzFrameReader_ReadFrame(f *testing.F) {
+	reading := NewPayload(38, 10, 21.033643, -89.5969049, 45)
+	f.Add(bytes.Repeat(reading[:], 3), []byte{1})
+	f.Add(bytes.Repeat(reading[:], 3), []byte{39, 41})
+	f.Add(bytes.Repeat(reading[:], 200), []byte{255, 0, 3})
+	f.Add([]byte{1, 2, 3}, []byte{})
+
+	f.Fuzz(func(t *testing.T, stream []byte, splits []byte) {
+		chunks := make([]int, 0, len(splits))
+		for _, s := range splits {
+			if s > 0 {
+				chunks = append(chunks, int(s))
+			}
+		}
+		frames := newFrameReader(&chunkedReader{b: stream, chunks: chunks})
+
+		var payload [40]byte
+		received := 0
+		for {
+			n, err := frames.readFrame(payload[:])
+			if err != nil {
+				if received+n != len(stream) {
+					t.Fatalf("received %d+%d bytes of a %d bytes stream", received, n, len(stream))
+				}
+				if n == 0 && err != io.EOF || n > 0 && err != io.ErrUnexpectedEOF {
+					t.Fatalf("unexpected error %v with %d bytes left", err, n)
+				}
+				return
+			}
+			if !bytes.Equal(payload[:], stream[received:received+40]) {
+				t.Fatalf("frame at %d: expected %v got %v", received, stream[received:received+40], payload)
+			}
+			received += n
+		}
+	})
+}
+
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return r.r.Read(p)
+}
@@ -0,0 +1,512 @@
+package device
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// Profiles of the simulated devices of a load test.
+const (
+	// LoadRandom devices send random readings every reading interval.
+	LoadRandom = "random"
+	// LoadSlow devices send readings every 3 seconds, so the server read
+	// timeout disconnects them.
+	LoadSlow = "slow"
+	// LoadTooSlow devices wait 2 seconds before sending their login, so the
+	// server login timeout disconnects them.
+	LoadTooSlow = "too-slow"
+	// LoadFlapping devices close their connection after a few readings, and
+	// reconnect.
+	LoadFlapping = "flapping"
+	// LoadGarbage devices send random bytes instead of readings.
+	LoadGarbage = "garbage"
+)
+
+const (
+	// loadReconnectDelay is how long a simulated device waits before
+	// reconnecting, jittered like the reading interval.
+	loadReconnectDelay = time.Second
+	// loadLatencySamples bounds the latency samples kept for the percentiles,
+	// they are split between the devices.
+	loadLatencySamples = 100000
+	// loadMaxFlaps is the maximum number of readings a flapping device sends
+	// before disconnecting.
+	loadMaxFlaps = 10
+)
+
+// LoadShare is the share of the devices of a load test with a profile.
+type LoadShare struct {
+	Profile string
+	Weight  int
+}
+
+// ParseLoadMix parses a comma separated list of profile=weight, e.g.
+// random=90,slow=5,garbage=5 runs 90% of random devices, 5% of slow ones and
+// 5% of garbage ones.
+func ParseLoadMix(spec string) ([]LoadShare, error) {
+	var mix []LoadShare
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid profile share %q, it should be profile=weight", part)
+		}
+		switch kv[0] {
+		case LoadRandom, LoadSlow, LoadTooSlow, LoadFlapping, LoadGarbage:
+		default:
+			return nil, fmt.Errorf("unknown profile %q, it could be random, slow, too-slow, flapping or garbage", kv[0])
+		}
+		if seen[kv[0]] {
+			return nil, fmt.Errorf("duplicated profile %q", kv[0])
+		}
+		seen[kv[0]] = true
+		weight, err := strconv.Atoi(kv[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight of profile %s %q", kv[0], kv[1])
+		}
+		if weight > 0 {
+			mix = append(mix, LoadShare{Profile: kv[0], Weight: weight})
+		}
+	}
+	if len(mix) == 0 {
+		return nil, fmt.Errorf("no profile with a positive weight in %q", spec)
+	}
+	return mix, nil
+}
+
+// LuhnIMEI returns the IMEI of serial, its 14 leading digits, followed by its
+// Luhn check digit.
+func LuhnIMEI(serial uint64) uint64 {
+	var digits [14]int
+	for i, s := 13, serial; i >= 0; i, s = i-1, s/10 {
+		digits[i] = int(s % 10)
+	}
+	sum := 0
+	for i, d := range digits {
+		// every second digit is doubled, like decodeIMEI checks it
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return serial%1e14*10 + uint64((10-sum%10)%10)
+}
+
+// LoadConfig holds the settings of a load test.
+type LoadConfig struct {
+	// ServerAddress (host:port) of the thermomatic server.
+	ServerAddress string
+	// Devices is the number of simulated devices.
+	Devices int
+	// RampUp is the number of devices started per second, 0 starts them all
+	// at once.
+	RampUp float64
+	// Duration of the test, it runs until its context is done when 0.
+	Duration time.Duration
+	// ReadingRate is the interval between readings of the random, flapping
+	// and garbage devices.
+	ReadingRate time.Duration
+	// Jitter is the fraction the intervals vary by, e.g. 0.2 is ±20%.
+	Jitter float64
+	// Mix of the device profiles, every device is random when empty.
+	Mix []LoadShare
+	// FirstSerial is the serial of the IMEI of the first device, the next
+	// devices have the next serials.
+	FirstSerial uint64
+	// Protocol version spoken by the devices, ProtocolV1 or ProtocolV2.
+	Protocol uint
+	// TLS connects to the server over TLS when it is not nil.
+	TLS *tls.Config
+	// CertFile is the PEM file with the certificate and key of each device,
+	// for mutual TLS, {imei} is replaced by the IMEI of the device as the
+	// server only accepts certificates issued to it, e.g. certs/{imei}.pem.
+	// It requires TLS.
+	CertFile string
+	// Secret answers the login challenge of servers requiring
+	// authentication, Secrets overrides it by IMEI. Devices without a secret
+	// do not expect a challenge.
+	Secret  []byte
+	Secrets map[uint64][]byte
+	// Seed of the jitter and of the garbage, the current time when 0.
+	Seed int64
+}
+
+// Latencies are percentiles of a latency distribution.
+type Latencies struct {
+	Samples int           `json:"samples"`
+	P50     time.Duration `json:"p50"`
+	P90     time.Duration `json:"p90"`
+	P99     time.Duration `json:"p99"`
+	Max     time.Duration `json:"max"`
+}
+
+func (l Latencies) String() string {
+	if l.Samples == 0 {
+		return "no samples"
+	}
+	return fmt.Sprintf("p50=%v p90=%v p99=%v max=%v", l.P50, l.P90, l.P99, l.Max)
+}
+
+// LoadReport is the outcome of a load test.
+type LoadReport struct {
+	Devices  int            `json:"devices"`
+	Profiles map[string]int `json:"profiles"`
+	Elapsed  time.Duration  `json:"elapsed"`
+	// Logins are the connections which sent their login, ConnectFailures
+	// the ones which did not
+	Logins          uint64 `json:"logins"`
+	ConnectFailures uint64 `json:"connectFailures"`
+	// Disconnects are the sessions which ended with a write error, which is
+	// how devices notice the server closed their connection
+	Disconnects uint64 `json:"disconnects"`
+	// Readings written, garbage included, and their rate per second over the
+	// elapsed time
+	Readings   uint64  `json:"readings"`
+	Throughput float64 `json:"throughput"`
+	// ConnectLatency is the time to dial and send the login, the challenge
+	// included. SocketWriteLatency is the time to write a reading to the
+	// connection, which only copies it to the send buffer of the kernel: it
+	// grows once the buffer is full because the server fell behind reading,
+	// not with the time the server takes to process the reading. Readings are
+	// not acknowledged so there is no round trip to measure.
+	ConnectLatency     Latencies `json:"connectLatency"`
+	SocketWriteLatency Latencies `json:"socketWriteLatency"`
+}
+
+func (r LoadReport) String() string {
+	var b strings.Builder
+	profiles := make([]string, 0, len(r.Profiles))
+	for profile, n := range r.Profiles {
+		profiles = append(profiles, fmt.Sprintf("%s=%d", profile, n))
+	}
+	sort.Strings(profiles)
+	fmt.Fprintf(&b, "devices:          %d (%s)\n", r.Devices, strings.Join(profiles, ", "))
+	fmt.Fprintf(&b, "elapsed:          %v\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(&b, "logins:           %d\n", r.Logins)
+	fmt.Fprintf(&b, "connect failures: %d\n", r.ConnectFailures)
+	fmt.Fprintf(&b, "disconnects:      %d\n", r.Disconnects)
+	fmt.Fprintf(&b, "readings:         %d (%.1f/s)\n", r.Readings, r.Throughput)
+	fmt.Fprintf(&b, "connect latency:  %v\n", r.ConnectLatency)
+	fmt.Fprintf(&b, "socket write:     %v\n", r.SocketWriteLatency)
+	return b.String()
+}
+
+// loadStats are the counters of a load test, updated atomically.
+type loadStats struct {
+	logins          uint64
+	connectFailures uint64
+	disconnects     uint64
+	readings        uint64
+}
+
+// latencySampler keeps a uniform sample of at most size latencies, by
+// reservoir sampling. It is owned by a single device.
+type latencySampler struct {
+	size    int
+	seen    int
+	samples []time.Duration
+}
+
+func (s *latencySampler) observe(d time.Duration, rnd *rand.Rand) {
+	s.seen++
+	if len(s.samples) < s.size {
+		s.samples = append(s.samples, d)
+		return
+	}
+	if i := rnd.Intn(s.seen); i < s.size {
+		s.samples[i] = d
+	}
+}
+
+func percentiles(samples []time.Duration) Latencies {
+	if len(samples) == 0 {
+		return Latencies{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	at := func(p float64) time.Duration { return samples[int(p*float64(len(samples)-1))] }
+	return Latencies{Samples: len(samples), P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: samples[len(samples)-1]}
+}
+
+// loadDevice is a simulated device of a load test.
+type loadDevice struct {
+	sim         *simulator
+	profile     string
+	cfg         *LoadConfig
+	stats       *loadStats
+	rnd         *rand.Rand
+	connect     latencySampler
+	socketWrite latencySampler
+}
+
+// RunLoad runs cfg.Devices simulated devices against the server until
+// cfg.Duration elapses or ctx is done, and reports how it went. Devices
+// reconnect whenever their connection fails or is closed.
+func RunLoad(ctx context.Context, cfg LoadConfig) (LoadReport, error) {
+	if cfg.Protocol != ProtocolV1 && cfg.Protocol != ProtocolV2 {
+		return LoadReport{}, fmt.Errorf("unknown protocol version %d, it could be %d or %d", cfg.Protocol, ProtocolV1, ProtocolV2)
+	}
+	if cfg.Devices <= 0 {
+		return LoadReport{}, fmt.Errorf("the number of devices should be positive")
+	}
+	if cfg.Jitter < 0 || cfg.Jitter >= 1 {
+		return LoadReport{}, fmt.Errorf("the jitter should be between 0 and 1")
+	}
+	if cfg.ReadingRate <= 0 {
+		return LoadReport{}, fmt.Errorf("the reading rate should be positive")
+	}
+	if cfg.CertFile != "" && cfg.TLS == nil {
+		return LoadReport{}, fmt.Errorf("the client certificates require TLS")
+	}
+	if len(cfg.Mix) == 0 {
+		cfg.Mix = []LoadShare{{Profile: LoadRandom, Weight: 1}}
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	samples := loadLatencySamples / cfg.Devices
+	if samples < 10 {
+		samples = 10
+	}
+
+	report := LoadReport{Devices: cfg.Devices, Profiles: make(map[string]int)}
+	var stats loadStats
+	devices := make([]*loadDevice, cfg.Devices)
+	for i, profile := range dealProfiles(cfg.Mix, cfg.Devices) {
+		imeiNumber := LuhnIMEI(cfg.FirstSerial + uint64(i))
+		imei := fmt.Sprintf("%015d", imeiNumber)
+		tlsConfig := cfg.TLS
+		if cfg.CertFile != "" {
+			var err error
+			tlsConfig, err = withCertificate(cfg.TLS, strings.ReplaceAll(cfg.CertFile, "{imei}", imei))
+			if err != nil {
+				return LoadReport{}, err
+			}
+		}
+		secret, ok := cfg.Secrets[imeiNumber]
+		if !ok {
+			secret = cfg.Secret
+		}
+		report.Profiles[profile]++
+		devices[i] = &loadDevice{
+			sim: &simulator{
+				address:     cfg.ServerAddress,
+				imei:        imei,
+				protocol:    int(cfg.Protocol),
+				tlsConfig:   tlsConfig,
+				secret:      secret,
+				rebootDelay: rebootDelay,
+				log:         logging.Default().With(logging.F("imei", imei), logging.F("profile", profile)),
+			},
+			profile:     profile,
+			cfg:         &cfg,
+			stats:       &stats,
+			rnd:         rand.New(rand.NewSource(cfg.Seed + int64(i))),
+			connect:     latencySampler{size: samples},
+			socketWrite: latencySampler{size: samples},
+		}
+		if profile == LoadTooSlow {
+			devices[i].sim.sleepBeforeLogin = 2 * time.Second
+		}
+	}
+
+	started := time.Now()
+	// the devices take a moment to notice the test is over, it is not part
+	// of it
+	stopped := make(chan time.Time, 1)
+	go func() {
+		<-ctx.Done()
+		stopped <- time.Now()
+	}()
+	var wg sync.WaitGroup
+ramp:
+	for i, dev := range devices {
+		if cfg.RampUp > 0 {
+			at := started.Add(time.Duration(float64(i) / cfg.RampUp * float64(time.Second)))
+			select {
+			case <-time.After(time.Until(at)):
+			case <-ctx.Done():
+				break ramp
+			}
+		}
+		wg.Add(1)
+		go func(dev *loadDevice) {
+			defer wg.Done()
+			dev.run(ctx)
+		}(dev)
+	}
+	wg.Wait()
+
+	report.Elapsed = (<-stopped).Sub(started)
+	report.Logins = atomic.LoadUint64(&stats.logins)
+	report.ConnectFailures = atomic.LoadUint64(&stats.connectFailures)
+	report.Disconnects = atomic.LoadUint64(&stats.disconnects)
+	report.Readings = atomic.LoadUint64(&stats.readings)
+	if report.Elapsed > 0 {
+		report.Throughput = float64(report.Readings) / report.Elapsed.Seconds()
+	}
+	var connect, socketWrite []time.Duration
+	for _, dev := range devices {
+		connect = append(connect, dev.connect.samples...)
+		socketWrite = append(socketWrite, dev.socketWrite.samples...)
+	}
+	report.ConnectLatency = percentiles(connect)
+	report.SocketWriteLatency = percentiles(socketWrite)
+	return report, nil
+}
+
+// dealProfiles returns the profiles of n devices following mix, dealt by
+// smooth weighted round robin so every profile is spread across the devices
+// and a ramp-up starts all of them early.
+func dealProfiles(mix []LoadShare, n int) []string {
+	total := 0
+	for _, share := range mix {
+		total += share.Weight
+	}
+	current := make([]int, len(mix))
+	profiles := make([]string, n)
+	for i := range profiles {
+		best := 0
+		for j, share := range mix {
+			current[j] += share.Weight
+			if current[j] > current[best] {
+				best = j
+			}
+		}
+		current[best] -= total
+		profiles[i] = mix[best].Profile
+	}
+	return profiles
+}
+
+// jitter returns d varied by the jitter of the test.
+func (d *loadDevice) jitter(interval time.Duration) time.Duration {
+	if d.cfg.Jitter == 0 {
+		return interval
+	}
+	return time.Duration(float64(interval) * (1 + d.cfg.Jitter*(2*d.rnd.Float64()-1)))
+}
+
+// sleep waits for interval, it returns false if ctx is done meanwhile.
+func sleep(ctx context.Context, interval time.Duration) bool {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// run connects the device and runs its sessions until ctx is done.
+func (d *loadDevice) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		started := time.Now()
+		conn, err := d.sim.login()
+		if err != nil {
+			if ctx.Err() == nil {
+				atomic.AddUint64(&d.stats.connectFailures, 1)
+				d.sim.log.Warn("connecting", logging.F("err", err))
+			}
+			sleep(ctx, d.jitter(loadReconnectDelay))
+			continue
+		}
+		// too-slow devices wait before their login on purpose
+		d.connect.observe(time.Since(started)-d.sim.sleepBeforeLogin, d.rnd)
+		atomic.AddUint64(&d.stats.logins, 1)
+
+		// closing the connection unblocks the session once ctx is done
+		sessionDone := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-sessionDone:
+			}
+		}()
+		reboot := make(chan struct{})
+		go d.sim.receiveDownlinks(conn, reboot)
+		err = d.session(ctx, conn, reboot)
+		close(sessionDone)
+		conn.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		delay := d.jitter(loadReconnectDelay)
+		select {
+		case <-reboot:
+			delay = d.sim.rebootDelay
+		default:
+			if err != nil {
+				atomic.AddUint64(&d.stats.disconnects, 1)
+				d.sim.log.Debug("disconnected", logging.F("err", err))
+			}
+		}
+		sleep(ctx, delay)
+	}
+}
+
+// session writes the readings of the device profile to conn, until the
+// server closes it, reboot is closed or ctx is done. Flapping devices end
+// their sessions on their own and return nil.
+func (d *loadDevice) session(ctx context.Context, conn net.Conn, reboot <-chan struct{}) error {
+	interval := d.cfg.ReadingRate
+	readings := -1
+	switch d.profile {
+	case LoadSlow:
+		interval = 3 * time.Second
+	case LoadTooSlow:
+		interval = time.Second
+	case LoadFlapping:
+		readings = 1 + d.rnd.Intn(loadMaxFlaps)
+	}
+	for sent := 0; readings < 0 || sent < readings; sent++ {
+		select {
+		case <-reboot:
+			return nil
+		default:
+		}
+		var payload []byte
+		if d.profile == LoadGarbage {
+			// random bytes the size of a reading, framed for v2 devices so
+			// the server validates them rather than their framing
+			garbage := CreateRandReadingBytes()
+			d.rnd.Read(garbage[:])
+			payload = garbage[:]
+			if d.sim.protocol == ProtocolV2 {
+				payload = AppendFrameV2(nil, payload)
+			}
+		} else {
+			payload = d.sim.nextReading()
+		}
+		started := time.Now()
+		if _, err := d.sim.write(conn, payload); err != nil {
+			return err
+		}
+		d.socketWrite.observe(time.Since(started), d.rnd)
+		atomic.AddUint64(&d.stats.readings, 1)
+		if !sleep(ctx, d.jitter(interval)) {
+			return nil
+		}
+	}
+	return nil
+}
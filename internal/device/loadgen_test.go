@@ -0,0 +1,140 @@
+package device
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLuhnIMEI(t *testing.T) {
+	if imei := LuhnIMEI(49015420323751); imei != 490154203237518 {
+		t.Errorf("expected 490154203237518 got %d", imei)
+	}
+	for serial := uint64(35000000000000); serial < 35000000000100; serial++ {
+		b := []byte(strconv.FormatUint(LuhnIMEI(serial), 10))
+		for i := range b {
+			b[i] -= '0'
+		}
+		if _, err := decodeIMEI(b); err != nil {
+			t.Errorf("expected a valid IMEI for serial %d, %v", serial, err)
+		}
+	}
+}
+
+func TestParseLoadMix(t *testing.T) {
+	mix, err := ParseLoadMix("random=90, slow=5,garbage=5,flapping=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mix) != 3 || mix[0] != (LoadShare{LoadRandom, 90}) || mix[2] != (LoadShare{LoadGarbage, 5}) {
+		t.Errorf("unexpected mix %+v", mix)
+	}
+	for _, invalid := range []string{"", "random", "random=-1", "random=x", "fast=1", "random=1,random=2", "slow=0"} {
+		if _, err := ParseLoadMix(invalid); err == nil {
+			t.Errorf("expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func TestDealProfiles(t *testing.T) {
+	mix := []LoadShare{{LoadRandom, 90}, {LoadSlow, 5}, {LoadGarbage, 5}}
+	counts := make(map[string]int)
+	for _, profile := range dealProfiles(mix, 100) {
+		counts[profile]++
+	}
+	if counts[LoadRandom] != 90 || counts[LoadSlow] != 5 || counts[LoadGarbage] != 5 {
+		t.Errorf("expected the devices to follow the mix, got %v", counts)
+	}
+	profiles := dealProfiles([]LoadShare{{LoadRandom, 1}, {LoadFlapping, 1}}, 4)
+	if profiles[0] == profiles[1] || profiles[2] == profiles[3] {
+		t.Errorf("expected the profiles to alternate, got %v", profiles)
+	}
+}
+
+func TestRunLoad(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mux sync.Mutex
+	imeis := make(map[uint64]bool)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var login [15]byte
+				if _, err := io.ReadFull(conn, login[:]); err != nil {
+					return
+				}
+				if imei, err := decodeIMEI(login[:]); err == nil {
+					mux.Lock()
+					imeis[imei] = true
+					mux.Unlock()
+				}
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	cfg := LoadConfig{
+		ServerAddress: ln.Addr().String(),
+		Devices:       5,
+		RampUp:        100,
+		Duration:      300 * time.Millisecond,
+		ReadingRate:   10 * time.Millisecond,
+		Jitter:        0.2,
+		Mix:           []LoadShare{{LoadRandom, 4}, {LoadGarbage, 1}},
+		FirstSerial:   35000000000000,
+		Protocol:      ProtocolV1,
+		Seed:          1,
+	}
+	report, err := RunLoad(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Logins != 5 || report.ConnectFailures != 0 || report.Profiles[LoadRandom] != 4 || report.Profiles[LoadGarbage] != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	// 5 devices sending every 10ms for about 300ms
+	if report.Readings < 50 || report.Throughput <= 0 {
+		t.Errorf("expected about 150 readings got %d", report.Readings)
+	}
+	if report.ConnectLatency.Samples != 5 || report.SocketWriteLatency.Samples == 0 || report.SocketWriteLatency.P50 > report.SocketWriteLatency.Max {
+		t.Errorf("unexpected latencies %+v %+v", report.ConnectLatency, report.SocketWriteLatency)
+	}
+	mux.Lock()
+	if len(imeis) != 5 {
+		t.Errorf("expected 5 devices with valid IMEIs got %v", imeis)
+	}
+	mux.Unlock()
+
+	ln.Close()
+	report, err = RunLoad(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Logins != 0 || report.ConnectFailures < 5 {
+		t.Errorf("expected the connections to fail, got %+v", report)
+	}
+
+	for _, invalid := range []LoadConfig{
+		{Devices: 0, ReadingRate: time.Second, Protocol: ProtocolV1},
+		{Devices: 1, ReadingRate: 0, Protocol: ProtocolV1},
+		{Devices: 1, ReadingRate: time.Second, Protocol: 3},
+		{Devices: 1, ReadingRate: time.Second, Protocol: ProtocolV1, Jitter: 1},
+		{Devices: 1, ReadingRate: time.Second, Protocol: ProtocolV1, CertFile: "{imei}.pem"},
+	} {
+		if _, err := RunLoad(context.Background(), invalid); err == nil {
+			t.Errorf("expected an error running %+v", invalid)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package device
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Protocol versions spoken by devices.
+//
+// A v1 device sends its IMEI and then 40 bytes reading payloads. A v2 device
+// sends V2Marker right after its IMEI, and then v2 frames, each one a payload
+// prefixed by its length:
+//
+//	| Field   | Start Index | Size | Notes                                   |
+//	| ------- | ----------- | ---- | --------------------------------------- |
+//	| Length  | 0           | 2    | length of the payload, BE               |
+//	| Payload | 2           | n    | v2 reading payload or ack frame         |
+//
+// A v2 reading payload starts with V2Marker followed by type-length-value
+// fields, a tag byte, a length byte and the value, all numbers are BE:
+//
+//	| Tag | Field          | Size | Notes                                     |
+//	| --- | -------------- | ---- | ----------------------------------------- |
+//	| 1   | Sequence       | 4    | uint32, optional                          |
+//	| 2   | DeviceEpoch    | 8    | int64 nanoseconds since epoch, optional   |
+//	| 3   | Temperature    | 8    | float64, required                         |
+//	| 4   | Altitude       | 8    | float64, required                         |
+//	| 5   | Latitude       | 8    | float64, required                         |
+//	| 6   | Longitude      | 8    | float64, required                         |
+//	| 7   | BatteryLevel   | 8    | float64, required                         |
+//	| 8   | Humidity       | 8    | float64 0 to 100, optional                |
+//	| 9   | SignalStrength | 1    | int8 dBm, optional                        |
+//
+// Unknown tags are skipped, so new fields can be added without breaking the
+// servers which do not know them yet.
+//
+// No valid v1 reading starts with V2Marker, it would be a temperature far out of
+// range, which is how the server tells both versions apart.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+
+	// MaxPayloadSize is the maximum length of a v2 payload.
+	MaxPayloadSize = 1024
+
+	// V2Marker is sent by v2 devices right after their IMEI, and starts every v2
+	// reading payload.
+	V2Marker = 0xF2
+)
+
+const (
+	tagSequence byte = iota + 1
+	tagDeviceEpoch
+	tagTemperature
+	tagAltitude
+	tagLatitude
+	tagLongitude
+	tagBatteryLevel
+	tagHumidity
+	tagSignalStrength
+)
+
+// ReadingFields is a set of the optional v2 fields of a Reading.
+type ReadingFields uint8
+
+const (
+	// FieldSequence is set when Reading.Sequence was received.
+	FieldSequence ReadingFields = 1 << iota
+	// FieldDeviceEpoch is set when Reading.DeviceEpoch was received.
+	FieldDeviceEpoch
+	// FieldHumidity is set when Reading.Humidity was received.
+	FieldHumidity
+	// FieldSignalStrength is set when Reading.SignalStrength was received.
+	FieldSignalStrength
+)
+
+// Has reports whether every field of f2 is in f.
+func (f ReadingFields) Has(f2 ReadingFields) bool {
+	return f&f2 == f2
+}
+
+const (
+	humidityMin = 0
+	humidityMax = 100
+)
+
+// DecodeV2 decodes the v2 reading payload in the given b into r.
+//
+// If the payload is truncated, any required field is missing, or any of the
+// fields are outside their valid min/max ranges ok will be unset.
+//
+// DecodeV2 does NOT allocate under any condition.
+func (r *Reading) DecodeV2(b []byte) (ok bool) {
+	if len(b) == 0 || b[0] != V2Marker {
+		return false
+	}
+	return r.Decode(b)
+}
+
+// DecodeV2WithRules decodes the v2 payload in the given b into r like
+// DecodeWithRules does. Every reading frame of a v2 device is a v2 payload, so
+// b is rejected as malformed unless it starts with V2Marker.
+//
+// DecodeV2WithRules does NOT allocate under any condition.
+func (r *Reading) DecodeV2WithRules(b []byte, rules *Rules) RejectReason {
+	if len(b) == 0 || b[0] != V2Marker {
+		return RejectMalformed
+	}
+	return r.DecodeWithRules(b, rules)
+}
+
+// decodeV2 decodes the fields of the v2 payload b into r, which must be zero,
+// without validating their values. It returns false if b is malformed.
+func (r *Reading) decodeV2(b []byte) bool {
+	const required = 1<<tagTemperature | 1<<tagAltitude | 1<<tagLatitude | 1<<tagLongitude | 1<<tagBatteryLevel
+	seen := 0
+	for i := 1; i < len(b); {
+		if i+2 > len(b) {
+			return false
+		}
+		tag, size := b[i], int(b[i+1])
+		i += 2
+		if i+size > len(b) {
+			return false
+		}
+		value := b[i : i+size]
+		i += size
+
+		switch tag {
+		case tagSequence:
+			if size != 4 {
+				return false
+			}
+			r.Sequence = binary.BigEndian.Uint32(value)
+			r.Fields |= FieldSequence
+		case tagDeviceEpoch:
+			if size != 8 {
+				return false
+			}
+			r.DeviceEpoch = int64(binary.BigEndian.Uint64(value))
+			r.Fields |= FieldDeviceEpoch
+		case tagTemperature, tagAltitude, tagLatitude, tagLongitude, tagBatteryLevel, tagHumidity:
+			if size != 8 {
+				return false
+			}
+			v := math.Float64frombits(binary.BigEndian.Uint64(value))
+			switch tag {
+			case tagTemperature:
+				r.Temperature = v
+			case tagAltitude:
+				r.Altitude = v
+			case tagLatitude:
+				r.Latitude = v
+			case tagLongitude:
+				r.Longitude = v
+			case tagBatteryLevel:
+				r.BatteryLevel = v
+			case tagHumidity:
+				r.Humidity = v
+				r.Fields |= FieldHumidity
+			}
+		case tagSignalStrength:
+			if size != 1 {
+				return false
+			}
+			r.SignalStrength = int8(value[0])
+			r.Fields |= FieldSignalStrength
+		default:
+			// a field added after this version, skip it
+			continue
+		}
+		seen |= 1 << tag
+	}
+
+	return seen&required == required
+}
+
+// AppendPayloadV2 appends the v2 payload of r to dst, the optional fields are
+// appended only if they are in r.Fields.
+func AppendPayloadV2(dst []byte, r *Reading) []byte {
+	dst = append(dst, V2Marker)
+	if r.Fields.Has(FieldSequence) {
+		dst = append(dst, tagSequence, 4)
+		dst = appendUint32(dst, r.Sequence)
+	}
+	if r.Fields.Has(FieldDeviceEpoch) {
+		dst = append(dst, tagDeviceEpoch, 8)
+		dst = appendUint64(dst, uint64(r.DeviceEpoch))
+	}
+	dst = appendFloatField(dst, tagTemperature, r.Temperature)
+	dst = appendFloatField(dst, tagAltitude, r.Altitude)
+	dst = appendFloatField(dst, tagLatitude, r.Latitude)
+	dst = appendFloatField(dst, tagLongitude, r.Longitude)
+	dst = appendFloatField(dst, tagBatteryLevel, r.BatteryLevel)
+	if r.Fields.Has(FieldHumidity) {
+		dst = appendFloatField(dst, tagHumidity, r.Humidity)
+	}
+	if r.Fields.Has(FieldSignalStrength) {
+		dst = append(dst, tagSignalStrength, 1, byte(r.SignalStrength))
+	}
+	return dst
+}
+
+// AppendFrameV2 appends payload to dst as a v2 frame. It panics if payload is
+// bigger than MaxPayloadSize.
+func AppendFrameV2(dst []byte, payload []byte) []byte {
+	if len(payload) > MaxPayloadSize {
+		panic("device: v2 payload bigger than MaxPayloadSize")
+	}
+	dst = append(dst, byte(len(payload)>>8), byte(len(payload)))
+	return append(dst, payload...)
+}
+
+func appendFloatField(dst []byte, tag byte, v float64) []byte {
+	dst = append(dst, tag, 8)
+	return appendUint64(dst, math.Float64bits(v))
+}
+
+func appendUint32(dst []byte, v uint32) []byte {
+	return append(dst, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(dst []byte, v uint64) []byte {
+	return append(dst, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
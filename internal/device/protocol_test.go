@@ -0,0 +1,118 @@
+package device
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/spin-org/thermomatic/internal/common"
+)
+
+var testReadingV2 = Reading{
+	Temperature:    38,
+	Altitude:       10,
+	Latitude:       21.033643,
+	Longitude:      -89.5969049,
+	BatteryLevel:   45,
+	Sequence:       42,
+	DeviceEpoch:    1596397680000000000,
+	Humidity:       63.5,
+	SignalStrength: -87,
+	Fields:         FieldSequence | FieldDeviceEpoch | FieldHumidity | FieldSignalStrength,
+}
+
+func TestReading_DecodeV2(t *testing.T) {
+	payload := AppendPayloadV2(nil, &testReadingV2)
+
+	var reading Reading
+	if !reading.Decode(payload) {
+		t.Fatalf("expected %v to be decoded", payload)
+	}
+	if reading != testReadingV2 {
+		t.Errorf("expected %+v got %+v", testReadingV2, reading)
+	}
+
+	// a v1 payload decoded later resets the v2 fields
+	v1 := NewPayload(30, 5, 21, -89, 99)
+	if !reading.Decode(v1[:]) {
+		t.Fatal("expected the v1 payload to be decoded")
+	}
+	expected := Reading{Temperature: 30, Altitude: 5, Latitude: 21, Longitude: -89, BatteryLevel: 99}
+	if reading != expected {
+		t.Errorf("expected %+v got %+v", expected, reading)
+	}
+}
+
+func TestReading_DecodeV2_OptionalAndUnknownFields(t *testing.T) {
+	minimal := testReadingV2
+	minimal.Sequence, minimal.DeviceEpoch, minimal.Humidity, minimal.SignalStrength, minimal.Fields = 0, 0, 0, 0, 0
+	payload := AppendPayloadV2(nil, &minimal)
+	// a field from the future
+	payload = append(payload, 200, 3, 1, 2, 3)
+
+	var reading Reading
+	if !reading.DecodeV2(payload) {
+		t.Fatalf("expected %v to be decoded", payload)
+	}
+	if reading != minimal {
+		t.Errorf("expected %+v got %+v", minimal, reading)
+	}
+}
+
+func TestReading_DecodeV2_Invalid(t *testing.T) {
+	valid := AppendPayloadV2(nil, &testReadingV2)
+	outOfRange := testReadingV2
+	outOfRange.Humidity = 101
+
+	tests := map[string][]byte{
+		"empty":                 {},
+		"v1 marker":             {0},
+		"truncated":             valid[:len(valid)-1],
+		"truncated tag":         append(append([]byte{}, valid...), tagHumidity),
+		"missing required":      {V2Marker, tagTemperature, 8, 0, 0, 0, 0, 0, 0, 0, 0},
+		"wrong size":            append(append([]byte{}, valid...), tagSequence, 2, 0, 1),
+		"humidity out of range": AppendPayloadV2(nil, &outOfRange),
+	}
+	for name, payload := range tests {
+		var reading Reading
+		if reading.DecodeV2(payload) {
+			t.Errorf("%s: expected %v not to be decoded", name, payload)
+		}
+	}
+}
+
+func TestReading_DecodeV2_Allocations(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	var start, end runtime.MemStats
+	reading := Reading{}
+	payload := AppendPayloadV2(nil, &testReadingV2)
+	runtime.GC()
+	runtime.ReadMemStats(&start)
+
+	reading.Decode(payload)
+
+	runtime.ReadMemStats(&end)
+	alloc := end.TotalAlloc - start.TotalAlloc
+	if alloc > 0 {
+		t.Errorf("DecodeV2 should NOT allocate under any condition, it allocated %d bytes", alloc)
+	}
+}
+
+func TestAppendFrameV2_PanicsWhenTooBig(t *testing.T) {
+	common.ShouldPanic(t, func() {
+		AppendFrameV2(nil, make([]byte, MaxPayloadSize+1))
+	})
+}
+
+func BenchmarkReading_DecodeV2(b *testing.B) {
+	payload := AppendPayloadV2(nil, &testReadingV2)
+	reading := Reading{}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if ok := reading.Decode(payload); !ok {
+			b.Fail()
+		}
+	}
+	b.StopTimer()
+}
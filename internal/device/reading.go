@@ -22,6 +22,22 @@ type Reading struct {
 
 	// BatteryLevel denotes the battery level reading of the message.
 	BatteryLevel float64
+
+	// Sequence is the sequence number of the message, sent by v2 devices only.
+	Sequence uint32 `json:",omitempty"`
+
+	// DeviceEpoch is the device clock, in nanoseconds since the unix epoch,
+	// when the reading was taken. It is sent by v2 devices only.
+	DeviceEpoch int64 `json:",omitempty"`
+
+	// Humidity denotes the relative humidity reading, an optional v2 field.
+	Humidity float64 `json:",omitempty"`
+
+	// SignalStrength denotes the signal strength in dBm, an optional v2 field.
+	SignalStrength int8 `json:",omitempty"`
+
+	// Fields tells which of the v2 fields were received.
+	Fields ReadingFields `json:"-"`
 }
 
 const (
@@ -37,50 +53,56 @@ const (
 	batteryLevelMax = 100
 )
 
-// Decode decodes the reading message payload in the given b into r.
+// Decode decodes the reading message payload in the given b into r, b could be
+// a v1 payload or a v2 one, see DecodeV2. The fields are validated with
+// DefaultRules, DecodeWithRules reports which rule rejected a reading.
 //
 // If any of the fields are outside their valid min/max ranges ok will be unset.
 //
 // Decode does NOT allocate under any condition. Additionally, it panics if b
-// isn't at least 40 bytes long.
+// is a v1 payload and it isn't at least 40 bytes long.
 func (r *Reading) Decode(b []byte) (ok bool) {
-	_ = b[39] // compiler bound check hint
-	temperature := math.Float64frombits(binary.BigEndian.Uint64(b[0:]))
-	altitude := math.Float64frombits(binary.BigEndian.Uint64(b[8:]))
-	latitude := math.Float64frombits(binary.BigEndian.Uint64(b[16:]))
-	longitude := math.Float64frombits(binary.BigEndian.Uint64(b[24:]))
-	batteryLevel := math.Float64frombits(binary.BigEndian.Uint64(b[32:]))
-
-	if !allFieldsAreValid(temperature, altitude, latitude, longitude, batteryLevel) {
-		return false
+	if len(b) == 0 || b[0] != V2Marker {
+		_ = b[39] // short v1 payloads panic, DecodeWithRules rejects them
 	}
-
-	r.Temperature = temperature
-	r.Altitude = altitude
-	r.Latitude = latitude
-	r.Longitude = longitude
-	r.BatteryLevel = batteryLevel
-
-	return true
+	return r.DecodeWithRules(b, &defaultRules) == RejectNone
 }
 
-func allFieldsAreValid(temperature, altitude, latitude, longitude, batteryLevel float64) bool {
-	validTemperature := isInRange(temperature, temperatureMin, temperatureMax)
-	validAltitude := isInRange(altitude, altitudeMin, altitudMax)
-	validLatitude := isInRange(latitude, latitudeMin, latitudeMax)
-	validLongitude := isInRange(longitude, longitudeMin, longitudeMax)
-	validBatteryLevel := isInRange(batteryLevel, batteryLevelMin, batteryLevelMax)
-
-	return validTemperature &&
-		validAltitude &&
-		validLatitude &&
-		validLongitude &&
-		validBatteryLevel
-
+// DecodeWithRules decodes b into r like Decode does, but validates the fields
+// with rules and returns the reason of the rejection, r is only set when it is
+// RejectNone. A nil rules skips the validation, for payloads which were already
+// validated when they were received. v1 payloads shorter than 40 bytes are
+// rejected as malformed.
+//
+// DecodeWithRules does NOT allocate under any condition.
+func (r *Reading) DecodeWithRules(b []byte, rules *Rules) RejectReason {
+	var decoded Reading
+	if len(b) > 0 && b[0] == V2Marker {
+		if !decoded.decodeV2(b) {
+			return RejectMalformed
+		}
+	} else {
+		if len(b) < 40 {
+			return RejectMalformed
+		}
+		decoded.decodeV1(b)
+	}
+	if rules != nil {
+		if reason := rules.Check(&decoded); reason != RejectNone {
+			return reason
+		}
+	}
+	*r = decoded
+	return RejectNone
 }
 
-func isInRange(value, min, max float64) bool {
-	return value >= min && value <= max
+func (r *Reading) decodeV1(b []byte) {
+	_ = b[39] // compiler bound check hint
+	r.Temperature = math.Float64frombits(binary.BigEndian.Uint64(b[0:]))
+	r.Altitude = math.Float64frombits(binary.BigEndian.Uint64(b[8:]))
+	r.Latitude = math.Float64frombits(binary.BigEndian.Uint64(b[16:]))
+	r.Longitude = math.Float64frombits(binary.BigEndian.Uint64(b[24:]))
+	r.BatteryLevel = math.Float64frombits(binary.BigEndian.Uint64(b[32:]))
 }
 
 // CreateRandReading creates a new random bytes payload for testing
@@ -99,7 +121,8 @@ func randFloat(min, max float64) float64 {
 	return min + rand.Float64()*(max-min)
 }
 
-// NewPayload returns a input reading values as byte array
+// NewPayload returns a input reading values as v1 payload, see AppendPayloadV2
+// for v2 ones.
 func NewPayload(expectedTemperature float64, expectedAltitude float64, expectedLatitude float64, expectedLongitude float64, expectedBatteryLevel float64) [40]byte {
 	var payload [40]byte
 	binary.BigEndian.PutUint64(payload[0:], math.Float64bits(expectedTemperature))
@@ -86,3 +86,41 @@ func BenchmarkReading_Decode(b *testing.B) {
 	}
 	b.StopTimer()
 }
+
+func BenchmarkFrameReader_ReadFrame(b *testing.B) {
+	reading := CreateRandReadingBytes()
+	// an endless stream of readings delivered in segments of 1448 bytes, a
+	// typical TCP MSS, so most segments end in the middle of a frame
+	frames := newFrameReader(&repeatReader{b: reading[:], segment: 1448})
+	var payload [40]byte
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := frames.readFrame(payload[:]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+}
+
+// repeatReader repeats b forever, in reads of at most segment bytes.
+type repeatReader struct {
+	b       []byte
+	segment int
+	off     int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if len(p) > r.segment {
+		p = p[:r.segment]
+	}
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.b[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.b)
+	}
+	return n, nil
+}
@@ -0,0 +1,182 @@
+package device
+
+import (
+	"fmt"
+	"math"
+)
+
+// RejectReason tells which validation rule rejected a reading.
+type RejectReason uint8
+
+const (
+	// RejectNone is returned for valid readings.
+	RejectNone RejectReason = iota
+	// RejectMalformed readings are truncated payloads, frames of v2 devices
+	// which are not v2 payloads, or lack a required field.
+	RejectMalformed
+	// RejectNaN readings have a field which is not a number.
+	RejectNaN
+	// RejectInf readings have an infinite field.
+	RejectInf
+	// RejectTemperature readings have a temperature out of its range, and so
+	// on for the other fields.
+	RejectTemperature
+	RejectAltitude
+	RejectLatitude
+	RejectLongitude
+	RejectBatteryLevel
+	RejectHumidity
+	// RejectTemperatureJump readings changed the temperature more than allowed
+	// since the previous reading of the device.
+	RejectTemperatureJump
+
+	// NumRejectReasons is the number of reasons, RejectNone included, so
+	// counters can be indexed by reason.
+	NumRejectReasons = int(RejectTemperatureJump) + 1
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectNone:
+		return "none"
+	case RejectMalformed:
+		return "malformed"
+	case RejectNaN:
+		return "nan"
+	case RejectInf:
+		return "inf"
+	case RejectTemperature:
+		return "temperature-range"
+	case RejectAltitude:
+		return "altitude-range"
+	case RejectLatitude:
+		return "latitude-range"
+	case RejectLongitude:
+		return "longitude-range"
+	case RejectBatteryLevel:
+		return "battery-level-range"
+	case RejectHumidity:
+		return "humidity-range"
+	case RejectTemperatureJump:
+		return "temperature-jump"
+	}
+	return fmt.Sprintf("RejectReason(%d)", int(r))
+}
+
+// Range bounds the values of a field, both ends are included unless they are
+// marked as exclusive.
+type Range struct {
+	Min          float64 `json:"min"`
+	Max          float64 `json:"max"`
+	ExclusiveMin bool    `json:"exclusiveMin,omitempty"`
+	ExclusiveMax bool    `json:"exclusiveMax,omitempty"`
+}
+
+// Contains reports whether v is within the range, NaN never is.
+func (rg Range) Contains(v float64) bool {
+	if rg.ExclusiveMin && v <= rg.Min || v < rg.Min {
+		return false
+	}
+	if rg.ExclusiveMax && v >= rg.Max || v > rg.Max {
+		return false
+	}
+	return v == v
+}
+
+func (rg Range) validate() error {
+	if math.IsNaN(rg.Min) || math.IsNaN(rg.Max) || rg.Min > rg.Max {
+		return fmt.Errorf("invalid range [%v, %v]", rg.Min, rg.Max)
+	}
+	return nil
+}
+
+// Rules are the validation rules of the readings of a device.
+type Rules struct {
+	Temperature  Range `json:"temperature"`
+	Altitude     Range `json:"altitude"`
+	Latitude     Range `json:"latitude"`
+	Longitude    Range `json:"longitude"`
+	BatteryLevel Range `json:"batteryLevel"`
+	// Humidity is only checked when the reading has it.
+	Humidity Range `json:"humidity"`
+	// MaxTemperatureJump is the maximum change of temperature, in °C, from the
+	// last accepted reading of a device, 0 means no limit.
+	MaxTemperatureJump float64 `json:"maxTemperatureJump"`
+}
+
+// defaultRules are the ranges of the thermomatic protocol spec.
+var defaultRules = Rules{
+	Temperature:  Range{Min: temperatureMin, Max: temperatureMax},
+	Altitude:     Range{Min: altitudeMin, Max: altitudMax},
+	Latitude:     Range{Min: latitudeMin, Max: latitudeMax},
+	Longitude:    Range{Min: longitudeMin, Max: longitudeMax},
+	BatteryLevel: Range{Min: batteryLevelMin, Max: batteryLevelMax, ExclusiveMin: true},
+	Humidity:     Range{Min: humidityMin, Max: humidityMax},
+}
+
+// DefaultRules returns the rules used by Decode, the ranges of the protocol
+// spec without a temperature jump limit.
+func DefaultRules() Rules {
+	return defaultRules
+}
+
+// Validate checks that every range is well formed.
+func (rules *Rules) Validate() error {
+	for _, field := range []struct {
+		name string
+		rg   Range
+	}{
+		{"temperature", rules.Temperature},
+		{"altitude", rules.Altitude},
+		{"latitude", rules.Latitude},
+		{"longitude", rules.Longitude},
+		{"batteryLevel", rules.BatteryLevel},
+		{"humidity", rules.Humidity},
+	} {
+		if err := field.rg.validate(); err != nil {
+			return fmt.Errorf("%s, %v", field.name, err)
+		}
+	}
+	if !(rules.MaxTemperatureJump >= 0) {
+		return fmt.Errorf("invalid maxTemperatureJump %v", rules.MaxTemperatureJump)
+	}
+	return nil
+}
+
+// Check returns the first rule r breaks, NaN and infinite fields are rejected
+// before the ranges are checked. It does NOT allocate.
+func (rules *Rules) Check(r *Reading) RejectReason {
+	values := [...]float64{r.Temperature, r.Altitude, r.Latitude, r.Longitude, r.BatteryLevel, r.Humidity}
+	for _, v := range values {
+		if math.IsNaN(v) {
+			return RejectNaN
+		}
+		if math.IsInf(v, 0) {
+			return RejectInf
+		}
+	}
+	switch {
+	case !rules.Temperature.Contains(r.Temperature):
+		return RejectTemperature
+	case !rules.Altitude.Contains(r.Altitude):
+		return RejectAltitude
+	case !rules.Latitude.Contains(r.Latitude):
+		return RejectLatitude
+	case !rules.Longitude.Contains(r.Longitude):
+		return RejectLongitude
+	case !rules.BatteryLevel.Contains(r.BatteryLevel):
+		return RejectBatteryLevel
+	case r.Fields.Has(FieldHumidity) && !rules.Humidity.Contains(r.Humidity):
+		return RejectHumidity
+	}
+	return RejectNone
+}
+
+// CheckJump returns RejectTemperatureJump if temperature differs from the
+// previous temperature of the device more than rules allow.
+func (rules *Rules) CheckJump(previous, temperature float64) RejectReason {
+	if rules.MaxTemperatureJump > 0 && math.Abs(temperature-previous) > rules.MaxTemperatureJump {
+		return RejectTemperatureJump
+	}
+	return RejectNone
+}
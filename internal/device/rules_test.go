@@ -0,0 +1,120 @@
+package device
+
+import (
+	"math"
+	"runtime"
+	"testing"
+)
+
+func TestReading_DecodeWithRules_Reasons(t *testing.T) {
+	rules := DefaultRules()
+	for _, tc := range []struct {
+		name     string
+		payload  [40]byte
+		expected RejectReason
+	}{
+		{"valid", NewPayload(38, 10, 21.03, -89.59, 45), RejectNone},
+		{"full battery", NewPayload(38, 10, 21.03, -89.59, 100), RejectNone},
+		{"empty battery", NewPayload(38, 10, 21.03, -89.59, 0), RejectBatteryLevel},
+		{"nan", NewPayload(38, math.NaN(), 21.03, -89.59, 45), RejectNaN},
+		{"inf", NewPayload(38, 10, math.Inf(-1), -89.59, 45), RejectInf},
+		{"temperature", NewPayload(300.5, 10, 21.03, -89.59, 45), RejectTemperature},
+		{"altitude", NewPayload(38, -20001, 21.03, -89.59, 45), RejectAltitude},
+		{"latitude", NewPayload(38, 10, 91, -89.59, 45), RejectLatitude},
+		{"longitude", NewPayload(38, 10, 21.03, 180.1, 45), RejectLongitude},
+	} {
+		var reading Reading
+		if reason := reading.DecodeWithRules(tc.payload[:], &rules); reason != tc.expected {
+			t.Errorf("%s: expected %v got %v", tc.name, tc.expected, reason)
+		}
+		if ok := reading.Decode(tc.payload[:]); ok != (tc.expected == RejectNone) {
+			t.Errorf("%s: expected Decode to return %v", tc.name, tc.expected == RejectNone)
+		}
+	}
+}
+
+func TestReading_DecodeWithRules_V2(t *testing.T) {
+	rules := DefaultRules()
+	reading := Reading{Temperature: 20, Altitude: 1, Latitude: 2, Longitude: 3, BatteryLevel: 50, Humidity: 101, Fields: FieldHumidity}
+	payload := AppendPayloadV2(nil, &reading)
+	var decoded Reading
+	if reason := decoded.DecodeWithRules(payload, &rules); reason != RejectHumidity {
+		t.Errorf("expected %v got %v", RejectHumidity, reason)
+	}
+	if reason := decoded.DecodeWithRules(payload[:len(payload)-3], &rules); reason != RejectMalformed {
+		t.Errorf("expected %v got %v", RejectMalformed, reason)
+	}
+	if reason := decoded.DecodeWithRules(payload, nil); reason != RejectNone || decoded.Humidity != 101 {
+		t.Errorf("expected nil rules to skip the validation, got %v %+v", reason, decoded)
+	}
+	if reason := decoded.DecodeWithRules([]byte{1, 2}, &rules); reason != RejectMalformed {
+		t.Errorf("expected a short v1 payload to be %v got %v", RejectMalformed, reason)
+	}
+	v1 := NewPayload(38, 10, 21.03, -89.59, 45)
+	if reason := decoded.DecodeV2WithRules(v1[:], &rules); reason != RejectMalformed {
+		t.Errorf("expected a v1 payload to be a %v v2 one, got %v", RejectMalformed, reason)
+	}
+	if reason := decoded.DecodeV2WithRules(payload, nil); reason != RejectNone {
+		t.Errorf("expected %v got %v", RejectNone, reason)
+	}
+}
+
+func TestReading_DecodeWithRules_Overrides(t *testing.T) {
+	rules := DefaultRules()
+	rules.Temperature = Range{Min: -40, Max: 85}
+	payload := NewPayload(90, 10, 21.03, -89.59, 45)
+	var reading Reading
+	if reason := reading.DecodeWithRules(payload[:], &rules); reason != RejectTemperature {
+		t.Errorf("expected %v got %v", RejectTemperature, reason)
+	}
+	if reading.Temperature != 0 {
+		t.Errorf("expected a rejected reading to leave the reading untouched, got %+v", reading)
+	}
+}
+
+func TestRules_CheckJump(t *testing.T) {
+	rules := DefaultRules()
+	if reason := rules.CheckJump(20, 80); reason != RejectNone {
+		t.Errorf("expected no limit by default, got %v", reason)
+	}
+	rules.MaxTemperatureJump = 5
+	if reason := rules.CheckJump(20, 25); reason != RejectNone {
+		t.Errorf("expected a jump of 5 to be accepted, got %v", reason)
+	}
+	if reason := rules.CheckJump(20, 14.9); reason != RejectTemperatureJump {
+		t.Errorf("expected %v got %v", RejectTemperatureJump, reason)
+	}
+}
+
+func TestRules_Validate(t *testing.T) {
+	rules := DefaultRules()
+	if err := rules.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	rules.Latitude = Range{Min: 10, Max: -10}
+	if err := rules.Validate(); err == nil {
+		t.Error("expected an inverted range to be invalid")
+	}
+	rules = DefaultRules()
+	rules.MaxTemperatureJump = -1
+	if err := rules.Validate(); err == nil {
+		t.Error("expected a negative jump to be invalid")
+	}
+}
+
+func TestReading_DecodeWithRules_Allocations(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	var start, end runtime.MemStats
+	rules := DefaultRules()
+	reading := Reading{}
+	payload := NewPayload(30, 5, 21, -89, math.NaN())
+	runtime.GC()
+	runtime.ReadMemStats(&start)
+
+	reading.DecodeWithRules(payload[:], &rules)
+
+	runtime.ReadMemStats(&end)
+	if alloc := end.TotalAlloc - start.TotalAlloc; alloc > 0 {
+		t.Errorf("DecodeWithRules should NOT allocate under any condition, it allocated %d bytes", alloc)
+	}
+}
@@ -0,0 +1,62 @@
+package device
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// verifyPeerIMEI checks that the certificate of a mutual TLS connection was
+// issued to imei, its common name must be the 15 digits of the IMEI. Plain TCP
+// connections and TLS connections without a client certificate are not checked.
+func verifyPeerIMEI(conn net.Conn, imei uint64) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	peers := tlsConn.ConnectionState().PeerCertificates
+	if len(peers) == 0 {
+		return nil
+	}
+	if cn := peers[0].Subject.CommonName; cn != fmt.Sprintf("%015d", imei) {
+		return fmt.Errorf("client certificate issued to %q, not to IMEI %d", cn, imei)
+	}
+	return nil
+}
+
+// LoadClientTLSConfig returns the TLS configuration of a simulated device.
+// certFile is a PEM file with the certificate of the device and its key, for
+// mutual TLS, and caFile the PEM certificates trusted to verify the server.
+// Both are optional, the system roots are used when caFile is empty.
+func LoadClientTLSConfig(certFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading ca %s, %v", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		return withCertificate(config, certFile)
+	}
+	return config, nil
+}
+
+// withCertificate returns a copy of config presenting the certificate, and its
+// key, of the PEM file certFile.
+func withCertificate(config *tls.Config, certFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, certFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading client certificate %s, %v", certFile, err)
+	}
+	config = config.Clone()
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
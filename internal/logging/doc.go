@@ -0,0 +1,14 @@
+/*
+Package logging provides leveled, structured logging.
+
+A record is a level, an optional lifecycle event name, a message and a list of
+fields, written as a single logfmt or JSON line:
+
+	time=2020-08-02T19:48:00.000Z level=info event=welcome conn=7 remote=10.0.0.1:51234 imei=490154203237518 session=3
+	{"time":"2020-08-02T19:48:00.000Z","level":"info","event":"welcome","conn":7,"remote":"10.0.0.1:51234","imei":490154203237518,"session":3}
+
+Loggers derived with With share their output and level, and add their fields
+to every record, so the logger of a connection carries its ID, remote address
+and IMEI.
+*/
+package logging
@@ -0,0 +1,334 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Level is the severity of a record.
+type Level int32
+
+const (
+	// LevelDebug records are meant for troubleshooting, they may be emitted
+	// for every reading.
+	LevelDebug Level = iota
+	// LevelInfo records are the lifecycle of the server and its connections.
+	LevelInfo
+	// LevelWarn records are unexpected but handled conditions.
+	LevelWarn
+	// LevelError records are failures.
+	LevelError
+)
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	switch s {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, it could be debug, info, warn or error", s)
+}
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "info"
+}
+
+// Format is the encoding of the records.
+type Format int
+
+const (
+	// FormatLogfmt writes key=value pairs.
+	FormatLogfmt Format = iota
+	// FormatJSON writes a JSON object per record.
+	FormatJSON
+)
+
+// ParseFormat parses logfmt or json.
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "logfmt":
+		return FormatLogfmt, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return FormatLogfmt, fmt.Errorf("unknown log format %q, it could be logfmt or json", s)
+}
+
+func (f Format) String() string {
+	if f == FormatJSON {
+		return "json"
+	}
+	return "logfmt"
+}
+
+// Field is a key and value of a record.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns the field key=value.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger writes records with its fields. It is safe for concurrent use.
+type Logger struct {
+	out    *output
+	fields []Field
+}
+
+// output is shared by a logger and every logger derived from it.
+type output struct {
+	mux    sync.Mutex
+	w      io.Writer
+	level  int32 // Level, accessed atomically
+	format Format
+	now    func() time.Time
+	buf    []byte
+}
+
+// New returns a logger writing the records of level or above to w.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{out: &output{w: w, level: int32(level), format: format, now: time.Now}}
+}
+
+// With returns a logger which adds fields to every record, after the fields
+// of l.
+func (l *Logger) With(fields ...Field) *Logger {
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+	return &Logger{out: l.out, fields: all}
+}
+
+// SetLevel changes the level of l and of every logger sharing its output.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+// Enabled reports whether records of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return int32(level) >= atomic.LoadInt32(&l.out.level)
+}
+
+// Debug writes a debug record.
+func (l *Logger) Debug(msg string, fields ...Field) {
+	l.write(LevelDebug, "", msg, fields)
+}
+
+// Info writes an info record.
+func (l *Logger) Info(msg string, fields ...Field) {
+	l.write(LevelInfo, "", msg, fields)
+}
+
+// Warn writes a warn record.
+func (l *Logger) Warn(msg string, fields ...Field) {
+	l.write(LevelWarn, "", msg, fields)
+}
+
+// Error writes an error record.
+func (l *Logger) Error(msg string, fields ...Field) {
+	l.write(LevelError, "", msg, fields)
+}
+
+// Event writes an info record of the lifecycle event named event. Event names
+// are fixed, so they can be alerted on.
+func (l *Logger) Event(event string, fields ...Field) {
+	l.write(LevelInfo, event, "", fields)
+}
+
+// WarnEvent writes a warn record of the lifecycle event named event.
+func (l *Logger) WarnEvent(event string, fields ...Field) {
+	l.write(LevelWarn, event, "", fields)
+}
+
+func (l *Logger) write(level Level, event string, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	out := l.out
+	out.mux.Lock()
+	defer out.mux.Unlock()
+	enc := encoder{buf: out.buf[:0], format: out.format}
+	enc.begin()
+	enc.field("time", out.now().UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	enc.field("level", level.String())
+	if event != "" {
+		enc.field("event", event)
+	}
+	if msg != "" {
+		enc.field("msg", msg)
+	}
+	for _, f := range l.fields {
+		enc.field(f.Key, f.Value)
+	}
+	for _, f := range fields {
+		enc.field(f.Key, f.Value)
+	}
+	enc.end()
+	out.buf = enc.buf
+	out.w.Write(enc.buf)
+}
+
+// encoder appends the fields of a record to buf.
+type encoder struct {
+	buf    []byte
+	format Format
+	n      int
+}
+
+func (e *encoder) begin() {
+	if e.format == FormatJSON {
+		e.buf = append(e.buf, '{')
+	}
+}
+
+func (e *encoder) end() {
+	if e.format == FormatJSON {
+		e.buf = append(e.buf, '}')
+	}
+	e.buf = append(e.buf, '\n')
+}
+
+func (e *encoder) field(key string, value interface{}) {
+	if e.format == FormatJSON {
+		if e.n > 0 {
+			e.buf = append(e.buf, ',')
+		}
+		e.buf = strconv.AppendQuote(e.buf, key)
+		e.buf = append(e.buf, ':')
+		e.buf = appendJSONValue(e.buf, value)
+	} else {
+		if e.n > 0 {
+			e.buf = append(e.buf, ' ')
+		}
+		e.buf = append(e.buf, key...)
+		e.buf = append(e.buf, '=')
+		e.buf = appendLogfmtValue(e.buf, value)
+	}
+	e.n++
+}
+
+// text returns the text of values which are not numbers nor booleans.
+func text(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
+
+func appendLogfmtValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(buf, v, 10)
+	case uint64:
+		return strconv.AppendUint(buf, v, 10)
+	case uint32:
+		return strconv.AppendUint(buf, uint64(v), 10)
+	case float64:
+		return strconv.AppendFloat(buf, v, 'g', -1, 64)
+	case bool:
+		return strconv.AppendBool(buf, v)
+	case nil:
+		return append(buf, "null"...)
+	}
+	s := text(value)
+	if needsQuoting(s) {
+		return strconv.AppendQuote(buf, s)
+	}
+	return append(buf, s...)
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError {
+			return true
+		}
+	}
+	return false
+}
+
+func appendJSONValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case int, int64, uint64, uint32, bool, nil:
+		return appendLogfmtValue(buf, v)
+	case float64:
+		b, err := json.Marshal(v)
+		if err != nil {
+			// NaN and infinities are not JSON numbers
+			return strconv.AppendQuote(buf, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		return append(buf, b...)
+	}
+	b, _ := json.Marshal(text(value))
+	return append(buf, b...)
+}
+
+var std atomic.Value // *Logger
+
+func init() {
+	std.Store(New(os.Stderr, LevelInfo, FormatLogfmt))
+}
+
+// Default returns the logger used by the package functions, it writes info
+// records and above to stderr until SetDefault is called.
+func Default() *Logger {
+	return std.Load().(*Logger)
+}
+
+// SetDefault replaces the logger used by the package functions.
+func SetDefault(l *Logger) {
+	std.Store(l)
+}
+
+// Debug writes a debug record with the default logger.
+func Debug(msg string, fields ...Field) {
+	Default().Debug(msg, fields...)
+}
+
+// Info writes an info record with the default logger.
+func Info(msg string, fields ...Field) {
+	Default().Info(msg, fields...)
+}
+
+// Warn writes a warn record with the default logger.
+func Warn(msg string, fields ...Field) {
+	Default().Warn(msg, fields...)
+}
+
+// Error writes an error record with the default logger.
+func Error(msg string, fields ...Field) {
+	Default().Error(msg, fields...)
+}
@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger(level Level, format Format) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := New(&buf, level, format)
+	l.out.now = func() time.Time { return time.Date(2020, 3, 1, 10, 30, 0, 0, time.UTC) }
+	return l, &buf
+}
+
+func TestLogfmtRecord(t *testing.T) {
+	l, buf := newTestLogger(LevelInfo, FormatLogfmt)
+	l.With(F("conn", uint64(7)), F("remote", "10.0.0.1:5000")).
+		Event("login", F("imei", uint64(490154203237518)), F("err", errors.New("read tcp: i/o timeout")))
+
+	expected := `time=2020-03-01T10:30:00.000Z level=info event=login conn=7 remote=10.0.0.1:5000 imei=490154203237518 err="read tcp: i/o timeout"` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q but got %q", expected, buf.String())
+	}
+}
+
+func TestLogfmtQuoting(t *testing.T) {
+	for value, expected := range map[string]string{
+		"plain":      "plain",
+		"":           `""`,
+		"two words":  `"two words"`,
+		"a=b":        `"a=b"`,
+		`say "hi"`:   `"say \"hi\""`,
+		"line\nfeed": `"line\nfeed"`,
+	} {
+		l, buf := newTestLogger(LevelInfo, FormatLogfmt)
+		l.Info("m", F("v", value))
+		if !strings.HasSuffix(buf.String(), " v="+expected+"\n") {
+			t.Errorf("expected v=%s but got %q", expected, buf.String())
+		}
+	}
+}
+
+func TestJSONRecord(t *testing.T) {
+	l, buf := newTestLogger(LevelInfo, FormatJSON)
+	l.With(F("conn", uint64(7))).Warn("reading failed", F("err", errors.New(`bad "frame"`)), F("ok", false), F("ratio", 0.5))
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%q is not JSON, %v", buf.String(), err)
+	}
+	expected := map[string]interface{}{
+		"time":  "2020-03-01T10:30:00.000Z",
+		"level": "warn",
+		"msg":   "reading failed",
+		"conn":  float64(7),
+		"err":   `bad "frame"`,
+		"ok":    false,
+		"ratio": 0.5,
+	}
+	if len(record) != len(expected) {
+		t.Fatalf("expected %v but got %v", expected, record)
+	}
+	for k, v := range expected {
+		if record[k] != v {
+			t.Errorf("expected %s=%v but got %v", k, v, record[k])
+		}
+	}
+}
+
+func TestLevelFiltering(t *testing.T) {
+	l, buf := newTestLogger(LevelWarn, FormatLogfmt)
+	l.Debug("debug")
+	l.Info("info")
+	l.Event("accept")
+	l.Warn("warn")
+	l.WarnEvent("timeout")
+	l.Error("error")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 records but got %q", lines)
+	}
+	for i, level := range []string{"warn", "warn", "error"} {
+		if !strings.Contains(lines[i], "level="+level) {
+			t.Errorf("expected record %d to be %s but got %q", i, level, lines[i])
+		}
+	}
+
+	l.With(F("conn", 1)).SetLevel(LevelDebug)
+	if !l.Enabled(LevelDebug) {
+		t.Fatal("expected SetLevel to change the level of every derived logger")
+	}
+}
+
+func TestWithDoesNotShareFields(t *testing.T) {
+	l, buf := newTestLogger(LevelInfo, FormatLogfmt)
+	parent := l.With(F("conn", 1))
+	parent.With(F("imei", 1)).Info("a")
+	parent.With(F("imei", 2)).Info("b")
+	parent.Info("c")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	for i, suffix := range []string{"msg=a conn=1 imei=1", "msg=b conn=1 imei=2", "msg=c conn=1"} {
+		if !strings.HasSuffix(lines[i], suffix) {
+			t.Errorf("expected record %d to end with %q but got %q", i, suffix, lines[i])
+		}
+	}
+}
+
+func TestParseLevelAndFormat(t *testing.T) {
+	for _, s := range []string{"debug", "info", "warn", "error"} {
+		level, err := ParseLevel(s)
+		if err != nil || level.String() != s {
+			t.Errorf("expected %s to parse, got %v %v", s, level, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected an error parsing verbose")
+	}
+	for _, s := range []string{"logfmt", "json"} {
+		format, err := ParseFormat(s)
+		if err != nil || format.String() != s {
+			t.Errorf("expected %s to parse, got %v %v", s, format, err)
+		}
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("expected an error parsing xml")
+	}
+}
@@ -0,0 +1,610 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// alertCondition is what an alert rule watches, the zero value is none so a
+// rule must set it.
+type alertCondition int
+
+const (
+	// alertTemperatureAbove fires when the temperature stays above the
+	// threshold for the rule duration.
+	alertTemperatureAbove alertCondition = iota + 1
+	// alertTemperatureBelow fires when the temperature stays below the
+	// threshold for the rule duration.
+	alertTemperatureBelow
+	// alertBatteryBelow fires when the battery level stays below the threshold
+	// for the rule duration.
+	alertBatteryBelow
+	// alertOffline fires when a device sends no reading for the rule duration.
+	alertOffline
+	// alertOutsideGeofence fires when the position of a device stays outside
+	// the rule geofence for the rule duration.
+	alertOutsideGeofence
+)
+
+func parseAlertCondition(s string) (alertCondition, error) {
+	switch s {
+	case "temperature-above":
+		return alertTemperatureAbove, nil
+	case "temperature-below":
+		return alertTemperatureBelow, nil
+	case "battery-below":
+		return alertBatteryBelow, nil
+	case "offline":
+		return alertOffline, nil
+	case "outside-geofence":
+		return alertOutsideGeofence, nil
+	}
+	return 0, fmt.Errorf("unknown alert condition %q, it could be temperature-above, temperature-below, battery-below, offline or outside-geofence", s)
+}
+
+func (c alertCondition) String() string {
+	switch c {
+	case alertTemperatureAbove:
+		return "temperature-above"
+	case alertTemperatureBelow:
+		return "temperature-below"
+	case alertBatteryBelow:
+		return "battery-below"
+	case alertOffline:
+		return "offline"
+	case alertOutsideGeofence:
+		return "outside-geofence"
+	}
+	return fmt.Sprintf("alertCondition(%d)", int(c))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (c alertCondition) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (c *alertCondition) UnmarshalText(text []byte) error {
+	condition, err := parseAlertCondition(string(text))
+	if err != nil {
+		return err
+	}
+	*c = condition
+	return nil
+}
+
+// jsonDuration is a time.Duration written as a Go duration string, e.g. "5m".
+type jsonDuration time.Duration
+
+// MarshalText implements encoding.TextMarshaler.
+func (d jsonDuration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *jsonDuration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(v)
+	return nil
+}
+
+// alertRule is a condition watched on the readings of every device, or of the
+// devices in IMEIs when it is not empty.
+type alertRule struct {
+	Name      string         `json:"name"`
+	Condition alertCondition `json:"condition"`
+	// Threshold of the temperature and battery conditions
+	Threshold float64 `json:"threshold"`
+	// For is how long the condition must hold before the alert fires, for
+	// the offline condition it is how long the device must be silent
+	For      jsonDuration `json:"for"`
+	IMEIs    []uint64     `json:"imeis,omitempty"`
+	Geofence *geoShape    `json:"geofence,omitempty"`
+}
+
+func (r *alertRule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("alert rule without name")
+	}
+	if r.Condition == 0 {
+		return fmt.Errorf("alert rule %s, without condition", r.Name)
+	}
+	if r.For < 0 {
+		return fmt.Errorf("alert rule %s, negative duration", r.Name)
+	}
+	if r.Condition == alertOffline && r.For == 0 {
+		return fmt.Errorf("alert rule %s, offline needs a duration", r.Name)
+	}
+	if r.Condition == alertOutsideGeofence {
+		if r.Geofence == nil {
+			return fmt.Errorf("alert rule %s, outside-geofence needs a geofence", r.Name)
+		}
+		if err := r.Geofence.validate(); err != nil {
+			return fmt.Errorf("alert rule %s, %v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+// appliesTo reports whether the rule watches imei.
+func (r *alertRule) appliesTo(imei uint64) bool {
+	if len(r.IMEIs) == 0 {
+		return true
+	}
+	for _, i := range r.IMEIs {
+		if i == imei {
+			return true
+		}
+	}
+	return false
+}
+
+// check reports whether reading meets the condition of the rule, and the
+// value which was checked. It must not be called for offline rules.
+func (r *alertRule) check(reading *device.Reading) (bool, float64) {
+	switch r.Condition {
+	case alertTemperatureAbove:
+		return reading.Temperature > r.Threshold, reading.Temperature
+	case alertTemperatureBelow:
+		return reading.Temperature < r.Threshold, reading.Temperature
+	case alertBatteryBelow:
+		return reading.BatteryLevel < r.Threshold, reading.BatteryLevel
+	case alertOutsideGeofence:
+		return !r.Geofence.contains(geoPoint{Lat: reading.Latitude, Lon: reading.Longitude}), 0
+	}
+	return false, 0
+}
+
+// webhookConfig is an HTTP endpoint every alert notification is POSTed to.
+type webhookConfig struct {
+	URL string `json:"url"`
+	// Retries is how many times a failed delivery is retried, waiting
+	// Backoff, then twice as much, and so on.
+	Retries int          `json:"retries"`
+	Backoff jsonDuration `json:"backoff"`
+	Timeout jsonDuration `json:"timeout"`
+}
+
+const (
+	defaultWebhookBackoff = time.Second
+	defaultWebhookTimeout = 5 * time.Second
+	// webhookQueueSize bounds the notifications waiting for each webhook,
+	// newer ones are dropped when it is full
+	webhookQueueSize = 256
+	// alertsCheckInterval is how often the offline rules are checked
+	alertsCheckInterval = time.Second
+)
+
+// alertsConfig is the content of an alerts file:
+//
+//	{
+//	  "webhooks": [{"url": "http://localhost:9000/alerts", "retries": 3, "backoff": "1s", "timeout": "5s"}],
+//	  "rules": [
+//	    {"name": "greenhouse-freezing", "condition": "temperature-below", "threshold": 2, "for": "30s"},
+//	    {"name": "battery-low", "condition": "battery-below", "threshold": 10},
+//	    {"name": "silent", "condition": "offline", "for": "5m"},
+//	    {"name": "moved", "condition": "outside-geofence", "imeis": [490154203237518],
+//	     "geofence": {"circle": {"center": {"lat": 21.03, "lon": -89.59}, "radius": 500}}}
+//	  ]
+//	}
+type alertsConfig struct {
+	Webhooks []webhookConfig `json:"webhooks"`
+	Rules    []alertRule     `json:"rules"`
+}
+
+// loadAlerts reads and validates an alerts file.
+func loadAlerts(path string) (*alertsConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg alertsConfig
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parsing alerts %s, %v", path, err)
+	}
+	names := make(map[string]bool, len(cfg.Rules))
+	for i := range cfg.Rules {
+		rule := &cfg.Rules[i]
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("alerts %s, %v", path, err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("alerts %s, duplicated rule %s", path, rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	for i := range cfg.Webhooks {
+		hook := &cfg.Webhooks[i]
+		if hook.URL == "" {
+			return nil, fmt.Errorf("alerts %s, webhook without url", path)
+		}
+		if hook.Retries < 0 {
+			return nil, fmt.Errorf("alerts %s, webhook %s, negative retries", path, hook.URL)
+		}
+		if hook.Backoff <= 0 {
+			hook.Backoff = jsonDuration(defaultWebhookBackoff)
+		}
+		if hook.Timeout <= 0 {
+			hook.Timeout = jsonDuration(defaultWebhookTimeout)
+		}
+	}
+	return &cfg, nil
+}
+
+// alert is a notification of a rule firing or resolving for a device. The ID
+// is the same in both, so receivers can deduplicate retried deliveries.
+type alert struct {
+	ID        string         `json:"id"`
+	Rule      string         `json:"rule"`
+	Condition alertCondition `json:"condition"`
+	IMEI      uint64         `json:"imei"`
+	// Status is firing or resolved
+	Status    string     `json:"status"`
+	Value     float64    `json:"value"`
+	Threshold float64    `json:"threshold"`
+	StartsAt  time.Time  `json:"startsAt"`
+	EndsAt    *time.Time `json:"endsAt,omitempty"`
+}
+
+type alertKey struct {
+	rule int
+	imei uint64
+}
+
+// alertState tracks a rule for a device while its condition holds.
+type alertState struct {
+	// since is when the condition started to hold, in nanoseconds
+	since  int64
+	value  float64
+	firing *alert
+}
+
+// alertsStats are counters of the alerter, updated atomically.
+type alertsStats struct {
+	fired                uint64
+	resolved             uint64
+	notificationsSent    uint64
+	notificationsFailed  uint64
+	notificationsDropped uint64
+}
+
+// alertCounts are the alerts fired and resolved, as reported by /stats.
+type alertCounts struct {
+	Fired    uint64 `json:"fired"`
+	Resolved uint64 `json:"resolved"`
+}
+
+func (s *alertsStats) counts() *alertCounts {
+	return &alertCounts{Fired: atomic.LoadUint64(&s.fired), Resolved: atomic.LoadUint64(&s.resolved)}
+}
+
+// alerter evaluates the alert rules on every valid reading and notifies the
+// webhooks when an alert fires or resolves. An alert is notified once when it
+// fires and once when it resolves, however many readings meet its condition.
+//
+// It is a Sink, so readings reach it through a queue and a slow webhook never
+// stalls the core.
+type alerter struct {
+	rules    []alertRule
+	webhooks []*webhook
+	now      func() time.Time
+	// closeTimeout bounds how long Close waits for pending deliveries
+	closeTimeout time.Duration
+
+	mux      sync.Mutex
+	states   map[alertKey]*alertState
+	lastSeen map[uint64]int64
+	stats    alertsStats
+
+	done     chan struct{}
+	checking sync.WaitGroup
+}
+
+func newAlerter(cfg *alertsConfig, now func() time.Time, checkInterval, closeTimeout time.Duration) *alerter {
+	a := &alerter{
+		rules:        cfg.Rules,
+		now:          now,
+		closeTimeout: closeTimeout,
+		states:       make(map[alertKey]*alertState),
+		lastSeen:     make(map[uint64]int64),
+		done:         make(chan struct{}),
+	}
+	for _, hook := range cfg.Webhooks {
+		a.webhooks = append(a.webhooks, newWebhook(hook, &a.stats))
+	}
+	a.checking.Add(1)
+	go a.checkPeriodically(checkInterval)
+	return a
+}
+
+// Write evaluates the rules of rec.IMEI on its reading.
+func (a *alerter) Write(rec Record) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.lastSeen[rec.IMEI] = rec.Epoch
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if !rule.appliesTo(rec.IMEI) {
+			continue
+		}
+		if rule.Condition == alertOffline {
+			a.update(alertKey{i, rec.IMEI}, false, 0, 0, rec.Epoch)
+			continue
+		}
+		holds, value := rule.check(&rec.Reading)
+		a.update(alertKey{i, rec.IMEI}, holds, value, time.Duration(rule.For), rec.Epoch)
+	}
+	return nil
+}
+
+// Flush is a no-op, notifications are sent as soon as alerts change.
+func (a *alerter) Flush() error {
+	return nil
+}
+
+// Close stops checking the offline rules and waits for the pending
+// notifications, at most closeTimeout.
+func (a *alerter) Close() error {
+	close(a.done)
+	a.checking.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), a.closeTimeout)
+	defer cancel()
+	for _, hook := range a.webhooks {
+		hook.close(ctx)
+	}
+	return nil
+}
+
+func (a *alerter) checkPeriodically(interval time.Duration) {
+	defer a.checking.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.checkOffline()
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// checkOffline fires the offline rules of the devices silent for too long.
+func (a *alerter) checkOffline() {
+	now := a.now().UnixNano()
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if rule.Condition != alertOffline {
+			continue
+		}
+		for imei, seen := range a.lastSeen {
+			if !rule.appliesTo(imei) {
+				continue
+			}
+			silent := now - seen
+			if silent >= int64(rule.For) {
+				a.update(alertKey{i, imei}, true, time.Duration(silent).Seconds(), 0, now)
+			}
+		}
+	}
+}
+
+// update moves the alert of key forward, it fires once the condition held for
+// hold, and resolves as soon as it no longer holds. It must be called with the
+// lock held.
+func (a *alerter) update(key alertKey, holds bool, value float64, hold time.Duration, epoch int64) {
+	state := a.states[key]
+	if !holds {
+		if state == nil {
+			return
+		}
+		delete(a.states, key)
+		if state.firing != nil {
+			resolved := *state.firing
+			resolved.Status = "resolved"
+			resolved.Value = value
+			endsAt := time.Unix(0, epoch).UTC()
+			resolved.EndsAt = &endsAt
+			atomic.AddUint64(&a.stats.resolved, 1)
+			a.notify(resolved)
+		}
+		return
+	}
+	if state == nil {
+		state = &alertState{since: epoch}
+		a.states[key] = state
+	}
+	state.value = value
+	if state.firing != nil || epoch-state.since < int64(hold) {
+		return
+	}
+	rule := &a.rules[key.rule]
+	startsAt := time.Unix(0, state.since).UTC()
+	state.firing = &alert{
+		ID:        rule.Name + "-" + strconv.FormatUint(key.imei, 10) + "-" + strconv.FormatInt(state.since, 10),
+		Rule:      rule.Name,
+		Condition: rule.Condition,
+		IMEI:      key.imei,
+		Status:    "firing",
+		Value:     value,
+		Threshold: rule.Threshold,
+		StartsAt:  startsAt,
+	}
+	atomic.AddUint64(&a.stats.fired, 1)
+	a.notify(*state.firing)
+}
+
+func (a *alerter) notify(al alert) {
+	logging.Default().WarnEvent("alert-"+al.Status, logging.F("rule", al.Rule), logging.F("imei", al.IMEI),
+		logging.F("value", al.Value))
+	for _, hook := range a.webhooks {
+		hook.enqueue(al)
+	}
+}
+
+// firing returns the alerts firing, oldest first.
+func (a *alerter) firing() []alert {
+	a.mux.Lock()
+	list := make([]alert, 0, len(a.states))
+	for _, state := range a.states {
+		if state.firing != nil {
+			al := *state.firing
+			al.Value = state.value
+			list = append(list, al)
+		}
+	}
+	a.mux.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].StartsAt.Equal(list[j].StartsAt) {
+			return list[i].StartsAt.Before(list[j].StartsAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// webhook delivers the alerts to an HTTP endpoint from its own goroutine.
+type webhook struct {
+	cfg    webhookConfig
+	client *http.Client
+	stats  *alertsStats
+	queue  chan alert
+	done   chan struct{}
+	// ctx is canceled to abort the deliveries still retrying on close
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newWebhook(cfg webhookConfig, stats *alertsStats) *webhook {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhook{
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		stats:  stats,
+		queue:  make(chan alert, webhookQueueSize),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go w.run()
+	return w
+}
+
+// enqueue queues al for delivery, it does NOT block.
+func (w *webhook) enqueue(al alert) {
+	select {
+	case w.queue <- al:
+	default:
+		atomic.AddUint64(&w.stats.notificationsDropped, 1)
+		logging.Warn("webhook queue is full, dropping alert", logging.F("url", w.cfg.URL), logging.F("alert", al.ID))
+	}
+}
+
+// close delivers the queued alerts until ctx is done, then aborts them.
+func (w *webhook) close(ctx context.Context) {
+	close(w.queue)
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		w.cancel()
+		<-w.done
+	}
+	w.cancel()
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+	for al := range w.queue {
+		w.deliver(al)
+	}
+}
+
+// deliver POSTs al, retrying with exponential backoff when the endpoint can
+// not be reached or answers with a 5xx status.
+func (w *webhook) deliver(al alert) {
+	body, err := json.Marshal(al)
+	if err != nil {
+		atomic.AddUint64(&w.stats.notificationsFailed, 1)
+		return
+	}
+	backoff := time.Duration(w.cfg.Backoff)
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil {
+			atomic.AddUint64(&w.stats.notificationsSent, 1)
+			return
+		}
+		if !retry || attempt >= w.cfg.Retries {
+			atomic.AddUint64(&w.stats.notificationsFailed, 1)
+			logging.Error("delivering alert", logging.F("url", w.cfg.URL), logging.F("alert", al.ID),
+				logging.F("attempts", attempt+1), logging.F("err", err))
+			return
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-w.ctx.Done():
+			atomic.AddUint64(&w.stats.notificationsFailed, 1)
+			logging.Error("delivering alert", logging.F("url", w.cfg.URL), logging.F("alert", al.ID),
+				logging.F("attempts", attempt+1), logging.F("err", w.ctx.Err()))
+			return
+		}
+	}
+}
+
+// post sends body once, retry tells whether a failure may be retried.
+func (w *webhook) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(w.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook answered %s", resp.Status)
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return false, nil
+}
+
+// alertsHandler serves GET /alerts, the alerts firing.
+func (d *httpd) alertsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if d.core.alerts == nil {
+		http.Error(w, "no alerts configured", http.StatusNotFound)
+		return
+	}
+	d.writeJSONResponse(w, d.core.alerts.firing())
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+// alertReceiver is a webhook endpoint which answers the first failures
+// requests with a 500 status, and sends every alert received to alerts.
+type alertReceiver struct {
+	*httptest.Server
+	alerts   chan alert
+	requests int32
+	failures int32
+}
+
+func newAlertReceiver(t *testing.T, failures int32) *alertReceiver {
+	r := &alertReceiver{alerts: make(chan alert, 16), failures: failures}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&r.requests, 1) <= r.failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var al alert
+		if err := json.NewDecoder(req.Body).Decode(&al); err != nil {
+			t.Errorf("decoding alert, %v", err)
+		}
+		r.alerts <- al
+	}))
+	return r
+}
+
+func (r *alertReceiver) next(t *testing.T) alert {
+	t.Helper()
+	select {
+	case al := <-r.alerts:
+		return al
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for an alert")
+	}
+	return alert{}
+}
+
+func (r *alertReceiver) expectNone(t *testing.T) {
+	t.Helper()
+	select {
+	case al := <-r.alerts:
+		t.Fatalf("unexpected alert %+v", al)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func readingRecord(imei uint64, epoch time.Duration, temperature, battery float64) Record {
+	return Record{
+		IMEI:    imei,
+		Epoch:   common.FrozenInTime().Add(epoch).UnixNano(),
+		Reading: device.Reading{Temperature: temperature, BatteryLevel: battery, Latitude: 21.03, Longitude: -89.59},
+	}
+}
+
+func TestLoadAlerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "alerts.json")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{
+		"webhooks": [{"url": "http://localhost:9000/alerts", "retries": 2}],
+		"rules": [
+			{"name": "hot", "condition": "temperature-above", "threshold": 40, "for": "30s"},
+			{"name": "silent", "condition": "offline", "for": "5m", "imeis": [490154203237518]},
+			{"name": "moved", "condition": "outside-geofence",
+			 "geofence": {"circle": {"center": {"lat": 21.03, "lon": -89.59}, "radius": 500}}}
+		]
+	}`)
+	cfg, err := loadAlerts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Rules) != 3 || cfg.Rules[0].Condition != alertTemperatureAbove || time.Duration(cfg.Rules[1].For) != 5*time.Minute {
+		t.Errorf("unexpected rules %+v", cfg.Rules)
+	}
+	if hook := cfg.Webhooks[0]; time.Duration(hook.Backoff) != defaultWebhookBackoff || time.Duration(hook.Timeout) != defaultWebhookTimeout {
+		t.Errorf("expected the default backoff and timeout, got %+v", hook)
+	}
+
+	for _, content := range []string{
+		`{"rules": [{"name": "x", "condition": "humid"}]}`,
+		`{"rules": [{"condition": "temperature-above"}]}`,
+		`{"rules": [{"name": "x", "condition": "offline"}]}`,
+		`{"rules": [{"name": "x", "condition": "outside-geofence"}]}`,
+		`{"rules": [{"name": "x", "condition": "temperature-above"}, {"name": "x", "condition": "battery-below"}]}`,
+		`{"webhooks": [{"retries": 1}]}`,
+		`{"webhooks": [{"url": "http://localhost:9000/alerts", "retries": -1}]}`,
+		`{"rules": [{"name": "x", "threshold": 40}]}`,
+		`{"rules": [{"name": "x", "conditon": "temperature-above", "threshold": 40}]}`,
+	} {
+		write(content)
+		if _, err := loadAlerts(path); err == nil {
+			t.Errorf("expected an error loading %s", content)
+		}
+	}
+}
+
+func TestAlerter_FiresOnceAndResolves(t *testing.T) {
+	receiver := newAlertReceiver(t, 0)
+	defer receiver.Close()
+	a := newAlerter(&alertsConfig{
+		Webhooks: []webhookConfig{{URL: receiver.URL, Backoff: jsonDuration(time.Millisecond), Timeout: jsonDuration(time.Second)}},
+		Rules: []alertRule{
+			{Name: "hot", Condition: alertTemperatureAbove, Threshold: 40, For: jsonDuration(10 * time.Second)},
+			{Name: "battery", Condition: alertBatteryBelow, Threshold: 10},
+		},
+	}, common.FrozenInTime, time.Hour, time.Second)
+	defer a.Close()
+	imei := uint64(490154203237518)
+
+	a.Write(readingRecord(imei, 0, 41, 50))
+	a.Write(readingRecord(imei, 5*time.Second, 42, 50))
+	receiver.expectNone(t)
+
+	a.Write(readingRecord(imei, 10*time.Second, 43, 50))
+	fired := receiver.next(t)
+	if fired.Rule != "hot" || fired.Status != "firing" || fired.Value != 43 || fired.IMEI != imei ||
+		!fired.StartsAt.Equal(common.FrozenInTime()) {
+		t.Errorf("unexpected alert %+v", fired)
+	}
+	a.Write(readingRecord(imei, 11*time.Second, 44, 50))
+	receiver.expectNone(t)
+	if firing := a.firing(); len(firing) != 1 || firing[0].Value != 44 {
+		t.Errorf("expected the alert to be firing with the last value, got %+v", firing)
+	}
+
+	a.Write(readingRecord(imei, 12*time.Second, 20, 50))
+	resolved := receiver.next(t)
+	if resolved.ID != fired.ID || resolved.Status != "resolved" || resolved.EndsAt == nil {
+		t.Errorf("expected alert %s to be resolved, got %+v", fired.ID, resolved)
+	}
+
+	// no duration, it fires with the first reading
+	a.Write(readingRecord(imei, 13*time.Second, 20, 5))
+	if al := receiver.next(t); al.Rule != "battery" || al.Status != "firing" {
+		t.Errorf("unexpected alert %+v", al)
+	}
+	if fired, resolved := atomic.LoadUint64(&a.stats.fired), atomic.LoadUint64(&a.stats.resolved); fired != 2 || resolved != 1 {
+		t.Errorf("expected 2 alerts fired and 1 resolved, got %d and %d", fired, resolved)
+	}
+}
+
+func TestAlerter_Offline(t *testing.T) {
+	receiver := newAlertReceiver(t, 0)
+	defer receiver.Close()
+	now := common.FrozenInTime()
+	a := newAlerter(&alertsConfig{
+		Webhooks: []webhookConfig{{URL: receiver.URL, Backoff: jsonDuration(time.Millisecond), Timeout: jsonDuration(time.Second)}},
+		Rules:    []alertRule{{Name: "silent", Condition: alertOffline, For: jsonDuration(5 * time.Minute)}},
+	}, func() time.Time { return now }, time.Hour, time.Second)
+	defer a.Close()
+	imei := uint64(490154203237518)
+
+	a.Write(readingRecord(imei, 0, 20, 50))
+	now = now.Add(4 * time.Minute)
+	a.checkOffline()
+	receiver.expectNone(t)
+
+	now = now.Add(time.Minute)
+	a.checkOffline()
+	a.checkOffline()
+	if al := receiver.next(t); al.Rule != "silent" || al.Status != "firing" || al.Value != 300 {
+		t.Errorf("unexpected alert %+v", al)
+	}
+	receiver.expectNone(t)
+
+	a.Write(readingRecord(imei, 6*time.Minute, 20, 50))
+	if al := receiver.next(t); al.Rule != "silent" || al.Status != "resolved" {
+		t.Errorf("unexpected alert %+v", al)
+	}
+}
+
+func TestAlerter_OutsideGeofence(t *testing.T) {
+	a := newAlerter(&alertsConfig{
+		Rules: []alertRule{{
+			Name:      "moved",
+			Condition: alertOutsideGeofence,
+			IMEIs:     []uint64{490154203237518},
+			Geofence:  &geoShape{Circle: &geoCircle{Center: geoPoint{Lat: 21.03, Lon: -89.59}, Radius: 500}},
+		}},
+	}, common.FrozenInTime, time.Hour, time.Second)
+	defer a.Close()
+
+	home := readingRecord(490154203237518, 0, 20, 50)
+	a.Write(home)
+	stolen := readingRecord(490154203237518, time.Second, 20, 50)
+	stolen.Reading.Latitude = 21.04
+	a.Write(stolen)
+	other := readingRecord(448324242329542, time.Second, 20, 50)
+	other.Reading.Latitude = 21.04
+	a.Write(other)
+
+	firing := a.firing()
+	if len(firing) != 1 || firing[0].IMEI != 490154203237518 || firing[0].Condition != alertOutsideGeofence {
+		t.Errorf("expected the moved device to be outside its geofence, got %+v", firing)
+	}
+}
+
+func TestWebhook_Retries(t *testing.T) {
+	receiver := newAlertReceiver(t, 2)
+	defer receiver.Close()
+	a := newAlerter(&alertsConfig{
+		Webhooks: []webhookConfig{{URL: receiver.URL, Retries: 2, Backoff: jsonDuration(time.Millisecond), Timeout: jsonDuration(time.Second)}},
+		Rules:    []alertRule{{Name: "battery", Condition: alertBatteryBelow, Threshold: 10}},
+	}, common.FrozenInTime, time.Hour, time.Second)
+
+	a.Write(readingRecord(490154203237518, 0, 20, 5))
+	if al := receiver.next(t); al.Rule != "battery" {
+		t.Errorf("unexpected alert %+v", al)
+	}
+	a.Close()
+	if requests := atomic.LoadInt32(&receiver.requests); requests != 3 {
+		t.Errorf("expected 3 requests got %d", requests)
+	}
+	if sent, failed := atomic.LoadUint64(&a.stats.notificationsSent), atomic.LoadUint64(&a.stats.notificationsFailed); sent != 1 || failed != 0 {
+		t.Errorf("expected 1 notification sent and none failed, got %d and %d", sent, failed)
+	}
+
+	// every attempt fails
+	receiver.failures = 100
+	a = newAlerter(&alertsConfig{
+		Webhooks: []webhookConfig{{URL: receiver.URL, Retries: 1, Backoff: jsonDuration(time.Millisecond), Timeout: jsonDuration(time.Second)}},
+		Rules:    []alertRule{{Name: "battery", Condition: alertBatteryBelow, Threshold: 10}},
+	}, common.FrozenInTime, time.Hour, time.Second)
+	a.Write(readingRecord(490154203237518, 0, 20, 5))
+	a.Close()
+	if failed := atomic.LoadUint64(&a.stats.notificationsFailed); failed != 1 {
+		t.Errorf("expected 1 notification failed got %d", failed)
+	}
+}
+
+func TestHttpd_Alerts(t *testing.T) {
+	core := newCore(common.FrozenInTime, uint(1337), 2)
+	d := newHttpd(core, 8080)
+	resp := httptest.NewRecorder()
+	d.handler().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/alerts", nil))
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without alerts got %d", resp.Code)
+	}
+
+	core.alerts = newAlerter(&alertsConfig{
+		Rules: []alertRule{{Name: "battery", Condition: alertBatteryBelow, Threshold: 10}},
+	}, common.FrozenInTime, time.Hour, time.Second)
+	defer core.alerts.Close()
+	core.alerts.Write(readingRecord(490154203237518, 0, 20, 5))
+	resp = httptest.NewRecorder()
+	d.handler().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/alerts", nil))
+	var firing []alert
+	if err := json.Unmarshal(resp.Body.Bytes(), &firing); err != nil {
+		t.Fatal(err)
+	}
+	if len(firing) != 1 || firing[0].Rule != "battery" || firing[0].Value != 5 {
+		t.Errorf("unexpected alerts %+v", firing)
+	}
+
+	resp = httptest.NewRecorder()
+	d.handler().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats struct{ Alerts *alertCounts }
+	if err := json.Unmarshal(resp.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Alerts == nil || *stats.Alerts != (alertCounts{Fired: 1}) {
+		t.Errorf("unexpected alert counts %+v", stats.Alerts)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+// authenticator implements device.Authenticator with the secrets of a
+// credentials file.
+type authenticator struct {
+	secrets map[uint64][]byte
+	stats   *coreStats
+}
+
+// LoadCredentials reads a credentials file, as used by the server and by the
+// load generator, every line holds the IMEI of a device and its secret
+// separated by spaces. Empty lines and lines starting
+// with # are skipped:
+//
+//	# imei           secret
+//	490154203237518  8f3c0a6d9b
+func LoadCredentials(path string) (map[uint64][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	secrets := make(map[uint64][]byte)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d expected an IMEI and its secret", path, line)
+		}
+		imei, err := parseIMEI(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d %v", path, line, err)
+		}
+		if _, exists := secrets[imei]; exists {
+			return nil, fmt.Errorf("%s:%d duplicated IMEI %d", path, line, imei)
+		}
+		secrets[imei] = []byte(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+func (a *authenticator) Secret(imei uint64) ([]byte, bool) {
+	secret, ok := a.secrets[imei]
+	return secret, ok
+}
+
+// authStats are the results of the login authentications.
+type authStats struct {
+	Authenticated  uint64 `json:"authenticated"`
+	UnknownDevices uint64 `json:"unknownDevices"`
+	BadResponses   uint64 `json:"badResponses"`
+	NoResponses    uint64 `json:"noResponses"`
+}
+
+// authSnapshot returns the results of the authentications, nil when logins
+// are not authenticated.
+func (c *core) authSnapshot() *authStats {
+	if c.auth == nil {
+		return nil
+	}
+	return &authStats{
+		Authenticated:  atomic.LoadUint64(&c.stats.authenticated),
+		UnknownDevices: atomic.LoadUint64(&c.stats.authUnknownDevices),
+		BadResponses:   atomic.LoadUint64(&c.stats.authBadResponses),
+		NoResponses:    atomic.LoadUint64(&c.stats.authNoResponses),
+	}
+}
+
+// Authenticated counts every authentication by result, the client logs the
+// failed ones with their own lifecycle event.
+func (a *authenticator) Authenticated(imei uint64, result device.AuthResult) {
+	var counter *uint64
+	switch result {
+	case device.AuthOK:
+		atomic.AddUint64(&a.stats.authenticated, 1)
+		return
+	case device.AuthUnknownDevice:
+		counter = &a.stats.authUnknownDevices
+	case device.AuthBadResponse:
+		counter = &a.stats.authBadResponses
+	default:
+		counter = &a.stats.authNoResponses
+	}
+	atomic.AddUint64(counter, 1)
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+func writeCredentials(t *testing.T, dir string, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secrets, err := LoadCredentials(writeCredentials(t, dir, "# imei secret\n\n490154203237518 s3cr3t\n  448324242329542\tother  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 2 || string(secrets[490154203237518]) != "s3cr3t" || string(secrets[448324242329542]) != "other" {
+		t.Errorf("unexpected secrets %q", secrets)
+	}
+
+	invalid := map[string]string{
+		"missing secret": "490154203237518\n",
+		"extra field":    "490154203237518 s3cr3t extra\n",
+		"short imei":     "4901542032375 s3cr3t\n",
+		"not a number":   "49015420323751x s3cr3t\n",
+		"duplicated":     "490154203237518 s3cr3t\n490154203237518 other\n",
+	}
+	for name, content := range invalid {
+		if _, err := LoadCredentials(writeCredentials(t, dir, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := LoadCredentials(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error loading a missing file")
+	}
+}
+
+func TestServer_Run_AuthenticatedLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, cancel, done := startTestServer(t, Config{
+		MaxClients:      10,
+		CredentialsFile: writeCredentials(t, dir, "490154203237518 s3cr3t\n"),
+		ShutdownTimeout: time.Second,
+	})
+	defer func() {
+		cancel()
+		<-done
+	}()
+	stats := &s.core.stats
+
+	// the v2 marker follows the challenge response
+	device.Randomatic(device.SimulatorConfig{
+		ServerAddress: s.ln.Addr().String(),
+		IMEI:          "490154203237518",
+		NumReadings:   3,
+		ReadingRate:   time.Millisecond,
+		Protocol:      device.ProtocolV2,
+		Secret:        "s3cr3t",
+	})
+	waitFor(t, "the readings", func() bool { return atomic.LoadUint64(&stats.readings) == 3 })
+	if invalid := atomic.LoadUint64(&stats.invalidReadings); invalid != 0 {
+		t.Errorf("expected every reading to be valid, %d invalid", invalid)
+	}
+
+	// answers the challenge of a device logging in with imei using secret
+	login := func(imei []byte, secret string) net.Conn {
+		conn := dialTestDevice(t, s, imei)
+		var challenge [device.ChallengeSize]byte
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(conn, challenge[:]); err != nil {
+			t.Fatal(err)
+		}
+		if secret != "" {
+			conn.Write(device.AuthResponse([]byte(secret), decodeTestIMEI(imei), challenge[:]))
+		}
+		return conn
+	}
+	bad := login([]byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}, "guessed")
+	defer bad.Close()
+	unknown := login([]byte{4, 4, 8, 3, 2, 4, 2, 4, 2, 3, 2, 9, 5, 4, 2}, "s3cr3t")
+	defer unknown.Close()
+	// hangs up instead of answering, so the test does not wait for the login deadline
+	login([]byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}, "").Close()
+
+	waitFor(t, "the failed authentications", func() bool {
+		return atomic.LoadUint64(&stats.authBadResponses) == 1 &&
+			atomic.LoadUint64(&stats.authUnknownDevices) == 1 &&
+			atomic.LoadUint64(&stats.authNoResponses) == 1
+	})
+	if authenticated := atomic.LoadUint64(&stats.authenticated); authenticated != 1 {
+		t.Errorf("expected 1 authenticated login got %d", authenticated)
+	}
+	if logins := atomic.LoadUint64(&stats.logins); logins != 1 {
+		t.Errorf("expected 1 login got %d", logins)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/stats", s.httpLn.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct{ Auth authStats }
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.Auth != (authStats{Authenticated: 1, UnknownDevices: 1, BadResponses: 1, NoResponses: 1}) {
+		t.Errorf("unexpected auth stats %+v", body.Auth)
+	}
+	resp, err = http.Get(fmt.Sprintf("http://%s/metrics", s.httpLn.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(metrics), `thermomatic_authentications_total{result="bad_response"} 1`+"\n") {
+		t.Errorf("expected the authentications in the metrics:\n%s", metrics)
+	}
+
+	// the load generator answers with the secret of each device
+	report, err := device.RunLoad(context.Background(), device.LoadConfig{
+		ServerAddress: s.ln.Addr().String(),
+		Devices:       1,
+		Duration:      100 * time.Millisecond,
+		ReadingRate:   10 * time.Millisecond,
+		FirstSerial:   49015420323751,
+		Protocol:      device.ProtocolV2,
+		Secrets:       map[uint64][]byte{490154203237518: []byte("s3cr3t")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Logins != 1 || report.Disconnects != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	waitFor(t, "the authenticated load generator", func() bool { return atomic.LoadUint64(&stats.authenticated) == 2 })
+}
+
+// decodeTestIMEI returns the number of an IMEI sent as digits.
+func decodeTestIMEI(digits []byte) uint64 {
+	var imei uint64
+	for _, d := range digits {
+		imei = imei*10 + uint64(d)
+	}
+	return imei
+}
@@ -1,82 +1,172 @@
 package server
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spin-org/thermomatic/internal/common"
 	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
 )
 
-// core mantains a map of clients and communication channels
+// core mantains a registry of clients and communication channels
 type core struct {
-	devices          map[uint64]*connectedDevice
+	registry *registry
+	// commands receives the LOGIN commands, once logged in devices send their
+	// commands straight to the channel of their registry shard
 	commands         chan common.Command
 	port             uint
 	serverMaxClients uint
 	now              func() time.Time
-	mux              sync.Mutex
+	sinks            []Sink
+	loginPolicy      LoginPolicy
+	// auth authenticates the logins when it is not nil
+	auth *authenticator
+	// limiter decides which connections are accepted
+	limiter *connLimiter
+	// inventory decides which devices may log in, any device may when it is nil
+	inventory *inventory
+	// bans are the devices disconnected by an administrator which may not log
+	// in again for a while
+	bans deviceBans
+	// rules validate the readings of each device
+	rules *ruleSet
+	// alerts evaluates the alert rules on the valid readings, it is nil when
+	// no alert is configured
+	alerts *alerter
+	// streams fans the valid readings out to the live stream subscribers
+	streams *streamHub
+	// sessions keeps the finished sessions of every device
+	sessions *sessionHistory
+	// geofences tracks the devices in and out of their geofences, it is nil
+	// when no geofence is configured
+	geofences *geofencer
+	// logger is the parent of the connection loggers
+	logger *logging.Logger
+	// lastConnID is the id of the last connection accepted, updated atomically
+	lastConnID uint64
+	// lastSessionID is the id of the last session logged in, updated atomically
+	lastSessionID uint64
+	// lastDownlinkID is the id of the last downlink command, updated atomically
+	lastDownlinkID uint32
+	// clients tracks the device.Client goroutines
+	clients sync.WaitGroup
+	// workers tracks the shard workers and the LOGIN router
+	workers sync.WaitGroup
+	quit    chan struct{}
+	closing int32
+	stats   coreStats
+	metrics coreMetrics
 }
 
-type connectedDevice struct {
-	callbackChannel  chan common.Command
-	lastReadingEpoch int64
-	lastReading      *device.Reading
+// coreStats are counters of the commands processed by the core, they are
+// updated atomically.
+type coreStats struct {
+	accepted           uint64
+	rejectedMaxClients uint64
+	// handshakeTimeouts counts the connections which did not log in, TLS
+	// handshake and authentication included, before the login deadline
+	handshakeTimeouts uint64
+	bytesRead         uint64
+	logins            uint64
+	logouts           uint64
+	readings          uint64
+	invalidReadings   uint64
+	// rejectedReadings counts the invalid readings by device.RejectReason
+	rejectedReadings [device.NumRejectReasons]uint64
+	downlinks        uint64
+	acks             uint64
+	// sequenceGaps counts v2 readings whose sequence number does not follow
+	// the previous one of the device, they were lost or reordered
+	sequenceGaps uint64
+	// authenticated counts the logins which passed the challenge, the others
+	// count the failures by reason
+	authenticated      uint64
+	authUnknownDevices uint64
+	authBadResponses   uint64
+	authNoResponses    uint64
+	// deniedLogins counts the logins of devices denied by the inventory
+	deniedLogins uint64
+	// bannedLogins counts the logins of devices banned for a while after an
+	// administrative disconnect
+	bannedLogins uint64
+	// adminDisconnects counts the devices disconnected by an administrator
+	adminDisconnects uint64
+	// quarantinedReadings counts the readings of quarantined devices, which
+	// are not written to the sinks
+	quarantinedReadings uint64
 }
 
 // NewCore allocates a Core struct
 func newCore(now func() time.Time, port uint, serverMaxClients uint) *core {
 	return &core{
-		devices:          make(map[uint64]*connectedDevice),
+		registry:         newRegistry(defaultRegistryShards),
 		commands:         make(chan common.Command),
+		quit:             make(chan struct{}),
 		now:              now,
 		port:             port,
 		serverMaxClients: serverMaxClients,
+		limiter:          newConnLimiter(ConnLimits{}, now),
+		rules:            newRuleSet(),
+		sessions:         newSessionHistory(defaultSessionHistorySize),
+		metrics:          newCoreMetrics(),
+		logger:           logging.Default(),
 	}
 }
 
-func (c *core) numConnectedDevices() int {
-	c.mux.Lock()
-	numActiveClients := len(c.devices)
-	c.mux.Unlock()
-	return numActiveClients
+// requireAuthentication makes every device authenticate with its secret in
+// secrets before logging in.
+func (c *core) requireAuthentication(secrets map[uint64][]byte) {
+	c.auth = &authenticator{secrets: secrets, stats: &c.stats}
 }
 
-func (c *core) listenConnections(wg *sync.WaitGroup) {
-	address := fmt.Sprintf(":%d", c.port)
-	ln, err := net.Listen("tcp", address)
-	if err != nil {
-		log.Fatalf("ERR Failed to start tcp listener at %s,  %v", address, err)
-	}
-	defer func() {
-		ln.Close()
-		wg.Done()
-	}()
+func (c *core) numConnectedDevices() int {
+	return c.registry.len()
+}
 
-	log.Printf("Server started listening for connections at %s ", address)
+// listenConnections accepts device connections from ln until ln is closed,
+// each of them is handled by its own device.Client goroutine.
+func (c *core) listenConnections(ln net.Listener) {
+	c.logger.Info("listening for device connections", logging.F("addr", ln.Addr().String()))
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				c.logger.Info("stopped listening for device connections", logging.F("addr", ln.Addr().String()))
+				return
+			}
+			c.logger.Error("accepting a connection", logging.F("err", err))
 			continue
 		}
-		log.Print("DEBUG: new client connection")
+		connLog := c.logger.With(
+			logging.F("conn", atomic.AddUint64(&c.lastConnID, 1)),
+			logging.F("remote", conn.RemoteAddr().String()),
+		)
 		numActiveClients := c.numConnectedDevices()
 		if uint(numActiveClients) >= c.serverMaxClients {
 			// Limit the number of active clients to prevent resource exhaustion
-			log.Printf("ERR reached serverMaxClients:%d, there are already %d connected clients", c.serverMaxClients, numActiveClients)
+			connLog.WarnEvent("reject", logging.F("reason", "max clients"), logging.F("clients", numActiveClients))
+			atomic.AddUint64(&c.stats.rejectedMaxClients, 1)
+			conn.Close()
+
+		} else if admitted, err := c.limiter.admit(conn.RemoteAddr()); err != nil {
+			connLog.WarnEvent("reject", logging.F("reason", err))
 			conn.Close()
 
 		} else {
-			log.Printf("client connection from %v", conn.RemoteAddr())
+			atomic.AddUint64(&c.stats.accepted, 1)
+			connLog.Event("accept")
 			//if the device fail to send the login message within 1 second the server will drop the client connection.
 			err := conn.SetReadDeadline(time.Now().Add(time.Second))
 			if err != nil {
-				log.Printf("trying to set read timeout of 1 sec for the login message %v", err)
+				connLog.Error("setting the login deadline", logging.F("err", err))
 				conn.Close()
+				admitted.excuse()
+				admitted.release()
 				continue
 			}
 			client, err := device.NewClient(
@@ -86,140 +176,407 @@ func (c *core) listenConnections(wg *sync.WaitGroup) {
 			)
 			if err != nil {
 				conn.Close()
-				log.Printf("ERR trying to create a client worker for the connection, %v", err)
+				admitted.excuse()
+				admitted.release()
+				connLog.Error("creating the client of the connection", logging.F("err", err))
 				continue
 			}
-			wg.Add(1)
-			go client.Read(wg)
+			client.SetLogger(connLog)
+			if c.auth != nil {
+				client.RequireAuthentication(c.auth)
+			}
+			client.OnLogin(admitted.login)
+			client.OnLoginRefused(admitted.excuse)
+			client.OnLoginTimeout(c.countHandshakeTimeout)
+			client.CountBytesRead(&c.stats.bytesRead)
+			c.clients.Add(1)
+			go func() {
+				defer admitted.release()
+				client.Read(&c.clients)
+			}()
 		}
 
 	}
 
 }
 
-// Run handles channels inbound communications from connected clients
-func (c *core) run(wg *sync.WaitGroup) {
-	wg.Add(1)
-	defer wg.Done()
-
-	go c.listenConnections(wg)
+// start launches the registry shard workers and the LOGIN router, they run
+// until stop is called.
+func (c *core) start() {
+	for _, s := range c.registry.shards {
+		c.workers.Add(1)
+		go c.runShard(s)
+	}
+	c.workers.Add(1)
+	go c.routeLogins()
+}
 
+// routeLogins sends every LOGIN command to the shard owning the IMEI
+func (c *core) routeLogins() {
+	defer c.workers.Done()
 	for {
-		var err error
 		select {
 		case cmd := <-c.commands:
-			switch cmd.ID {
-			case common.LOGIN:
-				err = c.register(cmd.Sender, cmd.CallbackChannel)
-			case common.LOGOUT:
-				err = c.deregister(cmd.Sender)
-			case common.READING:
-				err = c.handleReading(cmd.Sender, cmd.Body)
-			default:
-				err = fmt.Errorf("Unknown Command %d", cmd.ID)
+			c.registry.shardFor(cmd.Sender).commands <- cmd
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// runShard processes the commands of the devices owned by s until the core
+// is stopped, then it processes any command still queued and returns.
+func (c *core) runShard(s *shard) {
+	defer c.workers.Done()
+	for {
+		select {
+		case cmd := <-s.commands:
+			c.process(cmd)
+		case <-c.quit:
+			for {
+				select {
+				case cmd := <-s.commands:
+					c.process(cmd)
+				default:
+					return
+				}
 			}
 		}
-		if err != nil {
-			log.Printf("ERR %v", err)
+	}
+}
+
+// countHandshakeTimeout counts a connection which did not log in in time.
+func (c *core) countHandshakeTimeout() {
+	atomic.AddUint64(&c.stats.handshakeTimeouts, 1)
+}
+
+func (c *core) process(cmd common.Command) {
+	started := time.Now()
+	defer func() { c.metrics.commandDuration.observeDuration(time.Since(started)) }()
+	var err error
+	switch cmd.ID {
+	case common.LOGIN:
+		err = c.register(cmd.Sender, cmd.CallbackChannel, cmd.Logger, cmd.Conn)
+	case common.LOGOUT:
+		err = c.deregister(cmd.Sender, cmd.Session, cmd.Reason)
+	case common.READING:
+		session := c.countSessionReading(cmd.Sender, cmd.Session)
+		err = c.handleReading(cmd.Sender, session, cmd.Protocol, cmd.Body)
+	case common.ACK:
+		err = c.handleAck(cmd.Sender, cmd.Session, cmd.Body)
+	default:
+		err = fmt.Errorf("Unknown Command %d", cmd.ID)
+	}
+	if err != nil {
+		c.logger.Error("processing command", logging.F("command", int(cmd.ID)), logging.F("imei", cmd.Sender), logging.F("err", err))
+	}
+}
+
+// killAll makes the core refuse new logins and kills every logged in device,
+// it returns the number of sessions told to finish.
+func (c *core) killAll() int {
+	atomic.StoreInt32(&c.closing, 1)
+	killed := 0
+	c.registry.each(func(imei uint64, dev *connectedDevice) bool {
+		for _, session := range dev.loadSessions() {
+			if session.kill(disconnectShutdown) {
+				killed++
+			}
 		}
+		return true
+	})
+	return killed
+}
+
+// deviceState returns the inventory state of imei, every device is allowed
+// when there is no inventory. It does NOT lock.
+func (c *core) deviceState(imei uint64) DeviceState {
+	if c.inventory == nil {
+		return DeviceAllowed
+	}
+	return c.inventory.state(imei)
+}
 
+// deviceSite returns the inventory site of imei, empty when there is no
+// inventory or the device has no site. It does NOT lock.
+func (c *core) deviceSite(imei uint64) string {
+	if c.inventory == nil {
+		return ""
 	}
+	entry, _ := c.inventory.lookup(imei)
+	return entry.Site
+}
 
+// enforceInventory kills every session of the logged in devices which the
+// inventory denies, it returns the number of sessions told to finish.
+func (c *core) enforceInventory() int {
+	killed := 0
+	c.registry.each(func(imei uint64, dev *connectedDevice) bool {
+		if c.deviceState(imei) != DeviceDenied {
+			return true
+		}
+		for _, session := range dev.loadSessions() {
+			if session.kill(disconnectDenied) {
+				killed++
+				session.log.Event("denied")
+			}
+		}
+		return true
+	})
+	return killed
 }
 
+// waitClients waits for every device.Client goroutine to finish, it returns
+// false if they did not finish within timeout.
+func (c *core) waitClients(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		c.clients.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// stop terminates the shard workers once they processed every queued command,
+// and then closes the sinks so every buffered reading is written, and the
+// session history.
+func (c *core) stop() {
+	close(c.quit)
+	c.workers.Wait()
+	for _, sink := range c.sinks {
+		if err := sink.Close(); err != nil {
+			c.logger.Error("closing sink", logging.F("err", err))
+		}
+	}
+	if err := c.sessions.close(); err != nil {
+		c.logger.Error("closing the session history", logging.F("err", err))
+	}
+}
+
+// deviceLastReading returns a copy of the last reading of a logged in device,
+// lastReading is nil if the device did not send any valid reading yet.
 func (c *core) deviceLastReading(imei uint64) (lastReadingEpoch int64, lastReading *device.Reading, exists bool) {
 	dev, exists := c.deviceByIMEI(imei)
 	if !exists {
 		return
 	}
 	//a little copying is better than a little sharing
-	lastReading = &device.Reading{
-		Temperature:  dev.lastReading.Temperature,
-		Altitude:     dev.lastReading.Altitude,
-		Latitude:     dev.lastReading.Latitude,
-		Longitude:    dev.lastReading.Longitude,
-		BatteryLevel: dev.lastReading.BatteryLevel,
+	epoch, reading, ok := dev.loadReading()
+	if ok {
+		lastReadingEpoch = epoch
+		lastReading = &reading
 	}
-
-	lastReadingEpoch = dev.lastReadingEpoch
 	return
 }
 
+// deviceByIMEI looks up a logged in device, it does NOT lock.
 func (c *core) deviceByIMEI(imei uint64) (*connectedDevice, bool) {
-	c.mux.Lock()
-	dev, exists := c.devices[imei]
-	c.mux.Unlock()
-
-	return dev, exists
+	return c.registry.get(imei)
 }
 
-func (c *core) handleReading(imei uint64, payload []byte) (err error) {
+// handleReading validates and fans out a reading of imei received in session,
+// a nil session skips the checks against the previous readings. The payload of
+// a v2 device must be a v2 one, protocol 0 accepts both versions.
+func (c *core) handleReading(imei uint64, session *sessionInfo, protocol int, payload []byte) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			err = fmt.Errorf("ERR recovering from hadleReading panic %v", r)
+			err = fmt.Errorf("recovering from handleReading panic %v", r)
 		}
 	}()
 
-	reading := &device.Reading{}
-	if !reading.Decode(payload) {
-		return fmt.Errorf("ERR decoding payload from device with IMEI %d", imei)
+	rules := c.rules.forDevice(imei)
+	var reading device.Reading
+	decode := reading.DecodeWithRules
+	if protocol == device.ProtocolV2 {
+		decode = reading.DecodeV2WithRules
+	}
+	if reason := decode(payload, rules); reason != device.RejectNone {
+		c.countRejectedReading(reason)
+		return fmt.Errorf("rejecting reading of device with IMEI %d, %v", imei, reason)
 	}
 
 	dev, exists := c.deviceByIMEI(imei)
 	if !exists {
 		return fmt.Errorf("Client with IMEI %d does not exists", imei)
 	}
-	dev.lastReadingEpoch = c.now().UnixNano()
-	dev.lastReading = reading
+	if session != nil {
+		if err := c.checkSessionReading(imei, &session.checks, rules, &reading); err != nil {
+			return err
+		}
+	}
+	epoch := c.now().UnixNano()
+	if previous, _, ok := dev.loadReading(); ok {
+		c.metrics.readingInterval.observeDuration(time.Duration(epoch - previous))
+	}
+	dev.storeReading(epoch, &reading)
+	atomic.AddUint64(&c.stats.readings, 1)
+	if c.deviceState(imei) == DeviceQuarantined {
+		atomic.AddUint64(&c.stats.quarantinedReadings, 1)
+		return nil
+	}
 
-	fmt.Println(formatReadingOutput(imei, dev.lastReadingEpoch, dev.lastReading))
+	rec := Record{
+		IMEI:    imei,
+		Epoch:   epoch,
+		Reading: reading,
+	}
+	for _, sink := range c.sinks {
+		if errSink := sink.Write(rec); errSink != nil {
+			err = fmt.Errorf("writing reading of device with IMEI %d to sink, %v", imei, errSink)
+		}
+	}
 
-	return nil
+	return err
 }
 
-func formatReadingOutput(imei uint64, lastReadingEpoch int64, lastReading *device.Reading) string {
-	return fmt.Sprintf("%d,%d,%f,%f,%f,%f,%f",
-		lastReadingEpoch,
-		imei,
-		lastReading.Temperature,
-		lastReading.Altitude,
-		lastReading.Latitude,
-		lastReading.Longitude,
-		lastReading.BatteryLevel)
-
+// maxJumpRejections is the number of consecutive readings rejected by the
+// jump check after which the temperature is taken as really changed.
+const maxJumpRejections = 3
+
+// checkSessionReading checks reading against the previous ones of the session,
+// it returns an error if its temperature jumped. A single spike does not
+// reject the next readings, they are compared to the last accepted one, and
+// after maxJumpRejections consecutive jumps the rejected temperature becomes
+// the baseline so a device whose temperature really changed is not rejected
+// forever.
+func (c *core) checkSessionReading(imei uint64, checks *readingChecks, rules *device.Rules, reading *device.Reading) error {
+	if reading.Fields.Has(device.FieldSequence) {
+		if checks.hasSequence && reading.Sequence != checks.sequence+1 {
+			atomic.AddUint64(&c.stats.sequenceGaps, 1)
+			c.logger.Warn("sequence gap", logging.F("imei", imei), logging.F("sequence", reading.Sequence), logging.F("previous", checks.sequence))
+		}
+		checks.sequence, checks.hasSequence = reading.Sequence, true
+	}
+	if checks.hasTemperature {
+		if reason := rules.CheckJump(checks.temperature, reading.Temperature); reason != device.RejectNone {
+			c.countRejectedReading(reason)
+			checks.jumps++
+			if checks.jumps >= maxJumpRejections {
+				checks.temperature, checks.jumps = reading.Temperature, 0
+			}
+			return fmt.Errorf("rejecting reading of device with IMEI %d, %v", imei, reason)
+		}
+	}
+	checks.temperature, checks.hasTemperature, checks.jumps = reading.Temperature, true, 0
+	return nil
 }
 
-func (c *core) register(imei uint64, callbackChannel chan common.Command) error {
+// countRejectedReading counts an invalid reading rejected for reason.
+func (c *core) countRejectedReading(reason device.RejectReason) {
+	atomic.AddUint64(&c.stats.invalidReadings, 1)
+	atomic.AddUint64(&c.stats.rejectedReadings[reason], 1)
+}
 
-	_, exists := c.deviceByIMEI(imei)
+// addSink makes core fan out every valid reading to sink.
+func (c *core) addSink(sink Sink) {
+	c.sinks = append(c.sinks, sink)
+}
 
-	if exists {
-		log.Printf("DEBUG trying to kill connected dup device %v", imei)
+// register logs a device in. The WELCOME command carries the session of the
+// connection, and the channel of the registry shard owning the device where it
+// must send its next commands. When the device is already logged in the core
+// login policy decides whether the new connection is accepted. connLog is the
+// logger of the connection, the core logger is used when it is nil, and conn
+// describes it, it may be nil as well.
+func (c *core) register(imei uint64, callbackChannel chan common.Command, connLog *logging.Logger, conn *common.ConnInfo) error {
+	if connLog == nil {
+		connLog = c.logger.With(logging.F("imei", imei))
+	}
+	if atomic.LoadInt32(&c.closing) == 1 {
 		callbackChannel <- common.Command{ID: common.KILL}
-		log.Printf("DEBUG KILL cmd sent  %v", imei)
-		return fmt.Errorf("imei %d already logged in", imei)
+		return fmt.Errorf("imei %d can not log in, the server is shutting down", imei)
 	}
-	c.mux.Lock()
-	c.devices[imei] = &connectedDevice{
+	if c.deviceState(imei) == DeviceDenied {
+		callbackChannel <- common.Command{ID: common.KILL}
+		atomic.AddUint64(&c.stats.deniedLogins, 1)
+		connLog.Event("login-denied")
+		return nil
+	}
+	if until, banned := c.bans.bannedUntil(imei, c.now()); banned {
+		callbackChannel <- common.Command{ID: common.KILL}
+		atomic.AddUint64(&c.stats.bannedLogins, 1)
+		connLog.Event("login-banned", logging.F("until", until))
+		return nil
+	}
+
+	s := c.registry.shardFor(imei)
+	id := atomic.AddUint64(&c.lastSessionID, 1)
+	session := deviceSession{
+		id:              id,
 		callbackChannel: callbackChannel,
+		log:             connLog.With(logging.F("session", id)),
+		info:            newSessionInfo(conn, c.now()),
+	}
+	online := s.add(imei, newConnectedDevice(session))
+	if !online {
+		dev, _ := c.registry.get(imei)
+		if err := c.applyLoginPolicy(imei, dev, session); err != nil {
+			return err
+		}
+	}
+	callbackChannel <- common.Command{ID: common.WELCOME, Session: session.id, CallbackChannel: s.commands, Kill: session.info.kill}
+	atomic.AddUint64(&c.stats.logins, 1)
+	session.log.Debug("session registered")
+	if online {
+		c.publishPresence(streamOnlineEvent, imei, "")
 	}
-	c.mux.Unlock()
-	callbackChannel <- common.Command{ID: common.WELCOME}
-	log.Printf("device with IMEI %d connected succesfuly", imei)
 
 	return nil
 }
 
-func (c *core) deregister(imei uint64) error {
-	log.Printf("DEBUG trying to deregister device with IMEI %d ", imei)
-	_, exists := c.deviceByIMEI(imei)
+// deregister logs the session of a device out for reason, and records it in
+// the session history. The device is logged out when it has no sessions left.
+// The logout of a session replaced by another one is ignored.
+func (c *core) deregister(imei uint64, session uint64, reason string) error {
+	s := c.registry.shardFor(imei)
+	dev, exists := c.registry.get(imei)
 	if !exists {
-		return fmt.Errorf("ERR imei %d is not logged in", imei)
+		return fmt.Errorf("imei %d is not logged in", imei)
 	}
-
-	c.mux.Lock()
-	delete(c.devices, imei)
-	c.mux.Unlock()
-	log.Printf("device with IMEI %d desconnected succesfuly", imei)
+	current := dev.loadSessions()
+	remaining := make([]deviceSession, 0, len(current))
+	var finished deviceSession
+	for _, sess := range current {
+		if sess.id != session {
+			remaining = append(remaining, sess)
+		} else {
+			finished = sess
+		}
+	}
+	if len(remaining) == len(current) {
+		c.logger.Event("stale-logout", logging.F("imei", imei), logging.F("session", session))
+		return nil
+	}
+	atomic.AddUint64(&c.stats.logouts, 1)
+	rec := finished.record(imei)
+	rec.close(c.now(), finished.disconnectReason(reason))
+	c.sessions.add(rec)
+	finished.log.Debug("session deregistered", logging.F("sessions", len(remaining)), logging.F("reason", rec.Reason))
+	if len(remaining) > 0 {
+		dev.storeSessions(remaining)
+		return nil
+	}
+	if !s.remove(imei) {
+		return fmt.Errorf("imei %d is not logged in", imei)
+	}
+	c.publishPresence(streamOfflineEvent, imei, rec.Reason)
 	return nil
 }
+
+// publishPresence tells the live stream subscribers that a device went online
+// or offline, reason is why it went offline.
+func (c *core) publishPresence(eventType string, imei uint64, reason string) {
+	if c.streams == nil {
+		return
+	}
+	c.streams.publish(streamEvent{
+		Type:   eventType,
+		Record: Record{IMEI: imei, Epoch: c.now().UnixNano()},
+		Reason: reason,
+	})
+}
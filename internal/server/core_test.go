@@ -2,7 +2,9 @@ package server
 
 import (
 	"fmt"
+	"os"
 	"reflect"
+	"sync/atomic"
 	"testing"
 
 	"github.com/spin-org/thermomatic/internal/common"
@@ -19,7 +21,7 @@ func TestNewCore(t *testing.T) {
 }
 
 func TestOutputReading(t *testing.T) {
-	expectedRecord := "1257894000000000000,490154203237518,67.770000,2.635550,33.410000,44.400000,0.256660"
+	expectedRecord := "1257894000000000000,490154203237518,67.77,2.63555,33.41,44.4,0.25666"
 	actualRecord := formatReadingOutput(490154203237518, 1257894000000000000, &device.Reading{
 		Temperature:  67.77,
 		Altitude:     2.63555,
@@ -42,22 +44,23 @@ func TestCore_HandleReading(t *testing.T) {
 	core := newCore(common.FrozenInTime, uint(1337), 2)
 	expectedClientIMEI := uint64(448324242329542)
 	dev := &connectedDevice{}
-	core.devices[expectedClientIMEI] = dev
+	core.registry.shardFor(expectedClientIMEI).add(expectedClientIMEI, dev)
 
 	//Exercise
-	core.handleReading(expectedClientIMEI, expectedPayload[:])
+	core.handleReading(expectedClientIMEI, nil, 0, expectedPayload[:])
 
-	if dev.lastReadingEpoch != expectedLastReadingEpoch {
+	lastReadingEpoch, lastReading, _ := dev.loadReading()
+	if lastReadingEpoch != expectedLastReadingEpoch {
 		t.Errorf("expected LastReadingEpoch to equal %d but got %d",
 			expectedLastReadingEpoch,
-			dev.lastReadingEpoch)
+			lastReadingEpoch)
 	}
-	expectedReading := &device.Reading{}
+	expectedReading := device.Reading{}
 	expectedReading.Decode(expectedPayload[:])
-	if !reflect.DeepEqual(expectedReading, dev.lastReading) {
+	if !reflect.DeepEqual(expectedReading, lastReading) {
 		t.Errorf("expected LastReading to equal %v but got %v",
 			expectedReading,
-			dev.lastReading)
+			lastReading)
 	}
 }
 
@@ -68,7 +71,7 @@ func TestCore_HandleReading_UnknownClient(t *testing.T) {
 	//Exercise
 
 	unknownIMEI := uint64(123)
-	err := core.handleReading(unknownIMEI, []byte{1, 2})
+	err := core.handleReading(unknownIMEI, nil, 0, []byte{1, 2})
 	if err == nil {
 		t.Errorf("expected get an error for unknown client %d", unknownIMEI)
 	}
@@ -79,17 +82,17 @@ func TestCore_HandleReading_InvalidPayload(t *testing.T) {
 	core := newCore(common.FrozenInTime, uint(1337), 2)
 	expectedClientIMEI := uint64(448324242329542)
 	dev := &connectedDevice{}
-	core.devices[expectedClientIMEI] = dev
+	core.registry.shardFor(expectedClientIMEI).add(expectedClientIMEI, dev)
 
 	//Exercise bound check panic
-	errBoundCheckPanic := core.handleReading(expectedClientIMEI, []byte{1, 2})
+	errBoundCheckPanic := core.handleReading(expectedClientIMEI, nil, 0, []byte{1, 2})
 	if errBoundCheckPanic == nil {
 		t.Errorf("expected get an error for unknown client %d", expectedClientIMEI)
 	}
 
 	invalidPayload := device.NewPayload(9999999, 9999999, 9999999, 9999999, 9999999)
 
-	errInvalidPayload := core.handleReading(expectedClientIMEI, invalidPayload[:])
+	errInvalidPayload := core.handleReading(expectedClientIMEI, nil, 0, invalidPayload[:])
 	if errInvalidPayload == nil {
 		t.Errorf("expected get an error for unknown client %d", expectedClientIMEI)
 	}
@@ -99,7 +102,7 @@ func TestCore_Register(t *testing.T) {
 	core := newCore(common.FrozenInTime, uint(1337), 2)
 	expectedIMEI := uint64(448324242329542)
 	callBackChannel := make(chan common.Command, 1)
-	err := core.register(expectedIMEI, callBackChannel)
+	err := core.register(expectedIMEI, callBackChannel, nil, nil)
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -121,13 +124,13 @@ func TestCore_Register_ExistingClient(t *testing.T) {
 	callBackChannel := make(chan common.Command, 2)
 
 	//Exercise
-	err := core.register(expectedIMEI, callBackChannel)
+	err := core.register(expectedIMEI, callBackChannel, nil, nil)
 	if err != nil {
 		t.Errorf("Unexpected err (%v) while trying to register %d", err, expectedIMEI)
 	}
 	<-callBackChannel //ignore welcome cmd
 
-	err = core.register(expectedIMEI, callBackChannel)
+	err = core.register(expectedIMEI, callBackChannel, nil, nil)
 	if err == nil {
 		t.Errorf("An error is expected when trying to register an existing client ")
 	}
@@ -146,15 +149,112 @@ func TestCore_Deregister_ExistingClient(t *testing.T) {
 	callBackChannel := make(chan common.Command, 1)
 
 	//Exercise
-	err := core.register(imei, callBackChannel)
+	err := core.register(imei, callBackChannel, nil, nil)
 	if err != nil {
 		t.Errorf("Unexpected err (%v)while trying to register %d", err, imei)
 	}
+	welcome := <-callBackChannel
 
-	err = core.deregister(imei)
+	err = core.deregister(imei, welcome.Session, device.LogoutEOF)
 	if err != nil {
 		t.Errorf("Unexpected error trying to deregister an existing client %v ", err)
 	}
+	if _, exists := core.deviceByIMEI(imei); exists {
+		t.Errorf("device %d should be logged out", imei)
+	}
+}
+
+func TestCore_Register_ReplaceOld(t *testing.T) {
+	core := newCore(common.FrozenInTime, uint(1337), 2)
+	core.loginPolicy = LoginReplaceOld
+	imei := uint64(448324242329542)
+	oldChannel := make(chan common.Command, 2)
+	newChannel := make(chan common.Command, 1)
+
+	if err := core.register(imei, oldChannel, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	oldWelcome := <-oldChannel
+	if err := core.register(imei, newChannel, nil, nil); err != nil {
+		t.Fatalf("Unexpected err (%v) replacing the session of %d", err, imei)
+	}
+
+	select {
+	case <-oldWelcome.Kill:
+	default:
+		t.Error("Expected the old session to be killed")
+	}
+	newWelcome := <-newChannel
+	if newWelcome.ID != common.WELCOME || newWelcome.Session == oldWelcome.Session {
+		t.Errorf("Expected a WELCOME with a new session but got %+v", newWelcome)
+	}
+
+	// the killed connection logs out after the handover, which must not log
+	// the new one out
+	if err := core.deregister(imei, oldWelcome.Session, device.LogoutEOF); err != nil {
+		t.Errorf("Unexpected err (%v) logging out the replaced session", err)
+	}
+	dev, exists := core.deviceByIMEI(imei)
+	if !exists {
+		t.Fatalf("device %d should still be logged in", imei)
+	}
+	if sessions := dev.loadSessions(); len(sessions) != 1 || sessions[0].id != newWelcome.Session {
+		t.Errorf("Expected only session %d but got %+v", newWelcome.Session, sessions)
+	}
+}
+
+func TestCore_Register_AllowBoth(t *testing.T) {
+	core := newCore(common.FrozenInTime, uint(1337), 2)
+	core.loginPolicy = LoginAllowBoth
+	imei := uint64(448324242329542)
+	firstChannel := make(chan common.Command, 1)
+	secondChannel := make(chan common.Command, 1)
+
+	if err := core.register(imei, firstChannel, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := core.register(imei, secondChannel, nil, nil); err != nil {
+		t.Fatalf("Unexpected err (%v) adding a session to %d", err, imei)
+	}
+	first, second := <-firstChannel, <-secondChannel
+	if first.ID != common.WELCOME || second.ID != common.WELCOME {
+		t.Fatalf("Expected both sessions to be welcomed but got %v and %v", first.ID, second.ID)
+	}
+	if first.Session == second.Session {
+		t.Errorf("Expected different sessions but both got %d", first.Session)
+	}
+
+	dev, _ := core.deviceByIMEI(imei)
+	if n := len(dev.loadSessions()); n != 2 {
+		t.Errorf("Expected 2 sessions but got %d", n)
+	}
+	if err := core.deregister(imei, first.Session, device.LogoutEOF); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := core.deviceByIMEI(imei); !exists {
+		t.Errorf("device %d should be logged in while it has a session", imei)
+	}
+	if err := core.deregister(imei, second.Session, device.LogoutEOF); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := core.deviceByIMEI(imei); exists {
+		t.Errorf("device %d should be logged out", imei)
+	}
+	if logouts := atomic.LoadUint64(&core.stats.logouts); logouts != 2 {
+		t.Errorf("Expected 2 logouts but got %d", logouts)
+	}
+}
+
+func TestParseLoginPolicy(t *testing.T) {
+	for _, policy := range []LoginPolicy{LoginRejectNew, LoginReplaceOld, LoginAllowBoth} {
+		parsed, err := ParseLoginPolicy(policy.String())
+		if err != nil || parsed != policy {
+			t.Errorf("Expected %v parsing %q but got %v, %v", policy, policy.String(), parsed, err)
+		}
+	}
+	if _, err := ParseLoginPolicy("kill-all"); err == nil {
+		t.Error("An error is expected parsing an unknown policy")
+	}
 }
 
 func TestCore_Deregister_UnknownClient(t *testing.T) {
@@ -164,31 +264,34 @@ func TestCore_Deregister_UnknownClient(t *testing.T) {
 
 	//Exercise
 
-	err := core.deregister(expectedClientIMEI)
+	err := core.deregister(expectedClientIMEI, 1, device.LogoutEOF)
 	if err == nil {
 		t.Errorf("An error is expected when trying to deregister an unknown client")
 	}
 }
 
-func ExampleCore_handleReading() {
+func Example_coreHandleReading() {
 	//Setup
 
 	expectedPayload := device.NewPayload(9.127577, 12545.598440, -51.432503, -42.963412, 31.805817)
 
 	core := newCore(common.FrozenInTime, uint(1337), 2)
+	stdout := newStdoutSink(os.Stdout)
+	core.addSink(stdout)
 	expectedIMEI := uint64(448324242329542)
 	callBackChannel := make(chan common.Command, 1)
 
 	//Exercise
-	err := core.register(expectedIMEI, callBackChannel)
+	err := core.register(expectedIMEI, callBackChannel, nil, nil)
 	if err != nil {
 		fmt.Printf("Unexpected err (%v) while trying to register %d", err, expectedIMEI)
 	}
 	//Exercise
 
-	core.handleReading(expectedIMEI, expectedPayload[:])
+	core.handleReading(expectedIMEI, nil, 0, expectedPayload[:])
+	stdout.Flush()
 
-	// Output: 1596397680000000000,448324242329542,9.127577,12545.598440,-51.432503,-42.963412,31.805817
+	// Output: 1596397680000000000,448324242329542,9.127577,12545.59844,-51.432503,-42.963412,31.805817
 }
 
 func BenchmarkCore_HandleReading(b *testing.B) {
@@ -201,7 +304,7 @@ func BenchmarkCore_HandleReading(b *testing.B) {
 
 	callBackChannel := make(chan common.Command, 1)
 
-	err := core.register(expectedClientIMEI, callBackChannel)
+	err := core.register(expectedClientIMEI, callBackChannel, nil, nil)
 	if err != nil {
 		b.Error(err)
 	}
@@ -213,7 +316,7 @@ func BenchmarkCore_HandleReading(b *testing.B) {
 
 	for i := 0; i < b.N; i++ {
 		fmt.Printf("reading %d of %d readings", i, b.N)
-		err := core.handleReading(expectedClientIMEI, expectedPayload[:])
+		err := core.handleReading(expectedClientIMEI, nil, 0, expectedPayload[:])
 		if err != nil {
 			b.Fail()
 		}
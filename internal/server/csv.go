@@ -0,0 +1,105 @@
+package server
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+const (
+	// csvBufferSize is the initial capacity of a csvSink buffer.
+	csvBufferSize = 64 << 10
+	// csvFlushThreshold is the amount of buffered bytes that makes a csvSink
+	// write its batch of records to the underlying writer.
+	csvFlushThreshold = 32 << 10
+)
+
+// appendReadingCSV appends to dst the CSV record of a reading, as defined by
+// the thermomatic output format, without the trailing new line.
+//
+// Floats use the shortest representation that round-trips, e.g. 67.77 and not
+// 67.770000. appendReadingCSV does NOT allocate when dst has enough capacity.
+func appendReadingCSV(dst []byte, imei uint64, epoch int64, r *device.Reading) []byte {
+	dst = strconv.AppendInt(dst, epoch, 10)
+	dst = append(dst, ',')
+	dst = strconv.AppendUint(dst, imei, 10)
+	dst = appendCSVFloat(dst, r.Temperature)
+	dst = appendCSVFloat(dst, r.Altitude)
+	dst = appendCSVFloat(dst, r.Latitude)
+	dst = appendCSVFloat(dst, r.Longitude)
+	dst = appendCSVFloat(dst, r.BatteryLevel)
+	return dst
+}
+
+func appendCSVFloat(dst []byte, f float64) []byte {
+	dst = append(dst, ',')
+	return strconv.AppendFloat(dst, f, 'f', -1, 64)
+}
+
+// formatReadingOutput returns the CSV record of a reading as a string.
+func formatReadingOutput(imei uint64, lastReadingEpoch int64, lastReading *device.Reading) string {
+	var buf [128]byte
+	return string(appendReadingCSV(buf[:0], imei, lastReadingEpoch, lastReading))
+}
+
+// csvSink writes records as CSV lines in the output format defined by the
+// thermomatic spec.
+//
+// Records are encoded into a reusable buffer and written to the underlying
+// writer in batches, once csvFlushThreshold bytes are buffered or on Flush,
+// so writing a record does NOT allocate.
+type csvSink struct {
+	w      io.Writer
+	closer io.Closer
+	buf    []byte
+}
+
+func newCSVSink(w io.Writer, closer io.Closer) *csvSink {
+	return &csvSink{
+		w:      w,
+		closer: closer,
+		buf:    make([]byte, 0, csvBufferSize),
+	}
+}
+
+// newStdoutSink returns a csvSink writing to w, typically os.Stdout, which is
+// never closed.
+func newStdoutSink(w io.Writer) *csvSink {
+	return newCSVSink(w, nil)
+}
+
+func (s *csvSink) Write(rec Record) error {
+	s.buf = appendReadingCSV(s.buf, rec.IMEI, rec.Epoch, &rec.Reading)
+	s.buf = append(s.buf, '\n')
+	if len(s.buf) >= csvFlushThreshold {
+		return s.Flush()
+	}
+	return nil
+}
+
+// buffered returns the number of encoded bytes not flushed yet.
+func (s *csvSink) buffered() int {
+	return len(s.buf)
+}
+
+// Flush writes the batch of buffered records. The batch is discarded even if
+// the write fails, so a broken writer can not make the buffer grow forever.
+func (s *csvSink) Flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	_, err := s.w.Write(s.buf)
+	s.buf = s.buf[:0]
+	return err
+}
+
+func (s *csvSink) Close() error {
+	err := s.Flush()
+	if s.closer != nil {
+		if errClose := s.closer.Close(); err == nil {
+			err = errClose
+		}
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"testing"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+func TestAppendReadingCSV(t *testing.T) {
+	tests := []struct {
+		reading  device.Reading
+		expected string
+	}{
+		{
+			reading:  device.Reading{Temperature: 67.77, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.25666},
+			expected: "1257894000000000000,490154203237518,67.77,2.63555,33.41,44.4,0.25666",
+		},
+		{
+			reading:  device.Reading{Temperature: -300, Altitude: 20000, Latitude: -90, Longitude: 180, BatteryLevel: 100},
+			expected: "1257894000000000000,490154203237518,-300,20000,-90,180,100",
+		},
+		{
+			reading:  device.Reading{Temperature: 0.1, Altitude: 1e-7, Latitude: 0, Longitude: -0.5, BatteryLevel: 1},
+			expected: "1257894000000000000,490154203237518,0.1,0.0000001,0,-0.5,1",
+		},
+	}
+
+	for _, test := range tests {
+		actual := string(appendReadingCSV(nil, 490154203237518, 1257894000000000000, &test.reading))
+		if actual != test.expected {
+			t.Errorf("expected %s got %s", test.expected, actual)
+		}
+	}
+}
+
+func TestAppendReadingCSV_Allocations(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	buf := make([]byte, 0, 128)
+	var start, end runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&start)
+
+	buf = appendReadingCSV(buf[:0], testRecord.IMEI, testRecord.Epoch, &testRecord.Reading)
+
+	runtime.ReadMemStats(&end)
+	alloc := end.TotalAlloc - start.TotalAlloc
+	if alloc > 0 {
+		t.Errorf("appendReadingCSV should NOT allocate with a big enough buffer, it allocated %d bytes", alloc)
+	}
+}
+
+func TestCSVSink_Write_Allocations(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	sink := newCSVSink(ioutil.Discard, nil)
+	var start, end runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&start)
+
+	// enough records to go through a few batch flushes
+	for i := 0; i < 10000; i++ {
+		sink.Write(testRecord)
+	}
+	sink.Flush()
+
+	runtime.ReadMemStats(&end)
+	alloc := end.TotalAlloc - start.TotalAlloc
+	if alloc > 0 {
+		t.Errorf("csvSink.Write should NOT allocate, it allocated %d bytes", alloc)
+	}
+}
+
+func TestCSVSink_Write_FlushesBatches(t *testing.T) {
+	var out bytes.Buffer
+	sink := newCSVSink(&out, nil)
+	line := formatReadingOutput(testRecord.IMEI, testRecord.Epoch, &testRecord.Reading) + "\n"
+
+	recordsPerBatch := csvFlushThreshold/len(line) + 1
+	for i := 0; i < recordsPerBatch-1; i++ {
+		sink.Write(testRecord)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("expected records to be buffered until the batch is full, got %d bytes written", out.Len())
+	}
+	sink.Write(testRecord)
+	if out.Len() != recordsPerBatch*len(line) {
+		t.Errorf("expected a full batch of %d bytes to be written, got %d", recordsPerBatch*len(line), out.Len())
+	}
+	if sink.buffered() != 0 {
+		t.Errorf("expected an empty buffer after the batch write, got %d bytes", sink.buffered())
+	}
+}
+
+// BenchmarkFormatReadingOutput_Sprintf is the baseline, the fmt.Sprintf based
+// formatting used before appendReadingCSV.
+func BenchmarkFormatReadingOutput_Sprintf(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = fmt.Sprintf("%d,%d,%f,%f,%f,%f,%f",
+			testRecord.Epoch,
+			testRecord.IMEI,
+			testRecord.Reading.Temperature,
+			testRecord.Reading.Altitude,
+			testRecord.Reading.Latitude,
+			testRecord.Reading.Longitude,
+			testRecord.Reading.BatteryLevel)
+	}
+	b.StopTimer()
+}
+
+func BenchmarkAppendReadingCSV(b *testing.B) {
+	buf := make([]byte, 0, 128)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = appendReadingCSV(buf[:0], testRecord.IMEI, testRecord.Epoch, &testRecord.Reading)
+	}
+	b.StopTimer()
+}
+
+// BenchmarkCore_HandleReading_CSVSink compares with BenchmarkCore_HandleReading
+// the cost of handling a reading including its CSV output.
+func BenchmarkCore_HandleReading_CSVSink(b *testing.B) {
+	expectedPayload := device.CreateRandReadingBytes()
+	core := newCore(common.FrozenInTime, uint(1337), 2)
+	core.addSink(newCSVSink(ioutil.Discard, nil))
+	expectedClientIMEI := uint64(448324242329542)
+	callBackChannel := make(chan common.Command, 1)
+	if err := core.register(expectedClientIMEI, callBackChannel, nil, nil); err != nil {
+		b.Error(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := core.handleReading(expectedClientIMEI, nil, 0, expectedPayload[:]); err != nil {
+			b.Fail()
+		}
+	}
+	b.StopTimer()
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// maxDeviceBan bounds the ban of DELETE /devices/:imei/session, longer ones
+// belong in the inventory.
+const maxDeviceBan = 24 * time.Hour
+
+// deviceBans are the devices temporarily refused to log in, by IMEI. Unlike
+// the bans of the limiter they follow the device whatever its IP address.
+type deviceBans struct {
+	mux   sync.Mutex
+	until map[uint64]time.Time
+}
+
+// ban refuses the logins of imei until until, expired bans are dropped.
+func (b *deviceBans) ban(imei uint64, until, now time.Time) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.until == nil {
+		b.until = make(map[uint64]time.Time)
+	}
+	for banned, t := range b.until {
+		if !now.Before(t) {
+			delete(b.until, banned)
+		}
+	}
+	b.until[imei] = until
+}
+
+// bannedUntil returns when the ban of imei ends, ok is unset when it is not
+// banned at now.
+func (b *deviceBans) bannedUntil(imei uint64, now time.Time) (until time.Time, ok bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	until, ok = b.until[imei]
+	if ok && !now.Before(until) {
+		delete(b.until, imei)
+		return until, false
+	}
+	return until, ok
+}
+
+// disconnect kills every session of imei, which close their connections and
+// finish with the admin reason, and bans the device for ban when it is
+// positive. It returns the number of sessions told to finish, the ones already
+// killed excluded, and false when the device is not logged in. The device is
+// only banned when a session was told to finish.
+func (c *core) disconnect(imei uint64, ban time.Duration) (int, bool) {
+	dev, exists := c.registry.get(imei)
+	if !exists {
+		return 0, false
+	}
+	killed := 0
+	for _, session := range dev.loadSessions() {
+		if session.kill(disconnectAdmin) {
+			killed++
+		}
+	}
+	if killed == 0 {
+		return 0, true
+	}
+	if ban > 0 {
+		c.bans.ban(imei, c.now().Add(ban), c.now())
+	}
+	atomic.AddUint64(&c.stats.adminDisconnects, 1)
+	c.logger.WarnEvent("admin-disconnect", logging.F("imei", imei), logging.F("sessions", killed), logging.F("ban", ban))
+	return killed, true
+}
+
+// disconnectResponse is the body of DELETE /devices/:imei/session.
+type disconnectResponse struct {
+	IMEI uint64 `json:"imei"`
+	// Sessions told to finish, they log out asynchronously
+	Sessions    int        `json:"sessions"`
+	BannedUntil *time.Time `json:"bannedUntil,omitempty"`
+}
+
+// sessionHandler serves DELETE /devices/:imei/session?ban=10m, which
+// disconnects an online device, and refuses its logins for the optional ban
+// duration.
+func (d *httpd) sessionHandler(w http.ResponseWriter, req *http.Request, imeiStr string) {
+	if req.Method != http.MethodDelete {
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	imei, err := parseIMEI(imeiStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ban time.Duration
+	if v := req.URL.Query().Get("ban"); v != "" {
+		ban, err = time.ParseDuration(v)
+		if err != nil || ban <= 0 || ban > maxDeviceBan {
+			http.Error(w, fmt.Sprintf("invalid ban %q, it should be a duration up to %v", v, maxDeviceBan), http.StatusBadRequest)
+			return
+		}
+	}
+	killed, ok := d.core.disconnect(imei, ban)
+	if !ok {
+		http.Error(w, "device is not online", http.StatusNotFound)
+		return
+	}
+	if killed == 0 {
+		http.Error(w, "the sessions of the device are already finishing", http.StatusServiceUnavailable)
+		return
+	}
+	resp := disconnectResponse{IMEI: imei, Sessions: killed}
+	if until, banned := d.core.bans.bannedUntil(imei, d.core.now()); banned {
+		until = until.UTC()
+		resp.BannedUntil = &until
+	}
+	d.writeJSONResponse(w, resp)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/common"
+)
+
+func TestDeviceBans(t *testing.T) {
+	var bans deviceBans
+	now := common.FrozenInTime()
+	if _, banned := bans.bannedUntil(490154203237518, now); banned {
+		t.Error("expected no ban")
+	}
+	bans.ban(490154203237518, now.Add(time.Minute), now)
+	if until, banned := bans.bannedUntil(490154203237518, now.Add(59*time.Second)); !banned || !until.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected the device banned for a minute, got %v %v", until, banned)
+	}
+	if _, banned := bans.bannedUntil(448324242329542, now); banned {
+		t.Error("expected only the banned device to be banned")
+	}
+	if _, banned := bans.bannedUntil(490154203237518, now.Add(time.Minute)); banned {
+		t.Error("expected the ban to expire")
+	}
+	if len(bans.until) != 0 {
+		t.Errorf("expected the expired ban to be dropped, got %v", bans.until)
+	}
+}
+
+func TestServer_Run_AdminDisconnect(t *testing.T) {
+	s, cancel, done := startTestServer(t, Config{MaxClients: 10, ShutdownTimeout: time.Second})
+	defer func() {
+		cancel()
+		<-done
+	}()
+	imei := []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}
+	url := fmt.Sprintf("http://%s/devices/490154203237518/session", s.httpLn.Addr())
+	do := func(method, target string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := do(http.MethodDelete, url); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an offline device got %d", resp.StatusCode)
+	}
+	conn := dialTestDevice(t, s, imei)
+	defer conn.Close()
+	waitFor(t, "the device to log in", func() bool { return s.core.numConnectedDevices() == 1 })
+
+	for _, tc := range []struct {
+		method, query string
+		code          int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "?ban=forever", http.StatusBadRequest},
+		{http.MethodDelete, "?ban=-1m", http.StatusBadRequest},
+		{http.MethodDelete, "?ban=48h", http.StatusBadRequest},
+	} {
+		if resp := do(tc.method, url+tc.query); resp.StatusCode != tc.code {
+			t.Errorf("%s %s, expected %d got %d", tc.method, tc.query, tc.code, resp.StatusCode)
+		}
+	}
+
+	resp := do(http.MethodDelete, url+"?ban=1m")
+	var body disconnectResponse
+	err := json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Sessions != 1 || body.BannedUntil == nil {
+		t.Errorf("unexpected response %d %+v", resp.StatusCode, body)
+	}
+
+	// the server closes the connection right away, well before the device
+	// read timeout
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.Copy(ioutil.Discard, conn); isTimeoutError(err) {
+		t.Fatal("expected the connection to be closed by the server")
+	}
+	waitFor(t, "the device to log out", func() bool { return s.core.numConnectedDevices() == 0 })
+	if sessions := s.core.deviceSessions(490154203237518); len(sessions) != 1 || sessions[0].Reason != disconnectAdmin {
+		t.Errorf("expected the session to finish with the admin reason, got %+v", sessions)
+	}
+
+	// the device can not log in again while it is banned
+	banned := dialTestDevice(t, s, imei)
+	defer banned.Close()
+	waitFor(t, "the banned login", func() bool { return atomic.LoadUint64(&s.core.stats.bannedLogins) == 1 })
+	banned.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.Copy(ioutil.Discard, banned); isTimeoutError(err) {
+		t.Fatal("expected the connection of the banned device to be closed")
+	}
+	if n := s.core.numConnectedDevices(); n != 0 {
+		t.Errorf("expected the banned device to stay offline, got %d devices", n)
+	}
+
+	resp = do(http.MethodGet, fmt.Sprintf("http://%s/metrics", s.httpLn.Addr()))
+	metrics, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, line := range []string{
+		`thermomatic_logins_rejected_total{reason="banned"} 1`,
+		`thermomatic_logins_rejected_total{reason="admin_disconnect"} 1`,
+	} {
+		if !strings.Contains(string(metrics), line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestHttpd_SessionHandler_KillNotDropped(t *testing.T) {
+	now := common.FrozenInTime()
+	core := newCore(func() time.Time { return now }, uint(1337), 2)
+	d := newHttpd(core, 8080)
+	// the WELCOME is never read, so the commands channel stays full
+	channel := make(chan common.Command, 1)
+	if err := core.register(490154203237518, channel, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	welcome := <-channel
+	channel <- common.Command{ID: common.DOWNLINK}
+
+	del := func(query string) int {
+		resp := httptest.NewRecorder()
+		d.handler().ServeHTTP(resp, httptest.NewRequest(http.MethodDelete, "/devices/490154203237518/session"+query, nil))
+		return resp.Code
+	}
+	if code := del(""); code != http.StatusOK {
+		t.Errorf("expected 200 got %d", code)
+	}
+	select {
+	case <-welcome.Kill:
+	default:
+		t.Error("expected the session to be killed")
+	}
+	// the session is already finishing, the device is not banned
+	if code := del("?ban=1m"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 got %d", code)
+	}
+	if _, banned := core.bans.bannedUntil(490154203237518, now); banned {
+		t.Error("expected no ban when no session was told to finish")
+	}
+	if n := atomic.LoadUint64(&core.stats.adminDisconnects); n != 1 {
+		t.Errorf("expected 1 admin disconnect got %d", n)
+	}
+}
@@ -17,12 +17,136 @@ device.  3 channels are used to communicate the client data to the server core
 		to send a newly created(and) client so the receiver can store
 		its reference in the connected clients map
 
+Connected devices are kept in a registry split in shards by IMEI. Every shard
+has its own goroutine and commands channel: LOGIN commands go through the core
+commands channel to the shard owning the IMEI, which answers WELCOME with its
+own channel, where the device sends its READING and LOGOUT commands from then
+on. The HTTP handlers read the registry without locking.
+
+Devices speak protocol v1, 40 bytes readings, or v2, length prefixed readings
+with sequence numbers, device timestamps and optional fields, see the device
+package. The version is negotiated by the byte following the IMEI. Sequence
+gaps of v2 devices are logged, sinks and storage keep the v1 fields only.
+
+The device listener optionally speaks TLS, its certificate files are checked
+for changes on new handshakes and reloaded without a restart. With mutual TLS
+the client certificate must be issued to the IMEI of the login frame, its
+common name, or the login is rejected.
+
+Besides the maximum number of logged in devices, accepted connections are
+bounded per source IP, by a token bucket accept rate and by the number of
+connections which did not log in yet. IPs which exceed their connections or
+keep closing connections without logging in are banned for a while. The
+counters of every limit are reported by `/stats`.
+
+When a credentials file is configured devices must authenticate after their
+IMEI frame, answering a random challenge with an HMAC keyed with their secret.
+Unknown devices, bad responses and missing responses are logged as distinct
+lifecycle events and counted separately, in `/stats` and `/metrics`.
+
+When an inventory file is configured only the devices listed in it may log
+in. Denied devices are rejected, and disconnected when they are denied while
+logged in. Quarantined devices stay connected but their readings are not
+written to the sinks. The inventory is reloaded on SIGHUP or when the file
+changes, without dropping the connections of the devices still allowed.
+
+Readings are validated with the ranges of the protocol spec, NaN and infinite
+fields are rejected. A rules file may override the ranges, limit how much the
+temperature may change between consecutive readings, and do both per device.
+Rejected readings are counted by the rule which rejected them.
+
+Every accepted connection gets a session ID in its WELCOME command and sends it
+back on LOGOUT. When an IMEI logs in twice the login policy decides whether
+the new connection is rejected (reject-new), the old one is killed and replaced
+(replace-old), or both are kept as separate sessions (allow-both).
+
+Every accepted connection also gets a connection ID, and every record logged
+about it carries the ID, its remote address and, once known, the IMEI and the
+session. The lifecycle of a connection is logged as records with fixed event
+names: accept, login, welcome, kill, timeout, logout and close. Rejections are
+logged as reject, login-denied, login-rejected and auth-unknown-device,
+auth-bad-response or auth-no-response.
+
+Every valid reading is fanned out by the core to the configured output sinks
+(stdout, rotating file or Unix socket). Each sink owns a bounded queue with a
+block or drop policy, so a slow consumer can not stall the core, the records
+dropped are counted by sink in `/metrics`. When a data directory is configured
+readings are also persisted by the storage package.
+
+When an alerts file is configured the valid readings also feed the alert
+rules: temperature above or below a threshold, battery below a threshold or
+position outside a geofence for a while, and devices offline for too long.
+Each alert is POSTed as JSON to the webhooks once when it fires and once when
+it resolves, with the same ID, and failed deliveries are retried with
+exponential backoff.
+
+When a geofences file is configured the position of every valid reading is
+checked against the circle and polygon geofences of its device, listed by IMEI
+or by inventory site. A device crossing one raises a geofence-enter or
+geofence-exit event, the first reading of a device only sets its state.
+
+Operators watch the valid readings live through Server-Sent Events, filtered by
+IMEI, inventory site or bounding box. The readings reach the subscribers
+through a queue like any sink, each subscriber has a bounded buffer and is
+disconnected as a slow consumer when it falls behind. Dashboards use a
+WebSocket instead, where they subscribe to devices on the fly with JSON
+messages and are also told when devices go online and offline.
+
+When a session finishes it is kept in the session history of its device, a
+bounded ring optionally persisted to a file, with its connect, login and
+disconnect times, the reason of the disconnection (timeout, eof, kill,
+invalid-payload, error, or shutdown, replaced and denied when the server killed
+it), and the readings and bytes it received.
+
+On SIGINT or SIGTERM the server stops accepting connections, sends KILL to
+every connected device, flushes the sinks, shuts the HTTP server down and logs
+a summary of the session.
+
 These HTTP are the implemented json endpoints
 
   - `GET /stats`: returns a JSON document which contains runtime statistical
      information about the server (i.e. number of goroutines, bytes read per second, etc.).
+  - `GET /metrics`: returns the counters of connections, logins and rejected
+     logins by reason, readings, sequence gaps, downlinks and acks, and bytes
+     read, and the histograms of the interval between readings and the
+     command processing latency, in the Prometheus text exposition format.
   - `GET /readings/:imei:` if the device is online returns a JSON representation of
      the last reading the device has sent (timestamped)
   - `GET /status/:imei:` reports whether the device is online or not.
+  - `GET /devices?sort=&offset=&limit=&site=&battery_lt=&stale_gt=` lists the
+     online devices with their connect time, remote address, last reading,
+     last-seen age and reading rate, e.g. `?battery_lt=20&sort=-lastSeen`.
+  - `GET /readings/:imei:/history?from=&to=&limit=&cursor=&step=&format=` returns
+     the persisted readings of the device, online or not, in JSON or CSV. Pages
+     are chained with the returned cursor, `step=1m` downsamples the readings to
+     min/max/avg per field.
+  - `POST /devices/:imei:/commands` queues a downlink command to an online device,
+     e.g. `{"type":"set-reading-interval","value":500}`, `{"type":"reboot"}` or
+     `{"type":"time-sync"}`. The device acknowledges it asynchronously, see the
+     downlink frame format in the device package.
+  - `GET /inventory` lists the inventory, `GET|PUT|DELETE /inventory/:imei:`
+     reads, adds or replaces, e.g. `{"name":"freezer 3","state":"quarantined"}`,
+     and removes the entry of a device. Changes are written to the file.
+  - `GET /alerts` lists the alerts firing.
+  - `GET /geofences` lists the geofences, `GET|PUT|DELETE /geofences/:id:`
+     reads, adds or replaces, e.g. `{"sites":["merida"],"circle":{"center":
+     {"lat":21.03,"lon":-89.59},"radius":500}}`, and removes a geofence.
+     Changes are written to the file.
+  - `GET /stream/readings?imei=&site=&bbox=minLat,minLon,maxLat,maxLon` streams
+     the valid readings as they arrive as Server-Sent Events, `imei` and `site`
+     are comma separated lists.
+  - `GET /ws` upgrades to a WebSocket. Clients send
+     `{"type":"subscribe","imeis":[490154203237518]}`, or `"all":true`, and
+     `unsubscribe` to choose their devices, and receive `reading`, `online`
+     and `offline` messages. Idle clients are pinged and must answer.
+  - `GET /devices/:imei:/sessions` lists the sessions of a device, newest
+     first, the ones logged in included.
+  - `GET /devices/:imei:/uptime?window=24h` returns the percentage of the window
+     the device was logged in, according to its session history.
+  - `DELETE /devices/:imei:/session?ban=10m` disconnects an online device, its
+     sessions finish with the `admin` reason. With `ban` the device may not log
+     in again, whatever its IP, for that long.
+  - `GET /devices/:imei:/geofence-state` returns the last position of a device
+     and whether it is inside each of its geofences, since when.
 */
 package server
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+var (
+	errDeviceOffline     = errors.New("device is not logged in")
+	errDownlinkQueueFull = errors.New("device downlink queue is full")
+)
+
+// sendDownlink queues d to the newest session of the device logged in with
+// imei, it returns the id assigned to the command. It does NOT block, the
+// command is rejected when the session channel is full.
+func (c *core) sendDownlink(imei uint64, d device.Downlink) (uint32, error) {
+	dev, exists := c.deviceByIMEI(imei)
+	if !exists {
+		return 0, errDeviceOffline
+	}
+	sessions := dev.loadSessions()
+	if len(sessions) == 0 {
+		return 0, errDeviceOffline
+	}
+	session := sessions[len(sessions)-1]
+
+	d.ID = atomic.AddUint32(&c.lastDownlinkID, 1)
+	frame := d.Encode()
+	select {
+	case session.callbackChannel <- common.Command{ID: common.DOWNLINK, Sender: imei, Body: frame[:]}:
+	default:
+		return 0, errDownlinkQueueFull
+	}
+	atomic.AddUint64(&c.stats.downlinks, 1)
+	session.log.Event("command-sent", logging.F("command", d.ID), logging.F("type", d.Type), logging.F("arg", d.Arg))
+	return d.ID, nil
+}
+
+// handleAck logs the acknowledgment of a downlink command sent by a device.
+func (c *core) handleAck(imei uint64, session uint64, frame []byte) error {
+	var ack device.Ack
+	if len(frame) < device.AckFrameSize || !ack.Decode(frame) {
+		return fmt.Errorf("decoding ack from device with IMEI %d", imei)
+	}
+	atomic.AddUint64(&c.stats.acks, 1)
+	c.logger.Event("command-acked", logging.F("imei", imei), logging.F("session", session),
+		logging.F("command", ack.ID), logging.F("status", ack.Status))
+	return nil
+}
+
+// downlinkRequest is the body of POST /devices/:imei/commands
+type downlinkRequest struct {
+	// Type is set-reading-interval, reboot or time-sync
+	Type string `json:"type"`
+	// Value is the reading interval in milliseconds for set-reading-interval,
+	// and the epoch in nanoseconds for time-sync, the server clock if not set.
+	Value int64 `json:"value"`
+}
+
+type downlinkResponse struct {
+	ID   uint32 `json:"id"`
+	Type string `json:"type"`
+	Arg  int64  `json:"arg"`
+}
+
+// devicesHandler routes the /devices/:imei/... endpoints
+func (d *httpd) devicesHandler(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/devices/")
+	if strings.HasSuffix(path, "/commands") {
+		d.commandsHandler(w, req, strings.TrimSuffix(path, "/commands"))
+		return
+	}
+	if strings.HasSuffix(path, "/geofence-state") {
+		d.geofenceStateHandler(w, req, strings.TrimSuffix(path, "/geofence-state"))
+		return
+	}
+	if strings.HasSuffix(path, "/sessions") {
+		d.sessionsHandler(w, req, strings.TrimSuffix(path, "/sessions"))
+		return
+	}
+	if strings.HasSuffix(path, "/session") {
+		d.sessionHandler(w, req, strings.TrimSuffix(path, "/session"))
+		return
+	}
+	if strings.HasSuffix(path, "/uptime") {
+		d.uptimeHandler(w, req, strings.TrimSuffix(path, "/uptime"))
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// commandsHandler serves POST /devices/:imei/commands, which queues a downlink
+// command to an online device. The device acknowledges it asynchronously.
+func (d *httpd) commandsHandler(w http.ResponseWriter, req *http.Request, imeiStr string) {
+	if req.Method != http.MethodPost {
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	imei, err := parseIMEI(imeiStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var body downlinkRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid command, %v", err), http.StatusBadRequest)
+		return
+	}
+	cmdType, err := device.ParseDownlinkType(body.Type)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	downlink := device.Downlink{Type: cmdType, Arg: body.Value}
+	switch cmdType {
+	case device.SetReadingInterval:
+		if body.Value <= 0 {
+			http.Error(w, "value should be the reading interval in milliseconds", http.StatusBadRequest)
+			return
+		}
+	case device.TimeSync:
+		if body.Value == 0 {
+			downlink.Arg = d.core.now().UnixNano()
+		}
+	}
+
+	id, err := d.core.sendDownlink(imei, downlink)
+	switch err {
+	case nil:
+	case errDeviceOffline:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errDownlinkQueueFull:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		d.log.Warn("sending command", logging.F("imei", imei), logging.F("err", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(downlinkResponse{ID: id, Type: cmdType.String(), Arg: downlink.Arg})
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+func postCommand(t *testing.T, d *httpd, imei uint64, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := http.NewRequest("POST", fmt.Sprintf("/devices/%d/commands", imei), strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	d.handler().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestHttpd_CommandsHandler(t *testing.T) {
+	frozen := common.FrozenInTime()
+	core := newCore(func() time.Time { return frozen }, uint(1337), 2)
+	d := newHttpd(core, 80)
+	imei := uint64(448324242329542)
+	callbackChannel := make(chan common.Command, 2)
+	if err := core.register(imei, callbackChannel, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-callbackChannel //ignore welcome cmd
+
+	rr := postCommand(t, d, imei, `{"type":"time-sync"}`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d got %d %s", http.StatusAccepted, rr.Code, rr.Body.String())
+	}
+	jsonMap, err := parseJSONAsMap(rr.Body.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSONMapHasField(t, jsonMap, "id")
+
+	cmd := <-callbackChannel
+	if cmd.ID != common.DOWNLINK {
+		t.Fatalf("expected a DOWNLINK cmd got %v", cmd.ID)
+	}
+	var downlink device.Downlink
+	if !downlink.Decode(cmd.Body) {
+		t.Fatalf("expected a downlink frame got %v", cmd.Body)
+	}
+	if downlink.Type != device.TimeSync || downlink.Arg != frozen.UnixNano() {
+		t.Errorf("expected a time sync to the server clock got %+v", downlink)
+	}
+	if uint64(downlink.ID) != uint64(jsonMap["id"].(float64)) {
+		t.Errorf("expected command id %v got %d", jsonMap["id"], downlink.ID)
+	}
+
+	// the channel of the session is full, commands are rejected
+	postCommand(t, d, imei, `{"type":"reboot"}`)
+	postCommand(t, d, imei, `{"type":"reboot"}`)
+	if rr := postCommand(t, d, imei, `{"type":"reboot"}`); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+}
+
+func TestHttpd_CommandsHandler_Errors(t *testing.T) {
+	core := newCore(common.FrozenInTime, uint(1337), 2)
+	d := newHttpd(core, 80)
+	imei := uint64(448324242329542)
+	if err := core.register(imei, make(chan common.Command, 1), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		imei   uint64
+		body   string
+		status int
+	}{
+		{imei, `{"type":"self-destruct"}`, http.StatusBadRequest},
+		{imei, `{"type":"set-reading-interval"}`, http.StatusBadRequest},
+		{imei, `not json`, http.StatusBadRequest},
+		{123, `{"type":"reboot"}`, http.StatusBadRequest},
+		{490154203237518, `{"type":"reboot"}`, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if rr := postCommand(t, d, test.imei, test.body); rr.Code != test.status {
+			t.Errorf("%d %s: expected status %d got %d", test.imei, test.body, test.status, rr.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/devices/%d/commands", imei), nil)
+	rr := httptest.NewRecorder()
+	d.handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d got %d", http.StatusMethodNotAllowed, rr.Code)
+	}
+}
+
+func TestCore_HandleAck(t *testing.T) {
+	core := newCore(common.FrozenInTime, uint(1337), 2)
+	imei := uint64(448324242329542)
+
+	ack := device.Ack{ID: 3, Status: device.AckOK}
+	frame := ack.Encode()
+	if err := core.handleAck(imei, 1, frame[:]); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if acks := atomic.LoadUint64(&core.stats.acks); acks != 1 {
+		t.Errorf("expected 1 ack got %d", acks)
+	}
+
+	payload := device.CreateRandReadingBytes()
+	if err := core.handleAck(imei, 1, payload[:]); err == nil {
+		t.Error("expected an error handling a reading as an ack")
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+const (
+	// defaultFleetLimit is the page size of GET /devices when the request has
+	// none.
+	defaultFleetLimit = 100
+	maxFleetLimit     = 1000
+)
+
+// fleetDevice describes a logged in device in GET /devices.
+type fleetDevice struct {
+	IMEI uint64 `json:"imei"`
+	Site string `json:"site,omitempty"`
+	// Sessions logged in, more than one only with the allow-both policy
+	Sessions int `json:"sessions"`
+	// Remote address of the newest session
+	Remote string `json:"remote,omitempty"`
+	// ConnectedAt is when the oldest session connected
+	ConnectedAt time.Time           `json:"connectedAt"`
+	LastReading *timeStampedReading `json:"lastReading,omitempty"`
+	// LastSeenAt is when the last valid reading was received, or when the
+	// device logged in if it did not send any yet
+	LastSeenAt  time.Time `json:"lastSeenAt"`
+	LastSeenAge float64   `json:"lastSeenAgeSeconds"`
+	// ReadingRate is the number of readings per minute since the device
+	// logged in
+	ReadingRate float64 `json:"readingRate"`
+}
+
+// fleetResponse is the body of GET /devices.
+type fleetResponse struct {
+	// Total is the number of devices matching the filters, in every page
+	Total   int           `json:"total"`
+	Offset  int           `json:"offset"`
+	Limit   int           `json:"limit"`
+	Devices []fleetDevice `json:"devices"`
+}
+
+// fleetQuery are the parameters of GET /devices.
+type fleetQuery struct {
+	sort       string
+	descending bool
+	offset     int
+	limit      int
+	site       string
+	// batteryLT selects the devices whose last reading battery level is
+	// below it, when set
+	batteryLT *float64
+	// staleGT selects the devices not seen for longer than it, when set
+	staleGT time.Duration
+}
+
+// fleetSorts are the orders of GET /devices, by the sort parameter.
+var fleetSorts = map[string]func(a, b *fleetDevice) bool{
+	"imei":        func(a, b *fleetDevice) bool { return a.IMEI < b.IMEI },
+	"connectedAt": func(a, b *fleetDevice) bool { return a.ConnectedAt.Before(b.ConnectedAt) },
+	"lastSeen":    func(a, b *fleetDevice) bool { return a.LastSeenAt.Before(b.LastSeenAt) },
+	"rate":        func(a, b *fleetDevice) bool { return a.ReadingRate < b.ReadingRate },
+	"battery": func(a, b *fleetDevice) bool {
+		return a.LastReading.Reading.BatteryLevel < b.LastReading.Reading.BatteryLevel
+	},
+}
+
+// fleetSortsMissing tell the devices without the value of a sort, which are
+// last in both orders.
+var fleetSortsMissing = map[string]func(d *fleetDevice) bool{
+	"battery": func(d *fleetDevice) bool { return d.LastReading == nil },
+}
+
+func parseFleetQuery(req *http.Request) (fleetQuery, error) {
+	params := req.URL.Query()
+	query := fleetQuery{sort: "imei", limit: defaultFleetLimit, site: params.Get("site")}
+	if v := params.Get("sort"); v != "" {
+		query.sort = strings.TrimPrefix(v, "-")
+		query.descending = strings.HasPrefix(v, "-")
+		if _, ok := fleetSorts[query.sort]; !ok {
+			return query, fmt.Errorf("invalid sort %q, it should be imei, connectedAt, lastSeen, rate or battery, prefixed by - for descending", v)
+		}
+	}
+	var err error
+	if v := params.Get("limit"); v != "" {
+		if query.limit, err = strconv.Atoi(v); err != nil || query.limit < 1 || query.limit > maxFleetLimit {
+			return query, fmt.Errorf("limit should be between 1 and %d", maxFleetLimit)
+		}
+	}
+	if v := params.Get("offset"); v != "" {
+		if query.offset, err = strconv.Atoi(v); err != nil || query.offset < 0 {
+			return query, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+	if v := params.Get("battery_lt"); v != "" {
+		battery, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return query, fmt.Errorf("invalid battery_lt %q", v)
+		}
+		query.batteryLT = &battery
+	}
+	if v := params.Get("stale_gt"); v != "" {
+		if query.staleGT, err = time.ParseDuration(v); err != nil || query.staleGT < 0 {
+			return query, fmt.Errorf("invalid stale_gt %q", v)
+		}
+	}
+	return query, nil
+}
+
+func (q *fleetQuery) matches(dev *fleetDevice) bool {
+	if q.site != "" && dev.Site != q.site {
+		return false
+	}
+	if q.batteryLT != nil && (dev.LastReading == nil || dev.LastReading.Reading.BatteryLevel >= *q.batteryLT) {
+		return false
+	}
+	if q.staleGT > 0 && dev.LastSeenAge <= q.staleGT.Seconds() {
+		return false
+	}
+	return true
+}
+
+// fleet returns the logged in devices as of now. The registry is read from
+// its snapshots, so no lock is held while the list is filtered and encoded.
+func (c *core) fleet(now time.Time) []fleetDevice {
+	devices := make([]fleetDevice, 0, c.registry.len())
+	c.registry.each(func(imei uint64, dev *connectedDevice) bool {
+		sessions := dev.loadSessions()
+		if len(sessions) == 0 {
+			return true
+		}
+		oldest, newest := sessions[0].info, sessions[len(sessions)-1].info
+		fd := fleetDevice{
+			IMEI:        imei,
+			Site:        c.deviceSite(imei),
+			Sessions:    len(sessions),
+			Remote:      newest.conn.Remote,
+			ConnectedAt: oldest.conn.ConnectedAt.UTC(),
+			LastSeenAt:  newest.loginAt.UTC(),
+		}
+		var readings uint64
+		for _, session := range sessions {
+			readings += atomic.LoadUint64(&session.info.readings)
+		}
+		if elapsed := now.Sub(oldest.loginAt); elapsed > 0 {
+			fd.ReadingRate = float64(readings) / elapsed.Minutes()
+		}
+		if epoch, reading, ok := dev.loadReading(); ok {
+			fd.LastReading = &timeStampedReading{TimestampEpoch: epoch, Reading: &reading}
+			fd.LastSeenAt = time.Unix(0, epoch).UTC()
+		}
+		fd.LastSeenAge = now.Sub(fd.LastSeenAt).Seconds()
+		devices = append(devices, fd)
+		return true
+	})
+	return devices
+}
+
+// fleetHandler serves GET /devices?sort=&offset=&limit=&site=&battery_lt=&stale_gt=,
+// the logged in devices:
+//
+//   - sort: imei (default), connectedAt, lastSeen, rate or battery, prefixed
+//     by - for descending, e.g. sort=-lastSeen
+//   - offset, limit: the page, 100 devices by default
+//   - site: the devices of an inventory site
+//   - battery_lt: the devices whose last reading battery level is below it
+//   - stale_gt: the devices not seen for longer than it, e.g. stale_gt=1s
+func (d *httpd) fleetHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query, err := parseFleetQuery(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	all := d.core.fleet(d.core.now())
+	devices := all[:0]
+	for i := range all {
+		if query.matches(&all[i]) {
+			devices = append(devices, all[i])
+		}
+	}
+	less, missing := fleetSorts[query.sort], fleetSortsMissing[query.sort]
+	sort.Slice(devices, func(i, j int) bool {
+		a, b := &devices[i], &devices[j]
+		if missing != nil {
+			if missingA, missingB := missing(a), missing(b); missingA || missingB {
+				if missingA != missingB {
+					return missingB
+				}
+				return a.IMEI < b.IMEI
+			}
+		}
+		if query.descending {
+			a, b = b, a
+		}
+		if less(a, b) != less(b, a) {
+			return less(a, b)
+		}
+		// ties are ordered by IMEI, so pages are stable
+		return devices[i].IMEI < devices[j].IMEI
+	})
+	resp := fleetResponse{Total: len(devices), Offset: query.offset, Limit: query.limit, Devices: []fleetDevice{}}
+	if query.offset < len(devices) {
+		end := query.offset + query.limit
+		if end > len(devices) {
+			end = len(devices)
+		}
+		resp.Devices = devices[query.offset:end]
+	}
+	d.writeJSONResponse(w, resp)
+}
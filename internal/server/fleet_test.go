@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+func TestHttpd_FleetHandler(t *testing.T) {
+	now := common.FrozenInTime()
+	core := newCore(func() time.Time { return now }, uint(1337), 2)
+	d := newHttpd(core, 8080)
+
+	// each device logs in a minute after the previous one, and sends readings
+	// with the given battery level every second
+	devices := []struct {
+		imei     uint64
+		readings int
+		battery  float64
+	}{
+		{490154203237518, 3, 80},
+		{448324242329542, 0, 0},
+		{356938035643809, 6, 15},
+	}
+	for _, dev := range devices {
+		channel := make(chan common.Command, 1)
+		conn := &common.ConnInfo{Remote: "10.0.0.1:5000", ConnectedAt: now.Add(-time.Second)}
+		if err := core.register(dev.imei, channel, nil, conn); err != nil {
+			t.Fatal(err)
+		}
+		session := (<-channel).Session
+		for i := 0; i < dev.readings; i++ {
+			now = now.Add(time.Second)
+			payload := device.NewPayload(20, 10, 21.03, -89.59, dev.battery)
+			core.process(common.Command{ID: common.READING, Sender: dev.imei, Session: session, Body: payload[:]})
+		}
+		now = now.Add(time.Minute)
+	}
+
+	list := func(query string, code int) fleetResponse {
+		t.Helper()
+		resp := httptest.NewRecorder()
+		d.handler().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/devices"+query, nil))
+		var fleet fleetResponse
+		if resp.Code != code {
+			t.Fatalf("%s, expected %d got %d %s", query, code, resp.Code, resp.Body)
+		}
+		if code == http.StatusOK {
+			if err := json.Unmarshal(resp.Body.Bytes(), &fleet); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return fleet
+	}
+	imeis := func(fleet fleetResponse) []uint64 {
+		list := []uint64{}
+		for _, dev := range fleet.Devices {
+			list = append(list, dev.IMEI)
+		}
+		return list
+	}
+	expect := func(query string, expected ...uint64) fleetResponse {
+		t.Helper()
+		fleet := list(query, http.StatusOK)
+		got := imeis(fleet)
+		if len(got) != len(expected) {
+			t.Errorf("%s, expected %v got %v", query, expected, got)
+			return fleet
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Errorf("%s, expected %v got %v", query, expected, got)
+				break
+			}
+		}
+		return fleet
+	}
+
+	fleet := expect("", 356938035643809, 448324242329542, 490154203237518)
+	if fleet.Total != 3 || fleet.Limit != defaultFleetLimit {
+		t.Errorf("unexpected page %+v", fleet)
+	}
+	last := fleet.Devices[0]
+	if last.Remote != "10.0.0.1:5000" || last.Sessions != 1 || last.LastReading == nil || last.LastReading.Reading.BatteryLevel != 15 ||
+		last.LastSeenAge != 60 || last.ReadingRate != 6/1.1 {
+		t.Errorf("unexpected device %+v", last)
+	}
+	if silent := fleet.Devices[1]; silent.LastReading != nil || silent.LastSeenAge != 60+6+60 || silent.ReadingRate != 0 {
+		t.Errorf("expected the device without readings seen when it logged in, got %+v", silent)
+	}
+
+	expect("?sort=-imei&limit=2", 490154203237518, 448324242329542)
+	fleet = expect("?sort=-imei&limit=2&offset=2", 356938035643809)
+	if fleet.Total != 3 || fleet.Offset != 2 {
+		t.Errorf("unexpected page %+v", fleet)
+	}
+	expect("?offset=5")
+	expect("?sort=battery", 356938035643809, 490154203237518, 448324242329542)
+	expect("?sort=-battery", 490154203237518, 356938035643809, 448324242329542)
+	expect("?sort=-connectedAt", 356938035643809, 448324242329542, 490154203237518)
+	expect("?sort=rate", 448324242329542, 490154203237518, 356938035643809)
+	expect("?battery_lt=20", 356938035643809)
+	expect("?stale_gt=2m", 448324242329542, 490154203237518)
+	expect("?stale_gt=2m&battery_lt=90", 490154203237518)
+	expect("?site=merida")
+
+	for _, invalid := range []string{"?sort=temperature", "?limit=0", "?limit=1001", "?offset=-1", "?battery_lt=low", "?stale_gt=1"} {
+		list(invalid, http.StatusBadRequest)
+	}
+	resp := httptest.NewRecorder()
+	d.handler().ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/devices", nil))
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 got %d", resp.Code)
+	}
+}
@@ -0,0 +1,557 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// earthRadius is the mean radius of the earth in meters.
+const earthRadius = 6371008.8
+
+// geoPoint is a position in decimal degrees.
+type geoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+func (p geoPoint) validate() error {
+	if !(p.Lat >= -90 && p.Lat <= 90) || !(p.Lon >= -180 && p.Lon <= 180) {
+		return fmt.Errorf("invalid position %v,%v", p.Lat, p.Lon)
+	}
+	return nil
+}
+
+// distance returns the great-circle distance in meters between p and q.
+func (p geoPoint) distance(q geoPoint) float64 {
+	lat1, lat2 := p.Lat*math.Pi/180, q.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (q.Lon - p.Lon) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// geoCircle is the area within Radius meters of Center.
+type geoCircle struct {
+	Center geoPoint `json:"center"`
+	Radius float64  `json:"radius"`
+}
+
+// geoShape is an area of the earth surface, either a circle or a polygon:
+//
+//	{"circle": {"center": {"lat": 21.03, "lon": -89.59}, "radius": 500}}
+//	{"polygon": [{"lat": 21.03, "lon": -89.59}, {"lat": 21.04, "lon": -89.59}, {"lat": 21.04, "lon": -89.58}]}
+//
+// Polygons are closed implicitly and must not cross the antimeridian.
+type geoShape struct {
+	Circle  *geoCircle `json:"circle,omitempty"`
+	Polygon []geoPoint `json:"polygon,omitempty"`
+}
+
+func (s *geoShape) validate() error {
+	switch {
+	case s.Circle != nil && s.Polygon != nil:
+		return fmt.Errorf("a geofence is either a circle or a polygon")
+	case s.Circle != nil:
+		if !(s.Circle.Radius > 0) {
+			return fmt.Errorf("invalid circle radius %v", s.Circle.Radius)
+		}
+		return s.Circle.Center.validate()
+	case s.Polygon != nil:
+		if len(s.Polygon) < 3 {
+			return fmt.Errorf("a polygon needs at least 3 points, it has %d", len(s.Polygon))
+		}
+		for _, p := range s.Polygon {
+			if err := p.validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("a geofence needs a circle or a polygon")
+}
+
+// contains reports whether p is inside the shape.
+func (s *geoShape) contains(p geoPoint) bool {
+	if s.Circle != nil {
+		return s.Circle.Center.distance(p) <= s.Circle.Radius
+	}
+	// ray casting, counts the edges crossed by a ray going east from p
+	inside := false
+	for i, j := 0, len(s.Polygon)-1; i < len(s.Polygon); j, i = i, i+1 {
+		a, b := s.Polygon[i], s.Polygon[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Lon < (b.Lon-a.Lon)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// geoBox is the area between two corners, it must not cross the antimeridian.
+type geoBox struct {
+	Min geoPoint
+	Max geoPoint
+}
+
+// parseGeoBox parses minLat,minLon,maxLat,maxLon.
+func parseGeoBox(s string) (*geoBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid bounding box %q, it should be minLat,minLon,maxLat,maxLon", s)
+	}
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bounding box %q, %v", s, err)
+		}
+		v[i] = f
+	}
+	b := &geoBox{Min: geoPoint{Lat: v[0], Lon: v[1]}, Max: geoPoint{Lat: v[2], Lon: v[3]}}
+	if err := b.Min.validate(); err != nil {
+		return nil, err
+	}
+	if err := b.Max.validate(); err != nil {
+		return nil, err
+	}
+	if b.Min.Lat > b.Max.Lat || b.Min.Lon > b.Max.Lon {
+		return nil, fmt.Errorf("invalid bounding box %q, its minimum is above its maximum", s)
+	}
+	return b, nil
+}
+
+func (b *geoBox) contains(p geoPoint) bool {
+	return p.Lat >= b.Min.Lat && p.Lat <= b.Max.Lat && p.Lon >= b.Min.Lon && p.Lon <= b.Max.Lon
+}
+
+// geofence is an area watched on the positions of the devices in IMEIs and of
+// the devices of the inventory sites in Sites, or of every device when both
+// are empty.
+type geofence struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	geoShape
+	IMEIs []uint64 `json:"imeis,omitempty"`
+	Sites []string `json:"sites,omitempty"`
+}
+
+func (f *geofence) validate() error {
+	if f.ID == "" {
+		return fmt.Errorf("geofence without id")
+	}
+	for _, r := range f.ID {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("invalid geofence id %q, it could only have letters, digits, '-', '_' and '.'", f.ID)
+		}
+	}
+	if err := f.geoShape.validate(); err != nil {
+		return fmt.Errorf("geofence %s, %v", f.ID, err)
+	}
+	for _, imei := range f.IMEIs {
+		if err := validateIMEI(imei); err != nil {
+			return fmt.Errorf("geofence %s, %v", f.ID, err)
+		}
+	}
+	return nil
+}
+
+// appliesTo reports whether the geofence watches imei, whose inventory site
+// is site.
+func (f *geofence) appliesTo(imei uint64, site string) bool {
+	if len(f.IMEIs) == 0 && len(f.Sites) == 0 {
+		return true
+	}
+	for _, i := range f.IMEIs {
+		if i == imei {
+			return true
+		}
+	}
+	if site == "" {
+		return false
+	}
+	for _, s := range f.Sites {
+		if s == site {
+			return true
+		}
+	}
+	return false
+}
+
+type geofenceKey struct {
+	id   string
+	imei uint64
+}
+
+// geofenceState is whether a device is inside a geofence, since the reading
+// where it entered or exited, or the first one seen, in nanoseconds.
+type geofenceState struct {
+	inside bool
+	since  int64
+}
+
+// devicePosition is the last position of a device.
+type devicePosition struct {
+	geoPoint
+	epoch int64
+}
+
+// geofenceStats are counters of the transitions, updated atomically.
+type geofenceStats struct {
+	enters uint64
+	exits  uint64
+}
+
+// geofenceCounts are the geofence transitions, as reported by /stats.
+type geofenceCounts struct {
+	Enters uint64 `json:"enters"`
+	Exits  uint64 `json:"exits"`
+}
+
+func (s *geofenceStats) counts() *geofenceCounts {
+	return &geofenceCounts{Enters: atomic.LoadUint64(&s.enters), Exits: atomic.LoadUint64(&s.exits)}
+}
+
+// geofencer tracks whether each device is inside the geofences which apply
+// to it, and raises an enter or exit event when a reading crosses one. The
+// first reading of a device only sets its state, it raises no event.
+//
+// The geofences are kept in a JSON file holding an array of them:
+//
+//	[
+//	  {"id": "farm", "name": "merida farm", "sites": ["merida"],
+//	   "polygon": [{"lat": 21.03, "lon": -89.59}, {"lat": 21.04, "lon": -89.59}, {"lat": 21.04, "lon": -89.58}]},
+//	  {"id": "freezer-3", "imeis": [490154203237518],
+//	   "circle": {"center": {"lat": 21.03, "lon": -89.59}, "radius": 50}}
+//	]
+//
+// A missing file is an empty one, changes made through the HTTP endpoints are
+// written to it. It is a Sink, so readings reach it through a queue.
+type geofencer struct {
+	path string
+	// site returns the inventory site of a device, empty when it has none
+	site func(imei uint64) string
+
+	mux       sync.Mutex
+	fences    map[string]geofence
+	states    map[geofenceKey]*geofenceState
+	positions map[uint64]devicePosition
+	stats     geofenceStats
+}
+
+// openGeofences loads the geofences file at path.
+func openGeofences(path string, site func(imei uint64) string) (*geofencer, error) {
+	g := &geofencer{
+		path:      path,
+		site:      site,
+		fences:    make(map[string]geofence),
+		states:    make(map[geofenceKey]*geofenceState),
+		positions: make(map[uint64]devicePosition),
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []geofence
+	if err := json.Unmarshal(content, &list); err != nil {
+		return nil, fmt.Errorf("parsing geofences %s, %v", path, err)
+	}
+	for _, fence := range list {
+		if err := fence.validate(); err != nil {
+			return nil, fmt.Errorf("geofences %s, %v", path, err)
+		}
+		if _, exists := g.fences[fence.ID]; exists {
+			return nil, fmt.Errorf("geofences %s, duplicated id %s", path, fence.ID)
+		}
+		g.fences[fence.ID] = fence
+	}
+	return g, nil
+}
+
+// Write updates the state of rec.IMEI in the geofences which apply to it.
+func (g *geofencer) Write(rec Record) error {
+	p := geoPoint{Lat: rec.Reading.Latitude, Lon: rec.Reading.Longitude}
+	site := g.site(rec.IMEI)
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.positions[rec.IMEI] = devicePosition{geoPoint: p, epoch: rec.Epoch}
+	for id, fence := range g.fences {
+		key := geofenceKey{id, rec.IMEI}
+		if !fence.appliesTo(rec.IMEI, site) {
+			delete(g.states, key)
+			continue
+		}
+		inside := fence.contains(p)
+		state := g.states[key]
+		if state == nil {
+			g.states[key] = &geofenceState{inside: inside, since: rec.Epoch}
+			continue
+		}
+		if state.inside == inside {
+			continue
+		}
+		state.inside = inside
+		state.since = rec.Epoch
+		fields := []logging.Field{logging.F("geofence", id), logging.F("imei", rec.IMEI), logging.F("lat", p.Lat), logging.F("lon", p.Lon)}
+		if inside {
+			atomic.AddUint64(&g.stats.enters, 1)
+			logging.Default().Event("geofence-enter", fields...)
+		} else {
+			atomic.AddUint64(&g.stats.exits, 1)
+			logging.Default().WarnEvent("geofence-exit", fields...)
+		}
+	}
+	return nil
+}
+
+// Flush is a no-op, the states are updated as readings arrive.
+func (g *geofencer) Flush() error {
+	return nil
+}
+
+// Close is a no-op, changes are written to the file when they are made.
+func (g *geofencer) Close() error {
+	return nil
+}
+
+// list returns every geofence sorted by id.
+func (g *geofencer) list() []geofence {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return sortedGeofences(g.fences)
+}
+
+func sortedGeofences(fences map[string]geofence) []geofence {
+	list := make([]geofence, 0, len(fences))
+	for _, fence := range fences {
+		list = append(list, fence)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// lookup returns the geofence id.
+func (g *geofencer) lookup(id string) (geofence, bool) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	fence, ok := g.fences[id]
+	return fence, ok
+}
+
+// put adds or replaces the geofence fence.ID, the states of a replaced one
+// are reset with the next reading of each device.
+func (g *geofencer) put(fence geofence) error {
+	if err := fence.validate(); err != nil {
+		return err
+	}
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	next := make(map[string]geofence, len(g.fences)+1)
+	for k, v := range g.fences {
+		next[k] = v
+	}
+	next[fence.ID] = fence
+	if err := g.store(next); err != nil {
+		return err
+	}
+	g.forget(fence.ID)
+	return nil
+}
+
+// remove deletes the geofence id, it returns false if there was none.
+func (g *geofencer) remove(id string) (bool, error) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if _, exists := g.fences[id]; !exists {
+		return false, nil
+	}
+	next := make(map[string]geofence, len(g.fences))
+	for k, v := range g.fences {
+		if k != id {
+			next[k] = v
+		}
+	}
+	if err := g.store(next); err != nil {
+		return false, err
+	}
+	g.forget(id)
+	return true, nil
+}
+
+// forget drops the states of the geofence id, it must be called with the
+// lock held.
+func (g *geofencer) forget(id string) {
+	for key := range g.states {
+		if key.id == id {
+			delete(g.states, key)
+		}
+	}
+}
+
+// store writes fences to the file and keeps them, it must be called with the
+// lock held.
+func (g *geofencer) store(fences map[string]geofence) error {
+	content, err := json.MarshalIndent(sortedGeofences(fences), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(g.path, append(content, '\n')); err != nil {
+		return err
+	}
+	g.fences = fences
+	return nil
+}
+
+// geofenceMembership is whether a device is inside a geofence, since when.
+type geofenceMembership struct {
+	ID     string    `json:"id"`
+	Name   string    `json:"name,omitempty"`
+	Inside bool      `json:"inside"`
+	Since  time.Time `json:"since"`
+}
+
+// geofenceDeviceState is the body of GET /devices/:imei/geofence-state.
+type geofenceDeviceState struct {
+	IMEI      uint64               `json:"imei"`
+	Position  geoPoint             `json:"position"`
+	UpdatedAt time.Time            `json:"updatedAt"`
+	Geofences []geofenceMembership `json:"geofences"`
+}
+
+// deviceState returns the last position of imei and its state in every
+// geofence, false when no reading of the device was seen.
+func (g *geofencer) deviceState(imei uint64) (geofenceDeviceState, bool) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	pos, ok := g.positions[imei]
+	if !ok {
+		return geofenceDeviceState{}, false
+	}
+	state := geofenceDeviceState{
+		IMEI:      imei,
+		Position:  pos.geoPoint,
+		UpdatedAt: time.Unix(0, pos.epoch).UTC(),
+		Geofences: []geofenceMembership{},
+	}
+	for id, fence := range g.fences {
+		s, ok := g.states[geofenceKey{id, imei}]
+		if !ok {
+			continue
+		}
+		state.Geofences = append(state.Geofences, geofenceMembership{
+			ID:     id,
+			Name:   fence.Name,
+			Inside: s.inside,
+			Since:  time.Unix(0, s.since).UTC(),
+		})
+	}
+	sort.Slice(state.Geofences, func(i, j int) bool { return state.Geofences[i].ID < state.Geofences[j].ID })
+	return state, true
+}
+
+// geofencesHandler serves the geofences endpoints:
+//
+//	GET    /geofences      lists every geofence
+//	GET    /geofences/:id  returns a geofence
+//	PUT    /geofences/:id  adds or replaces a geofence
+//	DELETE /geofences/:id  removes a geofence
+func (d *httpd) geofencesHandler(w http.ResponseWriter, req *http.Request) {
+	g := d.core.geofences
+	if g == nil {
+		http.Error(w, "no geofences configured", http.StatusNotFound)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/geofences"), "/")
+	if id == "" {
+		if req.Method != http.MethodGet {
+			d.log.Warn("method not allowed", logging.F("method", req.Method))
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		d.writeJSONResponse(w, g.list())
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		fence, ok := g.lookup(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		d.writeJSONResponse(w, fence)
+	case http.MethodPut:
+		var fence geofence
+		if err := json.NewDecoder(req.Body).Decode(&fence); err != nil {
+			http.Error(w, fmt.Sprintf("invalid geofence, %v", err), http.StatusBadRequest)
+			return
+		}
+		fence.ID = id
+		if err := fence.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := g.put(fence); err != nil {
+			d.log.Error("updating geofence", logging.F("geofence", id), logging.F("err", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		d.log.Info("geofence set", logging.F("geofence", id))
+		d.writeJSONResponse(w, fence)
+	case http.MethodDelete:
+		removed, err := g.remove(id)
+		if err != nil {
+			d.log.Error("removing geofence", logging.F("geofence", id), logging.F("err", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		d.log.Info("geofence removed", logging.F("geofence", id))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// geofenceStateHandler serves GET /devices/:imei/geofence-state, the last
+// position of a device and whether it is inside each of its geofences.
+func (d *httpd) geofenceStateHandler(w http.ResponseWriter, req *http.Request, imeiStr string) {
+	if req.Method != http.MethodGet {
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if d.core.geofences == nil {
+		http.Error(w, "no geofences configured", http.StatusNotFound)
+		return
+	}
+	imei, err := parseIMEI(imeiStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state, ok := d.core.geofences.deviceState(imei)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	d.writeJSONResponse(w, state)
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/common"
+)
+
+func TestGeoShape_Contains(t *testing.T) {
+	circle := geoShape{Circle: &geoCircle{Center: geoPoint{Lat: 21.03, Lon: -89.59}, Radius: 500}}
+	// a square of about 1km around the circle center
+	square := geoShape{Polygon: []geoPoint{{21.025, -89.595}, {21.035, -89.595}, {21.035, -89.585}, {21.025, -89.585}}}
+	for _, tc := range []struct {
+		p      geoPoint
+		circle bool
+		square bool
+	}{
+		{geoPoint{21.03, -89.59}, true, true},
+		{geoPoint{21.033, -89.59}, true, true},   // ~330m north
+		{geoPoint{21.034, -89.594}, false, true}, // corner of the square
+		{geoPoint{21.04, -89.59}, false, false},  // ~1.1km north
+		{geoPoint{-21.03, 89.59}, false, false},
+	} {
+		if inside := circle.contains(tc.p); inside != tc.circle {
+			t.Errorf("%v, expected inside the circle to be %v", tc.p, tc.circle)
+		}
+		if inside := square.contains(tc.p); inside != tc.square {
+			t.Errorf("%v, expected inside the square to be %v", tc.p, tc.square)
+		}
+	}
+}
+
+func TestOpenGeofences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-geofences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "geofences.json")
+	noSite := func(uint64) string { return "" }
+
+	g, err := openGeofences(path, noSite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.list()) != 0 {
+		t.Errorf("expected a missing file to have no geofence, got %+v", g.list())
+	}
+
+	for _, content := range []string{
+		`[{"id": "farm"}]`,
+		`[{"id": "", "circle": {"center": {"lat": 1, "lon": 1}, "radius": 5}}]`,
+		`[{"id": "a/b", "circle": {"center": {"lat": 1, "lon": 1}, "radius": 5}}]`,
+		`[{"id": "farm", "circle": {"center": {"lat": 91, "lon": 1}, "radius": 5}}]`,
+		`[{"id": "farm", "circle": {"center": {"lat": 1, "lon": 1}, "radius": 0}}]`,
+		`[{"id": "farm", "polygon": [{"lat": 1, "lon": 1}, {"lat": 2, "lon": 2}]}]`,
+		`[{"id": "farm", "circle": {"center": {"lat": 1, "lon": 1}, "radius": 5}},
+		  {"id": "farm", "circle": {"center": {"lat": 1, "lon": 1}, "radius": 5}}]`,
+		`{}`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openGeofences(path, noSite); err == nil {
+			t.Errorf("expected an error loading %s", content)
+		}
+	}
+}
+
+func TestGeofencer_Transitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-geofences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "geofences.json")
+	content := `[
+		{"id": "farm", "sites": ["merida"], "circle": {"center": {"lat": 21.03, "lon": -89.59}, "radius": 500}},
+		{"id": "freezer", "imeis": [448324242329542], "circle": {"center": {"lat": 21.03, "lon": -89.59}, "radius": 50}}
+	]`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sites := map[uint64]string{490154203237518: "merida"}
+	g, err := openGeofences(path, func(imei uint64) string { return sites[imei] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	farmDevice, freezerDevice := uint64(490154203237518), uint64(448324242329542)
+
+	moves := []struct {
+		imei uint64
+		lat  float64
+	}{
+		{farmDevice, 21.03},   // first reading, no event
+		{farmDevice, 21.031},  // still inside
+		{farmDevice, 21.04},   // exit
+		{farmDevice, 21.03},   // enter
+		{freezerDevice, 21.1}, // first reading
+		{freezerDevice, 21.2}, // still outside
+	}
+	for i, move := range moves {
+		rec := readingRecord(move.imei, time.Duration(i)*time.Second, 20, 50)
+		rec.Reading.Latitude = move.lat
+		g.Write(rec)
+	}
+	if counts := g.stats.counts(); *counts != (geofenceCounts{Enters: 1, Exits: 1}) {
+		t.Errorf("expected 1 enter and 1 exit got %+v", counts)
+	}
+
+	state, ok := g.deviceState(farmDevice)
+	if !ok {
+		t.Fatal("expected the state of the farm device")
+	}
+	if len(state.Geofences) != 1 || state.Geofences[0].ID != "farm" || !state.Geofences[0].Inside ||
+		!state.Geofences[0].Since.Equal(common.FrozenInTime().Add(3*time.Second)) {
+		t.Errorf("expected the device inside the farm since its last enter, got %+v", state)
+	}
+	state, _ = g.deviceState(freezerDevice)
+	if len(state.Geofences) != 1 || state.Geofences[0].ID != "freezer" || state.Geofences[0].Inside ||
+		state.Position != (geoPoint{Lat: 21.2, Lon: -89.59}) {
+		t.Errorf("expected the freezer device outside of its geofence, got %+v", state)
+	}
+	if _, ok := g.deviceState(123456789012345); ok {
+		t.Error("expected no state for a device without readings")
+	}
+
+	// the device moves to another site, the farm no longer applies
+	sites[farmDevice] = "cancun"
+	g.Write(readingRecord(farmDevice, 10*time.Second, 20, 50))
+	if state, _ := g.deviceState(farmDevice); len(state.Geofences) != 0 {
+		t.Errorf("expected no geofence for the device, got %+v", state.Geofences)
+	}
+}
+
+func TestHttpd_GeofencesHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-geofences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "geofences.json")
+	core := newCore(common.FrozenInTime, uint(1337), 2)
+	d := newHttpd(core, 8080)
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		d.handler().ServeHTTP(resp, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return resp
+	}
+	if resp := serve(http.MethodGet, "/geofences", ""); resp.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without geofences got %d", resp.Code)
+	}
+
+	core.geofences, err = openGeofences(path, core.deviceSite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats struct{ Geofences *geofenceCounts }
+	if err := json.Unmarshal(serve(http.MethodGet, "/stats", "").Body.Bytes(), &stats); err != nil || stats.Geofences == nil {
+		t.Errorf("expected the geofence transitions in the stats, got %+v %v", stats, err)
+	}
+	circle := `{"name": "farm", "circle": {"center": {"lat": 21.03, "lon": -89.59}, "radius": 500}}`
+	for _, tc := range []struct {
+		method, target, body string
+		code                 int
+	}{
+		{http.MethodPut, "/geofences/farm", circle, http.StatusOK},
+		{http.MethodPut, "/geofences/bad", `{"circle": {"center": {"lat": 21.03, "lon": -89.59}}}`, http.StatusBadRequest},
+		{http.MethodPut, "/geofences/bad", `{`, http.StatusBadRequest},
+		{http.MethodGet, "/geofences/farm", "", http.StatusOK},
+		{http.MethodGet, "/geofences/bad", "", http.StatusNotFound},
+		{http.MethodPost, "/geofences", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/devices/490154203237518/geofence-state", "", http.StatusNotFound},
+		{http.MethodGet, "/devices/49015420/geofence-state", "", http.StatusBadRequest},
+	} {
+		if resp := serve(tc.method, tc.target, tc.body); resp.Code != tc.code {
+			t.Errorf("%s %s, expected %d got %d %s", tc.method, tc.target, tc.code, resp.Code, resp.Body)
+		}
+	}
+
+	reopened, err := openGeofences(path, core.deviceSite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fences := reopened.list(); len(fences) != 1 || fences[0].ID != "farm" || fences[0].Circle.Radius != 500 {
+		t.Errorf("expected the geofence written to the file, got %+v", fences)
+	}
+
+	core.geofences.Write(readingRecord(490154203237518, 0, 20, 50))
+	resp := serve(http.MethodGet, "/devices/490154203237518/geofence-state", "")
+	var state geofenceDeviceState
+	if err := json.Unmarshal(resp.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Geofences) != 1 || state.Geofences[0].Name != "farm" || !state.Geofences[0].Inside {
+		t.Errorf("unexpected geofence state %+v", state)
+	}
+
+	if resp := serve(http.MethodDelete, "/geofences/farm", ""); resp.Code != http.StatusNoContent {
+		t.Errorf("expected 204 got %d", resp.Code)
+	}
+	if resp := serve(http.MethodDelete, "/geofences/farm", ""); resp.Code != http.StatusNotFound {
+		t.Errorf("expected 404 got %d", resp.Code)
+	}
+	if state, _ := core.geofences.deviceState(490154203237518); len(state.Geofences) != 0 {
+		t.Errorf("expected the state of the removed geofence to be dropped, got %+v", state.Geofences)
+	}
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
+	"github.com/spin-org/thermomatic/internal/storage"
+)
+
+const (
+	defaultHistoryWindow = 24 * time.Hour
+	defaultHistoryLimit  = 1000
+	maxHistoryLimit      = 10000
+)
+
+// historyQuery are the parameters of GET /readings/:imei/history
+type historyQuery struct {
+	imei   uint64
+	from   int64
+	to     int64
+	limit  int
+	step   time.Duration
+	format string
+	// cursor resumes a previous query, skipping the first skip readings
+	// received at from
+	skip int
+}
+
+type historyResponse struct {
+	IMEI       uint64               `json:"imei"`
+	From       int64                `json:"from"`
+	To         int64                `json:"to"`
+	Readings   []timeStampedReading `json:"readings,omitempty"`
+	Buckets    []readingBucket      `json:"buckets,omitempty"`
+	NextCursor string               `json:"nextCursor,omitempty"`
+}
+
+// readingBucket summarizes the readings received during a step.
+type readingBucket struct {
+	StartEpoch   int64      `json:"startEpoch"`
+	Count        int        `json:"count"`
+	Temperature  fieldStats `json:"temperature"`
+	Altitude     fieldStats `json:"altitude"`
+	Latitude     fieldStats `json:"latitude"`
+	Longitude    fieldStats `json:"longitude"`
+	BatteryLevel fieldStats `json:"batteryLevel"`
+}
+
+type fieldStats struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+	sum float64
+}
+
+func (f *fieldStats) add(v float64, first bool) {
+	if first {
+		f.Min, f.Max = v, v
+	}
+	f.Min = math.Min(f.Min, v)
+	f.Max = math.Max(f.Max, v)
+	f.sum += v
+}
+
+func (b *readingBucket) add(r *device.Reading) {
+	first := b.Count == 0
+	b.Count++
+	b.Temperature.add(r.Temperature, first)
+	b.Altitude.add(r.Altitude, first)
+	b.Latitude.add(r.Latitude, first)
+	b.Longitude.add(r.Longitude, first)
+	b.BatteryLevel.add(r.BatteryLevel, first)
+}
+
+func (b *readingBucket) close() {
+	n := float64(b.Count)
+	for _, f := range []*fieldStats{&b.Temperature, &b.Altitude, &b.Latitude, &b.Longitude, &b.BatteryLevel} {
+		f.Avg = f.sum / n
+	}
+}
+
+// historyHandler serves GET /readings/:imei/history?from=&to=&limit=&cursor=&step=&format=
+//
+//   - from, to: time range as epoch nanoseconds or RFC3339, the last 24h by default
+//   - limit: max number of readings, or buckets, in the response
+//   - cursor: nextCursor of the previous page
+//   - step: downsample to buckets of this duration, e.g. 1m, with min/max/avg per field
+//   - format: json (default) or csv, the csv next cursor is in the X-Next-Cursor header
+func (d *httpd) historyHandler(w http.ResponseWriter, req *http.Request, imeiStr string) {
+	if d.store == nil {
+		d.log.Warn("history requested but readings are not persisted")
+		http.Error(w, "readings history is not enabled, see -data-dir", http.StatusNotFound)
+		return
+	}
+	imei, err := strconv.ParseUint(imeiStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid imei", http.StatusBadRequest)
+		return
+	}
+	query, err := parseHistoryQuery(req, d.core.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.imei = imei
+
+	var resp *historyResponse
+	if query.step > 0 {
+		resp, err = d.downsampledHistory(query)
+	} else {
+		resp, err = d.rawHistory(query)
+	}
+	if err == storage.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		d.log.Error("reading history", logging.F("imei", imei), logging.F("err", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if resp.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", resp.NextCursor)
+	}
+	if query.format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write(appendHistoryCSV(nil, resp))
+		return
+	}
+	d.writeJSONResponse(w, resp)
+}
+
+func parseHistoryQuery(req *http.Request, now time.Time) (historyQuery, error) {
+	params := req.URL.Query()
+	query := historyQuery{
+		to:     now.UnixNano(),
+		limit:  defaultHistoryLimit,
+		format: "json",
+	}
+	var err error
+	if v := params.Get("to"); v != "" {
+		if query.to, err = parseHistoryTime(v); err != nil {
+			return query, fmt.Errorf("invalid to, %v", err)
+		}
+	}
+	query.from = query.to - int64(defaultHistoryWindow)
+	if v := params.Get("from"); v != "" {
+		if query.from, err = parseHistoryTime(v); err != nil {
+			return query, fmt.Errorf("invalid from, %v", err)
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if query.limit, err = strconv.Atoi(v); err != nil || query.limit < 1 || query.limit > maxHistoryLimit {
+			return query, fmt.Errorf("limit should be between 1 and %d", maxHistoryLimit)
+		}
+	}
+	if v := params.Get("step"); v != "" {
+		if query.step, err = time.ParseDuration(v); err != nil || query.step <= 0 {
+			return query, fmt.Errorf("invalid step %q", v)
+		}
+	}
+	if v := params.Get("format"); v != "" {
+		if v != "json" && v != "csv" {
+			return query, fmt.Errorf("format should be json or csv")
+		}
+		query.format = v
+	}
+	if v := params.Get("cursor"); v != "" {
+		if query.from, query.skip, err = decodeCursor(v); err != nil {
+			return query, fmt.Errorf("invalid cursor")
+		}
+	}
+	if query.from > query.to {
+		return query, fmt.Errorf("from should be before to")
+	}
+	return query, nil
+}
+
+func parseHistoryTime(v string) (int64, error) {
+	if epoch, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return epoch, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return 0, fmt.Errorf("%q should be epoch nanoseconds or RFC3339", v)
+	}
+	return t.UnixNano(), nil
+}
+
+// encodeCursor returns an opaque cursor resuming a query at epoch, skipping
+// the first skip readings received at epoch which were already returned.
+func encodeCursor(epoch int64, skip int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", epoch, skip)))
+}
+
+func decodeCursor(cursor string) (epoch int64, skip int, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, err
+	}
+	parts := strings.SplitN(string(raw), ".", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("malformed cursor")
+	}
+	if epoch, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if skip, err = strconv.Atoi(parts[1]); err != nil || skip < 0 {
+		return 0, 0, fmt.Errorf("malformed cursor")
+	}
+	return epoch, skip, nil
+}
+
+func (d *httpd) rawHistory(query historyQuery) (*historyResponse, error) {
+	resp := &historyResponse{IMEI: query.imei, From: query.from, To: query.to}
+	skip := query.skip
+	// sameEpoch counts the readings at lastEpoch returned by this page and the
+	// previous ones, the next cursor skips all of them
+	lastEpoch, sameEpoch := query.from, 0
+	err := d.store.Scan(query.imei, query.from, query.to, func(e storage.Entry) bool {
+		if skip > 0 && e.Epoch == query.from {
+			skip--
+			sameEpoch++
+			return true
+		}
+		if len(resp.Readings) == query.limit {
+			resp.NextCursor = encodeCursor(lastEpoch, sameEpoch)
+			return false
+		}
+		if e.Epoch == lastEpoch {
+			sameEpoch++
+		} else {
+			lastEpoch, sameEpoch = e.Epoch, 1
+		}
+		// payloads were validated with the rules of the device when received
+		reading := &device.Reading{}
+		reading.DecodeWithRules(e.Payload[:], nil)
+		resp.Readings = append(resp.Readings, timeStampedReading{TimestampEpoch: e.Epoch, Reading: reading})
+		return true
+	})
+	return resp, err
+}
+
+func (d *httpd) downsampledHistory(query historyQuery) (*historyResponse, error) {
+	resp := &historyResponse{IMEI: query.imei, From: query.from, To: query.to}
+	step := int64(query.step)
+	var bucket *readingBucket
+	err := d.store.Scan(query.imei, query.from, query.to, func(e storage.Entry) bool {
+		start := e.Epoch - e.Epoch%step
+		if bucket == nil || bucket.StartEpoch != start {
+			if len(resp.Buckets) == query.limit {
+				resp.NextCursor = encodeCursor(start, 0)
+				return false
+			}
+			resp.Buckets = append(resp.Buckets, readingBucket{StartEpoch: start})
+			bucket = &resp.Buckets[len(resp.Buckets)-1]
+		}
+		var reading device.Reading
+		reading.DecodeWithRules(e.Payload[:], nil)
+		bucket.add(&reading)
+		return true
+	})
+	for i := range resp.Buckets {
+		resp.Buckets[i].close()
+	}
+	return resp, err
+}
+
+// appendHistoryCSV appends the readings of resp in the thermomatic output
+// format, or its buckets with a header line.
+func appendHistoryCSV(dst []byte, resp *historyResponse) []byte {
+	for _, r := range resp.Readings {
+		dst = appendReadingCSV(dst, resp.IMEI, r.TimestampEpoch, r.Reading)
+		dst = append(dst, '\n')
+	}
+	if len(resp.Buckets) == 0 {
+		return dst
+	}
+	dst = append(dst, "startEpoch,imei,count"...)
+	for _, field := range []string{"temperature", "altitude", "latitude", "longitude", "batteryLevel"} {
+		dst = append(dst, fmt.Sprintf(",%sMin,%sMax,%sAvg", field, field, field)...)
+	}
+	dst = append(dst, '\n')
+	for _, b := range resp.Buckets {
+		dst = strconv.AppendInt(dst, b.StartEpoch, 10)
+		dst = append(dst, ',')
+		dst = strconv.AppendUint(dst, resp.IMEI, 10)
+		dst = append(dst, ',')
+		dst = strconv.AppendInt(dst, int64(b.Count), 10)
+		for _, f := range []fieldStats{b.Temperature, b.Altitude, b.Latitude, b.Longitude, b.BatteryLevel} {
+			dst = appendCSVFloat(dst, f.Min)
+			dst = appendCSVFloat(dst, f.Max)
+			dst = appendCSVFloat(dst, f.Avg)
+		}
+		dst = append(dst, '\n')
+	}
+	return dst
+}
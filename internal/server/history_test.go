@@ -0,0 +1,207 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/storage"
+)
+
+const historyIMEI = uint64(490154203237518)
+
+// historyTestHttpd returns an httpd whose store holds a reading per second of
+// historyIMEI during the minute before common.FrozenInTime, the temperature of
+// the i-th one is i. Readings 10 and 11 share the same timestamp.
+func historyTestHttpd(t *testing.T) (*httpd, time.Time) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "thermomatic-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store, err := storage.Open(dir, storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frozen := common.FrozenInTime()
+	start := frozen.Add(-time.Minute).Truncate(time.Minute)
+	for i := 0; i < 60; i++ {
+		epoch := start.Add(time.Duration(i) * time.Second).UnixNano()
+		if i == 11 {
+			epoch = start.Add(10 * time.Second).UnixNano()
+		}
+		payload := device.NewPayload(float64(i), 1, 2, 3, 0.5)
+		if err := store.Append(historyIMEI, epoch, &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := newHttpd(newCore(func() time.Time { return frozen }, 1337, 2), 80)
+	d.store = store
+	return d, start
+}
+
+func getHistory(t *testing.T, d *httpd, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := http.NewRequest("GET", fmt.Sprintf("/readings/%d/history%s", historyIMEI, query), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	d.handler().ServeHTTP(rr, req)
+	return rr
+}
+
+func decodeHistory(t *testing.T, rr *httptest.ResponseRecorder) historyResponse {
+	t.Helper()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var resp historyResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestHttpd_HistoryHandler_Paginates(t *testing.T) {
+	d, _ := historyTestHttpd(t)
+
+	var temperatures []float64
+	query := "?limit=7"
+	pages := 0
+	for {
+		rr := getHistory(t, d, query)
+		resp := decodeHistory(t, rr)
+		pages++
+		for _, r := range resp.Readings {
+			temperatures = append(temperatures, r.Reading.Temperature)
+		}
+		if rr.Header().Get("X-Next-Cursor") != resp.NextCursor {
+			t.Errorf("expected X-Next-Cursor %q, got %q", resp.NextCursor, rr.Header().Get("X-Next-Cursor"))
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		query = "?limit=7&cursor=" + resp.NextCursor
+	}
+
+	if pages != 9 {
+		t.Errorf("expected 9 pages, got %d", pages)
+	}
+	if len(temperatures) != 60 {
+		t.Fatalf("expected 60 readings, got %d", len(temperatures))
+	}
+	for i, temperature := range temperatures {
+		if temperature != float64(i) {
+			t.Fatalf("expected reading %d to have temperature %d, got %v", i, i, temperature)
+		}
+	}
+}
+
+func TestHttpd_HistoryHandler_Range(t *testing.T) {
+	d, start := historyTestHttpd(t)
+	from := start.Add(20 * time.Second).Format(time.RFC3339)
+	to := start.Add(29 * time.Second).UnixNano()
+
+	resp := decodeHistory(t, getHistory(t, d, fmt.Sprintf("?from=%s&to=%d", from, to)))
+	if len(resp.Readings) != 10 {
+		t.Fatalf("expected 10 readings, got %d", len(resp.Readings))
+	}
+	if resp.Readings[0].Reading.Temperature != 20 || resp.Readings[9].Reading.Temperature != 29 {
+		t.Errorf("unexpected readings %+v", resp.Readings)
+	}
+}
+
+func TestHttpd_HistoryHandler_Downsamples(t *testing.T) {
+	d, start := historyTestHttpd(t)
+
+	resp := decodeHistory(t, getHistory(t, d, "?step=30s"))
+	if len(resp.Buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(resp.Buckets))
+	}
+	first := resp.Buckets[0]
+	if first.StartEpoch != start.UnixNano() || first.Count != 30 {
+		t.Errorf("unexpected first bucket %+v", first)
+	}
+	expected := fieldStats{Min: 0, Max: 29, Avg: 14.5}
+	if first.Temperature != expected {
+		t.Errorf("expected temperature %+v, got %+v", expected, first.Temperature)
+	}
+	if first.BatteryLevel.Avg != 0.5 {
+		t.Errorf("expected battery level avg 0.5, got %v", first.BatteryLevel.Avg)
+	}
+
+	resp = decodeHistory(t, getHistory(t, d, "?step=30s&limit=1"))
+	if len(resp.Buckets) != 1 || resp.NextCursor == "" {
+		t.Fatalf("expected 1 bucket and a cursor, got %+v", resp)
+	}
+	resp = decodeHistory(t, getHistory(t, d, "?step=30s&limit=1&cursor="+resp.NextCursor))
+	if len(resp.Buckets) != 1 || resp.Buckets[0].Temperature.Min != 30 || resp.NextCursor != "" {
+		t.Errorf("unexpected second page %+v", resp)
+	}
+}
+
+func TestHttpd_HistoryHandler_CSV(t *testing.T) {
+	d, start := historyTestHttpd(t)
+
+	rr := getHistory(t, d, "?limit=2&format=csv")
+	expected := fmt.Sprintf("%d,%d,0,1,2,3,0.5\n%d,%d,1,1,2,3,0.5\n",
+		start.UnixNano(), historyIMEI, start.Add(time.Second).UnixNano(), historyIMEI)
+	if rr.Body.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, rr.Body.String())
+	}
+	if rr.Header().Get("X-Next-Cursor") == "" {
+		t.Error("expected X-Next-Cursor header")
+	}
+
+	rr = getHistory(t, d, "?step=1m&format=csv")
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "startEpoch,imei,count,temperatureMin") {
+		t.Errorf("unexpected downsampled csv %q", rr.Body.String())
+	}
+}
+
+func TestHttpd_HistoryHandler_Errors(t *testing.T) {
+	d, _ := historyTestHttpd(t)
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"?limit=0", http.StatusBadRequest},
+		{"?limit=100000", http.StatusBadRequest},
+		{"?from=yesterday", http.StatusBadRequest},
+		{"?from=2&to=1", http.StatusBadRequest},
+		{"?step=-1m", http.StatusBadRequest},
+		{"?format=xml", http.StatusBadRequest},
+		{"?cursor=garbage", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if rr := getHistory(t, d, test.query); rr.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.query, test.status, rr.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/readings/1/history", nil)
+	rr := httptest.NewRecorder()
+	d.handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown device: expected status %d, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	d.store = nil
+	if rr := getHistory(t, d, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("storage disabled: expected status %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
@@ -1,27 +1,52 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
+	"github.com/spin-org/thermomatic/internal/storage"
 )
 
 type httpd struct {
-	core *core
-	port uint
+	core   *core
+	port   uint
+	server *http.Server
+	// store serves the readings history, nil when readings are not persisted
+	store *storage.Store
+	log   *logging.Logger
+	// wsPingInterval is how often idle WebSocket clients are pinged
+	wsPingInterval time.Duration
 }
 type stats struct {
 	NumConnectedClients int               `json:"numConnectedClients"`
 	NumCPU              int               `json:"numCpu"`
 	NumGoroutine        int               `json:"numGoroutine"`
 	MemStats            *runtime.MemStats `json:"memStats"`
-	//TODO add bytes per second
+	Limits              limitsStats       `json:"limits"`
+	// BytesRead from device connections, its rate is the bytes per second
+	BytesRead uint64 `json:"bytesRead"`
+	// Auth counts the login authentications by result, it is omitted when
+	// logins are not authenticated
+	Auth *authStats `json:"auth,omitempty"`
+	// Alerts counts the alerts fired and resolved, it is omitted when there
+	// are no alert rules
+	Alerts *alertCounts `json:"alerts,omitempty"`
+	// Geofences counts the devices entering and exiting geofences, it is
+	// omitted when there are no geofences
+	Geofences *geofenceCounts `json:"geofences,omitempty"`
+	// RejectedReadings counts the invalid readings by the validation rule
+	// which rejected them
+	RejectedReadings map[string]uint64 `json:"rejectedReadings"`
 }
 
 type timeStampedReading struct {
@@ -30,15 +55,20 @@ type timeStampedReading struct {
 }
 
 func newHttpd(core *core, port uint) *httpd {
-	return &httpd{
+	d := &httpd{
 		core: core,
 		port: port,
+		log:  core.logger.With(logging.F("component", "httpd")),
+
+		wsPingInterval: defaultWSPingInterval,
 	}
+	d.server = &http.Server{Handler: d.handler()}
+	return d
 }
 
 func (d *httpd) statsHandler(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodGet {
-		log.Printf("[httpd] %s method not allowed ", req.Method)
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
@@ -47,6 +77,19 @@ func (d *httpd) statsHandler(w http.ResponseWriter, req *http.Request) {
 		NumConnectedClients: d.core.numConnectedDevices(),
 		NumCPU:              runtime.NumCPU(),
 		NumGoroutine:        runtime.NumGoroutine(),
+		Limits:              d.core.limiter.snapshot(),
+		BytesRead:           atomic.LoadUint64(&d.core.stats.bytesRead),
+		Auth:                d.core.authSnapshot(),
+		RejectedReadings:    make(map[string]uint64, device.NumRejectReasons-1),
+	}
+	if d.core.alerts != nil {
+		stats.Alerts = d.core.alerts.stats.counts()
+	}
+	if d.core.geofences != nil {
+		stats.Geofences = d.core.geofences.stats.counts()
+	}
+	for reason := device.RejectReason(1); int(reason) < device.NumRejectReasons; reason++ {
+		stats.RejectedReadings[reason.String()] = atomic.LoadUint64(&d.core.stats.rejectedReadings[reason])
 	}
 
 	var memStats runtime.MemStats
@@ -59,7 +102,6 @@ func imeiFromPath(path, prefix string) (uint64, error) {
 	imeiStr := strings.TrimPrefix(path, prefix)
 	imei, err := strconv.Atoi(imeiStr)
 	if err != nil {
-		log.Printf("[httpd] %s string can not be parsed as integer, %v", imeiStr, err)
 		return 0, err
 	}
 	return uint64(imei), err
@@ -67,13 +109,19 @@ func imeiFromPath(path, prefix string) (uint64, error) {
 
 func (d *httpd) readingsHandler(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodGet {
-		log.Printf("[httpd] %s method not allowed ", req.Method)
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
+	if path := strings.TrimPrefix(req.URL.Path, "/readings/"); strings.HasSuffix(path, "/history") {
+		d.historyHandler(w, req, strings.TrimSuffix(path, "/history"))
+		return
+	}
+
 	imei, err := imeiFromPath(req.URL.Path, "/readings/")
 	if err != nil {
+		d.log.Warn("invalid IMEI", logging.F("err", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -93,13 +141,14 @@ func (d *httpd) readingsHandler(w http.ResponseWriter, req *http.Request) {
 
 func (d *httpd) statusHandler(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodGet {
-		log.Printf("[httpd] %s method not allowed ", req.Method)
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
 	imei, err := imeiFromPath(req.URL.Path, "/status/")
 	if err != nil {
+		d.log.Warn("invalid IMEI", logging.F("err", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -109,19 +158,44 @@ func (d *httpd) statusHandler(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte(fmt.Sprintf("{\"online\":%v}", exists)))
 }
 
-func (d *httpd) run() {
-	http.HandleFunc("/stats", d.statsHandler)
-	http.HandleFunc("/readings/", d.readingsHandler)
-	http.HandleFunc("/status/", d.statusHandler)
-	httpAddress := fmt.Sprintf(":%d", d.port)
-	http.ListenAndServe(httpAddress, d.logRequest(http.DefaultServeMux))
-	log.Printf("[httpd] started at %s", httpAddress)
+// handler returns the router of every httpd endpoint
+func (d *httpd) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", d.statsHandler)
+	mux.HandleFunc("/metrics", d.metricsHandler)
+	mux.HandleFunc("/readings/", d.readingsHandler)
+	mux.HandleFunc("/status/", d.statusHandler)
+	mux.HandleFunc("/devices", d.fleetHandler)
+	mux.HandleFunc("/devices/", d.devicesHandler)
+	mux.HandleFunc("/inventory", d.inventoryHandler)
+	mux.HandleFunc("/inventory/", d.inventoryHandler)
+	mux.HandleFunc("/alerts", d.alertsHandler)
+	mux.HandleFunc("/geofences", d.geofencesHandler)
+	mux.HandleFunc("/geofences/", d.geofencesHandler)
+	mux.HandleFunc("/stream/readings", d.streamReadingsHandler)
+	mux.HandleFunc("/ws", d.websocketHandler)
+	return d.logRequest(mux)
+}
+
+// serve handles HTTP requests from ln until shutdown is called.
+func (d *httpd) serve(ln net.Listener) {
+	d.log.Info("listening for http requests", logging.F("addr", ln.Addr().String()))
+	err := d.server.Serve(ln)
+	if err != nil && err != http.ErrServerClosed {
+		d.log.Error("serving http requests", logging.F("err", err))
+	}
+}
+
+// shutdown stops accepting requests and waits for the active ones to finish
+// until ctx is done.
+func (d *httpd) shutdown(ctx context.Context) error {
+	return d.server.Shutdown(ctx)
 }
 
 func (d *httpd) writeJSONResponse(w http.ResponseWriter, v interface{}) {
 	json, err := json.Marshal(v)
 	if err != nil {
-		log.Printf("[httpd] ERR trying to serialize %v to json %v", v, err)
+		d.log.Error("serializing response to json", logging.F("err", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -131,7 +205,7 @@ func (d *httpd) writeJSONResponse(w http.ResponseWriter, v interface{}) {
 
 func (d *httpd) logRequest(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[httpd]%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+		d.log.Debug("request", logging.F("remote", r.RemoteAddr), logging.F("method", r.Method), logging.F("url", r.URL.String()))
 		handler.ServeHTTP(w, r)
 	})
 }
@@ -43,7 +43,7 @@ func TestHttpd_StatusHandler(t *testing.T) {
 	httpd := newHttpd(core, 80)
 	expectedIMEI := uint64(448324242329542)
 	callBackChannel := make(chan common.Command, 1)
-	err := core.register(expectedIMEI, callBackChannel)
+	err := core.register(expectedIMEI, callBackChannel, nil, nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -80,12 +80,12 @@ func TestHttpd_ReadingHandler(t *testing.T) {
 	reading.Decode(randomReadingBytes[:])
 
 	callBackChannel := make(chan common.Command, 1)
-	err := core.register(expectedIMEI, callBackChannel)
+	err := core.register(expectedIMEI, callBackChannel, nil, nil)
 	if err != nil {
 		t.Error(err)
 	}
 	dev, _ := core.deviceByIMEI(expectedIMEI)
-	dev.lastReading = reading
+	dev.storeReading(common.FrozenInTime().UnixNano(), reading)
 
 	url := fmt.Sprintf("/readings/%d", expectedIMEI)
 	req, err := http.NewRequest("GET", url, nil)
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// DeviceState decides whether a device of the inventory may log in.
+type DeviceState int
+
+const (
+	// DeviceAllowed devices log in and their readings flow as usual.
+	DeviceAllowed DeviceState = iota
+	// DeviceDenied devices can not log in, and are disconnected when they are
+	// denied while logged in.
+	DeviceDenied
+	// DeviceQuarantined devices log in and their last reading is tracked, but
+	// their readings are not written to the sinks nor persisted.
+	DeviceQuarantined
+)
+
+// ParseDeviceState parses allowed, denied or quarantined.
+func ParseDeviceState(s string) (DeviceState, error) {
+	switch s {
+	case "allowed":
+		return DeviceAllowed, nil
+	case "denied":
+		return DeviceDenied, nil
+	case "quarantined":
+		return DeviceQuarantined, nil
+	}
+	return DeviceAllowed, fmt.Errorf("unknown device state %q, it could be allowed, denied or quarantined", s)
+}
+
+func (s DeviceState) String() string {
+	switch s {
+	case DeviceDenied:
+		return "denied"
+	case DeviceQuarantined:
+		return "quarantined"
+	}
+	return "allowed"
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s DeviceState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, an empty state is allowed.
+func (s *DeviceState) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*s = DeviceAllowed
+		return nil
+	}
+	state, err := ParseDeviceState(string(text))
+	if err != nil {
+		return err
+	}
+	*s = state
+	return nil
+}
+
+// inventoryEntry describes a device of the inventory.
+type inventoryEntry struct {
+	IMEI  uint64      `json:"imei"`
+	Name  string      `json:"name,omitempty"`
+	Site  string      `json:"site,omitempty"`
+	Owner string      `json:"owner,omitempty"`
+	State DeviceState `json:"state"`
+}
+
+// inventoryCheckInterval is how often the inventory file is checked for
+// changes.
+const inventoryCheckInterval = time.Second
+
+// inventory is the registry of the devices allowed to log in, loaded from a
+// JSON file holding an array of entries:
+//
+//	[
+//	  {"imei": 490154203237518, "name": "freezer 3", "site": "merida", "owner": "ops", "state": "allowed"},
+//	  {"imei": 448324242329542, "state": "quarantined"}
+//	]
+//
+// Devices missing from the file are denied. Lookups never lock, every reload
+// or change publishes a new snapshot of the entries. Changes made through the
+// HTTP endpoints are written back to the file.
+type inventory struct {
+	path string
+	// mux serializes reloads and changes, readers use the snapshot
+	mux     sync.Mutex
+	entries atomic.Value // map[uint64]inventoryEntry
+	modTime time.Time
+	// failedModTime is the modification time of the file which last failed
+	// to load, it is not retried until it changes again
+	failedModTime time.Time
+}
+
+// openInventory loads the inventory file at path.
+func openInventory(path string) (*inventory, error) {
+	inv := &inventory{path: path}
+	if _, err := inv.reload(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+func (inv *inventory) snapshot() map[uint64]inventoryEntry {
+	return inv.entries.Load().(map[uint64]inventoryEntry)
+}
+
+// lookup returns the entry of imei, it does NOT lock.
+func (inv *inventory) lookup(imei uint64) (inventoryEntry, bool) {
+	entry, ok := inv.snapshot()[imei]
+	return entry, ok
+}
+
+// state returns the state of imei, devices missing from the inventory are
+// denied. It does NOT lock.
+func (inv *inventory) state(imei uint64) DeviceState {
+	entry, ok := inv.lookup(imei)
+	if !ok {
+		return DeviceDenied
+	}
+	return entry.State
+}
+
+// list returns every entry sorted by IMEI.
+func (inv *inventory) list() []inventoryEntry {
+	return sortedEntries(inv.snapshot())
+}
+
+func sortedEntries(entries map[uint64]inventoryEntry) []inventoryEntry {
+	list := make([]inventoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IMEI < list[j].IMEI })
+	return list
+}
+
+// reload reads the inventory file, the loaded entries are kept if it is not
+// valid. It returns the number of entries loaded.
+func (inv *inventory) reload() (int, error) {
+	inv.mux.Lock()
+	defer inv.mux.Unlock()
+	return inv.load()
+}
+
+// reloadIfModified reloads the inventory file if it was modified since it was
+// last loaded or written, changed is set when it was reloaded. An invalid file
+// returns an error once, it is not reloaded until it is modified again.
+func (inv *inventory) reloadIfModified() (changed bool, err error) {
+	inv.mux.Lock()
+	defer inv.mux.Unlock()
+	info, err := os.Stat(inv.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(inv.modTime) || info.ModTime().Equal(inv.failedModTime) {
+		return false, nil
+	}
+	if _, err := inv.load(); err != nil {
+		inv.failedModTime = info.ModTime()
+		return false, err
+	}
+	return true, nil
+}
+
+func (inv *inventory) load() (int, error) {
+	info, err := os.Stat(inv.path)
+	if err != nil {
+		return 0, err
+	}
+	content, err := ioutil.ReadFile(inv.path)
+	if err != nil {
+		return 0, err
+	}
+	var list []inventoryEntry
+	if err := json.Unmarshal(content, &list); err != nil {
+		return 0, fmt.Errorf("parsing inventory %s, %v", inv.path, err)
+	}
+	entries := make(map[uint64]inventoryEntry, len(list))
+	for _, entry := range list {
+		if err := validateIMEI(entry.IMEI); err != nil {
+			return 0, fmt.Errorf("inventory %s, %v", inv.path, err)
+		}
+		if _, exists := entries[entry.IMEI]; exists {
+			return 0, fmt.Errorf("inventory %s, duplicated IMEI %d", inv.path, entry.IMEI)
+		}
+		entries[entry.IMEI] = entry
+	}
+	inv.entries.Store(entries)
+	inv.modTime = info.ModTime()
+	return len(entries), nil
+}
+
+// put adds or replaces the entry of entry.IMEI.
+func (inv *inventory) put(entry inventoryEntry) error {
+	inv.mux.Lock()
+	defer inv.mux.Unlock()
+	current := inv.snapshot()
+	next := make(map[uint64]inventoryEntry, len(current)+1)
+	for k, v := range current {
+		next[k] = v
+	}
+	next[entry.IMEI] = entry
+	return inv.store(next)
+}
+
+// remove deletes the entry of imei, it returns false if there was none.
+func (inv *inventory) remove(imei uint64) (bool, error) {
+	inv.mux.Lock()
+	defer inv.mux.Unlock()
+	current := inv.snapshot()
+	if _, exists := current[imei]; !exists {
+		return false, nil
+	}
+	next := make(map[uint64]inventoryEntry, len(current))
+	for k, v := range current {
+		if k != imei {
+			next[k] = v
+		}
+	}
+	return true, inv.store(next)
+}
+
+// store writes entries to the inventory file and publishes them, the file is
+// replaced atomically so a failed write leaves it untouched.
+func (inv *inventory) store(entries map[uint64]inventoryEntry) error {
+	content, err := json.MarshalIndent(sortedEntries(entries), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(inv.path, append(content, '\n')); err != nil {
+		return err
+	}
+	info, err := os.Stat(inv.path)
+	if err != nil {
+		return err
+	}
+	inv.entries.Store(entries)
+	inv.modTime = info.ModTime()
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with content, through a temporary
+// file renamed over it, so a failed write leaves it untouched.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// parseIMEI parses the 15 digits of an IMEI.
+func parseIMEI(s string) (uint64, error) {
+	imei, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || len(s) != 15 {
+		return 0, fmt.Errorf("invalid IMEI %q", s)
+	}
+	return imei, nil
+}
+
+// validateIMEI checks that imei has at most 15 digits.
+func validateIMEI(imei uint64) error {
+	if imei >= 1e15 {
+		return fmt.Errorf("invalid IMEI %d", imei)
+	}
+	return nil
+}
+
+// inventoryRequest is the body of PUT /inventory/:imei.
+type inventoryRequest struct {
+	Name  string      `json:"name"`
+	Site  string      `json:"site"`
+	Owner string      `json:"owner"`
+	State DeviceState `json:"state"`
+}
+
+// inventoryHandler serves the inventory endpoints:
+//
+//	GET    /inventory        lists every entry
+//	GET    /inventory/:imei  returns the entry of a device
+//	PUT    /inventory/:imei  adds or replaces the entry of a device
+//	DELETE /inventory/:imei  removes the entry of a device
+//
+// Devices denied by a change are disconnected.
+func (d *httpd) inventoryHandler(w http.ResponseWriter, req *http.Request) {
+	inv := d.core.inventory
+	if inv == nil {
+		http.Error(w, "no inventory configured", http.StatusNotFound)
+		return
+	}
+	imeiStr := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/inventory"), "/")
+	if imeiStr == "" {
+		if req.Method != http.MethodGet {
+			d.log.Warn("method not allowed", logging.F("method", req.Method))
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		d.writeJSONResponse(w, inv.list())
+		return
+	}
+	imei, err := parseIMEI(imeiStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		entry, ok := inv.lookup(imei)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		d.writeJSONResponse(w, entry)
+	case http.MethodPut:
+		var body inventoryRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("invalid inventory entry, %v", err), http.StatusBadRequest)
+			return
+		}
+		entry := inventoryEntry{IMEI: imei, Name: body.Name, Site: body.Site, Owner: body.Owner, State: body.State}
+		if err := inv.put(entry); err != nil {
+			d.log.Error("updating inventory entry", logging.F("imei", imei), logging.F("err", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		d.log.Info("inventory entry set", logging.F("imei", imei), logging.F("state", entry.State))
+		d.core.enforceInventory()
+		d.writeJSONResponse(w, entry)
+	case http.MethodDelete:
+		removed, err := inv.remove(imei)
+		if err != nil {
+			d.log.Error("removing inventory entry", logging.F("imei", imei), logging.F("err", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		d.log.Info("inventory entry removed", logging.F("imei", imei))
+		d.core.enforceInventory()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// watchInventory reloads the inventory when the server receives SIGHUP or its
+// file changes, until ctx is done. Devices denied after a reload are
+// disconnected, the others keep their connections.
+func (s *server) watchInventory(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	ticker := time.NewTicker(inventoryCheckInterval)
+	defer ticker.Stop()
+
+	inv := s.core.inventory
+	for {
+		var changed bool
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			_, err = inv.reload()
+			changed = err == nil
+		case <-ticker.C:
+			changed, err = inv.reloadIfModified()
+		}
+		if err != nil {
+			s.core.logger.Error("reloading the inventory, keeping the loaded entries", logging.F("err", err))
+			continue
+		}
+		if changed {
+			killed := s.core.enforceInventory()
+			s.core.logger.Info("reloaded the inventory", logging.F("devices", len(inv.snapshot())), logging.F("disconnected", killed))
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+func writeInventory(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// a new modification time even if the file was written a moment ago
+	later := time.Now().Add(time.Duration(len(content)) * time.Second)
+	os.Chtimes(path, later, later)
+}
+
+func TestInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory.json")
+	writeInventory(t, path, `[
+		{"imei": 490154203237518, "name": "freezer 3", "site": "merida", "owner": "ops"},
+		{"imei": 448324242329542, "state": "quarantined"}
+	]`)
+
+	inv, err := openInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := inventoryEntry{IMEI: 490154203237518, Name: "freezer 3", Site: "merida", Owner: "ops", State: DeviceAllowed}
+	if entry, ok := inv.lookup(490154203237518); !ok || entry != expected {
+		t.Errorf("expected %+v got %+v", expected, entry)
+	}
+	states := map[uint64]DeviceState{
+		490154203237518: DeviceAllowed,
+		448324242329542: DeviceQuarantined,
+		304412928289834: DeviceDenied,
+	}
+	for imei, state := range states {
+		if got := inv.state(imei); got != state {
+			t.Errorf("expected %d to be %v got %v", imei, state, got)
+		}
+	}
+
+	// changes are written to the file
+	if err := inv.put(inventoryEntry{IMEI: 304412928289834, State: DeviceDenied}); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := inv.remove(448324242329542); !removed || err != nil {
+		t.Fatalf("expected the entry to be removed, %v", err)
+	}
+	if removed, _ := inv.remove(448324242329542); removed {
+		t.Error("expected the entry to be removed only once")
+	}
+	if changed, err := inv.reloadIfModified(); changed || err != nil {
+		t.Errorf("expected the written file not to be reloaded, changed:%v err:%v", changed, err)
+	}
+	reopened, err := openInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reopened.list(); len(list) != 2 || list[0].IMEI != 304412928289834 || list[0].State != DeviceDenied || list[1] != expected {
+		t.Errorf("unexpected entries %+v", list)
+	}
+
+	// an invalid file keeps the loaded entries
+	for _, content := range []string{
+		`{"imei": 490154203237518}`,
+		`[{"imei": 490154203237518, "state": "banned"}]`,
+		`[{"imei": 4901542032375180}]`,
+		`[{"imei": 490154203237518}, {"imei": 490154203237518}]`,
+	} {
+		writeInventory(t, path, content)
+		if changed, err := inv.reloadIfModified(); changed || err == nil {
+			t.Errorf("expected %s to be rejected", content)
+		}
+		// the error is only reported once per change
+		if changed, err := inv.reloadIfModified(); changed || err != nil {
+			t.Errorf("expected %s not to be reloaded again, changed:%v err:%v", content, changed, err)
+		}
+	}
+	if inv.state(490154203237518) != DeviceAllowed {
+		t.Error("expected the loaded entries to be kept")
+	}
+
+	writeInventory(t, path, `[{"imei": 490154203237518, "state": "denied"}]`)
+	if changed, err := inv.reloadIfModified(); !changed || err != nil {
+		t.Fatalf("expected the inventory to be reloaded, %v", err)
+	}
+	if inv.state(490154203237518) != DeviceDenied || inv.state(304412928289834) != DeviceDenied {
+		t.Errorf("unexpected entries after reload %+v", inv.list())
+	}
+}
+
+func TestServer_Run_Inventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory.json")
+	writeInventory(t, path, `[
+		{"imei": 490154203237518, "name": "freezer 3"},
+		{"imei": 448324242329542, "state": "quarantined"}
+	]`)
+	output := filepath.Join(dir, "readings.csv")
+	fileSink, _ := ParseSinkConfig("file:path=" + output)
+	s, cancel, done := startTestServer(t, Config{
+		MaxClients:      10,
+		Sinks:           []SinkConfig{fileSink},
+		InventoryFile:   path,
+		ShutdownTimeout: time.Second,
+	})
+	defer func() {
+		cancel()
+		<-done
+	}()
+	stats := &s.core.stats
+
+	allowed := dialTestDevice(t, s, []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8})
+	defer allowed.Close()
+	quarantined := dialTestDevice(t, s, []byte{4, 4, 8, 3, 2, 4, 2, 4, 2, 3, 2, 9, 5, 4, 2})
+	defer quarantined.Close()
+	unknown := dialTestDevice(t, s, []byte{3, 0, 4, 4, 1, 2, 9, 2, 8, 2, 8, 9, 8, 3, 4})
+	defer unknown.Close()
+	waitFor(t, "the logins", func() bool {
+		return atomic.LoadUint64(&stats.logins) == 2 && atomic.LoadUint64(&stats.deniedLogins) == 1
+	})
+	unknown.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := unknown.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection of the unknown device to be closed")
+	}
+
+	payload := device.NewPayload(38, 10, 21.033643, -89.5969049, 45)
+	allowed.Write(payload[:])
+	quarantined.Write(payload[:])
+	waitFor(t, "the readings", func() bool { return atomic.LoadUint64(&stats.readings) == 2 })
+	if n := atomic.LoadUint64(&stats.quarantinedReadings); n != 1 {
+		t.Errorf("expected 1 quarantined reading got %d", n)
+	}
+
+	// denied through the HTTP endpoint
+	url := fmt.Sprintf("http://%s/inventory/448324242329542", s.httpLn.Addr())
+	req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(`{"name":"compromised","state":"denied"}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry inventoryEntry
+	json.NewDecoder(resp.Body).Decode(&entry)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || entry.State != DeviceDenied || entry.Name != "compromised" {
+		t.Errorf("unexpected response %d %+v", resp.StatusCode, entry)
+	}
+	quarantined.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := quarantined.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the denied device to be disconnected")
+	}
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/inventory", s.httpLn.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []inventoryEntry
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 2 || list[0].IMEI != 448324242329542 || list[1].IMEI != 490154203237518 {
+		t.Errorf("unexpected inventory %+v", list)
+	}
+
+	// denied by editing the file, the watcher reloads it
+	writeInventory(t, path, `[{"imei": 490154203237518, "state": "denied"}]`)
+	waitForWithin(t, "the denied device to be disconnected", 3*time.Second, func() bool {
+		return s.core.numConnectedDevices() == 0
+	})
+}
+
+func TestHttpd_InventoryHandler_Errors(t *testing.T) {
+	d := newHttpd(newCore(time.Now, 0, 10), 0)
+	server := d.handler()
+	request := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := request(http.MethodGet, "/inventory", ""); code != http.StatusNotFound {
+		t.Errorf("expected %d without inventory got %d", http.StatusNotFound, code)
+	}
+
+	dir, err := ioutil.TempDir("", "thermomatic-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory.json")
+	writeInventory(t, path, `[]`)
+	if d.core.inventory, err = openInventory(path); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodPost, "/inventory", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/inventory/49015420323751", "", http.StatusBadRequest},
+		{http.MethodGet, "/inventory/490154203237518", "", http.StatusNotFound},
+		{http.MethodPut, "/inventory/490154203237518", `{"state":"banned"}`, http.StatusBadRequest},
+		{http.MethodDelete, "/inventory/490154203237518", "", http.StatusNotFound},
+		{http.MethodPut, "/inventory/490154203237518", `{"state":"quarantined"}`, http.StatusOK},
+		{http.MethodDelete, "/inventory/490154203237518", "", http.StatusNoContent},
+		{http.MethodPatch, "/inventory/490154203237518", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if code := request(tt.method, tt.path, tt.body); code != tt.code {
+			t.Errorf("%s %s: expected %d got %d", tt.method, tt.path, tt.code, code)
+		}
+	}
+}
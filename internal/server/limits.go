@@ -0,0 +1,247 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// ConnLimits bounds the connections accepted by the device listener, zero
+// values mean no limit.
+type ConnLimits struct {
+	// MaxConnsPerIP bounds the open connections of each source IP.
+	MaxConnsPerIP uint
+	// MaxPendingLogins bounds the connections which did not log in yet.
+	MaxPendingLogins uint
+	// AcceptRate is the number of connections accepted per second, with
+	// bursts of up to AcceptBurst connections.
+	AcceptRate  float64
+	AcceptBurst uint
+	// BanThreshold offenses of an IP within BanWindow ban it for BanDuration.
+	// Exceeding MaxConnsPerIP and closing a connection without logging in are
+	// offenses.
+	BanThreshold uint
+	BanWindow    time.Duration
+	BanDuration  time.Duration
+}
+
+var (
+	errIPBanned          = errors.New("ip temporarily banned")
+	errAcceptRate        = errors.New("accept rate exceeded")
+	errTooManyPending    = errors.New("too many pending logins")
+	errTooManyConnsPerIP = errors.New("too many connections from ip")
+)
+
+// limitsSweepInterval is how often the state of idle IPs is dropped.
+const limitsSweepInterval = time.Minute
+
+// connLimiter decides which connections the device listener accepts.
+type connLimiter struct {
+	limits ConnLimits
+	now    func() time.Time
+
+	mux       sync.Mutex
+	ips       map[string]*ipState
+	open      int
+	pending   int
+	tokens    float64
+	lastFill  time.Time
+	lastSweep time.Time
+	stats     limitsStats
+}
+
+// ipState tracks a source IP, it is dropped once the IP is idle.
+type ipState struct {
+	conns       int
+	offenses    uint
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+// limitsStats are the counters of the limiter, served by /stats.
+type limitsStats struct {
+	OpenConnections       int    `json:"openConnections"`
+	PendingLogins         int    `json:"pendingLogins"`
+	BannedIPs             int    `json:"bannedIps"`
+	Bans                  uint64 `json:"bans"`
+	RejectedBanned        uint64 `json:"rejectedBanned"`
+	RejectedAcceptRate    uint64 `json:"rejectedAcceptRate"`
+	RejectedPendingLogins uint64 `json:"rejectedPendingLogins"`
+	RejectedConnsPerIP    uint64 `json:"rejectedConnsPerIp"`
+}
+
+func newConnLimiter(limits ConnLimits, now func() time.Time) *connLimiter {
+	return &connLimiter{
+		limits:    limits,
+		now:       now,
+		ips:       make(map[string]*ipState),
+		tokens:    float64(limits.AcceptBurst),
+		lastFill:  now(),
+		lastSweep: now(),
+	}
+}
+
+// admission is an accepted connection, it is pending until login is called
+// and open until release is called.
+type admission struct {
+	limiter  *connLimiter
+	ip       string
+	loggedIn bool
+	// excused is set when the connection is closed before logging in through
+	// no fault of the device, which is then not an offense
+	excused bool
+}
+
+// admit accepts or rejects a connection from addr, the returned error tells
+// which limit rejected it.
+func (l *connLimiter) admit(addr net.Addr) (*admission, error) {
+	ip := hostOf(addr)
+	now := l.now()
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if now.Sub(l.lastSweep) >= limitsSweepInterval {
+		l.sweep(now)
+	}
+
+	state := l.ips[ip]
+	if state != nil && now.Before(state.bannedUntil) {
+		l.stats.RejectedBanned++
+		return nil, errIPBanned
+	}
+	if l.limits.AcceptRate > 0 && !l.takeToken(now) {
+		l.stats.RejectedAcceptRate++
+		return nil, errAcceptRate
+	}
+	if l.limits.MaxPendingLogins > 0 && l.pending >= int(l.limits.MaxPendingLogins) {
+		l.stats.RejectedPendingLogins++
+		return nil, errTooManyPending
+	}
+	if state == nil {
+		state = &ipState{}
+		l.ips[ip] = state
+	}
+	if l.limits.MaxConnsPerIP > 0 && state.conns >= int(l.limits.MaxConnsPerIP) {
+		l.stats.RejectedConnsPerIP++
+		l.offend(ip, state, now)
+		return nil, errTooManyConnsPerIP
+	}
+	state.conns++
+	l.open++
+	l.pending++
+	return &admission{limiter: l, ip: ip}, nil
+}
+
+// takeToken refills the accept bucket and takes a token from it, it returns
+// false if it is empty.
+func (l *connLimiter) takeToken(now time.Time) bool {
+	burst := float64(l.limits.AcceptBurst)
+	if burst < 1 {
+		burst = 1
+	}
+	l.tokens += now.Sub(l.lastFill).Seconds() * l.limits.AcceptRate
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.lastFill = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// offend counts an offense of ip, banning it when it reaches the threshold.
+func (l *connLimiter) offend(ip string, state *ipState, now time.Time) {
+	if l.limits.BanThreshold == 0 {
+		return
+	}
+	if now.Sub(state.windowStart) > l.limits.BanWindow {
+		state.windowStart = now
+		state.offenses = 0
+	}
+	state.offenses++
+	if state.offenses >= l.limits.BanThreshold {
+		state.offenses = 0
+		state.bannedUntil = now.Add(l.limits.BanDuration)
+		l.stats.Bans++
+		logging.Default().WarnEvent("ban", logging.F("ip", ip), logging.F("duration", l.limits.BanDuration),
+			logging.F("offenses", int(l.limits.BanThreshold)), logging.F("window", l.limits.BanWindow))
+	}
+}
+
+// sweep drops the state of the IPs without connections, offenses nor bans.
+func (l *connLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for ip, state := range l.ips {
+		if state.conns == 0 && now.After(state.bannedUntil) && now.Sub(state.windowStart) > l.limits.BanWindow {
+			delete(l.ips, ip)
+		}
+	}
+}
+
+// snapshot returns the current counters.
+func (l *connLimiter) snapshot() limitsStats {
+	now := l.now()
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	stats := l.stats
+	stats.OpenConnections = l.open
+	stats.PendingLogins = l.pending
+	for _, state := range l.ips {
+		if now.Before(state.bannedUntil) {
+			stats.BannedIPs++
+		}
+	}
+	return stats
+}
+
+// login marks the connection as logged in, it no longer counts as pending.
+func (a *admission) login() {
+	l := a.limiter
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if !a.loggedIn {
+		a.loggedIn = true
+		l.pending--
+	}
+}
+
+// excuse marks the connection as closed before logging in through no fault of
+// the device, like a login the core refused, as the device is denied, banned
+// or already logged in. Many devices may share the IP of a NAT, or a
+// rebooting device may still have a session, so it is not an offense.
+func (a *admission) excuse() {
+	l := a.limiter
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	a.excused = true
+}
+
+// release marks the connection as closed, closing it before logging in is an
+// offense unless it was excused.
+func (a *admission) release() {
+	l := a.limiter
+	now := l.now()
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.open--
+	state := l.ips[a.ip]
+	state.conns--
+	if !a.loggedIn {
+		l.pending--
+		if !a.excused {
+			l.offend(a.ip, state, now)
+		}
+	}
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
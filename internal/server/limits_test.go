@@ -0,0 +1,226 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func testAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func TestConnLimiter_PerIPAndPending(t *testing.T) {
+	now := time.Now()
+	l := newConnLimiter(ConnLimits{MaxConnsPerIP: 2, MaxPendingLogins: 3}, func() time.Time { return now })
+
+	first, err := l.admit(testAddr("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.admit(testAddr("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.admit(testAddr("10.0.0.1")); err != errTooManyConnsPerIP {
+		t.Errorf("expected %v got %v", errTooManyConnsPerIP, err)
+	}
+	if _, err := l.admit(testAddr("10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.admit(testAddr("10.0.0.3")); err != errTooManyPending {
+		t.Errorf("expected %v got %v", errTooManyPending, err)
+	}
+
+	// logged in connections are no longer pending
+	first.login()
+	if _, err := l.admit(testAddr("10.0.0.3")); err != nil {
+		t.Errorf("expected the connection to be admitted, %v", err)
+	}
+	first.release()
+	stats := l.snapshot()
+	expected := limitsStats{OpenConnections: 3, PendingLogins: 3, RejectedConnsPerIP: 1, RejectedPendingLogins: 1}
+	if stats != expected {
+		t.Errorf("expected %+v got %+v", expected, stats)
+	}
+}
+
+func TestConnLimiter_AcceptRate(t *testing.T) {
+	now := time.Now()
+	l := newConnLimiter(ConnLimits{AcceptRate: 10, AcceptBurst: 2}, func() time.Time { return now })
+
+	for i := 0; i < 2; i++ {
+		if _, err := l.admit(testAddr("10.0.0.1")); err != nil {
+			t.Fatalf("expected the burst to be admitted, %v", err)
+		}
+	}
+	if _, err := l.admit(testAddr("10.0.0.2")); err != errAcceptRate {
+		t.Errorf("expected %v got %v", errAcceptRate, err)
+	}
+	now = now.Add(100 * time.Millisecond)
+	if _, err := l.admit(testAddr("10.0.0.2")); err != nil {
+		t.Errorf("expected a refilled token, %v", err)
+	}
+	if _, err := l.admit(testAddr("10.0.0.2")); err != errAcceptRate {
+		t.Errorf("expected %v got %v", errAcceptRate, err)
+	}
+	// the bucket never holds more than the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if _, err := l.admit(testAddr("10.0.0.3")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := l.admit(testAddr("10.0.0.3")); err != errAcceptRate {
+		t.Errorf("expected %v got %v", errAcceptRate, err)
+	}
+	if rejected := l.snapshot().RejectedAcceptRate; rejected != 3 {
+		t.Errorf("expected 3 rejections got %d", rejected)
+	}
+}
+
+func TestConnLimiter_Bans(t *testing.T) {
+	now := time.Now()
+	l := newConnLimiter(ConnLimits{
+		BanThreshold: 3,
+		BanWindow:    time.Minute,
+		BanDuration:  5 * time.Minute,
+	}, func() time.Time { return now })
+	offend := func(ip string) {
+		t.Helper()
+		a, err := l.admit(testAddr(ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// closed without logging in
+		a.release()
+	}
+
+	// offenses out of the window are forgotten
+	offend("10.0.0.1")
+	offend("10.0.0.1")
+	now = now.Add(2 * time.Minute)
+	offend("10.0.0.1")
+	offend("10.0.0.1")
+	if _, err := l.admit(testAddr("10.0.0.1")); err != nil {
+		t.Fatalf("expected no ban yet, %v", err)
+	}
+	a, _ := l.admit(testAddr("10.0.0.2"))
+	a.login()
+	a.release()
+	// refused logins are not offenses
+	for i := 0; i < 3; i++ {
+		a, _ := l.admit(testAddr("10.0.0.2"))
+		a.excuse()
+		a.release()
+	}
+
+	offend("10.0.0.3")
+	offend("10.0.0.3")
+	offend("10.0.0.3")
+	if _, err := l.admit(testAddr("10.0.0.3")); err != errIPBanned {
+		t.Errorf("expected %v got %v", errIPBanned, err)
+	}
+	if a, err := l.admit(testAddr("10.0.0.2")); err != nil {
+		t.Errorf("expected other IPs to be admitted, %v", err)
+	} else {
+		a.login()
+		a.release()
+	}
+	stats := l.snapshot()
+	if stats.Bans != 1 || stats.BannedIPs != 1 || stats.RejectedBanned != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	now = now.Add(5 * time.Minute)
+	if _, err := l.admit(testAddr("10.0.0.3")); err != nil {
+		t.Errorf("expected the ban to expire, %v", err)
+	}
+
+	// idle IPs are swept
+	now = now.Add(limitsSweepInterval + time.Minute)
+	l.admit(testAddr("10.0.0.4"))
+	if _, tracked := l.ips["10.0.0.2"]; tracked {
+		t.Error("expected the idle IP to be swept")
+	}
+	if _, tracked := l.ips["10.0.0.1"]; !tracked {
+		t.Error("expected the IP with an open connection to be kept")
+	}
+}
+
+func TestServer_Run_ConnLimits(t *testing.T) {
+	s, cancel, done := startTestServer(t, Config{
+		MaxClients:      10,
+		Limits:          ConnLimits{MaxConnsPerIP: 1},
+		ShutdownTimeout: time.Second,
+	})
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	logged := dialTestDevice(t, s, []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8})
+	defer logged.Close()
+	waitFor(t, "the device to log in", func() bool { return s.core.numConnectedDevices() == 1 })
+	rejected, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the second connection of the IP to be closed")
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/stats", s.httpLn.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body stats
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	expected := limitsStats{OpenConnections: 1, RejectedConnsPerIP: 1}
+	if body.Limits != expected {
+		t.Errorf("expected %+v got %+v", expected, body.Limits)
+	}
+}
+
+func TestServer_Run_RefusedLoginsNotOffenses(t *testing.T) {
+	s, cancel, done := startTestServer(t, Config{
+		MaxClients:      10,
+		Limits:          ConnLimits{BanThreshold: 2, BanWindow: time.Minute, BanDuration: time.Minute},
+		ShutdownTimeout: time.Second,
+	})
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	imei := []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}
+	logged := dialTestDevice(t, s, imei)
+	defer logged.Close()
+	waitFor(t, "the device to log in", func() bool { return s.core.numConnectedDevices() == 1 })
+	// the core refuses the duplicate logins, as if the device rebooted
+	for i := 0; i < 2; i++ {
+		duplicate := dialTestDevice(t, s, imei)
+		duplicate.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.Copy(ioutil.Discard, duplicate); isTimeoutError(err) {
+			t.Fatal("expected the duplicate login to be refused")
+		}
+		duplicate.Close()
+	}
+	waitFor(t, "the refused connections to be released", func() bool { return s.core.limiter.snapshot().OpenConnections == 1 })
+
+	other := dialTestDevice(t, s, []byte{4, 4, 8, 3, 2, 4, 2, 4, 2, 3, 2, 9, 5, 4, 2})
+	defer other.Close()
+	waitFor(t, "the other device to log in", func() bool { return s.core.numConnectedDevices() == 2 })
+	if stats := s.core.limiter.snapshot(); stats.Bans != 0 {
+		t.Errorf("expected the refused logins not to ban the IP, got %+v", stats)
+	}
+}
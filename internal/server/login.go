@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// LoginPolicy decides what the core does when a device logs in with the IMEI
+// of a device which is already logged in.
+type LoginPolicy int
+
+const (
+	// LoginRejectNew sends KILL to the new connection and keeps the old one.
+	LoginRejectNew LoginPolicy = iota
+	// LoginReplaceOld kills the old connection and hands the device over to
+	// the new one, so a rebooted device whose old socket is half-open is not
+	// locked out.
+	LoginReplaceOld
+	// LoginAllowBoth keeps every connection, each one with its own session.
+	LoginAllowBoth
+)
+
+// ParseLoginPolicy parses reject-new, replace-old or allow-both.
+func ParseLoginPolicy(s string) (LoginPolicy, error) {
+	switch s {
+	case "reject-new":
+		return LoginRejectNew, nil
+	case "replace-old":
+		return LoginReplaceOld, nil
+	case "allow-both":
+		return LoginAllowBoth, nil
+	}
+	return LoginRejectNew, fmt.Errorf("unknown login policy %q, it could be reject-new, replace-old or allow-both", s)
+}
+
+func (p LoginPolicy) String() string {
+	switch p {
+	case LoginReplaceOld:
+		return "replace-old"
+	case LoginAllowBoth:
+		return "allow-both"
+	}
+	return "reject-new"
+}
+
+// applyLoginPolicy adds session to dev, a device already logged in with imei,
+// following the core login policy. It returns an error if session is rejected.
+func (c *core) applyLoginPolicy(imei uint64, dev *connectedDevice, session deviceSession) error {
+	current := dev.loadSessions()
+	switch c.loginPolicy {
+	case LoginReplaceOld:
+		// the replaced sessions finish now, their LOGOUT will be stale
+		for _, old := range current {
+			old.kill(disconnectReplaced)
+			old.log.Event("session-replaced", logging.F("by", session.id))
+			rec := old.record(imei)
+			rec.close(c.now(), disconnectReplaced)
+			c.sessions.add(rec)
+		}
+		dev.storeSessions([]deviceSession{session})
+		return nil
+	case LoginAllowBoth:
+		next := make([]deviceSession, 0, len(current)+1)
+		next = append(next, current...)
+		dev.storeSessions(append(next, session))
+		session.log.Event("session-added", logging.F("sessions", len(next)+1))
+		return nil
+	}
+	session.callbackChannel <- common.Command{ID: common.KILL}
+	session.log.Event("login-rejected", logging.F("reason", "already logged in"))
+	return fmt.Errorf("imei %d already logged in", imei)
+}
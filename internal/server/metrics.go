@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// histogram counts observations in cumulative buckets, as Prometheus
+// histograms do. It is safe for concurrent use and does not lock.
+type histogram struct {
+	// bounds are the upper bounds of the buckets, sorted, +Inf is implicit
+	bounds []float64
+	// counts has a non cumulative count per bucket, plus the +Inf one
+	counts  []uint64
+	sumBits uint64 // float64 bits of the sum of the observations
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// observe adds v to the histogram.
+func (h *histogram) observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+// observeDuration adds d in seconds to the histogram.
+func (h *histogram) observeDuration(d time.Duration) {
+	h.observe(d.Seconds())
+}
+
+// coreMetrics are the histograms of the core, the counters are in coreStats.
+type coreMetrics struct {
+	// readingInterval is the time between consecutive readings of a device
+	readingInterval *histogram
+	// commandDuration is the time the core takes to process a command
+	commandDuration *histogram
+}
+
+func newCoreMetrics() coreMetrics {
+	return coreMetrics{
+		readingInterval: newHistogram(0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60),
+		commandDuration: newHistogram(1e-5, 2.5e-5, 5e-5, 1e-4, 2.5e-4, 5e-4, 1e-3, 2.5e-3, 5e-3, 1e-2, 0.1, 1),
+	}
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (m *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m *metricsWriter) sample(name string, labels string, v float64) {
+	m.w.WriteString(name)
+	if labels != "" {
+		m.w.WriteString("{" + labels + "}")
+	}
+	m.w.WriteByte(' ')
+	m.w.WriteString(formatMetricValue(v))
+	m.w.WriteByte('\n')
+}
+
+func (m *metricsWriter) counter(name, help string, v uint64) {
+	m.header(name, "counter", help)
+	m.sample(name, "", float64(v))
+}
+
+func (m *metricsWriter) gauge(name, help string, v float64) {
+	m.header(name, "gauge", help)
+	m.sample(name, "", v)
+}
+
+// labeledCounter writes a counter with a sample per value of label.
+func (m *metricsWriter) labeledCounter(name, help, label string, values []string, counts []uint64) {
+	m.header(name, "counter", help)
+	for i, value := range values {
+		m.sample(name, label+`="`+value+`"`, float64(counts[i]))
+	}
+}
+
+func (m *metricsWriter) histogram(name, help string, h *histogram) {
+	m.header(name, "histogram", help)
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		m.sample(name+"_bucket", `le="`+formatMetricValue(bound)+`"`, float64(cumulative))
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	m.sample(name+"_bucket", `le="+Inf"`, float64(cumulative))
+	m.sample(name+"_sum", "", math.Float64frombits(atomic.LoadUint64(&h.sumBits)))
+	// the count matches the +Inf bucket even while observations are added
+	m.sample(name+"_count", "", float64(cumulative))
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeMetrics writes every metric of the core to w.
+func (c *core) writeMetrics(w io.Writer) error {
+	m := &metricsWriter{w: bufio.NewWriter(w)}
+	stats := &c.stats
+	limits := c.limiter.snapshot()
+
+	m.counter("thermomatic_connections_accepted_total", "Device connections accepted.",
+		atomic.LoadUint64(&stats.accepted))
+	m.labeledCounter("thermomatic_connections_rejected_total", "Device connections rejected, by reason.", "reason",
+		[]string{"max_clients", "banned", "accept_rate", "pending_logins", "conns_per_ip"},
+		[]uint64{
+			atomic.LoadUint64(&stats.rejectedMaxClients),
+			limits.RejectedBanned,
+			limits.RejectedAcceptRate,
+			limits.RejectedPendingLogins,
+			limits.RejectedConnsPerIP,
+		})
+	m.counter("thermomatic_handshake_timeouts_total", "Device connections which did not log in before the login deadline.",
+		atomic.LoadUint64(&stats.handshakeTimeouts))
+	if auth := c.authSnapshot(); auth != nil {
+		m.labeledCounter("thermomatic_authentications_total", "Login authentications, by result.", "result",
+			[]string{"ok", "unknown_device", "bad_response", "no_response"},
+			[]uint64{auth.Authenticated, auth.UnknownDevices, auth.BadResponses, auth.NoResponses})
+	}
+	m.counter("thermomatic_logins_total", "Device logins.", atomic.LoadUint64(&stats.logins))
+	m.labeledCounter("thermomatic_logins_rejected_total", "Device logins refused, and logged in devices disconnected by an administrator, by reason.", "reason",
+		[]string{"auth", "denied", "banned", "admin_disconnect"},
+		[]uint64{
+			atomic.LoadUint64(&stats.authUnknownDevices) + atomic.LoadUint64(&stats.authBadResponses) + atomic.LoadUint64(&stats.authNoResponses),
+			atomic.LoadUint64(&stats.deniedLogins),
+			atomic.LoadUint64(&stats.bannedLogins),
+			atomic.LoadUint64(&stats.adminDisconnects),
+		})
+	m.counter("thermomatic_logouts_total", "Device logouts.", atomic.LoadUint64(&stats.logouts))
+	m.labeledCounter("thermomatic_readings_total", "Readings received, by validity.", "status",
+		[]string{"valid", "invalid"},
+		[]uint64{atomic.LoadUint64(&stats.readings), atomic.LoadUint64(&stats.invalidReadings)})
+	reasons := make([]string, 0, device.NumRejectReasons-1)
+	rejected := make([]uint64, 0, device.NumRejectReasons-1)
+	for reason := device.RejectReason(1); int(reason) < device.NumRejectReasons; reason++ {
+		reasons = append(reasons, reason.String())
+		rejected = append(rejected, atomic.LoadUint64(&stats.rejectedReadings[reason]))
+	}
+	m.labeledCounter("thermomatic_readings_rejected_total", "Invalid readings, by the validation rule which rejected them.", "reason",
+		reasons, rejected)
+	m.counter("thermomatic_readings_quarantined_total", "Readings of quarantined devices, not written to the sinks.",
+		atomic.LoadUint64(&stats.quarantinedReadings))
+	m.counter("thermomatic_sequence_gaps_total", "Readings whose sequence number does not follow the previous one of the device.",
+		atomic.LoadUint64(&stats.sequenceGaps))
+	m.counter("thermomatic_downlinks_total", "Downlink commands sent to devices.", atomic.LoadUint64(&stats.downlinks))
+	m.counter("thermomatic_acks_total", "Downlink commands acknowledged by devices.", atomic.LoadUint64(&stats.acks))
+	m.counter("thermomatic_read_bytes_total", "Bytes read from device connections.",
+		atomic.LoadUint64(&stats.bytesRead))
+	m.gauge("thermomatic_connected_devices", "Devices logged in.", float64(c.numConnectedDevices()))
+	m.gauge("thermomatic_pending_logins", "Device connections which did not log in yet.", float64(limits.PendingLogins))
+	if c.alerts != nil {
+		alerts := &c.alerts.stats
+		m.labeledCounter("thermomatic_alerts_total", "Alerts raised, by status.", "status",
+			[]string{"firing", "resolved"},
+			[]uint64{atomic.LoadUint64(&alerts.fired), atomic.LoadUint64(&alerts.resolved)})
+		m.labeledCounter("thermomatic_alert_notifications_total", "Alert notifications to webhooks, by result.", "result",
+			[]string{"sent", "failed", "dropped"},
+			[]uint64{
+				atomic.LoadUint64(&alerts.notificationsSent),
+				atomic.LoadUint64(&alerts.notificationsFailed),
+				atomic.LoadUint64(&alerts.notificationsDropped),
+			})
+	}
+	if c.geofences != nil {
+		geofences := &c.geofences.stats
+		m.labeledCounter("thermomatic_geofence_transitions_total", "Devices entering or exiting a geofence, by direction.", "direction",
+			[]string{"enter", "exit"},
+			[]uint64{atomic.LoadUint64(&geofences.enters), atomic.LoadUint64(&geofences.exits)})
+	}
+	if c.streams != nil {
+		m.gauge("thermomatic_stream_subscribers", "Live stream subscribers.", float64(atomic.LoadInt64(&c.streams.stats.subscribers)))
+		m.counter("thermomatic_stream_slow_consumers_total", "Live stream subscribers disconnected for falling behind.",
+			atomic.LoadUint64(&c.streams.stats.slowConsumers))
+	}
+	// sinks of the same kind share their series
+	var queues []string
+	var dropped []uint64
+	seen := make(map[string]int)
+	for _, sink := range c.sinks {
+		q, ok := sink.(*queuedSink)
+		if !ok {
+			continue
+		}
+		i, exists := seen[q.name]
+		if !exists {
+			i = len(queues)
+			seen[q.name] = i
+			queues = append(queues, q.name)
+			dropped = append(dropped, 0)
+		}
+		dropped[i] += atomic.LoadUint64(&q.dropped)
+	}
+	if len(queues) > 0 {
+		m.labeledCounter("thermomatic_sink_dropped_total", "Records dropped because the queue of the sink was full, by sink.", "sink",
+			queues, dropped)
+	}
+	m.histogram("thermomatic_reading_interval_seconds", "Time between consecutive readings of a device.",
+		c.metrics.readingInterval)
+	m.histogram("thermomatic_command_duration_seconds", "Time the core takes to process a command.",
+		c.metrics.commandDuration)
+	return m.w.Flush()
+}
+
+// metricsHandler serves the metrics of the core in the Prometheus text
+// exposition format.
+func (d *httpd) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := d.core.writeMetrics(w); err != nil {
+		d.log.Error("writing metrics", logging.F("err", err))
+	}
+}
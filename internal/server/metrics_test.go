@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(0.1, 1)
+	for _, v := range []float64{0.05, 0.1, 0.5, 2, 3} {
+		h.observe(v)
+	}
+	var buf bytes.Buffer
+	m := &metricsWriter{w: bufio.NewWriter(&buf)}
+	m.histogram("test_seconds", "A test histogram.", h)
+	m.w.Flush()
+
+	expected := `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="+Inf"} 5
+test_seconds_sum 5.65
+test_seconds_count 5
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestServer_Run_Metrics(t *testing.T) {
+	s, cancel, done := startTestServer(t, Config{MaxClients: 10, ShutdownTimeout: time.Second})
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn := dialTestDevice(t, s, []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8})
+	defer conn.Close()
+	payload := device.NewPayload(38, 10, 21.033643, -89.5969049, 45)
+	conn.Write(payload[:])
+	conn.Write(payload[:])
+	invalid := device.NewPayload(1000, 10, 21.033643, -89.5969049, 45)
+	conn.Write(invalid[:])
+	waitFor(t, "the readings", func() bool {
+		return atomic.LoadUint64(&s.core.stats.readings) == 2 && atomic.LoadUint64(&s.core.stats.invalidReadings) == 1
+	})
+
+	// never logs in
+	silent, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	waitForWithin(t, "the handshake timeout", 3*time.Second, func() bool {
+		return atomic.LoadUint64(&s.core.stats.handshakeTimeouts) == 1
+	})
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", s.httpLn.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %s", contentType)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, line := range []string{
+		"thermomatic_connections_accepted_total 2",
+		`thermomatic_connections_rejected_total{reason="max_clients"} 0`,
+		"thermomatic_handshake_timeouts_total 1",
+		"thermomatic_logins_total 1",
+		`thermomatic_logins_rejected_total{reason="banned"} 0`,
+		"thermomatic_sequence_gaps_total 0",
+		"thermomatic_downlinks_total 0",
+		`thermomatic_sink_dropped_total{sink="streams"} 0`,
+		`thermomatic_readings_total{status="valid"} 2`,
+		`thermomatic_readings_total{status="invalid"} 1`,
+		"thermomatic_read_bytes_total 135",
+		"thermomatic_connected_devices 1",
+		"thermomatic_reading_interval_seconds_count 1",
+		"# TYPE thermomatic_command_duration_seconds histogram",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+const (
+	// defaultRegistryShards is the number of shards of the device registry, it
+	// must be a power of 2.
+	defaultRegistryShards = 64
+	// shardCommandsBuffer is the capacity of each shard commands channel.
+	shardCommandsBuffer = 256
+)
+
+// registry holds the connected devices split in shards by IMEI.
+//
+// Each shard is owned by its own goroutine which processes the LOGIN, LOGOUT
+// and READING commands of the devices that hash to it, so devices in
+// different shards are processed in parallel.
+//
+// Lookups never lock: every shard publishes an immutable snapshot of its
+// devices map which is replaced (copy-on-write) on every register and
+// deregister, so the HTTP handlers can read it while readings flow.
+type registry struct {
+	shards []*shard
+	bits   uint
+}
+
+type shard struct {
+	// mux serializes writers of devices, readers use the snapshot
+	mux      sync.Mutex
+	devices  atomic.Value // map[uint64]*connectedDevice
+	commands chan common.Command
+}
+
+// connectedDevice is a logged in device. Its sessions and last reading are
+// written by the shard goroutine and read by anyone, so they are stored
+// atomically.
+type connectedDevice struct {
+	sessions atomic.Value // []deviceSession
+	last     atomic.Value // *lastReading
+}
+
+// deviceSession is a connection logged in with the IMEI of a device. A device
+// has more than one session only with the LoginAllowBoth policy.
+type deviceSession struct {
+	id              uint64
+	callbackChannel chan common.Command
+	// log is the logger of the connection, its records carry the session
+	log *logging.Logger
+	// info is shared by the copies of the session
+	info *sessionInfo
+}
+
+// kill closes the kill channel of the session, which makes its device client
+// close the connection, reason is recorded as the reason of its disconnection.
+// It returns false if the session was already killed.
+func (s deviceSession) kill(reason string) bool {
+	killed := false
+	s.info.killOnce.Do(func() {
+		s.info.killReason.Store(reason)
+		close(s.info.kill)
+		killed = true
+	})
+	return killed
+}
+
+type lastReading struct {
+	epoch   int64
+	reading device.Reading
+}
+
+func newRegistry(numShards int) *registry {
+	bits := uint(0)
+	for 1<<bits < numShards {
+		bits++
+	}
+	r := &registry{
+		shards: make([]*shard, 1<<bits),
+		bits:   bits,
+	}
+	for i := range r.shards {
+		s := &shard{
+			commands: make(chan common.Command, shardCommandsBuffer),
+		}
+		s.devices.Store(map[uint64]*connectedDevice{})
+		r.shards[i] = s
+	}
+	return r
+}
+
+// shardFor returns the shard owning imei. IMEIs are mixed with a Fibonacci
+// hash so sequential IMEIs spread evenly across shards.
+func (r *registry) shardFor(imei uint64) *shard {
+	if r.bits == 0 {
+		return r.shards[0]
+	}
+	return r.shards[(imei*0x9E3779B97F4A7C15)>>(64-r.bits)]
+}
+
+// get returns the device logged in with imei, it does NOT lock.
+func (r *registry) get(imei uint64) (*connectedDevice, bool) {
+	dev, exists := r.shardFor(imei).snapshot()[imei]
+	return dev, exists
+}
+
+// len returns the number of logged in devices, it does NOT lock.
+func (r *registry) len() int {
+	n := 0
+	for _, s := range r.shards {
+		n += len(s.snapshot())
+	}
+	return n
+}
+
+// each calls fn for every logged in device until fn returns false, it does NOT
+// lock so devices logged in or out meanwhile may or may not be visited.
+func (r *registry) each(fn func(imei uint64, dev *connectedDevice) bool) {
+	for _, s := range r.shards {
+		for imei, dev := range s.snapshot() {
+			if !fn(imei, dev) {
+				return
+			}
+		}
+	}
+}
+
+func (s *shard) snapshot() map[uint64]*connectedDevice {
+	return s.devices.Load().(map[uint64]*connectedDevice)
+}
+
+// add stores dev under imei unless there is a device already logged in with
+// that imei, it returns false in such case.
+func (s *shard) add(imei uint64, dev *connectedDevice) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	current := s.snapshot()
+	if _, exists := current[imei]; exists {
+		return false
+	}
+	next := make(map[uint64]*connectedDevice, len(current)+1)
+	for k, v := range current {
+		next[k] = v
+	}
+	next[imei] = dev
+	s.devices.Store(next)
+	return true
+}
+
+// remove deletes the device logged in with imei, it returns false if there
+// was none.
+func (s *shard) remove(imei uint64) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	current := s.snapshot()
+	if _, exists := current[imei]; !exists {
+		return false
+	}
+	next := make(map[uint64]*connectedDevice, len(current))
+	for k, v := range current {
+		if k != imei {
+			next[k] = v
+		}
+	}
+	s.devices.Store(next)
+	return true
+}
+
+func newConnectedDevice(session deviceSession) *connectedDevice {
+	dev := &connectedDevice{}
+	dev.storeSessions([]deviceSession{session})
+	return dev
+}
+
+// loadSessions returns the sessions of the device, oldest first. The returned
+// slice must not be modified.
+func (d *connectedDevice) loadSessions() []deviceSession {
+	sessions, _ := d.sessions.Load().([]deviceSession)
+	return sessions
+}
+
+func (d *connectedDevice) storeSessions(sessions []deviceSession) {
+	d.sessions.Store(sessions)
+}
+
+func (d *connectedDevice) storeReading(epoch int64, reading *device.Reading) {
+	d.last.Store(&lastReading{epoch: epoch, reading: *reading})
+}
+
+// loadReading returns a copy of the last reading, ok is unset when the device
+// did not send any valid reading yet.
+func (d *connectedDevice) loadReading() (epoch int64, reading device.Reading, ok bool) {
+	last, ok := d.last.Load().(*lastReading)
+	if !ok {
+		return 0, reading, false
+	}
+	return last.epoch, last.reading, true
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+func TestNewRegistry_RoundsShardsToPowerOf2(t *testing.T) {
+	for numShards, expected := range map[int]int{1: 1, 2: 2, 3: 4, 64: 64, 100: 128} {
+		if actual := len(newRegistry(numShards).shards); actual != expected {
+			t.Errorf("expected %d shards for %d got %d", expected, numShards, actual)
+		}
+	}
+}
+
+func TestRegistry_ShardFor_SpreadsSequentialIMEIs(t *testing.T) {
+	r := newRegistry(16)
+	perShard := make(map[*shard]int)
+	for imei := uint64(490154203237500); imei < 490154203237500+1600; imei++ {
+		perShard[r.shardFor(imei)]++
+	}
+	for i, s := range r.shards {
+		if perShard[s] < 50 || perShard[s] > 150 {
+			t.Errorf("expected around 100 IMEIs in shard %d got %d", i, perShard[s])
+		}
+	}
+}
+
+func TestRegistry_AddRemove(t *testing.T) {
+	r := newRegistry(4)
+	imei := uint64(448324242329542)
+	s := r.shardFor(imei)
+	before := s.snapshot()
+
+	if !s.add(imei, &connectedDevice{}) {
+		t.Fatal("expected the device to be added")
+	}
+	if s.add(imei, &connectedDevice{}) {
+		t.Error("expected a second add of the same IMEI to fail")
+	}
+	if _, exists := r.get(imei); !exists {
+		t.Error("expected the device to be found")
+	}
+	if len(before) != 0 {
+		t.Error("published snapshots should never be modified")
+	}
+	if r.len() != 1 {
+		t.Errorf("expected 1 device got %d", r.len())
+	}
+
+	if !s.remove(imei) {
+		t.Error("expected the device to be removed")
+	}
+	if s.remove(imei) {
+		t.Error("expected a second remove of the same IMEI to fail")
+	}
+	if r.len() != 0 {
+		t.Errorf("expected 0 devices got %d", r.len())
+	}
+}
+
+func TestRegistry_ConcurrentReadersAndWriters(t *testing.T) {
+	r := newRegistry(8)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				imei := uint64(w*1000 + i)
+				s := r.shardFor(imei)
+				dev := &connectedDevice{}
+				s.add(imei, dev)
+				dev.storeReading(int64(i), &device.Reading{Temperature: float64(i)})
+				if i%2 == 0 {
+					s.remove(imei)
+				}
+			}
+		}(w)
+	}
+	for readers := 0; readers < 4; readers++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				r.each(func(imei uint64, dev *connectedDevice) bool {
+					dev.loadReading()
+					return true
+				})
+				r.len()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if r.len() != 4*250 {
+		t.Errorf("expected %d devices got %d", 4*250, r.len())
+	}
+}
+
+func TestCore_Run_RoutesCommandsToShards(t *testing.T) {
+	core := newCore(common.FrozenInTime, uint(1337), 2)
+	sink := &memorySink{}
+	core.addSink(sink)
+	core.start()
+
+	imei := uint64(448324242329542)
+	callbackChannel := make(chan common.Command, 1)
+	core.commands <- common.Command{ID: common.LOGIN, Sender: imei, CallbackChannel: callbackChannel}
+	welcome := <-callbackChannel
+	if welcome.ID != common.WELCOME {
+		t.Fatalf("expected WELCOME got %v", welcome.ID)
+	}
+	if welcome.CallbackChannel != core.registry.shardFor(imei).commands {
+		t.Fatal("expected WELCOME to carry the commands channel of the device shard")
+	}
+
+	payload := device.NewPayload(38, 10, 21.033643, -89.5969049, 45)
+	welcome.CallbackChannel <- common.Command{ID: common.READING, Sender: imei, Body: payload[:]}
+	welcome.CallbackChannel <- common.Command{ID: common.LOGOUT, Sender: imei, Session: welcome.Session}
+	waitFor(t, "the shard to process the commands", func() bool { return core.numConnectedDevices() == 0 })
+	core.stop()
+	if len(sink.records) != 1 {
+		t.Errorf("expected 1 reading in the sink got %d", len(sink.records))
+	}
+	if !sink.closed {
+		t.Error("expected stop to close the sinks")
+	}
+}
+
+// countingSink counts written records, it is safe for concurrent use.
+type countingSink struct {
+	wg *sync.WaitGroup
+	n  uint64
+}
+
+func (s *countingSink) Write(rec Record) error {
+	atomic.AddUint64(&s.n, 1)
+	s.wg.Done()
+	return nil
+}
+func (s *countingSink) Flush() error { return nil }
+func (s *countingSink) Close() error { return nil }
+
+// BenchmarkRegistry_Readings measures end to end throughput of READING
+// commands sent by 1024 devices through their shards. Compare the single shard
+// (the former single core.run goroutine) with the sharded registry using
+//
+//	go test ./internal/server -run xxx -bench Registry_Readings -cpu 1,2,4,8
+func BenchmarkRegistry_Readings(b *testing.B) {
+	for _, numShards := range []int{1, defaultRegistryShards} {
+		b.Run(fmt.Sprintf("shards=%d", numShards), func(b *testing.B) {
+			benchmarkRegistryReadings(b, numShards, 1024)
+		})
+	}
+}
+
+func benchmarkRegistryReadings(b *testing.B, numShards int, numDevices int) {
+	// common.FrozenInTime loads a time zone on every call, too slow here
+	frozen := common.FrozenInTime()
+	core := newCore(func() time.Time { return frozen }, uint(1337), uint(numDevices))
+	core.registry = newRegistry(numShards)
+	var processed sync.WaitGroup
+	core.addSink(&countingSink{wg: &processed})
+
+	imeis := make([]uint64, numDevices)
+	for i := range imeis {
+		imeis[i] = uint64(490154203237518 + i)
+		if err := core.register(imeis[i], make(chan common.Command, 1), nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	core.start()
+	payload := device.NewPayload(38, 10, 21.033643, -89.5969049, 45)
+	var nextDevice uint64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	processed.Add(b.N)
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&nextDevice, 1))
+		for pb.Next() {
+			imei := imeis[i%numDevices]
+			core.registry.shardFor(imei).commands <- common.Command{
+				ID:     common.READING,
+				Sender: imei,
+				Body:   payload[:],
+			}
+			i++
+		}
+	})
+	processed.Wait()
+	b.StopTimer()
+
+	core.stop()
+}
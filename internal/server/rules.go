@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+// ruleSet holds the validation rules of the readings, the default ones and the
+// overrides of some devices.
+type ruleSet struct {
+	defaults device.Rules
+	devices  map[uint64]*device.Rules
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{defaults: device.DefaultRules()}
+}
+
+// forDevice returns the rules of imei, they must not be modified.
+func (rs *ruleSet) forDevice(imei uint64) *device.Rules {
+	if rules, ok := rs.devices[imei]; ok {
+		return rules
+	}
+	return &rs.defaults
+}
+
+// rulesFile is the content of a rules file.
+type rulesFile struct {
+	Default json.RawMessage            `json:"default"`
+	Devices map[string]json.RawMessage `json:"devices"`
+}
+
+// loadRules reads a JSON rules file:
+//
+//	{
+//	  "default": {"temperature": {"min": -40, "max": 85}, "maxTemperatureJump": 10},
+//	  "devices": {
+//	    "490154203237518": {"temperature": {"min": -80, "max": 20}, "maxTemperatureJump": 0}
+//	  }
+//	}
+//
+// The default rules override the ranges of the protocol spec, and the rules of
+// each device override the default ones, only the fields present in the file
+// are overridden.
+func loadRules(path string) (*ruleSet, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file rulesFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("parsing rules %s, %v", path, err)
+	}
+	rs := newRuleSet()
+	if err := overrideRules(&rs.defaults, file.Default); err != nil {
+		return nil, fmt.Errorf("rules %s, default rules, %v", path, err)
+	}
+	rs.devices = make(map[uint64]*device.Rules, len(file.Devices))
+	for imeiStr, raw := range file.Devices {
+		imei, err := parseIMEI(imeiStr)
+		if err != nil {
+			return nil, fmt.Errorf("rules %s, %v", path, err)
+		}
+		rules := rs.defaults
+		if err := overrideRules(&rules, raw); err != nil {
+			return nil, fmt.Errorf("rules %s, rules of %d, %v", path, imei, err)
+		}
+		rs.devices[imei] = &rules
+	}
+	return rs, nil
+}
+
+// overrideRules sets the fields of rules present in raw, and validates them.
+func overrideRules(rules *device.Rules, raw json.RawMessage) error {
+	if len(raw) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(rules); err != nil {
+			return err
+		}
+	}
+	return rules.Validate()
+}
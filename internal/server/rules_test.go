@@ -0,0 +1,126 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+func writeRules(t *testing.T, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "thermomatic-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRules(t *testing.T) {
+	rs, err := loadRules(writeRules(t, `{
+		"default": {"temperature": {"min": -40, "max": 85}, "maxTemperatureJump": 10},
+		"devices": {"490154203237518": {"temperature": {"max": 20}, "maxTemperatureJump": 0}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := rs.forDevice(448324242329542)
+	if defaults.Temperature != (device.Range{Min: -40, Max: 85}) || defaults.MaxTemperatureJump != 10 {
+		t.Errorf("unexpected default rules %+v", defaults)
+	}
+	if defaults.Latitude != device.DefaultRules().Latitude {
+		t.Errorf("expected the fields missing from the file to keep the spec ranges, got %+v", defaults.Latitude)
+	}
+	overridden := rs.forDevice(490154203237518)
+	if overridden.Temperature != (device.Range{Min: -40, Max: 20}) || overridden.MaxTemperatureJump != 0 {
+		t.Errorf("expected the device rules to override the default ones, got %+v", overridden)
+	}
+
+	for _, content := range []string{
+		`{"default": {"temperature": {"min": 10, "max": -10}}}`,
+		`{"default": {"temprature": {"min": 10}}}`,
+		`{"devices": {"123": {}}}`,
+		`[]`,
+	} {
+		if _, err := loadRules(writeRules(t, content)); err == nil {
+			t.Errorf("expected an error loading %s", content)
+		}
+	}
+}
+
+func TestCore_HandleReading_Rules(t *testing.T) {
+	rs, err := loadRules(writeRules(t, `{
+		"default": {"maxTemperatureJump": 5},
+		"devices": {"490154203237518": {"temperature": {"min": -80, "max": -10}}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	core := newCore(common.FrozenInTime, uint(1337), 2)
+	core.rules = rs
+	core.loginPolicy = LoginAllowBoth
+	freezer, other := uint64(490154203237518), uint64(448324242329542)
+	// other has a second session, a distinct device sharing its IMEI
+	for _, imei := range []uint64{freezer, other, other} {
+		if err := core.register(imei, make(chan common.Command, 1), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	session := func(imei uint64, i int) *sessionInfo {
+		dev, _ := core.deviceByIMEI(imei)
+		return dev.loadSessions()[i].info
+	}
+
+	for _, tc := range []struct {
+		imei        uint64
+		session     int
+		temperature float64
+		battery     float64
+		valid       bool
+	}{
+		{other, 0, 20, 50, true},
+		{other, 1, 40, 50, true},  // the other session has its own baseline
+		{other, 0, 26, 50, false}, // jump
+		{other, 0, 21, 50, true},  // compared to the last accepted reading
+		{other, 0, 27, 50, false}, // jump
+		{other, 0, 27, 50, false}, // jump
+		{other, 0, 28, 50, false}, // jump, it becomes the baseline
+		{other, 0, 29, 50, true},
+		{other, 1, 41, 50, true},
+		{other, 0, 29, 0, false}, // empty battery
+		{freezer, 0, -20, 50, true},
+		{freezer, 0, 20, 50, false}, // out of the device range
+	} {
+		payload := device.NewPayload(tc.temperature, 10, 21.03, -89.59, tc.battery)
+		if err := core.handleReading(tc.imei, session(tc.imei, tc.session), 0, payload[:]); (err == nil) != tc.valid {
+			t.Errorf("reading %+v, expected valid:%v got %v", tc, tc.valid, err)
+		}
+	}
+
+	stats := &core.stats
+	for reason, expected := range map[device.RejectReason]uint64{
+		device.RejectTemperatureJump: 4,
+		device.RejectBatteryLevel:    1,
+		device.RejectTemperature:     1,
+	} {
+		if count := atomic.LoadUint64(&stats.rejectedReadings[reason]); count != expected {
+			t.Errorf("expected %d readings rejected by %v got %d", expected, reason, count)
+		}
+	}
+	if invalid := atomic.LoadUint64(&stats.invalidReadings); invalid != 6 {
+		t.Errorf("expected 6 invalid readings got %d", invalid)
+	}
+	if valid := atomic.LoadUint64(&stats.readings); valid != 6 {
+		t.Errorf("expected 6 valid readings got %d", valid)
+	}
+}
@@ -1,23 +1,321 @@
 package server
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/spin-org/thermomatic/internal/logging"
+	"github.com/spin-org/thermomatic/internal/storage"
 )
 
-// Start creates a tcp connection listener to accept connections at `port`
-func Start(port uint, httpPort uint, serverMaxClients uint) {
-	log.Printf("starting server demons  with \n  - thermomatic port:%d\n - httpPort:%d\n -serverMaxClients: %d\n",
-		port, httpPort, serverMaxClients)
+// Config holds the settings of the thermomatic server.
+type Config struct {
+	// Port to listen for TCP connections of thermomatic devices.
+	Port uint
+	// HTTPPort to listen for HTTP connections.
+	HTTPPort uint
+	// MaxClients is the maximum number of connected devices.
+	MaxClients uint
+	// LoginPolicy decides what happens when a device logs in with the IMEI of
+	// a device which is already logged in.
+	LoginPolicy LoginPolicy
+	// Sinks are the outputs where every valid reading is written to, stdout
+	// when empty.
+	Sinks []SinkConfig
+	// DataDir is where readings are persisted, they are not persisted when empty.
+	DataDir string
+	// RetentionAge is how long persisted readings are kept, 0 keeps them forever.
+	RetentionAge time.Duration
+	// RetentionBytes bounds the size of the persisted readings of each device,
+	// 0 means no limit.
+	RetentionBytes int64
+	// TLSCertFile and TLSKeyFile are the PEM certificate and key of the
+	// device listener, devices connect over plain TCP when they are empty.
+	// Both files are reloaded when they change.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile turns mutual TLS on, devices must present a certificate
+	// signed by one of its PEM certificates whose common name is their IMEI.
+	TLSClientCAFile string
+	// CredentialsFile holds the secrets of the devices, see LoadCredentials.
+	// When it is set devices must answer the login challenge with their
+	// secret.
+	CredentialsFile string
+	// Limits bounds the connections accepted from devices.
+	Limits ConnLimits
+	// InventoryFile lists the devices allowed to log in, see inventory. Any
+	// device may log in when it is empty. It is reloaded on SIGHUP or when it
+	// changes.
+	InventoryFile string
+	// RulesFile holds the validation rules of the readings, see loadRules.
+	// The ranges of the protocol spec are used when it is empty.
+	RulesFile string
+	// AlertsFile holds the alert rules and the webhooks they are notified
+	// to, see loadAlerts. No alert is raised when it is empty.
+	AlertsFile string
+	// GeofencesFile holds the geofences, see geofencer. Positions are not
+	// tracked when it is empty, a missing file has no geofence yet.
+	GeofencesFile string
+	// SessionHistory is the number of finished sessions kept per device,
+	// defaultSessionHistorySize when it is 0.
+	SessionHistory int
+	// SessionsFile persists the finished sessions, they are only kept in
+	// memory when it is empty.
+	SessionsFile string
+	// ShutdownTimeout bounds how long a graceful shutdown waits for devices to
+	// disconnect, and then for HTTP requests to finish.
+	ShutdownTimeout time.Duration
+}
+
+// DefaultShutdownTimeout is used when Config.ShutdownTimeout is not set.
+const DefaultShutdownTimeout = 10 * time.Second
+
+// Start runs the thermomatic and HTTP servers until SIGINT or SIGTERM is
+// received, then it shuts them down gracefully.
+func Start(cfg Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s, err := newServer(cfg)
+	if err != nil {
+		return err
+	}
+	s.run(ctx)
+	return nil
+}
+
+// server wires the core, its listeners and the httpd together.
+type server struct {
+	cfg     Config
+	core    *core
+	store   *storage.Store
+	httpd   *httpd
+	ln      net.Listener
+	httpLn  net.Listener
+	started time.Time
+}
+
+// newServer opens the sinks and the listeners described by cfg.
+func newServer(cfg Config) (*server, error) {
+	logging.Info("starting server", logging.F("port", int(cfg.Port)), logging.F("httpPort", int(cfg.HTTPPort)),
+		logging.F("maxClients", int(cfg.MaxClients)))
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = DefaultShutdownTimeout
+	}
+
+	core := newCore(time.Now, cfg.Port, cfg.MaxClients)
+	core.loginPolicy = cfg.LoginPolicy
+	core.limiter = newConnLimiter(cfg.Limits, time.Now)
+	core.sessions = newSessionHistory(cfg.SessionHistory)
+	if cfg.SessionsFile != "" {
+		sessions, err := openSessionHistory(cfg.SessionsFile, cfg.SessionHistory)
+		if err != nil {
+			core.stop()
+			return nil, fmt.Errorf("loading sessions, %v", err)
+		}
+		core.sessions = sessions
+		logging.Info("persisting sessions", logging.F("devices", len(sessions.rings)), logging.F("sessions", cfg.SessionsFile))
+	}
+	if cfg.CredentialsFile != "" {
+		secrets, err := LoadCredentials(cfg.CredentialsFile)
+		if err != nil {
+			core.stop()
+			return nil, fmt.Errorf("loading credentials, %v", err)
+		}
+		core.requireAuthentication(secrets)
+		logging.Info("authenticating logins", logging.F("devices", len(secrets)), logging.F("credentials", cfg.CredentialsFile))
+	}
+	if cfg.InventoryFile != "" {
+		inv, err := openInventory(cfg.InventoryFile)
+		if err != nil {
+			core.stop()
+			return nil, fmt.Errorf("loading inventory, %v", err)
+		}
+		core.inventory = inv
+		logging.Info("allowing the logins of the inventory", logging.F("devices", len(inv.snapshot())), logging.F("inventory", cfg.InventoryFile))
+	}
+	if cfg.RulesFile != "" {
+		rules, err := loadRules(cfg.RulesFile)
+		if err != nil {
+			core.stop()
+			return nil, fmt.Errorf("loading rules, %v", err)
+		}
+		core.rules = rules
+		logging.Info("validating readings with rules", logging.F("overrides", len(rules.devices)), logging.F("rules", cfg.RulesFile))
+	}
+	if cfg.AlertsFile != "" {
+		alertsCfg, err := loadAlerts(cfg.AlertsFile)
+		if err != nil {
+			core.stop()
+			return nil, fmt.Errorf("loading alerts, %v", err)
+		}
+		core.alerts = newAlerter(alertsCfg, time.Now, alertsCheckInterval, cfg.ShutdownTimeout)
+		// a dropped reading could miss a firing or resolved alert
+		core.addSink(newQueuedSink("alerts", core.alerts, defaultSinkQueueSize, policyBlock))
+		logging.Info("raising alerts", logging.F("rules", len(alertsCfg.Rules)), logging.F("webhooks", len(alertsCfg.Webhooks)),
+			logging.F("alerts", cfg.AlertsFile))
+	}
+	if cfg.GeofencesFile != "" {
+		geofences, err := openGeofences(cfg.GeofencesFile, core.deviceSite)
+		if err != nil {
+			core.stop()
+			return nil, fmt.Errorf("loading geofences, %v", err)
+		}
+		core.geofences = geofences
+		// a dropped reading could miss an enter or exit transition
+		core.addSink(newQueuedSink("geofences", geofences, defaultSinkQueueSize, policyBlock))
+		logging.Info("tracking geofences", logging.F("geofences", len(geofences.fences)), logging.F("file", cfg.GeofencesFile))
+	}
+	core.streams = newStreamHub(core.deviceSite)
+	core.addSink(newQueuedSink("streams", core.streams, defaultSinkQueueSize, policyDrop))
+	sinks := cfg.Sinks
+	if len(sinks) == 0 {
+		stdout, _ := ParseSinkConfig("stdout")
+		sinks = []SinkConfig{stdout}
+	}
+	for _, sinkCfg := range sinks {
+		sink, err := openSink(sinkCfg)
+		if err != nil {
+			core.stop()
+			return nil, fmt.Errorf("opening sink %v, %v", sinkCfg, err)
+		}
+		logging.Info("writing readings to sink", logging.F("sink", sinkCfg))
+		core.addSink(sink)
+	}
+
+	var store *storage.Store
+	if cfg.DataDir != "" {
+		var err error
+		store, err = storage.Open(cfg.DataDir, storage.Options{
+			MaxAge:   cfg.RetentionAge,
+			MaxBytes: cfg.RetentionBytes,
+		})
+		if err != nil {
+			core.stop()
+			return nil, err
+		}
+		logging.Info("persisting readings", logging.F("dir", cfg.DataDir), logging.F("retentionAge", cfg.RetentionAge),
+			logging.F("retentionBytes", cfg.RetentionBytes))
+		core.addSink(newQueuedSink("storage", newStorageSink(store), defaultSinkQueueSize, policyBlock))
+	}
+
+	address := fmt.Sprintf(":%d", cfg.Port)
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		core.stop()
+		return nil, fmt.Errorf("failed to start tcp listener at %s, %v", address, err)
+	}
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		reloader, err := newTLSReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile, time.Now)
+		if err != nil {
+			ln.Close()
+			core.stop()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, reloader.listenerConfig())
+		logging.Info("devices connect over tls", logging.F("certificate", cfg.TLSCertFile), logging.F("mutual", cfg.TLSClientCAFile != ""))
+	} else if cfg.TLSClientCAFile != "" {
+		ln.Close()
+		core.stop()
+		return nil, fmt.Errorf("a tls client ca requires a tls certificate and key")
+	}
+	httpAddress := fmt.Sprintf(":%d", cfg.HTTPPort)
+	httpLn, err := net.Listen("tcp", httpAddress)
+	if err != nil {
+		ln.Close()
+		core.stop()
+		return nil, fmt.Errorf("failed to start http listener at %s, %v", httpAddress, err)
+	}
+
+	httpd := newHttpd(core, cfg.HTTPPort)
+	httpd.store = store
+	return &server{
+		cfg:    cfg,
+		core:   core,
+		store:  store,
+		httpd:  httpd,
+		ln:     ln,
+		httpLn: httpLn,
+	}, nil
+}
+
+// run serves devices and HTTP requests until ctx is done, then it shuts down in
+// order:
+//
+//  1. stop accepting device connections
+//  2. kill every connected device.Client and wait for them to finish
+//  3. process the queued commands and flush every sink
+//  4. shut down the HTTP server, waiting at most cfg.ShutdownTimeout
+//  5. log a summary
+func (s *server) run(ctx context.Context) {
+	s.started = time.Now()
+	s.core.start()
+
+	var listeners sync.WaitGroup
+	listeners.Add(2)
+	go func() {
+		defer listeners.Done()
+		s.core.listenConnections(s.ln)
+	}()
+	go func() {
+		defer listeners.Done()
+		s.httpd.serve(s.httpLn)
+	}()
+	if s.core.inventory != nil {
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			s.watchInventory(ctx)
+		}()
+	}
+
+	<-ctx.Done()
+	shutdownStarted := time.Now()
+	logging.Info("shutting down", logging.F("reason", ctx.Err()))
+
+	s.ln.Close()
+	killed := s.core.killAll()
+	logging.Info("waiting for the connected devices to disconnect", logging.F("devices", killed))
+	if !s.core.waitClients(s.cfg.ShutdownTimeout) {
+		logging.Warn("devices did not disconnect in time", logging.F("timeout", s.cfg.ShutdownTimeout),
+			logging.F("connected", s.core.numConnectedDevices()))
+	}
 
-	core := newCore(time.Now, port, serverMaxClients)
-	httpd := newHttpd(core, httpPort)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go core.run(&wg)
-	go httpd.run()
+	s.core.stop()
 
-	wg.Wait()
+	httpCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	if err := s.httpd.shutdown(httpCtx); err != nil {
+		logging.Error("shutting down the http server", logging.F("err", err))
+	}
+	listeners.Wait()
 
+	stats := &s.core.stats
+	logging.Info("shutdown complete",
+		logging.F("took", time.Since(shutdownStarted).Round(time.Millisecond)),
+		logging.F("uptime", shutdownStarted.Sub(s.started).Round(time.Second)),
+		logging.F("logins", atomic.LoadUint64(&stats.logins)),
+		logging.F("logouts", atomic.LoadUint64(&stats.logouts)),
+		logging.F("authenticated", atomic.LoadUint64(&stats.authenticated)),
+		logging.F("authUnknownDevices", atomic.LoadUint64(&stats.authUnknownDevices)),
+		logging.F("authBadResponses", atomic.LoadUint64(&stats.authBadResponses)),
+		logging.F("authNoResponses", atomic.LoadUint64(&stats.authNoResponses)),
+		logging.F("deniedLogins", atomic.LoadUint64(&stats.deniedLogins)),
+		logging.F("bannedLogins", atomic.LoadUint64(&stats.bannedLogins)),
+		logging.F("adminDisconnects", atomic.LoadUint64(&stats.adminDisconnects)),
+		logging.F("readings", atomic.LoadUint64(&stats.readings)),
+		logging.F("invalidReadings", atomic.LoadUint64(&stats.invalidReadings)),
+		logging.F("sequenceGaps", atomic.LoadUint64(&stats.sequenceGaps)),
+		logging.F("quarantinedReadings", atomic.LoadUint64(&stats.quarantinedReadings)),
+		logging.F("commands", atomic.LoadUint64(&stats.downlinks)),
+		logging.F("acks", atomic.LoadUint64(&stats.acks)),
+		logging.F("connected", s.core.numConnectedDevices()))
 }
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
+	"github.com/spin-org/thermomatic/internal/storage"
+)
+
+// startTestServer runs a server listening on random ports until the returned
+// cancel function is called, done is closed once it has shut down.
+func startTestServer(t *testing.T, cfg Config) (s *server, cancel context.CancelFunc, done chan struct{}) {
+	t.Helper()
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done = make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+	return s, cancel, done
+}
+
+// dialTestDevice connects a device to s and logs it in with imei.
+func dialTestDevice(t *testing.T, s *server, imei []byte) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(imei); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// waitFor polls condition until it is true or a second elapses.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	waitForWithin(t, what, time.Second, condition)
+}
+
+// waitForWithin polls condition until it is true or timeout elapses.
+func waitForWithin(t *testing.T, what string, timeout time.Duration, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServer_Run_GracefulShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "readings.csv")
+	fileSink, err := ParseSinkConfig("file:path=" + output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, cancel, done := startTestServer(t, Config{
+		MaxClients:      10,
+		Sinks:           []SinkConfig{fileSink},
+		ShutdownTimeout: time.Second,
+	})
+	defer cancel()
+
+	conn := dialTestDevice(t, s, []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8})
+	defer conn.Close()
+	waitFor(t, "the device to log in", func() bool { return s.core.numConnectedDevices() == 1 })
+	for i := 0; i < 3; i++ {
+		payload := device.NewPayload(float64(i), 10, 21.033643, -89.5969049, 45)
+		conn.Write(payload[:])
+	}
+	waitFor(t, "the readings", func() bool { return atomic.LoadUint64(&s.core.stats.readings) == 3 })
+
+	httpURL := fmt.Sprintf("http://%s/stats", s.httpLn.Addr())
+	if _, err := http.Get(httpURL); err != nil {
+		t.Fatalf("unexpected error requesting %s, %v", httpURL, err)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the server to shut down")
+	}
+
+	// the device connection was closed by the server
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the device connection to be closed")
+	}
+	if s.core.numConnectedDevices() != 0 {
+		t.Errorf("expected every device to be logged out, %d still connected", s.core.numConnectedDevices())
+	}
+	if _, err := net.Dial("tcp", s.ln.Addr().String()); err == nil {
+		t.Error("expected the server to stop accepting device connections")
+	}
+	if _, err := http.Get(httpURL); err == nil {
+		t.Error("expected the http server to be shut down")
+	}
+
+	// every reading was flushed to the sink
+	content, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(content), "\n"); lines != 3 {
+		t.Errorf("expected 3 readings in the sink got %d:\n%s", lines, content)
+	}
+}
+
+func TestServer_Run_ShutdownWithPendingLogin(t *testing.T) {
+	s, cancel, done := startTestServer(t, Config{MaxClients: 10, ShutdownTimeout: 2 * time.Second})
+	defer cancel()
+
+	// connected but never logs in, the 1s login deadline bounds the shutdown
+	conn, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the server to shut down")
+	}
+}
+
+func TestServer_Run_ReplaceOldLogin(t *testing.T) {
+	s, cancel, done := startTestServer(t, Config{
+		MaxClients:      10,
+		LoginPolicy:     LoginReplaceOld,
+		ShutdownTimeout: time.Second,
+	})
+	defer func() {
+		cancel()
+		<-done
+	}()
+	imei := []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}
+
+	// the old connection stays open, as a half-open socket of a rebooted device
+	old := dialTestDevice(t, s, imei)
+	defer old.Close()
+	waitFor(t, "the device to log in", func() bool { return s.core.numConnectedDevices() == 1 })
+	rebooted := dialTestDevice(t, s, imei)
+	defer rebooted.Close()
+	waitFor(t, "the rebooted device to log in", func() bool {
+		return atomic.LoadUint64(&s.core.stats.logins) == 2
+	})
+
+	old.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := old.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the old connection to be closed")
+	}
+	payload := device.NewPayload(38, 10, 21.033643, -89.5969049, 45)
+	rebooted.Write(payload[:])
+	waitFor(t, "the reading of the rebooted device", func() bool {
+		return atomic.LoadUint64(&s.core.stats.readings) == 1
+	})
+	if s.core.numConnectedDevices() != 1 {
+		t.Errorf("expected the rebooted device to be logged in, %d connected", s.core.numConnectedDevices())
+	}
+}
+
+func TestServer_Run_PersistsReadings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	devNull, _ := ParseSinkConfig("file:path=" + filepath.Join(dir, "readings.csv"))
+
+	s, cancel, done := startTestServer(t, Config{
+		MaxClients: 10,
+		Sinks:      []SinkConfig{devNull},
+		DataDir:    filepath.Join(dir, "data"),
+	})
+	defer cancel()
+
+	conn := dialTestDevice(t, s, []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8})
+	defer conn.Close()
+	expected := device.NewPayload(38, 10, 21.033643, -89.5969049, 45)
+	conn.Write(expected[:])
+	conn.Write(expected[:])
+	waitFor(t, "the readings", func() bool { return atomic.LoadUint64(&s.core.stats.readings) == 2 })
+	cancel()
+	<-done
+
+	// history survives the restart
+	store, err := storage.Open(filepath.Join(dir, "data"), storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []storage.Entry
+	store.Scan(490154203237518, 0, time.Now().UnixNano(), func(e storage.Entry) bool {
+		entries = append(entries, e)
+		return true
+	})
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 persisted readings got %d", len(entries))
+	}
+	if entries[0].Payload != expected {
+		t.Errorf("expected payload %v got %v", expected, entries[0].Payload)
+	}
+}
+
+func TestServer_Run_Downlink(t *testing.T) {
+	s, cancel, done := startTestServer(t, Config{MaxClients: 10, ShutdownTimeout: time.Second})
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn := dialTestDevice(t, s, []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8})
+	defer conn.Close()
+	waitFor(t, "the device to log in", func() bool { return s.core.numConnectedDevices() == 1 })
+
+	url := fmt.Sprintf("http://%s/devices/490154203237518/commands", s.httpLn.Addr())
+	resp, err := http.Post(url, "application/json", strings.NewReader(`{"type":"set-reading-interval","value":100}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %d got %d", http.StatusAccepted, resp.StatusCode)
+	}
+
+	var frame [device.DownlinkFrameSize]byte
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, frame[:]); err != nil {
+		t.Fatal(err)
+	}
+	var downlink device.Downlink
+	if !downlink.Decode(frame[:]) || downlink.Type != device.SetReadingInterval || downlink.Arg != 100 {
+		t.Fatalf("unexpected downlink frame %v", frame)
+	}
+
+	ack := device.Ack{ID: downlink.ID, Status: device.AckOK}
+	ackFrame := ack.Encode()
+	conn.Write(ackFrame[:])
+	waitFor(t, "the ack", func() bool { return atomic.LoadUint64(&s.core.stats.acks) == 1 })
+	if readings := atomic.LoadUint64(&s.core.stats.invalidReadings); readings != 0 {
+		t.Errorf("expected the ack not to be handled as a reading, %d invalid readings", readings)
+	}
+}
+
+func TestServer_Run_ProtocolV2(t *testing.T) {
+	s, cancel, done := startTestServer(t, Config{MaxClients: 10, ShutdownTimeout: time.Second})
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	imei := []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}
+	conn := dialTestDevice(t, s, append(imei, device.V2Marker))
+	defer conn.Close()
+
+	reading := device.Reading{
+		Temperature:  38,
+		Altitude:     10,
+		Latitude:     21.033643,
+		Longitude:    -89.5969049,
+		BatteryLevel: 45,
+		Humidity:     63.5,
+		Fields:       device.FieldSequence | device.FieldHumidity,
+	}
+	// the third reading was lost
+	for _, sequence := range []uint32{1, 2, 4} {
+		reading.Sequence = sequence
+		conn.Write(device.AppendFrameV2(nil, device.AppendPayloadV2(nil, &reading)))
+	}
+	waitFor(t, "the readings", func() bool { return atomic.LoadUint64(&s.core.stats.readings) == 3 })
+
+	_, last, exists := s.core.deviceLastReading(490154203237518)
+	if !exists || last == nil {
+		t.Fatal("expected the device to have a last reading")
+	}
+	if *last != reading {
+		t.Errorf("expected last reading %+v got %+v", reading, *last)
+	}
+	if gaps := atomic.LoadUint64(&s.core.stats.sequenceGaps); gaps != 1 {
+		t.Errorf("expected 1 sequence gap got %d", gaps)
+	}
+
+	// a short frame, and a v1 payload, are malformed v2 readings
+	v1 := device.NewPayload(38, 10, 21.03, -89.59, 45)
+	conn.Write(device.AppendFrameV2(nil, []byte{1, 2}))
+	conn.Write(device.AppendFrameV2(nil, v1[:]))
+	malformed := &s.core.stats.rejectedReadings[device.RejectMalformed]
+	waitFor(t, "the malformed readings", func() bool { return atomic.LoadUint64(malformed) == 2 })
+	if readings := atomic.LoadUint64(&s.core.stats.readings); readings != 3 {
+		t.Errorf("expected the malformed readings to be rejected, got %d readings", readings)
+	}
+}
+
+func TestServer_Run_LoadGarbageV2(t *testing.T) {
+	s, cancel, done := startTestServer(t, Config{MaxClients: 10, ShutdownTimeout: time.Second})
+	defer func() {
+		cancel()
+		<-done
+	}()
+	report, err := device.RunLoad(context.Background(), device.LoadConfig{
+		ServerAddress: s.ln.Addr().String(),
+		Devices:       1,
+		Duration:      100 * time.Millisecond,
+		ReadingRate:   10 * time.Millisecond,
+		Mix:           []device.LoadShare{{Profile: device.LoadGarbage, Weight: 1}},
+		FirstSerial:   49015420323751,
+		Protocol:      device.ProtocolV2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the garbage is well framed, so it is rejected without closing the session
+	if report.Logins != 1 || report.Disconnects != 0 || report.Readings == 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	waitFor(t, "the rejected readings", func() bool { return atomic.LoadUint64(&s.core.stats.invalidReadings) == report.Readings })
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.String()
+}
+
+func TestServer_Run_LifecycleEvents(t *testing.T) {
+	var out syncBuffer
+	defaultLogger := logging.Default()
+	logging.SetDefault(logging.New(&out, logging.LevelInfo, logging.FormatLogfmt))
+	defer logging.SetDefault(defaultLogger)
+
+	s, cancel, done := startTestServer(t, Config{MaxClients: 10, ShutdownTimeout: time.Second})
+	conn := dialTestDevice(t, s, []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8})
+	remote := " remote=" + conn.LocalAddr().String()
+	waitFor(t, "the device to log in", func() bool { return s.core.numConnectedDevices() == 1 })
+	conn.Close()
+	waitFor(t, "the device to log out", func() bool { return s.core.numConnectedDevices() == 0 })
+	cancel()
+	<-done
+
+	var events []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if !strings.Contains(line, " conn=1 ") {
+			continue
+		}
+		if !strings.Contains(line, remote) {
+			t.Errorf("expected the remote address in %q", line)
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[2], "event=") {
+			continue
+		}
+		event := strings.TrimPrefix(fields[2], "event=")
+		events = append(events, event)
+		if event != "accept" && !strings.Contains(line, " imei=490154203237518") {
+			t.Errorf("expected the IMEI in %q", line)
+		}
+	}
+	expected := "accept login welcome logout close"
+	if strings.Join(events, " ") != expected {
+		t.Errorf("expected the events %q but got %q", expected, events)
+	}
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// Reasons of the sessions killed by the core, the others finish with the
+// reason sent by the device client on LOGOUT, e.g. device.LogoutTimeout.
+const (
+	disconnectShutdown = "shutdown"
+	disconnectReplaced = "replaced"
+	disconnectDenied   = "denied"
+	disconnectAdmin    = "admin"
+)
+
+const (
+	// defaultSessionHistorySize is the number of finished sessions kept per
+	// device when it is not configured.
+	defaultSessionHistorySize = 64
+	// defaultUptimeWindow is the window of GET /devices/:imei/uptime when the
+	// request has none.
+	defaultUptimeWindow = 24 * time.Hour
+)
+
+// sessionInfo tracks a session while it is logged in.
+type sessionInfo struct {
+	conn    *common.ConnInfo
+	loginAt time.Time
+	// readings received in the session, updated atomically
+	readings uint64
+	// killReason is why the core killed the session, if it did
+	killReason atomic.Value // string
+	// kill is closed, once, when the core kills the session
+	kill     chan struct{}
+	killOnce sync.Once
+	// checks validates the readings of the session against the previous ones
+	checks readingChecks
+}
+
+// readingChecks is what a session remembers of its readings to validate the
+// next one, it is only accessed by the shard goroutine. It is kept per session
+// as the sessions of a device, with LoginAllowBoth, are distinct devices
+// sharing an IMEI.
+type readingChecks struct {
+	// sequence is the sequence number of the last v2 reading
+	sequence    uint32
+	hasSequence bool
+	// temperature is the temperature of the last accepted reading, the
+	// baseline of the jump check
+	temperature    float64
+	hasTemperature bool
+	// jumps counts the consecutive readings rejected by the jump check
+	jumps int
+}
+
+// newSessionInfo tracks a session logged in at loginAt from conn, a nil conn
+// is a connection accepted at loginAt.
+func newSessionInfo(conn *common.ConnInfo, loginAt time.Time) *sessionInfo {
+	if conn == nil {
+		conn = &common.ConnInfo{ConnectedAt: loginAt}
+	}
+	return &sessionInfo{conn: conn, loginAt: loginAt, kill: make(chan struct{})}
+}
+
+// sessionRecord describes a session of a device, DisconnectedAt and Reason
+// are not set while it is logged in.
+type sessionRecord struct {
+	Session        uint64     `json:"session"`
+	IMEI           uint64     `json:"imei"`
+	Remote         string     `json:"remote,omitempty"`
+	ConnectedAt    time.Time  `json:"connectedAt"`
+	LoginAt        time.Time  `json:"loginAt"`
+	DisconnectedAt *time.Time `json:"disconnectedAt,omitempty"`
+	Reason         string     `json:"reason,omitempty"`
+	Readings       uint64     `json:"readings"`
+	BytesRead      uint64     `json:"bytesRead"`
+}
+
+// record returns the record of the session of imei as it is now.
+func (s deviceSession) record(imei uint64) sessionRecord {
+	return sessionRecord{
+		Session:     s.id,
+		IMEI:        imei,
+		Remote:      s.info.conn.Remote,
+		ConnectedAt: s.info.conn.ConnectedAt.UTC(),
+		LoginAt:     s.info.loginAt.UTC(),
+		Readings:    atomic.LoadUint64(&s.info.readings),
+		BytesRead:   atomic.LoadUint64(&s.info.conn.BytesRead),
+	}
+}
+
+// disconnectReason returns why the session finished, reason is the one sent
+// by the device client which only knows that it was killed by the core.
+func (s deviceSession) disconnectReason(reason string) string {
+	if killReason, ok := s.info.killReason.Load().(string); ok && reason == device.LogoutKill {
+		return killReason
+	}
+	if reason == "" {
+		return device.LogoutError
+	}
+	return reason
+}
+
+func (r *sessionRecord) close(at time.Time, reason string) {
+	at = at.UTC()
+	r.DisconnectedAt = &at
+	r.Reason = reason
+}
+
+// countSessionReading counts a reading received in session of imei, it
+// returns the session or nil when it is not logged in.
+func (c *core) countSessionReading(imei uint64, session uint64) *sessionInfo {
+	dev, exists := c.registry.get(imei)
+	if !exists {
+		return nil
+	}
+	for _, sess := range dev.loadSessions() {
+		if sess.id == session {
+			atomic.AddUint64(&sess.info.readings, 1)
+			return sess.info
+		}
+	}
+	return nil
+}
+
+// deviceSessions returns the sessions of imei, the ones logged in and the
+// finished ones kept by the history, newest first.
+func (c *core) deviceSessions(imei uint64) []sessionRecord {
+	var records []sessionRecord
+	if dev, exists := c.registry.get(imei); exists {
+		sessions := dev.loadSessions()
+		for i := len(sessions) - 1; i >= 0; i-- {
+			records = append(records, sessions[i].record(imei))
+		}
+	}
+	return append(records, c.sessions.list(imei)...)
+}
+
+// sessionRing holds the last finished sessions of a device.
+type sessionRing struct {
+	records []sessionRecord
+	// next is the index overwritten by the next record once records is full
+	next int
+}
+
+func (r *sessionRing) add(rec sessionRecord, size int) {
+	if len(r.records) < size {
+		r.records = append(r.records, rec)
+		return
+	}
+	r.records[r.next] = rec
+	r.next = (r.next + 1) % size
+}
+
+// newestFirst returns a copy of the records, the newest one first.
+func (r *sessionRing) newestFirst() []sessionRecord {
+	list := make([]sessionRecord, 0, len(r.records))
+	for i := 0; i < len(r.records); i++ {
+		list = append(list, r.records[(r.next+len(r.records)-1-i)%len(r.records)])
+	}
+	return list
+}
+
+// sessionHistory keeps the last finished sessions of every device in a ring
+// per device. When it is persisted every finished session is appended to a
+// file as a JSON line, the file is compacted to the content of the rings when
+// it is opened.
+type sessionHistory struct {
+	size int
+
+	mux   sync.Mutex
+	rings map[uint64]*sessionRing
+	// file is where finished sessions are appended, nil when they are not
+	// persisted
+	file *os.File
+}
+
+// newSessionHistory keeps the last size sessions of every device in memory.
+func newSessionHistory(size int) *sessionHistory {
+	if size <= 0 {
+		size = defaultSessionHistorySize
+	}
+	return &sessionHistory{size: size, rings: make(map[uint64]*sessionRing)}
+}
+
+// openSessionHistory keeps the last size sessions of every device, and
+// persists them to the file at path. Malformed lines of the file, like the
+// one a crash may leave behind, are skipped.
+func openSessionHistory(path string, size int) (*sessionHistory, error) {
+	h := newSessionHistory(size)
+	f, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec sessionRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				logging.Warn("skipping malformed session record", logging.F("sessions", path), logging.F("err", err))
+				continue
+			}
+			h.ring(rec.IMEI).add(rec, h.size)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading sessions %s, %v", path, err)
+		}
+	}
+
+	var content bytes.Buffer
+	enc := json.NewEncoder(&content)
+	for _, ring := range h.rings {
+		list := ring.newestFirst()
+		for i := len(list) - 1; i >= 0; i-- {
+			if err := enc.Encode(list[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := writeFileAtomic(path, content.Bytes()); err != nil {
+		return nil, err
+	}
+	h.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *sessionHistory) ring(imei uint64) *sessionRing {
+	ring, ok := h.rings[imei]
+	if !ok {
+		ring = &sessionRing{}
+		h.rings[imei] = ring
+	}
+	return ring
+}
+
+// add records a finished session, the oldest session of the device is
+// dropped when its ring is full.
+func (h *sessionHistory) add(rec sessionRecord) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.ring(rec.IMEI).add(rec, h.size)
+	if h.file == nil {
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err == nil {
+		_, err = h.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		logging.Error("persisting session", logging.F("imei", rec.IMEI), logging.F("session", rec.Session), logging.F("err", err))
+	}
+}
+
+// list returns the finished sessions of imei, newest first.
+func (h *sessionHistory) list(imei uint64) []sessionRecord {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	ring, ok := h.rings[imei]
+	if !ok {
+		return nil
+	}
+	return ring.newestFirst()
+}
+
+// close closes the file of a persisted history.
+func (h *sessionHistory) close() error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
+
+// uptime returns the percentage of [from, to) where at least one of the
+// sessions was logged in, sessions without disconnect time last until to.
+func uptime(records []sessionRecord, from, to time.Time) float64 {
+	if !to.After(from) {
+		return 0
+	}
+	type interval struct{ start, end time.Time }
+	intervals := make([]interval, 0, len(records))
+	for _, rec := range records {
+		start, end := rec.LoginAt, to
+		if rec.DisconnectedAt != nil {
+			end = *rec.DisconnectedAt
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			intervals = append(intervals, interval{start, end})
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].start.Before(intervals[j].start) })
+
+	// sessions overlap with the allow-both login policy, so they are merged
+	var online time.Duration
+	var current interval
+	for i, iv := range intervals {
+		switch {
+		case i == 0:
+			current = iv
+		case iv.start.After(current.end):
+			online += current.end.Sub(current.start)
+			current = iv
+		case iv.end.After(current.end):
+			current.end = iv.end
+		}
+	}
+	if len(intervals) > 0 {
+		online += current.end.Sub(current.start)
+	}
+	return 100 * float64(online) / float64(to.Sub(from))
+}
+
+// sessionsHandler serves GET /devices/:imei/sessions, the sessions of a
+// device newest first, the ones logged in included.
+func (d *httpd) sessionsHandler(w http.ResponseWriter, req *http.Request, imeiStr string) {
+	if req.Method != http.MethodGet {
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	imei, err := parseIMEI(imeiStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	records := d.core.deviceSessions(imei)
+	if records == nil {
+		records = []sessionRecord{}
+	}
+	d.writeJSONResponse(w, records)
+}
+
+// uptimeResponse is the body of GET /devices/:imei/uptime.
+type uptimeResponse struct {
+	IMEI   uint64    `json:"imei"`
+	Window string    `json:"window"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Online bool      `json:"online"`
+	// Uptime is the percentage of the window the device was logged in
+	Uptime float64 `json:"uptime"`
+}
+
+// uptimeHandler serves GET /devices/:imei/uptime?window=24h, the percentage
+// of the window a device was logged in. Sessions dropped from the history are
+// not counted.
+func (d *httpd) uptimeHandler(w http.ResponseWriter, req *http.Request, imeiStr string) {
+	if req.Method != http.MethodGet {
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	imei, err := parseIMEI(imeiStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	window := defaultUptimeWindow
+	if v := req.URL.Query().Get("window"); v != "" {
+		window, err = time.ParseDuration(v)
+		if err != nil || window <= 0 {
+			http.Error(w, fmt.Sprintf("invalid window %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	to := d.core.now().UTC()
+	from := to.Add(-window)
+	_, online := d.core.deviceByIMEI(imei)
+	d.writeJSONResponse(w, uptimeResponse{
+		IMEI:   imei,
+		Window: window.String(),
+		From:   from,
+		To:     to,
+		Online: online,
+		Uptime: uptime(d.core.deviceSessions(imei), from, to),
+	})
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+func TestSessionRing(t *testing.T) {
+	var ring sessionRing
+	for i := uint64(1); i <= 5; i++ {
+		ring.add(sessionRecord{Session: i}, 3)
+	}
+	list := ring.newestFirst()
+	if len(list) != 3 || list[0].Session != 5 || list[1].Session != 4 || list[2].Session != 3 {
+		t.Errorf("expected sessions 5, 4 and 3 got %+v", list)
+	}
+}
+
+func TestUptime(t *testing.T) {
+	from := common.FrozenInTime()
+	at := func(minutes int) time.Time { return from.Add(time.Duration(minutes) * time.Minute) }
+	closed := func(login, disconnect int) sessionRecord {
+		end := at(disconnect)
+		return sessionRecord{LoginAt: at(login), DisconnectedAt: &end}
+	}
+	for _, tc := range []struct {
+		name     string
+		records  []sessionRecord
+		expected float64
+	}{
+		{"no sessions", nil, 0},
+		{"half", []sessionRecord{closed(0, 50)}, 50},
+		{"before the window", []sessionRecord{closed(-30, 10)}, 10},
+		{"overlapping", []sessionRecord{closed(10, 30), closed(20, 40)}, 30},
+		{"still logged in", []sessionRecord{closed(0, 10), {LoginAt: at(80)}}, 30},
+	} {
+		if percent := uptime(tc.records, from, at(100)); percent != tc.expected {
+			t.Errorf("%s: expected %v%% got %v%%", tc.name, tc.expected, percent)
+		}
+	}
+}
+
+func TestCore_SessionHistory(t *testing.T) {
+	core := newCore(common.FrozenInTime, uint(1337), 2)
+	core.loginPolicy = LoginReplaceOld
+	imei := uint64(448324242329542)
+	conn := &common.ConnInfo{Remote: "127.0.0.1:4000", ConnectedAt: common.FrozenInTime().Add(-time.Second), BytesRead: 95}
+	oldChannel := make(chan common.Command, 2)
+	if err := core.register(imei, oldChannel, nil, conn); err != nil {
+		t.Fatal(err)
+	}
+	old := <-oldChannel
+	for i := 0; i < 2; i++ {
+		payload := device.NewPayload(20, 10, 21.03, -89.59, 45)
+		core.process(common.Command{ID: common.READING, Sender: imei, Session: old.Session, Body: payload[:]})
+	}
+
+	sessions := core.deviceSessions(imei)
+	if len(sessions) != 1 || sessions[0].DisconnectedAt != nil || sessions[0].Readings != 2 || sessions[0].BytesRead != 95 ||
+		sessions[0].Remote != conn.Remote {
+		t.Errorf("expected the session logged in got %+v", sessions)
+	}
+
+	if err := core.register(imei, make(chan common.Command, 2), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-old.Kill:
+	default:
+		t.Fatal("expected the old session to be killed")
+	}
+	if err := core.deregister(imei, old.Session, device.LogoutKill); err != nil {
+		t.Fatal(err)
+	}
+	core.killAll()
+	dev, _ := core.deviceByIMEI(imei)
+	if err := core.deregister(imei, dev.loadSessions()[0].id, device.LogoutKill); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions = core.deviceSessions(imei)
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions got %+v", sessions)
+	}
+	if sessions[0].Reason != disconnectShutdown || sessions[1].Reason != disconnectReplaced {
+		t.Errorf("expected the newest session to finish on shutdown and the oldest replaced, got %+v", sessions)
+	}
+	if sessions[1].Readings != 2 || sessions[1].DisconnectedAt == nil || !sessions[1].ConnectedAt.Equal(conn.ConnectedAt) {
+		t.Errorf("unexpected replaced session %+v", sessions[1])
+	}
+}
+
+func TestOpenSessionHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.jsonl")
+
+	h, err := openSessionHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		rec := sessionRecord{Session: i, IMEI: 490154203237518}
+		rec.close(common.FrozenInTime(), device.LogoutEOF)
+		h.add(rec)
+	}
+	h.add(sessionRecord{Session: 4, IMEI: 448324242329542})
+	if err := h.close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"session": 5, "imei": 4901`)
+	f.Close()
+
+	h, err = openSessionHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	if list := h.list(490154203237518); len(list) != 2 || list[0].Session != 3 || list[1].Session != 2 || list[0].Reason != device.LogoutEOF {
+		t.Errorf("expected sessions 3 and 2 got %+v", list)
+	}
+	if list := h.list(448324242329542); len(list) != 1 || list[0].Session != 4 {
+		t.Errorf("expected session 4 got %+v", list)
+	}
+	// compacted, the malformed line and the dropped session are gone
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines int
+	for _, b := range content {
+		if b == '\n' {
+			lines++
+		}
+	}
+	if lines != 3 {
+		t.Errorf("expected 3 sessions in the file got:\n%s", content)
+	}
+}
+
+func TestServer_Run_Sessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.jsonl")
+	s, cancel, done := startTestServer(t, Config{
+		MaxClients:      10,
+		SessionsFile:    path,
+		ShutdownTimeout: time.Second,
+	})
+	defer cancel()
+	imei := []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}
+	url := fmt.Sprintf("http://%s/devices/490154203237518/", s.httpLn.Addr())
+
+	conn := dialTestDevice(t, s, imei)
+	waitFor(t, "the device to log in", func() bool { return s.core.numConnectedDevices() == 1 })
+	for i := 0; i < 3; i++ {
+		payload := device.NewPayload(float64(i), 10, 21.03, -89.59, 45)
+		conn.Write(payload[:])
+	}
+	waitFor(t, "the readings", func() bool {
+		return len(s.core.deviceSessions(490154203237518)) == 1 && s.core.deviceSessions(490154203237518)[0].Readings == 3
+	})
+	conn.Close()
+	waitFor(t, "the device to log out", func() bool { return s.core.numConnectedDevices() == 0 })
+
+	conn = dialTestDevice(t, s, imei)
+	defer conn.Close()
+	waitFor(t, "the device to log in again", func() bool { return s.core.numConnectedDevices() == 1 })
+
+	resp, err := http.Get(url + "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions []sessionRecord
+	err = json.NewDecoder(resp.Body).Decode(&sessions)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].DisconnectedAt != nil || sessions[1].Reason != device.LogoutEOF ||
+		sessions[1].Readings != 3 || sessions[1].BytesRead != 15+3*40 {
+		t.Errorf("unexpected sessions %+v", sessions)
+	}
+
+	resp, err = http.Get(url + "uptime?window=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var up uptimeResponse
+	err = json.NewDecoder(resp.Body).Decode(&up)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !up.Online || up.Window != "1h0m0s" || !(up.Uptime > 0 && up.Uptime < 100) {
+		t.Errorf("unexpected uptime %+v", up)
+	}
+	if resp, err := http.Get(url + "uptime?window=-1h"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a negative window to be rejected, got %v %v", resp.StatusCode, err)
+	}
+
+	cancel()
+	<-done
+	h, err := openSessionHistory(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	if list := h.list(490154203237518); len(list) != 2 || list[0].Reason != disconnectShutdown {
+		t.Errorf("expected the sessions to be persisted, the last one finished on shutdown, got %+v", list)
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// Record is a valid reading received from a device, timestamped by the server
+// at reception time.
+type Record struct {
+	IMEI    uint64
+	Epoch   int64
+	Reading device.Reading
+}
+
+// Sink is an output destination for valid readings. core fans each valid
+// reading out to every configured Sink.
+//
+// Write is called concurrently by the registry shards. Implementations are not
+// required to be safe for concurrent use, core wraps each of them in a
+// queuedSink which owns a single writer goroutine.
+type Sink interface {
+	// Write outputs rec, it may be buffered until the next Flush.
+	Write(rec Record) error
+	// Flush writes any buffered record to the underlying destination.
+	Flush() error
+	// Close flushes and releases the sink resources.
+	Close() error
+}
+
+// queuePolicy decides what a queuedSink does when its queue is full.
+type queuePolicy int
+
+const (
+	// policyBlock makes the producer wait until there is room in the queue.
+	policyBlock queuePolicy = iota
+	// policyDrop discards the record and counts it as dropped.
+	policyDrop
+)
+
+func parseQueuePolicy(s string) (queuePolicy, error) {
+	switch s {
+	case "block":
+		return policyBlock, nil
+	case "drop":
+		return policyDrop, nil
+	}
+	return policyBlock, fmt.Errorf("unknown sink policy %q, it could be block or drop", s)
+}
+
+func (p queuePolicy) String() string {
+	if p == policyDrop {
+		return "drop"
+	}
+	return "block"
+}
+
+// queuedSink decouples a Sink from core.run using a bounded queue drained by
+// its own goroutine, so a slow consumer can only stall the core when its
+// policy is policyBlock.
+type queuedSink struct {
+	name    string
+	sink    Sink
+	policy  queuePolicy
+	queue   chan Record
+	done    chan struct{}
+	dropped uint64
+	errors  uint64
+}
+
+func newQueuedSink(name string, sink Sink, size int, policy queuePolicy) *queuedSink {
+	q := &queuedSink{
+		name:   name,
+		sink:   sink,
+		policy: policy,
+		queue:  make(chan Record, size),
+		done:   make(chan struct{}),
+	}
+	go q.drain()
+	return q
+}
+
+// Write enqueues rec following the sink policy. It must not be called after
+// Close.
+func (q *queuedSink) Write(rec Record) error {
+	if q.policy == policyBlock {
+		q.queue <- rec
+		return nil
+	}
+	select {
+	case q.queue <- rec:
+	default:
+		if atomic.AddUint64(&q.dropped, 1)%1000 == 1 {
+			logging.Warn("sink queue is full", logging.F("sink", q.name), logging.F("dropped", atomic.LoadUint64(&q.dropped)))
+		}
+	}
+	return nil
+}
+
+// Flush is a no-op, the drain goroutine flushes the sink every time the queue
+// runs empty.
+func (q *queuedSink) Flush() error {
+	return nil
+}
+
+// Close waits for every queued record to be written, then closes the sink.
+func (q *queuedSink) Close() error {
+	close(q.queue)
+	<-q.done
+	return q.sink.Close()
+}
+
+func (q *queuedSink) drain() {
+	defer close(q.done)
+	for rec := range q.queue {
+		if err := q.sink.Write(rec); err != nil {
+			q.countError(err)
+		}
+		if len(q.queue) == 0 {
+			if err := q.sink.Flush(); err != nil {
+				q.countError(err)
+			}
+		}
+	}
+}
+
+func (q *queuedSink) countError(err error) {
+	if atomic.AddUint64(&q.errors, 1)%1000 == 1 {
+		logging.Error("sink failed to write", logging.F("sink", q.name), logging.F("err", err))
+	}
+}
+
+// SinkConfig describes one output sink, see ParseSinkConfig.
+type SinkConfig struct {
+	// Kind is one of stdout, file or unix.
+	Kind string
+	// Path of the output file for the file sink, or of the socket for the unix sink.
+	Path string
+	// MaxBytes is the size at which the file sink rotates its output file.
+	MaxBytes int64
+	// MaxBackups is the number of rotated files kept by the file sink.
+	MaxBackups int
+	// QueueSize is the capacity of the sink queue.
+	QueueSize int
+	// Policy is what happens when the queue is full, block or drop.
+	Policy string
+}
+
+const (
+	defaultSinkQueueSize  = 1024
+	defaultFileMaxBytes   = 100 << 20
+	defaultFileMaxBackups = 5
+)
+
+// ParseSinkConfig parses a sink spec with the form kind[:key=value,...]
+//
+// e.g.
+//
+//	stdout
+//	stdout:queue=4096,policy=drop
+//	file:path=/var/log/thermomatic.csv,max-bytes=10485760,backups=3
+//	unix:path=/run/thermomatic.sock,policy=drop
+func ParseSinkConfig(spec string) (SinkConfig, error) {
+	kind := spec
+	options := ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, options = spec[:i], spec[i+1:]
+	}
+
+	cfg := SinkConfig{
+		Kind:       kind,
+		MaxBytes:   defaultFileMaxBytes,
+		MaxBackups: defaultFileMaxBackups,
+		QueueSize:  defaultSinkQueueSize,
+		Policy:     "block",
+	}
+	switch kind {
+	case "stdout", "file":
+	case "unix":
+		// a missing socket consumer should never stall the server
+		cfg.Policy = "drop"
+	default:
+		return cfg, fmt.Errorf("unknown sink kind %q, it could be stdout, file or unix", kind)
+	}
+
+	for _, option := range strings.Split(options, ",") {
+		if option == "" {
+			continue
+		}
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return cfg, fmt.Errorf("sink option %q should be key=value", option)
+		}
+		var err error
+		switch kv[0] {
+		case "path":
+			cfg.Path = kv[1]
+		case "max-bytes":
+			cfg.MaxBytes, err = strconv.ParseInt(kv[1], 10, 64)
+		case "backups":
+			cfg.MaxBackups, err = strconv.Atoi(kv[1])
+		case "queue":
+			cfg.QueueSize, err = strconv.Atoi(kv[1])
+		case "policy":
+			cfg.Policy = kv[1]
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("invalid sink option %q, %v", option, err)
+		}
+	}
+
+	if _, err := parseQueuePolicy(cfg.Policy); err != nil {
+		return cfg, err
+	}
+	if cfg.QueueSize < 1 {
+		return cfg, fmt.Errorf("sink queue should be at least 1, got %d", cfg.QueueSize)
+	}
+	if cfg.Kind != "stdout" && cfg.Path == "" {
+		return cfg, fmt.Errorf("%s sink requires a path option", cfg.Kind)
+	}
+	return cfg, nil
+}
+
+// String returns the sink spec of cfg.
+func (cfg SinkConfig) String() string {
+	switch cfg.Kind {
+	case "file":
+		return fmt.Sprintf("file:path=%s,max-bytes=%d,backups=%d,queue=%d,policy=%s",
+			cfg.Path, cfg.MaxBytes, cfg.MaxBackups, cfg.QueueSize, cfg.Policy)
+	case "unix":
+		return fmt.Sprintf("unix:path=%s,queue=%d,policy=%s", cfg.Path, cfg.QueueSize, cfg.Policy)
+	}
+	return fmt.Sprintf("%s:queue=%d,policy=%s", cfg.Kind, cfg.QueueSize, cfg.Policy)
+}
+
+// openSink creates the sink described by cfg wrapped in its queue.
+func openSink(cfg SinkConfig) (*queuedSink, error) {
+	policy, err := parseQueuePolicy(cfg.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	var sink Sink
+	switch cfg.Kind {
+	case "stdout":
+		sink = newStdoutSink(os.Stdout)
+	case "file":
+		sink, err = newRotatingFileSink(cfg.Path, cfg.MaxBytes, cfg.MaxBackups)
+	case "unix":
+		sink = newUnixSocketSink(cfg.Path)
+	default:
+		err = fmt.Errorf("unknown sink kind %q", cfg.Kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newQueuedSink(cfg.Kind, sink, cfg.QueueSize, policy), nil
+}
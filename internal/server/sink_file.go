@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// rotatingFileSink writes CSV records to a file, rotating it once it reaches
+// maxBytes. Rotated files are renamed path.1 (newest) to path.N (oldest) and
+// at most maxBackups of them are kept.
+type rotatingFileSink struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	csv        *csvSink
+	size       int64
+}
+
+func newRotatingFileSink(path string, maxBytes int64, maxBackups int) (*rotatingFileSink, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("file sink max-bytes should be positive, got %d", maxBytes)
+	}
+	s := &rotatingFileSink{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *rotatingFileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening sink file %s, %v", s.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("reading sink file %s size, %v", s.path, err)
+	}
+	s.file = file
+	s.size = info.Size()
+	s.csv = newCSVSink(&sizeCounter{w: file, n: &s.size}, file)
+	return nil
+}
+
+func (s *rotatingFileSink) Write(rec Record) error {
+	if s.size+int64(s.csv.buffered()) >= s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	return s.csv.Write(rec)
+}
+
+func (s *rotatingFileSink) rotate() error {
+	if err := s.csv.Close(); err != nil {
+		return err
+	}
+	if s.maxBackups > 0 {
+		for i := s.maxBackups - 1; i > 0; i-- {
+			os.Rename(backupPath(s.path, i), backupPath(s.path, i+1))
+		}
+		if err := os.Rename(s.path, backupPath(s.path, 1)); err != nil {
+			logging.Error("rotating sink file", logging.F("path", s.path), logging.F("err", err))
+		}
+	} else if err := os.Truncate(s.path, 0); err != nil {
+		logging.Error("truncating sink file", logging.F("path", s.path), logging.F("err", err))
+	}
+	logging.Info("sink file rotated", logging.F("path", s.path))
+	return s.open()
+}
+
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+func (s *rotatingFileSink) Flush() error {
+	return s.csv.Flush()
+}
+
+func (s *rotatingFileSink) Close() error {
+	return s.csv.Close()
+}
+
+// sizeCounter counts the bytes written to w into n.
+type sizeCounter struct {
+	w *os.File
+	n *int64
+}
+
+func (c *sizeCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
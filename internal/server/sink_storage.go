@@ -0,0 +1,67 @@
+package server
+
+import (
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
+	"github.com/spin-org/thermomatic/internal/storage"
+)
+
+// storageFlushInterval is how often buffered readings are written to the
+// store when no new reading arrives.
+const storageFlushInterval = time.Second
+
+// storageSink persists readings into a storage.Store, so their history
+// survives restarts.
+type storageSink struct {
+	store *storage.Store
+	done  chan struct{}
+}
+
+func newStorageSink(store *storage.Store) *storageSink {
+	s := &storageSink{
+		store: store,
+		done:  make(chan struct{}),
+	}
+	go s.flushPeriodically()
+	return s
+}
+
+// flushPeriodically writes the buffered readings of devices that went silent.
+func (s *storageSink) flushPeriodically() {
+	ticker := time.NewTicker(storageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.store.FlushIfDue(); err != nil {
+				logging.Error("flushing readings storage", logging.F("err", err))
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *storageSink) Write(rec Record) error {
+	payload := device.NewPayload(
+		rec.Reading.Temperature,
+		rec.Reading.Altitude,
+		rec.Reading.Latitude,
+		rec.Reading.Longitude,
+		rec.Reading.BatteryLevel)
+	if err := s.store.Append(rec.IMEI, rec.Epoch, &payload); err != nil {
+		return err
+	}
+	return s.store.FlushIfDue()
+}
+
+func (s *storageSink) Flush() error {
+	return s.store.FlushIfDue()
+}
+
+func (s *storageSink) Close() error {
+	close(s.done)
+	return s.store.Close()
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+var testRecord = Record{
+	IMEI:  490154203237518,
+	Epoch: 1257894000000000000,
+	Reading: device.Reading{
+		Temperature:  67.77,
+		Altitude:     2.63555,
+		Latitude:     33.41,
+		Longitude:    44.4,
+		BatteryLevel: 0.25666,
+	},
+}
+
+// memorySink records every written record, optionally blocking each write
+// until release is closed.
+type memorySink struct {
+	mux     sync.Mutex
+	records []Record
+	flushes int
+	closed  bool
+	release chan struct{}
+}
+
+func (s *memorySink) Write(rec Record) error {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mux.Lock()
+	s.records = append(s.records, rec)
+	s.mux.Unlock()
+	return nil
+}
+
+func (s *memorySink) Flush() error {
+	s.mux.Lock()
+	s.flushes++
+	s.mux.Unlock()
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.mux.Lock()
+	s.closed = true
+	s.mux.Unlock()
+	return nil
+}
+
+func TestParseSinkConfig(t *testing.T) {
+	cfg, err := ParseSinkConfig("file:path=/tmp/readings.csv,max-bytes=100,backups=2,queue=10,policy=drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SinkConfig{
+		Kind:       "file",
+		Path:       "/tmp/readings.csv",
+		MaxBytes:   100,
+		MaxBackups: 2,
+		QueueSize:  10,
+		Policy:     "drop",
+	}
+	if cfg != expected {
+		t.Errorf("expected %v got %v", expected, cfg)
+	}
+
+	unix, err := ParseSinkConfig("unix:path=/tmp/readings.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unix.Policy != "drop" {
+		t.Errorf("expected unix sink to drop by default, got policy %s", unix.Policy)
+	}
+
+	for _, invalid := range []string{"kafka", "file", "stdout:policy=maybe", "stdout:queue=0", "stdout:color=red", "stdout:queue"} {
+		if _, err := ParseSinkConfig(invalid); err == nil {
+			t.Errorf("expected an error parsing sink spec %q", invalid)
+		}
+	}
+}
+
+func TestQueuedSink_Close_WritesEveryQueuedRecord(t *testing.T) {
+	mem := &memorySink{}
+	q := newQueuedSink("memory", mem, 10, policyBlock)
+	for i := 0; i < 100; i++ {
+		q.Write(testRecord)
+	}
+	q.Close()
+
+	if len(mem.records) != 100 {
+		t.Errorf("expected 100 records got %d", len(mem.records))
+	}
+	if mem.flushes == 0 {
+		t.Error("expected the sink to be flushed")
+	}
+	if !mem.closed {
+		t.Error("expected the sink to be closed")
+	}
+}
+
+func TestQueuedSink_DropPolicy_DoesNotBlock(t *testing.T) {
+	mem := &memorySink{release: make(chan struct{})}
+	q := newQueuedSink("memory", mem, 2, policyDrop)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			q.Write(testRecord)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a sink with drop policy should never block the producer")
+	}
+	close(mem.release)
+	q.Close()
+
+	// one record taken by the drain goroutine plus two queued ones
+	if dropped := q.dropped; dropped < 7 {
+		t.Errorf("expected at least 7 dropped records got %d", dropped)
+	}
+	if len(mem.records)+int(q.dropped) != 10 {
+		t.Errorf("expected written plus dropped records to be 10, got %d+%d", len(mem.records), q.dropped)
+	}
+}
+
+func TestCore_HandleReading_FansOutToSinks(t *testing.T) {
+	core := newCore(common.FrozenInTime, uint(1337), 2)
+	first, second := &memorySink{}, &memorySink{}
+	core.addSink(first)
+	core.addSink(second)
+	imei := uint64(448324242329542)
+	core.registry.shardFor(imei).add(imei, &connectedDevice{})
+
+	payload := device.NewPayload(38, 10, 21.033643, -89.5969049, 45)
+	if err := core.handleReading(imei, nil, 0, payload[:]); err != nil {
+		t.Fatal(err)
+	}
+	invalidPayload := device.NewPayload(9999999, 9999999, 9999999, 9999999, 9999999)
+	core.handleReading(imei, nil, 0, invalidPayload[:])
+
+	for _, sink := range []*memorySink{first, second} {
+		if len(sink.records) != 1 {
+			t.Fatalf("expected only the valid reading in the sink, got %d records", len(sink.records))
+		}
+		rec := sink.records[0]
+		if rec.IMEI != imei || rec.Epoch != common.FrozenInTime().UnixNano() || rec.Reading.Temperature != 38 {
+			t.Errorf("unexpected record %v", rec)
+		}
+	}
+}
+
+func TestRotatingFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "readings.csv")
+
+	line := formatReadingOutput(testRecord.IMEI, testRecord.Epoch, &testRecord.Reading) + "\n"
+	// room for 2 records per file
+	sink, err := newRotatingFileSink(path, int64(2*len(line)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		sink.Write(testRecord)
+		sink.Flush()
+	}
+	sink.Close()
+
+	expectedLines := map[string]int{path: 1, path + ".1": 2, path + ".2": 2}
+	for file, lines := range expectedLines {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := strings.Count(string(content), line); actual != lines {
+			t.Errorf("expected %d records in %s got %d", lines, file, actual)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups, %s.3 should not exist", path)
+	}
+}
+
+func TestUnixSocketSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "readings.sock")
+
+	sink := newUnixSocketSink(path)
+	// nobody is listening yet
+	if err := sink.Write(testRecord); err != nil {
+		t.Errorf("a disconnected unix sink should discard records silently, got %v", err)
+	}
+	if sink.discarded != 1 {
+		t.Errorf("expected 1 discarded record got %d", sink.discarded)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+
+	// skip the redial interval
+	sink.lastDial = time.Time{}
+	sink.Write(testRecord)
+	sink.Flush()
+
+	expected := formatReadingOutput(testRecord.IMEI, testRecord.Epoch, &testRecord.Reading) + "\n"
+	select {
+	case line := <-received:
+		if line != expected {
+			t.Errorf("expected %q got %q", expected, line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the record on the unix socket")
+	}
+	sink.Close()
+}
+
+func TestStdoutSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := newStdoutSink(&out)
+	sink.Write(testRecord)
+	if out.Len() != 0 {
+		t.Error("stdout sink should buffer records until flushed")
+	}
+	sink.Flush()
+	expected := formatReadingOutput(testRecord.IMEI, testRecord.Epoch, &testRecord.Reading) + "\n"
+	if out.String() != expected {
+		t.Errorf("expected %q got %q", expected, out.String())
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// unixRedialInterval is the minimum time between two dial attempts of a
+// unixSocketSink to its consumer.
+const unixRedialInterval = time.Second
+
+// unixSocketSink streams CSV records to a consumer listening on a Unix domain
+// socket. When the consumer is not listening, or goes away, records are
+// discarded and the socket is dialed again at most once per unixRedialInterval.
+type unixSocketSink struct {
+	path      string
+	conn      net.Conn
+	csv       *csvSink
+	lastDial  time.Time
+	discarded uint64
+	now       func() time.Time
+}
+
+func newUnixSocketSink(path string) *unixSocketSink {
+	return &unixSocketSink{
+		path: path,
+		now:  time.Now,
+	}
+}
+
+func (s *unixSocketSink) connected() bool {
+	if s.conn != nil {
+		return true
+	}
+	now := s.now()
+	if now.Sub(s.lastDial) < unixRedialInterval {
+		return false
+	}
+	s.lastDial = now
+	conn, err := net.Dial("unix", s.path)
+	if err != nil {
+		return false
+	}
+	logging.Info("sink connected to unix socket", logging.F("path", s.path), logging.F("discarded", s.discarded))
+	s.conn = conn
+	s.csv = newCSVSink(conn, conn)
+	s.discarded = 0
+	return true
+}
+
+func (s *unixSocketSink) Write(rec Record) error {
+	if !s.connected() {
+		s.discarded++
+		return nil
+	}
+	return s.check(s.csv.Write(rec))
+}
+
+func (s *unixSocketSink) Flush() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.check(s.csv.Flush())
+}
+
+// check drops the connection after a write error, it will be dialed again by
+// the next Write.
+func (s *unixSocketSink) check(err error) error {
+	if err != nil {
+		logging.Warn("sink lost connection to unix socket", logging.F("path", s.path), logging.F("err", err))
+		s.conn.Close()
+		s.conn = nil
+		s.csv = nil
+	}
+	return err
+}
+
+func (s *unixSocketSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.csv.Close()
+}
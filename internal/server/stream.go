@@ -0,0 +1,369 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+const (
+	// streamBufferSize is the number of events buffered for each subscriber,
+	// a subscriber falling further behind is disconnected as a slow consumer.
+	streamBufferSize = 256
+	// streamWriteTimeout bounds how long writing an event to a subscriber may
+	// block, a subscriber not reading for that long is a slow consumer too.
+	streamWriteTimeout = 5 * time.Second
+	// streamHeartbeatInterval is how often an idle stream sends a comment, so
+	// proxies do not close it and gone subscribers are noticed.
+	streamHeartbeatInterval = 15 * time.Second
+)
+
+// Types of the events of the streamHub.
+const (
+	streamReadingEvent = "reading"
+	streamOnlineEvent  = "online"
+	streamOfflineEvent = "offline"
+)
+
+// streamEvent is sent to the subscribers of the streamHub. Online and offline
+// events only carry the IMEI and the epoch of the record.
+type streamEvent struct {
+	Type   string
+	Record Record
+	// Reason why the device went offline, the reason of its last session
+	Reason string
+}
+
+// streamReading is the data of a reading event.
+type streamReading struct {
+	IMEI           uint64          `json:"imei"`
+	TimestampEpoch int64           `json:"timestampEpoch"`
+	Reading        *device.Reading `json:"reading"`
+}
+
+// streamFilter selects the events a subscriber receives. A device is
+// selected when its IMEI is in imeis or its inventory site is in sites, or
+// when both are nil, and its readings must be within bbox when it is set.
+// Online and offline events are only received when presence is set.
+type streamFilter struct {
+	imeis    map[uint64]bool
+	sites    map[string]bool
+	bbox     *geoBox
+	presence bool
+}
+
+// parseStreamFilter parses the imei, site and bbox query parameters, imei and
+// site are comma separated lists and may be repeated, e.g.
+// ?imei=490154203237518,448324242329542&site=merida&bbox=20.9,-89.7,21.1,-89.5
+func parseStreamFilter(query url.Values) (streamFilter, error) {
+	var f streamFilter
+	for _, imeis := range query["imei"] {
+		for _, s := range strings.Split(imeis, ",") {
+			imei, err := parseIMEI(strings.TrimSpace(s))
+			if err != nil {
+				return f, err
+			}
+			if f.imeis == nil {
+				f.imeis = make(map[uint64]bool)
+			}
+			f.imeis[imei] = true
+		}
+	}
+	for _, sites := range query["site"] {
+		for _, site := range strings.Split(sites, ",") {
+			if site = strings.TrimSpace(site); site == "" {
+				continue
+			}
+			if f.sites == nil {
+				f.sites = make(map[string]bool)
+			}
+			f.sites[site] = true
+		}
+	}
+	if bbox := query.Get("bbox"); bbox != "" {
+		b, err := parseGeoBox(bbox)
+		if err != nil {
+			return f, err
+		}
+		f.bbox = b
+	}
+	return f, nil
+}
+
+// matches reports whether ev is selected by the filter, site returns the
+// inventory site of a device and it is only called when the filter has sites.
+func (f *streamFilter) matches(ev *streamEvent, site func(imei uint64) string) bool {
+	if ev.Type != streamReadingEvent && !f.presence {
+		return false
+	}
+	if f.imeis != nil || f.sites != nil {
+		if !f.imeis[ev.Record.IMEI] && (f.sites == nil || !f.sites[site(ev.Record.IMEI)]) {
+			return false
+		}
+	}
+	if f.bbox != nil && ev.Type == streamReadingEvent {
+		return f.bbox.contains(geoPoint{Lat: ev.Record.Reading.Latitude, Lon: ev.Record.Reading.Longitude})
+	}
+	return true
+}
+
+// subscription is a subscriber of the streamHub.
+type subscription struct {
+	filter streamFilter
+	events chan streamEvent
+	// done is closed when the subscription is dropped by the hub, or when the
+	// subscriber unsubscribes
+	done chan struct{}
+	// slow is set when the subscriber was dropped for falling behind
+	slow int32
+}
+
+// streamStats are counters of the streamHub, updated atomically.
+type streamStats struct {
+	subscribers   int64
+	slowConsumers uint64
+}
+
+// streamHub fans the valid readings out to the live stream subscribers. It is
+// a Sink, so the readings reach it through a queue and the core never waits
+// for a subscriber. Each subscriber has a bounded buffer, the hub drops the
+// subscribers whose buffer is full instead of waiting for them. The core also
+// publishes the devices going online and offline straight to it.
+type streamHub struct {
+	// site returns the inventory site of a device, empty when it has none
+	site func(imei uint64) string
+
+	mux    sync.Mutex
+	subs   map[*subscription]struct{}
+	closed bool
+	stats  streamStats
+}
+
+func newStreamHub(site func(imei uint64) string) *streamHub {
+	return &streamHub{site: site, subs: make(map[*subscription]struct{})}
+}
+
+// subscribe adds a subscriber of the events selected by filter, it returns
+// false when the hub is closed.
+func (h *streamHub) subscribe(filter streamFilter) (*subscription, bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.closed {
+		return nil, false
+	}
+	sub := &subscription{
+		filter: filter,
+		events: make(chan streamEvent, streamBufferSize),
+		done:   make(chan struct{}),
+	}
+	h.subs[sub] = struct{}{}
+	atomic.AddInt64(&h.stats.subscribers, 1)
+	return sub, true
+}
+
+// unsubscribe removes sub, it may have been dropped already.
+func (h *streamHub) unsubscribe(sub *subscription) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.drop(sub)
+}
+
+// drop removes sub and closes its done channel, it must be called with the
+// lock held.
+func (h *streamHub) drop(sub *subscription) {
+	if _, ok := h.subs[sub]; !ok {
+		return
+	}
+	delete(h.subs, sub)
+	close(sub.done)
+	atomic.AddInt64(&h.stats.subscribers, -1)
+}
+
+// slowConsumer counts a subscriber disconnected for falling behind.
+func (h *streamHub) slowConsumer(sub *subscription) {
+	if atomic.CompareAndSwapInt32(&sub.slow, 0, 1) {
+		atomic.AddUint64(&h.stats.slowConsumers, 1)
+	}
+}
+
+// update changes the filter of sub with fn.
+func (h *streamHub) update(sub *subscription, fn func(f *streamFilter)) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	fn(&sub.filter)
+}
+
+// Write sends the reading of rec to the subscribers it matches.
+func (h *streamHub) Write(rec Record) error {
+	h.publish(streamEvent{Type: streamReadingEvent, Record: rec})
+	return nil
+}
+
+// publish sends ev to the subscribers it matches without blocking, the ones
+// whose buffer is full are dropped.
+func (h *streamHub) publish(ev streamEvent) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for sub := range h.subs {
+		if !sub.filter.matches(&ev, h.site) {
+			continue
+		}
+		select {
+		case sub.events <- ev:
+		default:
+			h.slowConsumer(sub)
+			h.drop(sub)
+		}
+	}
+}
+
+// Flush is a no-op, events are sent as soon as they are written.
+func (h *streamHub) Flush() error {
+	return nil
+}
+
+// Close drops every subscriber, which ends their streams, and refuses new
+// ones.
+func (h *streamHub) Close() error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.closed = true
+	for sub := range h.subs {
+		h.drop(sub)
+	}
+	return nil
+}
+
+// hijackStream takes the connection of an HTTP/1.x request over and writes
+// the header of a response of contentType, whose body lasts until the
+// connection is closed. Streams own their connections so they can bound each
+// write with a deadline, and close them when the subscriber falls behind.
+func hijackStream(w http.ResponseWriter, contentType string) (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("streaming is not supported by the connection")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 200 OK\r\nContent-Type: %s\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n", contentType)
+	if err := writeStream(conn, rw); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
+
+// writeStream flushes rw to conn within streamWriteTimeout.
+func writeStream(conn net.Conn, rw *bufio.ReadWriter) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+// streamReadingsHandler serves GET /stream/readings, the valid readings as
+// they arrive as Server-Sent Events:
+//
+//	event: reading
+//	data: {"imei":490154203237518,"timestampEpoch":1596397680000000000,"reading":{...}}
+//
+// The readings are filtered by the imei, site and bbox query parameters, see
+// parseStreamFilter. A subscriber which falls behind gets an error event and
+// is disconnected.
+func (d *httpd) streamReadingsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		d.log.Warn("method not allowed", logging.F("method", req.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	hub := d.core.streams
+	if hub == nil {
+		http.Error(w, "no stream available", http.StatusNotFound)
+		return
+	}
+	filter, err := parseStreamFilter(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub, ok := hub.subscribe(filter)
+	if !ok {
+		http.Error(w, "the server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer hub.unsubscribe(sub)
+	conn, rw, err := hijackStream(w, "text/event-stream")
+	if err != nil {
+		d.log.Warn("starting the stream", logging.F("err", err))
+		return
+	}
+	defer conn.Close()
+	log := d.log.With(logging.F("remote", req.RemoteAddr))
+	log.Info("stream subscribed", logging.F("url", req.URL.String()))
+
+	// subscribers do not send anything, a read only returns once they are gone
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, rw)
+		close(gone)
+	}()
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev := <-sub.events:
+			data, err := json.Marshal(streamReading{
+				IMEI:           ev.Record.IMEI,
+				TimestampEpoch: ev.Record.Epoch,
+				Reading:        &ev.Record.Reading,
+			})
+			if err != nil {
+				log.Error("serializing event to json", logging.F("err", err))
+				continue
+			}
+			fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", ev.Type, data)
+		case <-heartbeat.C:
+			rw.WriteString(": heartbeat\n\n")
+		case <-sub.done:
+			if atomic.LoadInt32(&sub.slow) == 1 {
+				rw.WriteString("event: error\ndata: slow consumer\n\n")
+				writeStream(conn, rw)
+				log.Warn("stream disconnected", logging.F("reason", "slow consumer"))
+			}
+			return
+		case <-gone:
+			log.Info("stream unsubscribed")
+			return
+		}
+		if err := writeStream(conn, rw); err != nil {
+			if isTimeoutError(err) {
+				hub.slowConsumer(sub)
+				log.Warn("stream disconnected", logging.F("reason", "slow consumer"), logging.F("err", err))
+				return
+			}
+			log.Info("stream unsubscribed", logging.F("err", err))
+			return
+		}
+	}
+}
+
+// isTimeoutError reports whether err was caused by a deadline.
+func isTimeoutError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
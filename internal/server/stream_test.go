@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/common"
+)
+
+func TestStreamFilter(t *testing.T) {
+	sites := map[uint64]string{490154203237518: "merida"}
+	site := func(imei uint64) string { return sites[imei] }
+	merida, other := uint64(490154203237518), uint64(448324242329542)
+	reading := func(imei uint64, lat float64) *streamEvent {
+		ev := &streamEvent{Type: "reading", Record: readingRecord(imei, 0, 20, 50)}
+		ev.Record.Reading.Latitude = lat
+		return ev
+	}
+	for _, tc := range []struct {
+		query    string
+		ev       *streamEvent
+		expected bool
+	}{
+		{"", reading(other, 21.03), true},
+		{"imei=490154203237518,448324242329542", reading(other, 21.03), true},
+		{"imei=490154203237518", reading(other, 21.03), false},
+		{"site=merida", reading(merida, 21.03), true},
+		{"site=merida", reading(other, 21.03), false},
+		{"site=cancun&imei=448324242329542", reading(other, 21.03), true},
+		{"bbox=21,-89.6,21.1,-89.5", reading(other, 21.03), true},
+		{"bbox=21,-89.6,21.1,-89.5", reading(other, 22), false},
+		{"site=merida&bbox=21,-89.6,21.1,-89.5", reading(merida, 22), false},
+	} {
+		query, _ := url.ParseQuery(tc.query)
+		f, err := parseStreamFilter(query)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		if matches := f.matches(tc.ev, site); matches != tc.expected {
+			t.Errorf("%s: expected %+v to match %v", tc.query, tc.ev.Record, tc.expected)
+		}
+	}
+
+	for _, invalid := range []string{"imei=123", "bbox=1,2,3", "bbox=21.1,-89.6,21,-89.5", "bbox=a,b,c,d", "bbox=0,0,91,0"} {
+		query, _ := url.ParseQuery(invalid)
+		if _, err := parseStreamFilter(query); err == nil {
+			t.Errorf("expected an error parsing %s", invalid)
+		}
+	}
+}
+
+func TestStreamHub_SlowConsumer(t *testing.T) {
+	hub := newStreamHub(func(uint64) string { return "" })
+	slow, _ := hub.subscribe(streamFilter{})
+	fast, _ := hub.subscribe(streamFilter{})
+	for i := 0; i <= streamBufferSize; i++ {
+		hub.Write(readingRecord(490154203237518, time.Duration(i), 20, 50))
+		if i < streamBufferSize {
+			<-fast.events
+		}
+	}
+	select {
+	case <-slow.done:
+	default:
+		t.Fatal("expected the slow subscriber to be dropped")
+	}
+	if atomic.LoadInt32(&slow.slow) != 1 || atomic.LoadUint64(&hub.stats.slowConsumers) != 1 {
+		t.Errorf("expected 1 slow consumer got %d", atomic.LoadUint64(&hub.stats.slowConsumers))
+	}
+	if len(fast.events) != 1 {
+		t.Errorf("expected the fast subscriber to get the last reading")
+	}
+
+	hub.Close()
+	select {
+	case <-fast.done:
+	default:
+		t.Error("expected the subscribers to be dropped on close")
+	}
+	if _, ok := hub.subscribe(streamFilter{}); ok {
+		t.Error("expected no subscription once the hub is closed")
+	}
+	if n := atomic.LoadInt64(&hub.stats.subscribers); n != 0 {
+		t.Errorf("expected no subscribers got %d", n)
+	}
+}
+
+func TestHttpd_StreamReadingsHandler(t *testing.T) {
+	core := newCore(common.FrozenInTime, uint(1337), 2)
+	core.streams = newStreamHub(core.deviceSite)
+	ts := httptest.NewServer(newHttpd(core, 8080).handler())
+	defer ts.Close()
+
+	if resp, err := http.Get(ts.URL + "/stream/readings?bbox=1,2"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected an invalid filter to be rejected, got %v", err)
+	}
+
+	resp, err := http.Get(ts.URL + "/stream/readings?imei=490154203237518")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected an event stream got %s", ct)
+	}
+	waitFor(t, "the subscription", func() bool { return atomic.LoadInt64(&core.streams.stats.subscribers) == 1 })
+
+	core.streams.Write(readingRecord(448324242329542, 0, 10, 50))
+	core.streams.Write(readingRecord(490154203237518, time.Second, 20, 50))
+	events := bufio.NewReader(resp.Body)
+	readLine := func() string {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSuffix(line, "\n")
+	}
+	if line := readLine(); line != "event: reading" {
+		t.Fatalf("expected a reading event got %q", line)
+	}
+	var data streamReading
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(readLine(), "data: ")), &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.IMEI != 490154203237518 || data.Reading.Temperature != 20 {
+		t.Errorf("expected only the reading of the filtered device, got %+v", data)
+	}
+	readLine()
+
+	// the hub drops the subscriber as if it fell behind
+	core.streams.mux.Lock()
+	for sub := range core.streams.subs {
+		core.streams.slowConsumer(sub)
+		core.streams.drop(sub)
+	}
+	core.streams.mux.Unlock()
+	if line := readLine(); line != "event: error" {
+		t.Errorf("expected an error event got %q", line)
+	}
+	if line := readLine(); line != "data: slow consumer" {
+		t.Errorf("expected a slow consumer error got %q", line)
+	}
+	readLine()
+	if _, err := events.ReadString('\n'); err == nil {
+		t.Error("expected the stream to be closed")
+	}
+}
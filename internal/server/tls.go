@@ -0,0 +1,138 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+// tlsReloadInterval bounds how often the certificate files are checked for
+// changes, they are checked on the handshakes of new connections.
+const tlsReloadInterval = time.Second
+
+// tlsReloader builds the TLS configuration of the device listener from PEM
+// files, and reloads it when any of them changes so certificates can be
+// rotated without restarting the server.
+type tlsReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	now          func() time.Time
+
+	mux         sync.Mutex
+	config      *tls.Config
+	modTimes    []time.Time
+	lastChecked time.Time
+}
+
+// newTLSReloader loads the server certificate and key, and the client CA if
+// clientCAFile is not empty, which turns mutual TLS on.
+func newTLSReloader(certFile, keyFile, clientCAFile string, now func() time.Time) (*tlsReloader, error) {
+	r := &tlsReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		now:          now,
+	}
+	modTimes, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+	r.lastChecked = now()
+	return r, nil
+}
+
+// listenerConfig returns the configuration of the listener, every handshake
+// gets the latest loaded configuration.
+func (r *tlsReloader) listenerConfig() *tls.Config {
+	return &tls.Config{GetConfigForClient: r.configForClient}
+}
+
+func (r *tlsReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	now := r.now()
+	if now.Sub(r.lastChecked) < tlsReloadInterval {
+		return r.config, nil
+	}
+	r.lastChecked = now
+	modTimes, err := r.stat()
+	if err != nil {
+		logging.Error("checking tls files, keeping the loaded certificates", logging.F("err", err))
+		return r.config, nil
+	}
+	if r.modified(modTimes) {
+		if err := r.load(modTimes); err != nil {
+			logging.Error("reloading tls files, keeping the loaded certificates", logging.F("err", err))
+		} else {
+			logging.Info("reloaded tls certificate", logging.F("certificate", r.certFile))
+		}
+	}
+	return r.config, nil
+}
+
+func (r *tlsReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+func (r *tlsReloader) stat() ([]time.Time, error) {
+	files := r.files()
+	modTimes := make([]time.Time, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (r *tlsReloader) modified(modTimes []time.Time) bool {
+	for i := range modTimes {
+		if !modTimes[i].Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// load replaces the configuration, r.config is left untouched on errors.
+func (r *tlsReloader) load(modTimes []time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading tls certificate %s, %v", r.certFile, err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if r.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("loading tls client ca %s, %v", r.clientCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in tls client ca %s", r.clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	r.config = config
+	r.modTimes = modTimes
+	return nil
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+// testPKI is a CA and the files of a server certificate signed by it.
+type testPKI struct {
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+
+	caFile   string
+	certFile string
+	keyFile  string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "thermomatic-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPKI{
+		dir:      dir,
+		caFile:   filepath.Join(dir, "ca.pem"),
+		certFile: filepath.Join(dir, "server.pem"),
+		keyFile:  filepath.Join(dir, "server-key.pem"),
+	}
+	p.caKey = generateTestKey(t)
+	template := p.template("thermomatic test ca")
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &p.caKey.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ca, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, p.caFile, "CERTIFICATE", der)
+	p.writeServerCertificate(t)
+	return p
+}
+
+func (p *testPKI) template(commonName string) *x509.Certificate {
+	p.serial++
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+}
+
+// issue returns a certificate for commonName signed by the CA.
+func (p *testPKI) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) (der []byte, key *ecdsa.PrivateKey) {
+	t.Helper()
+	key = generateTestKey(t)
+	template := p.template(commonName)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der, key
+}
+
+// writeServerCertificate issues a new server certificate and returns its serial.
+func (p *testPKI) writeServerCertificate(t *testing.T) int64 {
+	t.Helper()
+	der, key := p.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	writePEM(t, p.certFile, "CERTIFICATE", der)
+	writePEM(t, p.keyFile, "EC PRIVATE KEY", marshalTestKey(t, key))
+	return p.serial
+}
+
+// writeClientCertificate writes a PEM file with a client certificate issued
+// to commonName and its key, as expected by device.LoadClientTLSConfig.
+func (p *testPKI) writeClientCertificate(t *testing.T, commonName string) string {
+	t.Helper()
+	der, key := p.issue(t, commonName, x509.ExtKeyUsageClientAuth)
+	path := filepath.Join(p.dir, commonName+".pem")
+	var content bytes.Buffer
+	pem.Encode(&content, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&content, &pem.Block{Type: "EC PRIVATE KEY", Bytes: marshalTestKey(t, key)})
+	if err := ioutil.WriteFile(path, content.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func generateTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func marshalTestKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	t.Helper()
+	content := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSReloader_ReloadsChangedCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	defer os.RemoveAll(pki.dir)
+	now := time.Now()
+	reloader, err := newTLSReloader(pki.certFile, pki.keyFile, pki.caFile, func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		config, _ := reloader.configForClient(nil)
+		cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.SerialNumber.Int64()
+	}
+	first := serial()
+
+	rotated := pki.writeServerCertificate(t)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(pki.certFile, later, later)
+	os.Chtimes(pki.keyFile, later, later)
+	if got := serial(); got != first {
+		t.Errorf("expected the files to be checked once per %v, got serial %d", tlsReloadInterval, got)
+	}
+	now = now.Add(tlsReloadInterval)
+	if got := serial(); got != rotated {
+		t.Errorf("expected the rotated certificate %d got %d", rotated, got)
+	}
+
+	// a broken rotation keeps the loaded certificate
+	ioutil.WriteFile(pki.keyFile, []byte("not a key"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(pki.keyFile, later, later)
+	now = now.Add(tlsReloadInterval)
+	if got := serial(); got != rotated {
+		t.Errorf("expected the loaded certificate %d to be kept got %d", rotated, got)
+	}
+}
+
+func TestNewServer_TLSErrors(t *testing.T) {
+	pki := newTestPKI(t)
+	defer os.RemoveAll(pki.dir)
+	tests := map[string]Config{
+		"missing key":      {TLSCertFile: pki.certFile},
+		"missing cert":     {TLSClientCAFile: pki.caFile},
+		"ca without certs": {TLSCertFile: pki.certFile, TLSKeyFile: pki.keyFile, TLSClientCAFile: pki.keyFile},
+	}
+	for name, cfg := range tests {
+		if s, err := newServer(cfg); err == nil {
+			s.ln.Close()
+			s.httpLn.Close()
+			s.core.stop()
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestServer_Run_MutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	defer os.RemoveAll(pki.dir)
+	s, cancel, done := startTestServer(t, Config{
+		MaxClients:      10,
+		TLSCertFile:     pki.certFile,
+		TLSKeyFile:      pki.keyFile,
+		TLSClientCAFile: pki.caFile,
+		ShutdownTimeout: time.Second,
+	})
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// the certificate of the server is issued to 127.0.0.1
+	address := net.JoinHostPort("127.0.0.1", fmt.Sprint(s.ln.Addr().(*net.TCPAddr).Port))
+
+	// the simulator logs in with a certificate issued to its IMEI
+	config, err := device.LoadClientTLSConfig(pki.writeClientCertificate(t, "490154203237518"), pki.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.Randomatic(device.SimulatorConfig{
+		ServerAddress: address,
+		IMEI:          "490154203237518",
+		NumReadings:   3,
+		ReadingRate:   time.Millisecond,
+		Protocol:      device.ProtocolV1,
+		TLS:           config,
+	})
+	waitFor(t, "the readings", func() bool { return atomic.LoadUint64(&s.core.stats.readings) == 3 })
+
+	// the common name keeps the leading zeros of the IMEI
+	zeroIMEI := fmt.Sprintf("%015d", device.LuhnIMEI(1234567890123))
+	config, err = device.LoadClientTLSConfig(pki.writeClientCertificate(t, zeroIMEI), pki.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.Randomatic(device.SimulatorConfig{
+		ServerAddress: address,
+		IMEI:          zeroIMEI,
+		NumReadings:   3,
+		ReadingRate:   time.Millisecond,
+		Protocol:      device.ProtocolV1,
+		TLS:           config,
+	})
+	waitFor(t, "the readings of the IMEI with leading zeros", func() bool { return atomic.LoadUint64(&s.core.stats.readings) == 6 })
+
+	// a certificate issued to another IMEI is rejected
+	config, err = device.LoadClientTLSConfig(pki.writeClientCertificate(t, "448324242329542"), pki.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	if logins := atomic.LoadUint64(&s.core.stats.logins); logins != 2 {
+		t.Errorf("expected 2 logins got %d", logins)
+	}
+
+	// the load generator presents the certificate issued to each device
+	config, err = device.LoadClientTLSConfig("", pki.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := device.RunLoad(context.Background(), device.LoadConfig{
+		ServerAddress: address,
+		Devices:       1,
+		Duration:      100 * time.Millisecond,
+		ReadingRate:   10 * time.Millisecond,
+		FirstSerial:   49015420323751,
+		Protocol:      device.ProtocolV1,
+		TLS:           config,
+		CertFile:      filepath.Join(pki.dir, "{imei}.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Logins != 1 || report.Disconnects != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	waitFor(t, "the login of the load generator", func() bool { return atomic.LoadUint64(&s.core.stats.logins) == 3 })
+
+	// no client certificate, no handshake
+	config, err = device.LoadClientTLSConfig("", pki.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := tls.Dial("tcp", address, config); err == nil {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+		if err == nil {
+			t.Error("expected the handshake without a client certificate to fail")
+		}
+	}
+}
@@ -0,0 +1,496 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+const (
+	// wsGUID is appended to the key of a WebSocket handshake to compute its
+	// accept value, RFC 6455 section 1.3.
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// wsMaxMessageSize is the largest message accepted from a client, its
+	// messages are small subscription requests.
+	wsMaxMessageSize = 64 << 10
+	// defaultWSPingInterval is how often the server pings an idle client, a
+	// client not answering for twice as long is disconnected.
+	defaultWSPingInterval = 30 * time.Second
+)
+
+// Opcodes of the WebSocket frames, RFC 6455 section 5.2.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// Status codes of the WebSocket close frames, RFC 6455 section 7.4.1.
+const (
+	wsCloseNormal          = 1000
+	wsCloseGoingAway       = 1001
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupportedData = 1003
+	wsCloseInvalidPayload  = 1007
+	wsClosePolicyViolation = 1008
+	wsCloseTooBig          = 1009
+)
+
+// wsCloseError is returned by readMessage once the connection is closed with a
+// close frame, sent by either side.
+type wsCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket closed with %d %s", e.Code, e.Reason)
+}
+
+// wsConn is the server side of a WebSocket connection. Messages are read by a
+// single goroutine, writes are serialized so any goroutine may write.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// readTimeout bounds how long reading a frame may block
+	readTimeout time.Duration
+
+	writeMux sync.Mutex
+	// closeSent is set once a close frame was written, nothing is written
+	// after it
+	closeSent bool
+}
+
+// checkWebSocketHandshake checks the opening handshake of a WebSocket client
+// and returns its key.
+func checkWebSocketHandshake(req *http.Request) (string, error) {
+	if req.Method != http.MethodGet {
+		return "", fmt.Errorf("websocket handshake with method %s", req.Method)
+	}
+	if !headerHasToken(req.Header, "Connection", "upgrade") || !headerHasToken(req.Header, "Upgrade", "websocket") {
+		return "", errors.New("not a websocket handshake")
+	}
+	if v := req.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		return "", fmt.Errorf("unsupported websocket version %q", v)
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		return "", fmt.Errorf("invalid websocket key %q", key)
+	}
+	return key, nil
+}
+
+// upgradeWebSocket takes the connection of a WebSocket client over and
+// answers its handshake, key is the key of the handshake.
+func upgradeWebSocket(w http.ResponseWriter, key string) (*wsConn, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("websockets are not supported by the connection")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		wsAccept(key))
+	if err := writeStream(conn, rw); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: rw.Reader, readTimeout: 2 * defaultWSPingInterval}, nil
+}
+
+// wsAccept returns the Sec-WebSocket-Accept value answering key.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether the comma separated values of the header
+// name contain token, case insensitively.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, v := range header[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsFrame is a frame read from a client, its payload is unmasked.
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// readFrame reads a frame of at most limit payload bytes. Client frames must
+// be masked, and no extension is negotiated so the reserved bits must be 0.
+func (c *wsConn) readFrame(limit int) (wsFrame, error) {
+	var f wsFrame
+	if err := c.conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+		return f, err
+	}
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return f, err
+	}
+	f.fin = header[0]&0x80 != 0
+	f.opcode = header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		return f, &wsCloseError{Code: wsCloseProtocolError, Reason: "reserved bits set"}
+	}
+	if header[1]&0x80 == 0 {
+		return f, &wsCloseError{Code: wsCloseProtocolError, Reason: "unmasked frame"}
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if f.opcode >= wsClose && (length > 125 || !f.fin) {
+		return f, &wsCloseError{Code: wsCloseProtocolError, Reason: "invalid control frame"}
+	}
+	if length > uint64(limit) {
+		return f, &wsCloseError{Code: wsCloseTooBig, Reason: "message too big"}
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return f, err
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		return f, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// readMessage returns the next text message of the client. It answers pings,
+// and the close frame of the client, in which case it returns a wsCloseError.
+// Protocol errors are answered with a close frame too.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	fragmented := false
+	for {
+		f, err := c.readFrame(wsMaxMessageSize - len(message))
+		if err != nil {
+			var closeErr *wsCloseError
+			if errors.As(err, &closeErr) {
+				c.writeClose(closeErr.Code, closeErr.Reason)
+			}
+			return nil, err
+		}
+		switch f.opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, f.payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			closeErr := &wsCloseError{Code: wsCloseNormal}
+			if len(f.payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(f.payload))
+				closeErr.Reason = string(f.payload[2:])
+			}
+			c.writeClose(closeErr.Code, "")
+			return nil, closeErr
+		case wsText, wsBinary:
+			if fragmented {
+				return nil, c.protocolError("expected a continuation frame")
+			}
+			if f.opcode == wsBinary {
+				c.writeClose(wsCloseUnsupportedData, "binary messages are not supported")
+				return nil, &wsCloseError{Code: wsCloseUnsupportedData}
+			}
+		case wsContinuation:
+			if !fragmented {
+				return nil, c.protocolError("unexpected continuation frame")
+			}
+		default:
+			return nil, c.protocolError(fmt.Sprintf("unknown opcode %d", f.opcode))
+		}
+		message = append(message, f.payload...)
+		fragmented = !f.fin
+		if f.fin {
+			if !utf8.Valid(message) {
+				c.writeClose(wsCloseInvalidPayload, "invalid utf-8")
+				return nil, &wsCloseError{Code: wsCloseInvalidPayload}
+			}
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) protocolError(reason string) error {
+	c.writeClose(wsCloseProtocolError, reason)
+	return &wsCloseError{Code: wsCloseProtocolError, Reason: reason}
+}
+
+// writeFrame writes an unmasked frame, within streamWriteTimeout.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	if c.closeSent {
+		return &wsCloseError{Code: wsCloseNormal, Reason: "close frame sent"}
+	}
+	if opcode == wsClose {
+		c.closeSent = true
+	}
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(len(payload)))
+		frame = append(append(frame, 127), ext[:]...)
+	}
+	frame = append(frame, payload...)
+	if err := c.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// writeJSON writes v as a text message.
+func (c *wsConn) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsText, data)
+}
+
+// writeClose writes a close frame with code and reason, once.
+func (c *wsConn) writeClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return c.writeFrame(wsClose, append(payload, reason...))
+}
+
+func (c *wsConn) close() error {
+	return c.conn.Close()
+}
+
+// wsRequest is a message of a WebSocket client:
+//
+//	{"type": "subscribe", "imeis": [490154203237518]}
+//	{"type": "unsubscribe", "imeis": [490154203237518]}
+//
+// All subscribes to, or unsubscribes from, every device instead.
+type wsRequest struct {
+	Type  string   `json:"type"`
+	IMEIs []uint64 `json:"imeis"`
+	All   bool     `json:"all"`
+}
+
+// wsMessage is a message sent to a WebSocket client: the reading, online and
+// offline events of its devices, the acknowledgement of its requests, with
+// the devices it is subscribed to, and errors.
+type wsMessage struct {
+	Type           string          `json:"type"`
+	IMEI           uint64          `json:"imei,omitempty"`
+	TimestampEpoch int64           `json:"timestampEpoch,omitempty"`
+	Reading        *device.Reading `json:"reading,omitempty"`
+	Reason         string          `json:"reason,omitempty"`
+	IMEIs          []uint64        `json:"imeis,omitempty"`
+	All            bool            `json:"all,omitempty"`
+	Error          string          `json:"error,omitempty"`
+}
+
+// wsSubscribed is the acknowledgement of a request which changed filter.
+func wsSubscribed(f *streamFilter) wsMessage {
+	msg := wsMessage{Type: "subscribed", All: f.imeis == nil, IMEIs: []uint64{}}
+	for imei := range f.imeis {
+		msg.IMEIs = append(msg.IMEIs, imei)
+	}
+	return msg
+}
+
+// websocketHandler serves GET /ws, a WebSocket connection where the client
+// subscribes to devices on the fly and receives their readings as they
+// arrive, and the devices going online and offline. A new connection is
+// subscribed to no device. A client which falls behind is disconnected with a
+// policy violation close frame, like the live streams.
+func (d *httpd) websocketHandler(w http.ResponseWriter, req *http.Request) {
+	hub := d.core.streams
+	if hub == nil {
+		http.Error(w, "no stream available", http.StatusNotFound)
+		return
+	}
+	key, err := checkWebSocketHandshake(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ws, err := upgradeWebSocket(w, key)
+	if err != nil {
+		d.log.Warn("starting the websocket", logging.F("err", err))
+		return
+	}
+	defer ws.close()
+	pingInterval := d.wsPingInterval
+	ws.readTimeout = 2 * pingInterval
+	log := d.log.With(logging.F("remote", req.RemoteAddr))
+	sub, ok := hub.subscribe(streamFilter{imeis: map[uint64]bool{}, presence: true})
+	if !ok {
+		ws.writeClose(wsCloseGoingAway, "the server is shutting down")
+		return
+	}
+	defer hub.unsubscribe(sub)
+	log.Info("websocket connected")
+
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		d.readWebSocket(ws, hub, sub, log)
+	}()
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case ev := <-sub.events:
+			msg := wsMessage{Type: ev.Type, IMEI: ev.Record.IMEI, TimestampEpoch: ev.Record.Epoch, Reason: ev.Reason}
+			if ev.Type == streamReadingEvent {
+				msg.Reading = &ev.Record.Reading
+			}
+			err = ws.writeJSON(msg)
+		case <-ping.C:
+			err = ws.writeFrame(wsPing, nil)
+		case <-sub.done:
+			if atomic.LoadInt32(&sub.slow) == 1 {
+				ws.writeClose(wsClosePolicyViolation, "slow consumer")
+				log.Warn("websocket disconnected", logging.F("reason", "slow consumer"))
+			} else {
+				ws.writeClose(wsCloseGoingAway, "the server is shutting down")
+			}
+			return
+		case <-gone:
+			return
+		}
+		if err != nil {
+			if isTimeoutError(err) {
+				hub.slowConsumer(sub)
+				log.Warn("websocket disconnected", logging.F("reason", "slow consumer"), logging.F("err", err))
+				return
+			}
+			log.Info("websocket disconnected", logging.F("err", err))
+			return
+		}
+	}
+}
+
+// readWebSocket handles the requests of a WebSocket client until it closes
+// the connection, or stops answering the pings.
+func (d *httpd) readWebSocket(ws *wsConn, hub *streamHub, sub *subscription, log *logging.Logger) {
+	for {
+		data, err := ws.readMessage()
+		if err != nil {
+			var closeErr *wsCloseError
+			if errors.As(err, &closeErr) && closeErr.Code == wsCloseNormal || err == io.EOF {
+				log.Info("websocket disconnected")
+			} else {
+				log.Info("websocket disconnected", logging.F("err", err))
+			}
+			return
+		}
+		var request wsRequest
+		if err := json.Unmarshal(data, &request); err != nil {
+			ws.writeJSON(wsMessage{Type: "error", Error: fmt.Sprintf("invalid message, %v", err)})
+			continue
+		}
+		if err := validateWSRequest(request); err != nil {
+			ws.writeJSON(wsMessage{Type: "error", Error: err.Error()})
+			continue
+		}
+		var ack wsMessage
+		hub.update(sub, func(f *streamFilter) {
+			if err := applyWSRequest(f, request); err != nil {
+				ack = wsMessage{Type: "error", Error: err.Error()}
+				return
+			}
+			ack = wsSubscribed(f)
+		})
+		ws.writeJSON(ack)
+	}
+}
+
+func validateWSRequest(request wsRequest) error {
+	if request.Type != "subscribe" && request.Type != "unsubscribe" {
+		return fmt.Errorf("unknown message type %q", request.Type)
+	}
+	if !request.All && len(request.IMEIs) == 0 {
+		return fmt.Errorf("%s needs imeis or all", request.Type)
+	}
+	for _, imei := range request.IMEIs {
+		if _, err := parseIMEI(fmt.Sprint(imei)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyWSRequest changes the devices selected by f, nil imeis selects every
+// device.
+func applyWSRequest(f *streamFilter, request wsRequest) error {
+	switch {
+	case request.Type == "subscribe" && request.All:
+		f.imeis = nil
+	case request.Type == "unsubscribe" && request.All:
+		f.imeis = map[uint64]bool{}
+	case f.imeis == nil && request.Type == "unsubscribe":
+		return errors.New("unsubscribe from all the devices first")
+	case request.Type == "subscribe":
+		// already subscribed to every device otherwise
+		if f.imeis != nil {
+			for _, imei := range request.IMEIs {
+				f.imeis[imei] = true
+			}
+		}
+	default:
+		for _, imei := range request.IMEIs {
+			delete(f.imeis, imei)
+		}
+	}
+	return nil
+}
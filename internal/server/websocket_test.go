@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/common"
+	"github.com/spin-org/thermomatic/internal/device"
+)
+
+// wsTestClient is a minimal WebSocket client, it masks its frames as RFC 6455
+// requires from clients.
+type wsTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, ts *httptest.Server) *wsTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: thermomatic\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", key)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the accept value of the sample handshake of RFC 6455 section 1.3
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected handshake response %d %v", resp.StatusCode, resp.Header)
+	}
+	c := &wsTestClient{t: t, conn: conn, br: br}
+	t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+func (c *wsTestClient) writeFrame(fin bool, opcode byte, payload []byte) {
+	c.t.Helper()
+	header := opcode
+	if fin {
+		header |= 0x80
+	}
+	frame := []byte{header}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	default:
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *wsTestClient) send(v interface{}) {
+	c.t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.writeFrame(true, wsText, data)
+}
+
+// readFrame reads a frame of the server, which must not be masked.
+func (c *wsTestClient) readFrame() (byte, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[1]&0x80 != 0 {
+		c.t.Fatal("expected an unmasked frame")
+	}
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(c.br, payload)
+	return header[0] & 0x0F, payload, err
+}
+
+// receive returns the next message of the server.
+func (c *wsTestClient) receive() wsMessage {
+	c.t.Helper()
+	opcode, payload, err := c.readFrame()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if opcode != wsText {
+		c.t.Fatalf("expected a text message got opcode %d %q", opcode, payload)
+	}
+	var msg wsMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+// expectClose reads the close frame of the server and returns its code.
+func (c *wsTestClient) expectClose() int {
+	c.t.Helper()
+	opcode, payload, err := c.readFrame()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if opcode != wsClose || len(payload) < 2 {
+		c.t.Fatalf("expected a close frame got opcode %d %q", opcode, payload)
+	}
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+func newWebSocketTestServer(t *testing.T) (*core, *httpd, *httptest.Server) {
+	core := newCore(common.FrozenInTime, uint(1337), 2)
+	core.streams = newStreamHub(core.deviceSite)
+	d := newHttpd(core, 8080)
+	ts := httptest.NewServer(d.handler())
+	t.Cleanup(ts.Close)
+	return core, d, ts
+}
+
+func TestWebSocket_Subscriptions(t *testing.T) {
+	core, _, ts := newWebSocketTestServer(t)
+	if resp, err := http.Get(ts.URL + "/ws"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a request without handshake to be rejected, got %v", err)
+	}
+
+	client := dialWebSocket(t, ts)
+	imei, other := uint64(490154203237518), uint64(448324242329542)
+	client.send(wsRequest{Type: "subscribe", IMEIs: []uint64{imei}})
+	if ack := client.receive(); ack.Type != "subscribed" || len(ack.IMEIs) != 1 || ack.IMEIs[0] != imei || ack.All {
+		t.Fatalf("unexpected acknowledgement %+v", ack)
+	}
+
+	core.streams.Write(readingRecord(other, 0, 10, 50))
+	core.streams.Write(readingRecord(imei, time.Second, 20, 50))
+	if msg := client.receive(); msg.Type != "reading" || msg.IMEI != imei || msg.Reading == nil || msg.Reading.Temperature != 20 {
+		t.Errorf("expected only the reading of the subscribed device, got %+v", msg)
+	}
+
+	channel := make(chan common.Command, 2)
+	if err := core.register(imei, channel, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	welcome := <-channel
+	if msg := client.receive(); msg.Type != "online" || msg.IMEI != imei {
+		t.Errorf("expected the device online got %+v", msg)
+	}
+	if err := core.deregister(imei, welcome.Session, device.LogoutTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if msg := client.receive(); msg.Type != "offline" || msg.IMEI != imei || msg.Reason != device.LogoutTimeout {
+		t.Errorf("expected the device offline got %+v", msg)
+	}
+
+	// a request fragmented in two frames
+	client.writeFrame(false, wsText, []byte(`{"type": "unsub`))
+	client.writeFrame(true, wsContinuation, []byte(`scribe", "imeis": [490154203237518]}`))
+	if ack := client.receive(); ack.Type != "subscribed" || len(ack.IMEIs) != 0 {
+		t.Errorf("expected no subscription left got %+v", ack)
+	}
+	for _, invalid := range []string{`{`, `{"type": "subscribe"}`, `{"type": "subscribe", "imeis": [1]}`, `{"type": "publish", "all": true}`} {
+		client.writeFrame(true, wsText, []byte(invalid))
+		if msg := client.receive(); msg.Type != "error" {
+			t.Errorf("expected an error for %s got %+v", invalid, msg)
+		}
+	}
+	client.send(wsRequest{Type: "subscribe", All: true})
+	if ack := client.receive(); !ack.All {
+		t.Errorf("expected a subscription to every device got %+v", ack)
+	}
+	client.send(wsRequest{Type: "unsubscribe", IMEIs: []uint64{imei}})
+	if msg := client.receive(); msg.Type != "error" {
+		t.Errorf("expected an error unsubscribing from a device while subscribed to all, got %+v", msg)
+	}
+	core.streams.Write(readingRecord(other, 2*time.Second, 30, 50))
+	if msg := client.receive(); msg.Type != "reading" || msg.IMEI != other {
+		t.Errorf("expected the reading of any device got %+v", msg)
+	}
+
+	client.writeFrame(true, wsPing, []byte("hello"))
+	if opcode, payload, err := client.readFrame(); err != nil || opcode != wsPong || string(payload) != "hello" {
+		t.Errorf("expected a pong echoing the ping, got %d %q %v", opcode, payload, err)
+	}
+
+	client.writeFrame(true, wsClose, []byte{0x03, 0xE8})
+	if code := client.expectClose(); code != wsCloseNormal {
+		t.Errorf("expected a normal close got %d", code)
+	}
+	if _, _, err := client.readFrame(); err != io.EOF {
+		t.Errorf("expected the connection to be closed got %v", err)
+	}
+	waitFor(t, "the subscriber to leave", func() bool { return atomic.LoadInt64(&core.streams.stats.subscribers) == 0 })
+}
+
+func TestWebSocket_ProtocolErrors(t *testing.T) {
+	_, _, ts := newWebSocketTestServer(t)
+	for _, tc := range []struct {
+		name  string
+		frame []byte
+		code  int
+	}{
+		{"unmasked", []byte{0x81, 0x02, '{', '}'}, wsCloseProtocolError},
+		{"binary", []byte{0x82, 0x80, 0, 0, 0, 0}, wsCloseUnsupportedData},
+		{"continuation", []byte{0x80, 0x80, 0, 0, 0, 0}, wsCloseProtocolError},
+		{"too big", []byte{0x81, 0xFF, 0, 0, 0, 0, 0, 1, 0, 1}, wsCloseTooBig},
+		{"invalid utf-8", []byte{0x81, 0x81, 0, 0, 0, 0, 0xFF}, wsCloseInvalidPayload},
+	} {
+		client := dialWebSocket(t, ts)
+		client.conn.Write(tc.frame)
+		if code := client.expectClose(); code != tc.code {
+			t.Errorf("%s: expected close %d got %d", tc.name, tc.code, code)
+		}
+	}
+}
+
+func TestWebSocket_Keepalive(t *testing.T) {
+	core, d, ts := newWebSocketTestServer(t)
+	d.wsPingInterval = 50 * time.Millisecond
+
+	// a client which does not answer the pings is disconnected
+	client := dialWebSocket(t, ts)
+	var pings int
+	for {
+		opcode, _, err := client.readFrame()
+		if err != nil {
+			break
+		}
+		if opcode != wsPing {
+			t.Fatalf("expected pings got opcode %d", opcode)
+		}
+		pings++
+	}
+	if pings == 0 {
+		t.Error("expected the server to ping the client")
+	}
+	waitFor(t, "the subscriber to leave", func() bool { return atomic.LoadInt64(&core.streams.stats.subscribers) == 0 })
+
+	// a client falling behind is disconnected as a slow consumer
+	client = dialWebSocket(t, ts)
+	waitFor(t, "the subscription", func() bool { return atomic.LoadInt64(&core.streams.stats.subscribers) == 1 })
+	core.streams.mux.Lock()
+	for sub := range core.streams.subs {
+		core.streams.slowConsumer(sub)
+		core.streams.drop(sub)
+	}
+	core.streams.mux.Unlock()
+	for {
+		opcode, payload, err := client.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode == wsClose {
+			if code := int(binary.BigEndian.Uint16(payload)); code != wsClosePolicyViolation {
+				t.Errorf("expected a policy violation got %d", code)
+			}
+			break
+		}
+	}
+
+	// subscribers are told the server is going away when it shuts down
+	client = dialWebSocket(t, ts)
+	waitFor(t, "the subscription", func() bool { return atomic.LoadInt64(&core.streams.stats.subscribers) == 1 })
+	core.streams.Close()
+	for {
+		opcode, payload, err := client.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode == wsClose {
+			if code := int(binary.BigEndian.Uint16(payload)); code != wsCloseGoingAway {
+				t.Errorf("expected going away got %d", code)
+			}
+			break
+		}
+	}
+}
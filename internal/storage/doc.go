@@ -0,0 +1,31 @@
+/*
+Package storage implements an embedded, append-only time-series store of
+device readings.
+
+Each device (IMEI) has its own directory holding a series of segment files,
+named after the timestamp of their first record so they sort by time:
+
+	<dir>/<imei>/<first epoch>.seg   records
+	<dir>/<imei>/<first epoch>.idx   sparse time index of the segment
+
+A record is the 40 bytes reading payload of the thermomatic protocol, prefixed
+by the reception timestamp and followed by a checksum:
+
+	| Field    | Start Index | Size | Notes                                   |
+	| -------- | ----------- | ---- | --------------------------------------- |
+	| Epoch    | 0           | 8    | nanoseconds since the unix epoch, BE    |
+	| Payload  | 8           | 40   | reading payload as sent by the device   |
+	| Checksum | 48          | 4    | CRC-32 (IEEE) of the previous 48 bytes  |
+
+Every IndexInterval records the epoch and offset of a record are appended to
+the segment index, so a range query only scans the records between two index
+entries before reaching the first record in range.
+
+Records are buffered in memory and written by Flush. After a crash the last
+segment of each device is checked on Open, and any torn or corrupt record at
+its tail is truncated along with the index entries pointing past it.
+
+Retention deletes whole segments, the ones older than MaxAge and the oldest
+ones of a device whose segments exceed MaxBytes in total.
+*/
+package storage
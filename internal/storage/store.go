@@ -0,0 +1,639 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spin-org/thermomatic/internal/logging"
+)
+
+const (
+	// PayloadSize is the size of a reading payload.
+	PayloadSize = 40
+	// RecordSize is the size of a stored record.
+	RecordSize = 8 + PayloadSize + 4
+	// indexEntrySize is the size of an index entry, epoch and offset.
+	indexEntrySize = 16
+
+	segmentExt = ".seg"
+	indexExt   = ".idx"
+)
+
+// Options tune a Store, zero values take the defaults.
+type Options struct {
+	// SegmentBytes is the size at which a new segment is started.
+	SegmentBytes int64
+	// IndexInterval is the number of records between two index entries.
+	IndexInterval int
+	// FlushInterval is the minimum time between two writes of buffered records
+	// made by FlushIfDue.
+	FlushInterval time.Duration
+	// MaxAge deletes segments whose newest record is older, 0 keeps them forever.
+	MaxAge time.Duration
+	// MaxBytes bounds the total size of the segments of a device, 0 means no
+	// limit.
+	MaxBytes int64
+	// Now returns the current time, used by retention.
+	Now func() time.Time
+}
+
+const (
+	defaultSegmentBytes  = 4 << 20
+	defaultIndexInterval = 128
+	defaultFlushInterval = time.Second
+)
+
+// ErrNotFound is returned when there are no records of a device.
+var ErrNotFound = errors.New("storage: device not found")
+
+// Entry is a stored reading.
+type Entry struct {
+	// Epoch is the reception time of the reading in nanoseconds.
+	Epoch int64
+	// Payload is the reading as sent by the device.
+	Payload [PayloadSize]byte
+}
+
+// Store is an append-only store of readings, safe for concurrent use.
+type Store struct {
+	dir       string
+	opts      Options
+	mux       sync.Mutex
+	series    map[uint64]*series
+	lastFlush time.Time
+}
+
+// series are the segments of a single device.
+type series struct {
+	mux      sync.Mutex
+	dir      string
+	segments []*segment
+	// pending records and index entries of the last segment not written yet
+	pending      []byte
+	pendingIndex []byte
+	// files of the last segment, kept open between flushes
+	segmentFile *os.File
+	indexFile   *os.File
+	// removed is set once retention deleted every segment and dropped the
+	// series from the store
+	removed bool
+}
+
+type segment struct {
+	path       string // without extension
+	firstEpoch int64
+	lastEpoch  int64
+	size       int64 // bytes including the pending ones
+	records    int64
+	index      []indexEntry
+}
+
+type indexEntry struct {
+	epoch  int64
+	offset int64
+}
+
+// Open opens, or creates, the store at dir recovering the segments left by
+// a previous run.
+func Open(dir string, opts Options) (*Store, error) {
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = defaultSegmentBytes
+	}
+	if opts.SegmentBytes < RecordSize {
+		opts.SegmentBytes = RecordSize
+	}
+	if opts.IndexInterval <= 0 {
+		opts.IndexInterval = defaultIndexInterval
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("storage: creating %s, %v", dir, err)
+	}
+
+	s := &Store{
+		dir:    dir,
+		opts:   opts,
+		series: make(map[uint64]*series),
+	}
+	dirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("storage: reading %s, %v", dir, err)
+	}
+	for _, d := range dirs {
+		imei, err := strconv.ParseUint(d.Name(), 10, 64)
+		if err != nil || !d.IsDir() {
+			continue
+		}
+		ser, err := openSeries(filepath.Join(dir, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(ser.segments) > 0 {
+			s.series[imei] = ser
+		}
+	}
+	s.lastFlush = opts.Now()
+	return s, nil
+}
+
+func openSeries(dir string) (*series, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	ser := &series{dir: dir}
+	for i, name := range names {
+		seg, err := openSegment(name[:len(name)-len(segmentExt)], i == len(names)-1)
+		if err != nil {
+			return nil, err
+		}
+		if seg.records == 0 {
+			os.Remove(seg.path + segmentExt)
+			os.Remove(seg.path + indexExt)
+			continue
+		}
+		ser.segments = append(ser.segments, seg)
+	}
+	return ser, nil
+}
+
+// openSegment loads the index of a segment. The last segment of a series may
+// have been torn by a crash, so its records after the last index entry are
+// verified and the corrupt tail is truncated.
+func openSegment(path string, last bool) (*segment, error) {
+	f, err := os.OpenFile(path+segmentExt, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	indexData, err := ioutil.ReadFile(path + indexExt)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	seg := &segment{path: path}
+	fileSize := info.Size()
+	size := fileSize / RecordSize * RecordSize
+	for i := 0; i+indexEntrySize <= len(indexData); i += indexEntrySize {
+		entry := indexEntry{
+			epoch:  int64(binary.BigEndian.Uint64(indexData[i:])),
+			offset: int64(binary.BigEndian.Uint64(indexData[i+8:])),
+		}
+		if entry.offset+RecordSize > size {
+			break
+		}
+		seg.index = append(seg.index, entry)
+	}
+
+	if last {
+		verified := int64(0)
+		if len(seg.index) > 0 {
+			verified = seg.index[len(seg.index)-1].offset
+		}
+		tail := make([]byte, size-verified)
+		if _, err := f.ReadAt(tail, verified); err != nil {
+			return nil, err
+		}
+		for i := 0; i+RecordSize <= len(tail) && validRecord(tail[i:i+RecordSize]); i += RecordSize {
+			verified += RecordSize
+		}
+		size = verified
+	}
+	if size != fileSize {
+		logging.Warn("storage recovering segment, truncating a torn or corrupt tail", logging.F("path", path+segmentExt),
+			logging.F("bytes", fileSize-size))
+		if err := f.Truncate(size); err != nil {
+			return nil, err
+		}
+	}
+	for len(seg.index) > 0 && seg.index[len(seg.index)-1].offset+RecordSize > size {
+		seg.index = seg.index[:len(seg.index)-1]
+	}
+	if len(seg.index)*indexEntrySize != len(indexData) {
+		if err := ioutil.WriteFile(path+indexExt, encodeIndex(seg.index), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	seg.size = size
+	seg.records = size / RecordSize
+	if seg.records > 0 {
+		var epoch [8]byte
+		if _, err := f.ReadAt(epoch[:], 0); err != nil {
+			return nil, err
+		}
+		seg.firstEpoch = int64(binary.BigEndian.Uint64(epoch[:]))
+		if _, err := f.ReadAt(epoch[:], size-RecordSize); err != nil {
+			return nil, err
+		}
+		seg.lastEpoch = int64(binary.BigEndian.Uint64(epoch[:]))
+	}
+	return seg, nil
+}
+
+func validRecord(rec []byte) bool {
+	_ = rec[RecordSize-1]
+	return crc32.ChecksumIEEE(rec[:RecordSize-4]) == binary.BigEndian.Uint32(rec[RecordSize-4:])
+}
+
+func encodeIndex(index []indexEntry) []byte {
+	buf := make([]byte, 0, len(index)*indexEntrySize)
+	for _, entry := range index {
+		buf = appendIndexEntry(buf, entry)
+	}
+	return buf
+}
+
+func appendIndexEntry(dst []byte, entry indexEntry) []byte {
+	var b [indexEntrySize]byte
+	binary.BigEndian.PutUint64(b[0:], uint64(entry.epoch))
+	binary.BigEndian.PutUint64(b[8:], uint64(entry.offset))
+	return append(dst, b[:]...)
+}
+
+func appendRecord(dst []byte, epoch int64, payload *[PayloadSize]byte) []byte {
+	var rec [RecordSize]byte
+	binary.BigEndian.PutUint64(rec[0:], uint64(epoch))
+	copy(rec[8:], payload[:])
+	binary.BigEndian.PutUint32(rec[RecordSize-4:], crc32.ChecksumIEEE(rec[:RecordSize-4]))
+	return append(dst, rec[:]...)
+}
+
+func decodeRecord(rec []byte) (entry Entry, ok bool) {
+	if !validRecord(rec) {
+		return entry, false
+	}
+	entry.Epoch = int64(binary.BigEndian.Uint64(rec[0:]))
+	copy(entry.Payload[:], rec[8:])
+	return entry, true
+}
+
+// Append buffers a reading of imei received at epoch, it is written by the
+// next Flush. Epochs of a device are expected to be increasing.
+func (s *Store) Append(imei uint64, epoch int64, payload *[PayloadSize]byte) error {
+	ser := s.lockSeries(imei)
+	defer ser.mux.Unlock()
+
+	last := ser.last()
+	if last == nil || last.size+RecordSize > s.opts.SegmentBytes {
+		if err := ser.flush(); err != nil {
+			return err
+		}
+		if err := ser.closeFiles(); err != nil {
+			return err
+		}
+		// retention removes the directory with the last segment
+		if err := os.MkdirAll(ser.dir, 0755); err != nil {
+			return fmt.Errorf("storage: creating %s, %v", ser.dir, err)
+		}
+		// segments are named after their first epoch so they sort by time,
+		// a clash with the previous one is solved bumping the name
+		name := epoch
+		if last != nil && name <= last.firstEpoch {
+			name = last.firstEpoch + 1
+		}
+		last = &segment{
+			path:       filepath.Join(ser.dir, fmt.Sprintf("%020d", name)),
+			firstEpoch: epoch,
+		}
+		ser.segments = append(ser.segments, last)
+	}
+
+	offset := last.size
+	if last.records%int64(s.opts.IndexInterval) == 0 {
+		entry := indexEntry{epoch: epoch, offset: offset}
+		last.index = append(last.index, entry)
+		ser.pendingIndex = appendIndexEntry(ser.pendingIndex, entry)
+	}
+	ser.pending = appendRecord(ser.pending, epoch, payload)
+	last.size += RecordSize
+	last.records++
+	last.lastEpoch = epoch
+	return nil
+}
+
+// lockSeries returns the series of imei locked, it is created if needed.
+func (s *Store) lockSeries(imei uint64) *series {
+	for {
+		s.mux.Lock()
+		ser, exists := s.series[imei]
+		if !exists {
+			ser = &series{dir: filepath.Join(s.dir, strconv.FormatUint(imei, 10))}
+			s.series[imei] = ser
+		}
+		s.mux.Unlock()
+
+		ser.mux.Lock()
+		if !ser.removed {
+			return ser
+		}
+		// retention dropped it meanwhile, the next lookup creates a new one
+		ser.mux.Unlock()
+	}
+}
+
+func (ser *series) last() *segment {
+	if len(ser.segments) == 0 {
+		return nil
+	}
+	return ser.segments[len(ser.segments)-1]
+}
+
+// flush appends the pending records, and then the pending index entries, to
+// the files of the last segment.
+func (ser *series) flush() error {
+	if len(ser.pending) == 0 {
+		return nil
+	}
+	last := ser.last()
+	if err := appendFile(&ser.segmentFile, last.path+segmentExt, ser.pending); err != nil {
+		return err
+	}
+	ser.pending = ser.pending[:0]
+	if len(ser.pendingIndex) > 0 {
+		if err := appendFile(&ser.indexFile, last.path+indexExt, ser.pendingIndex); err != nil {
+			return err
+		}
+		ser.pendingIndex = ser.pendingIndex[:0]
+	}
+	return nil
+}
+
+// closeFiles closes the files of the last segment, the next flush reopens
+// them.
+func (ser *series) closeFiles() error {
+	var err error
+	for _, f := range []**os.File{&ser.segmentFile, &ser.indexFile} {
+		if *f == nil {
+			continue
+		}
+		if errClose := (*f).Close(); err == nil {
+			err = errClose
+		}
+		*f = nil
+	}
+	return err
+}
+
+// appendFile appends data to the file at path, *f is opened on first use and
+// left open for the next calls.
+func appendFile(f **os.File, path string, data []byte) error {
+	if *f == nil {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("storage: opening %s, %v", path, err)
+		}
+		*f = file
+	}
+	if _, err := (*f).Write(data); err != nil {
+		return fmt.Errorf("storage: writing %s, %v", path, err)
+	}
+	return nil
+}
+
+// Flush writes every buffered record and enforces the retention options.
+func (s *Store) Flush() error {
+	s.mux.Lock()
+	s.lastFlush = s.opts.Now()
+	all := make([]*series, 0, len(s.series))
+	for _, ser := range s.series {
+		all = append(all, ser)
+	}
+	s.mux.Unlock()
+
+	var err error
+	for _, ser := range all {
+		ser.mux.Lock()
+		if errFlush := ser.flush(); errFlush != nil {
+			err = errFlush
+		}
+		ser.mux.Unlock()
+	}
+	if errRetention := s.enforceRetention(); err == nil {
+		err = errRetention
+	}
+	return err
+}
+
+// FlushIfDue calls Flush if Options.FlushInterval elapsed since the last one,
+// so frequent callers do not turn every record into a write.
+func (s *Store) FlushIfDue() error {
+	s.mux.Lock()
+	due := s.opts.Now().Sub(s.lastFlush) >= s.opts.FlushInterval
+	s.mux.Unlock()
+	if !due {
+		return nil
+	}
+	return s.Flush()
+}
+
+// Close flushes the store and closes its files.
+func (s *Store) Close() error {
+	err := s.Flush()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, ser := range s.series {
+		ser.mux.Lock()
+		if errClose := ser.closeFiles(); err == nil {
+			err = errClose
+		}
+		ser.mux.Unlock()
+	}
+	return err
+}
+
+// enforceRetention deletes the segments older than MaxAge and the oldest
+// segments of the devices exceeding MaxBytes. The last segment of a device is
+// only deleted by age.
+func (s *Store) enforceRetention() error {
+	if s.opts.MaxAge <= 0 && s.opts.MaxBytes <= 0 {
+		return nil
+	}
+	minEpoch := int64(0)
+	if s.opts.MaxAge > 0 {
+		minEpoch = s.opts.Now().Add(-s.opts.MaxAge).UnixNano()
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var err error
+	for imei, ser := range s.series {
+		ser.mux.Lock()
+		total := int64(0)
+		for _, seg := range ser.segments {
+			total += seg.size
+		}
+		for len(ser.segments) > 0 {
+			oldest := ser.segments[0]
+			expired := oldest.lastEpoch < minEpoch
+			oversized := s.opts.MaxBytes > 0 && total > s.opts.MaxBytes && len(ser.segments) > 1
+			if !expired && !oversized {
+				break
+			}
+			if expired && len(ser.segments) == 1 {
+				ser.pending = ser.pending[:0]
+				ser.pendingIndex = ser.pendingIndex[:0]
+				if errClose := ser.closeFiles(); errClose != nil {
+					err = errClose
+				}
+			}
+			if errRemove := oldest.remove(); errRemove != nil {
+				err = errRemove
+				break
+			}
+			total -= oldest.size
+			ser.segments = ser.segments[1:]
+		}
+		empty := len(ser.segments) == 0
+		if empty {
+			// appends waiting for ser.mux must not use it anymore
+			ser.removed = true
+			delete(s.series, imei)
+			os.Remove(ser.dir)
+		}
+		ser.mux.Unlock()
+	}
+	return err
+}
+
+func (seg *segment) remove() error {
+	if err := os.Remove(seg.path + segmentExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(seg.path + indexExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// IMEIs returns the devices with stored readings.
+func (s *Store) IMEIs() []uint64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	imeis := make([]uint64, 0, len(s.series))
+	for imei := range s.series {
+		imeis = append(imeis, imei)
+	}
+	sort.Slice(imeis, func(i, j int) bool { return imeis[i] < imeis[j] })
+	return imeis
+}
+
+// Scan calls fn, in time order, for every stored reading of imei received in
+// [from, to] until fn returns false. Buffered records are included.
+func (s *Store) Scan(imei uint64, from, to int64, fn func(Entry) bool) error {
+	s.mux.Lock()
+	ser, exists := s.series[imei]
+	s.mux.Unlock()
+	if !exists {
+		return ErrNotFound
+	}
+
+	// work on a consistent copy so appends do not block on the scan
+	ser.mux.Lock()
+	segments := make([]segment, len(ser.segments))
+	for i, seg := range ser.segments {
+		segments[i] = *seg
+	}
+	pending := append([]byte(nil), ser.pending...)
+	ser.mux.Unlock()
+
+	for i := range segments {
+		seg := &segments[i]
+		if seg.lastEpoch < from || seg.firstEpoch > to {
+			continue
+		}
+		onDisk := seg.size
+		var buffered []byte
+		if i == len(segments)-1 {
+			onDisk -= int64(len(pending))
+			buffered = pending
+		}
+		more, err := seg.scan(from, to, onDisk, fn)
+		if err != nil || !more {
+			return err
+		}
+		if !scanRecords(buffered, from, to, fn) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// scan reads the records of seg stored on disk, starting from the last index
+// entry before from, it returns false once fn or the to limit stop the scan.
+func (seg *segment) scan(from, to int64, size int64, fn func(Entry) bool) (bool, error) {
+	start := int64(0)
+	i := sort.Search(len(seg.index), func(i int) bool { return seg.index[i].epoch > from })
+	if i > 0 {
+		start = seg.index[i-1].offset
+	}
+	if start >= size {
+		return true, nil
+	}
+
+	f, err := os.Open(seg.path + segmentExt)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// deleted by retention meanwhile
+			return true, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 256*RecordSize)
+	for offset := start; offset < size; {
+		n := int64(len(buf))
+		if size-offset < n {
+			n = size - offset
+		}
+		read, err := f.ReadAt(buf[:n], offset)
+		read = read / RecordSize * RecordSize
+		if read == 0 {
+			return false, err
+		}
+		if !scanRecords(buf[:read], from, to, fn) {
+			return false, nil
+		}
+		offset += int64(read)
+	}
+	return true, nil
+}
+
+// scanRecords calls fn for the valid records of data within [from, to], it
+// returns false once fn or the to limit stop the scan.
+func scanRecords(data []byte, from, to int64, fn func(Entry) bool) bool {
+	for i := 0; i+RecordSize <= len(data); i += RecordSize {
+		entry, ok := decodeRecord(data[i : i+RecordSize])
+		if !ok || entry.Epoch < from {
+			continue
+		}
+		if entry.Epoch > to {
+			return false
+		}
+		if !fn(entry) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testIMEI = uint64(490154203237518)
+
+func tempStore(t *testing.T, opts Options) (*Store, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "thermomatic-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func testPayload(i int) *[PayloadSize]byte {
+	var payload [PayloadSize]byte
+	for j := range payload {
+		payload[j] = byte(i + j)
+	}
+	return &payload
+}
+
+func appendN(t *testing.T, s *Store, imei uint64, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := s.Append(imei, int64(i*1000), testPayload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func scanAll(t *testing.T, s *Store, imei uint64, from, to int64) []Entry {
+	t.Helper()
+	var entries []Entry
+	err := s.Scan(imei, from, to, func(e Entry) bool {
+		entries = append(entries, e)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestStore_AppendScan(t *testing.T) {
+	s, _ := tempStore(t, Options{SegmentBytes: 10 * RecordSize, IndexInterval: 3})
+	appendN(t, s, testIMEI, 35)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := scanAll(t, s, testIMEI, 7000, 22000)
+	if len(entries) != 16 {
+		t.Fatalf("expected 16 entries got %d", len(entries))
+	}
+	for i, e := range entries {
+		if e.Epoch != int64((i+7)*1000) {
+			t.Errorf("entry %d: expected epoch %d got %d", i, (i+7)*1000, e.Epoch)
+		}
+		if e.Payload != *testPayload(i + 7) {
+			t.Errorf("entry %d: unexpected payload %v", i, e.Payload)
+		}
+	}
+
+	if segments := len(s.series[testIMEI].segments); segments != 4 {
+		t.Errorf("expected 4 segments of 10 records got %d", segments)
+	}
+}
+
+func TestStore_Scan_StopsWhenFnReturnsFalse(t *testing.T) {
+	s, _ := tempStore(t, Options{})
+	appendN(t, s, testIMEI, 10)
+
+	n := 0
+	s.Scan(testIMEI, 0, 1<<62, func(e Entry) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Errorf("expected the scan to stop after 3 entries got %d", n)
+	}
+}
+
+func TestStore_Scan_IncludesBufferedRecords(t *testing.T) {
+	s, _ := tempStore(t, Options{})
+	appendN(t, s, testIMEI, 5)
+	s.Flush()
+	s.Append(testIMEI, 5000, testPayload(5))
+
+	if entries := scanAll(t, s, testIMEI, 0, 1<<62); len(entries) != 6 {
+		t.Errorf("expected 6 entries got %d", len(entries))
+	}
+	if err := s.Scan(1, 0, 1, func(Entry) bool { return true }); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for an unknown device got %v", err)
+	}
+}
+
+func TestStore_Open_SurvivesRestart(t *testing.T) {
+	s, dir := tempStore(t, Options{SegmentBytes: 10 * RecordSize, IndexInterval: 4})
+	appendN(t, s, testIMEI, 25)
+	appendN(t, s, 448324242329542, 3)
+	s.Close()
+
+	reopened, err := Open(dir, Options{SegmentBytes: 10 * RecordSize, IndexInterval: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imeis := reopened.IMEIs(); len(imeis) != 2 {
+		t.Errorf("expected 2 devices got %v", imeis)
+	}
+	if entries := scanAll(t, reopened, testIMEI, 0, 1<<62); len(entries) != 25 {
+		t.Errorf("expected 25 entries got %d", len(entries))
+	}
+
+	// keeps appending to the last segment
+	reopened.Append(testIMEI, 25000, testPayload(25))
+	reopened.Flush()
+	if entries := scanAll(t, reopened, testIMEI, 24000, 1<<62); len(entries) != 2 {
+		t.Errorf("expected 2 entries got %d", len(entries))
+	}
+}
+
+func TestStore_Open_RecoversTornTail(t *testing.T) {
+	s, dir := tempStore(t, Options{IndexInterval: 4})
+	appendN(t, s, testIMEI, 10)
+	s.Close()
+
+	segment := s.series[testIMEI].segments[0].path + segmentExt
+	f, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a record written halfway by a crash
+	f.Write(appendRecord(nil, 10000, testPayload(10))[:30])
+	f.Close()
+
+	reopened, err := Open(dir, Options{IndexInterval: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := scanAll(t, reopened, testIMEI, 0, 1<<62); len(entries) != 10 {
+		t.Errorf("expected 10 entries got %d", len(entries))
+	}
+	if info, _ := os.Stat(segment); info.Size() != 10*RecordSize {
+		t.Errorf("expected the torn record to be truncated, size %d", info.Size())
+	}
+}
+
+func TestStore_Open_RecoversCorruptTail(t *testing.T) {
+	s, dir := tempStore(t, Options{IndexInterval: 4})
+	appendN(t, s, testIMEI, 10)
+	s.Close()
+
+	segment := s.series[testIMEI].segments[0].path + segmentExt
+	data, _ := ioutil.ReadFile(segment)
+	// corrupt the 9th record, so the 9th and 10th are dropped, and the index
+	// entry of the 9th too
+	data[8*RecordSize+10] ^= 0xFF
+	ioutil.WriteFile(segment, data, 0644)
+
+	reopened, err := Open(dir, Options{IndexInterval: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := scanAll(t, reopened, testIMEI, 0, 1<<62); len(entries) != 8 {
+		t.Errorf("expected 8 entries got %d", len(entries))
+	}
+	seg := reopened.series[testIMEI].segments[0]
+	if len(seg.index) != 2 {
+		t.Errorf("expected 2 index entries got %d", len(seg.index))
+	}
+	index, _ := ioutil.ReadFile(seg.path + indexExt)
+	if len(index) != 2*indexEntrySize {
+		t.Errorf("expected the index file to be rewritten with 2 entries, got %d bytes", len(index))
+	}
+}
+
+func TestStore_Retention_MaxBytes(t *testing.T) {
+	s, _ := tempStore(t, Options{SegmentBytes: 10 * RecordSize, MaxBytes: 25 * RecordSize})
+	appendN(t, s, testIMEI, 45)
+	s.Flush()
+
+	// 5 segments, 45 records: the 2 oldest ones go away
+	entries := scanAll(t, s, testIMEI, 0, 1<<62)
+	if len(entries) != 25 || entries[0].Epoch != 20000 {
+		t.Errorf("expected 25 entries from epoch 20000, got %d", len(entries))
+	}
+	files, _ := filepath.Glob(filepath.Join(s.series[testIMEI].dir, "*"+segmentExt))
+	if len(files) != 3 {
+		t.Errorf("expected 3 segment files got %d", len(files))
+	}
+}
+
+func TestStore_Retention_MaxAge(t *testing.T) {
+	now := time.Unix(0, 100000)
+	s, _ := tempStore(t, Options{
+		SegmentBytes: 10 * RecordSize,
+		MaxAge:       50 * time.Microsecond,
+		Now:          func() time.Time { return now },
+	})
+	appendN(t, s, testIMEI, 100)
+	s.Flush()
+
+	// segments with records newer than 50000 are kept
+	entries := scanAll(t, s, testIMEI, 0, 1<<62)
+	if len(entries) != 50 || entries[0].Epoch != 50000 {
+		t.Errorf("expected 50 entries from epoch 50000, got %d", len(entries))
+	}
+
+	expired := s.series[testIMEI]
+	now = time.Unix(0, 1000000)
+	s.Flush()
+	if imeis := s.IMEIs(); len(imeis) != 0 {
+		t.Errorf("expected every device to expire got %v", imeis)
+	}
+
+	// an append holding the expired series starts a new one in a new directory
+	if !expired.removed {
+		t.Error("expected the expired series to be flagged as removed")
+	}
+	if err := s.Append(testIMEI, 2000000, testPayload(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if entries := scanAll(t, s, testIMEI, 0, 1<<62); len(entries) != 1 || s.series[testIMEI] == expired {
+		t.Errorf("expected the reading in a new series, got %d entries", len(entries))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore_FlushIfDue(t *testing.T) {
+	now := time.Unix(100, 0)
+	s, _ := tempStore(t, Options{FlushInterval: time.Second, Now: func() time.Time { return now }})
+	appendN(t, s, testIMEI, 1)
+
+	s.FlushIfDue()
+	if len(s.series[testIMEI].pending) == 0 {
+		t.Error("expected the record to stay buffered before the flush interval")
+	}
+	now = now.Add(time.Second)
+	s.FlushIfDue()
+	if len(s.series[testIMEI].pending) != 0 {
+		t.Error("expected the record to be written after the flush interval")
+	}
+}
+
+func BenchmarkStore_Append(b *testing.B) {
+	dir, err := ioutil.TempDir("", "thermomatic-storage")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := Open(dir, Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	payload := testPayload(0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Append(testIMEI+uint64(i%100), int64(i), payload)
+		if i%10000 == 0 {
+			s.Flush()
+		}
+	}
+	s.Flush()
+	b.StopTimer()
+}
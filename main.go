@@ -1,32 +1,63 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spin-org/thermomatic/internal/device"
+	"github.com/spin-org/thermomatic/internal/logging"
 	"github.com/spin-org/thermomatic/internal/server"
 )
 
 func main() {
-	//Logging messages are written to os.Stderr.
-	log.SetOutput(os.Stderr)
 	initCommandLineInterface(
 		serverCommandHandler,
 		clientCommandHandler,
+		loadgenCommandHandler,
 	)
 }
 
-type serverHandler func(port uint, httpPort uint, serverMaxClients uint)
-type clientHandler func(clientServerAddress *string, clientImei *string, clientType *string, numReadings *uint, readingRateInMilliSeconds *uint)
+type serverHandler func(cfg server.Config)
+type clientHandler func(clientType string, cfg device.SimulatorConfig)
+type loadgenHandler func(cfg device.LoadConfig)
 
-func initCommandLineInterface(handleServerCmd serverHandler, handleClientCmd clientHandler) {
+func initCommandLineInterface(handleServerCmd serverHandler, handleClientCmd clientHandler, handleLoadgenCmd loadgenHandler) {
 	serverCmd := flag.NewFlagSet("server", flag.ExitOnError)
 	serverPort := serverCmd.Uint("port", 1337, "port number to listen for TCP connections of clients implementing the  thermomatic protocol")
 	serverHTTPPort := serverCmd.Uint("http-port", 80, "port number to listen for HTTP connections used mainly for healthchecks")
 	serverMaxClients := serverCmd.Uint("max-clients", 1000, "maximun number of active client connections  using the thermomatic protocol")
+	serverLoginPolicy := serverCmd.String("login-policy", server.LoginRejectNew.String(), "what to do when a device logs in with the IMEI of a connected device: reject-new, replace-old or allow-both")
+	serverShutdownTimeout := serverCmd.Duration("shutdown-timeout", server.DefaultShutdownTimeout, "maximum time to wait for connected devices, and then for HTTP requests, to finish on SIGINT or SIGTERM")
+	serverTLSCert := serverCmd.String("tls-cert", "", "PEM certificate of the device listener, devices connect over plain TCP when empty. It is reloaded when it changes")
+	serverTLSKey := serverCmd.String("tls-key", "", "PEM private key of the -tls-cert certificate")
+	serverTLSClientCA := serverCmd.String("tls-client-ca", "", "PEM certificates used to verify device certificates, it turns mutual TLS on. Certificates must be issued to the IMEI as common name")
+	serverCredentials := serverCmd.String("credentials", "", "file with the secret of every device, one 'imei secret' line per device. Devices must authenticate with their secret when it is set")
+	serverInventory := serverCmd.String("inventory", "", "JSON file listing the devices allowed to log in with their name, site, owner and state (allowed, denied or quarantined). Any device may log in when empty. It is reloaded on SIGHUP or when it changes")
+	serverMaxConnsPerIP := serverCmd.Uint("max-conns-per-ip", 0, "maximum number of open device connections from the same IP, 0 means no limit")
+	serverMaxPendingLogins := serverCmd.Uint("max-pending-logins", 1024, "maximum number of device connections which did not log in yet, 0 means no limit")
+	serverAcceptRate := serverCmd.Float64("accept-rate", 0, "device connections accepted per second, 0 means no limit")
+	serverAcceptBurst := serverCmd.Uint("accept-burst", 100, "device connections accepted at once when -accept-rate is set")
+	serverBanThreshold := serverCmd.Uint("ban-threshold", 0, "offenses within -ban-window that ban an IP, exceeding -max-conns-per-ip and closing a connection without logging in, unless the server refused the login, are offenses. 0 disables bans")
+	serverBanWindow := serverCmd.Duration("ban-window", time.Minute, "window where the offenses of an IP are counted")
+	serverBanDuration := serverCmd.Duration("ban-duration", 5*time.Minute, "how long an IP is banned")
+	serverRules := serverCmd.String("rules", "", "JSON file with the validation rules of the readings, default ones and per device overrides of the field ranges and the maximum temperature jump. The ranges of the protocol spec are used when empty")
+	serverAlerts := serverCmd.String("alerts", "", "JSON file with the alert rules, on temperature, battery level, offline devices and geofences, and the webhooks alerts are POSTed to. No alert is raised when empty")
+	serverGeofences := serverCmd.String("geofences", "", "JSON file with the circle and polygon geofences of devices and inventory sites, devices entering or exiting them are logged. It is created by the /geofences endpoints when missing. Positions are not tracked when empty")
+	serverSessionHistory := serverCmd.Int("session-history", 64, "number of finished sessions kept per device, served by /devices/:imei/sessions and /devices/:imei/uptime")
+	serverSessionsFile := serverCmd.String("sessions-file", "", "file where finished sessions are persisted as JSON lines, they are only kept in memory when empty")
+	serverDataDir := serverCmd.String("data-dir", "", "directory where readings are persisted, they are not persisted when empty")
+	serverRetentionAge := serverCmd.Duration("retention-age", 0, "how long persisted readings are kept, 0 keeps them forever")
+	serverRetentionBytes := serverCmd.Int64("retention-bytes", 0, "maximum size in bytes of the persisted readings of each device, 0 means no limit")
+	var serverSinks sinkFlags
+	serverCmd.Var(&serverSinks, "sink", "output sink for valid readings, it could be repeated. Format kind[:key=value,...] where kind is stdout, file or unix, e.g. file:path=readings.csv,max-bytes=10485760,backups=3,queue=1024,policy=block (default stdout)")
+	serverLogLevel := serverCmd.String("log-level", "info", "minimum level of the logged records: debug, info, warn or error")
+	serverLogFormat := serverCmd.String("log-format", "logfmt", "encoding of the logged records: logfmt or json")
 
 	clientCmd := flag.NewFlagSet("client", flag.ExitOnError)
 	clientServerAddress := clientCmd.String("server-address", "localhost:1337", "Address (host:port) of the Thermomatic server")
@@ -34,9 +65,35 @@ func initCommandLineInterface(handleServerCmd serverHandler, handleClientCmd cli
 	clientType := clientCmd.String("type", "random", "Automated simulated client type, it could be random, slow, too slow ")
 	clientNumReadings := clientCmd.Uint("readings", 5, "Number of automatic readings the automated client will send,  if equals 0  it sends an infite number of readings")
 	clientReadingRate := clientCmd.Uint("reading-rate", 25, "Number of milliseconds between each reading ")
+	clientProtocol := clientCmd.Uint("protocol", 1, "version of the thermomatic protocol spoken by the client, 1 or 2")
+	clientSecret := clientCmd.String("secret", "", "secret of the device, used to answer the login challenge of servers requiring authentication")
+	clientTLS := clientCmd.Bool("tls", false, "connect to the server over TLS")
+	clientCert := clientCmd.String("cert", "", "PEM file with the client certificate and its key, for mutual TLS. Its common name must be the IMEI")
+	clientCA := clientCmd.String("ca", "", "PEM file with the certificates trusted to verify the server, the system roots when empty")
+	clientLogLevel := clientCmd.String("log-level", "info", "minimum level of the logged records: debug, info, warn or error")
+	clientLogFormat := clientCmd.String("log-format", "logfmt", "encoding of the logged records: logfmt or json")
+
+	loadgenCmd := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	loadgenServerAddress := loadgenCmd.String("server-address", "localhost:1337", "Address (host:port) of the Thermomatic server")
+	loadgenDevices := loadgenCmd.Int("devices", 100, "number of simulated devices")
+	loadgenRampUp := loadgenCmd.Float64("ramp-up", 50, "devices started per second, 0 starts them all at once")
+	loadgenDuration := loadgenCmd.Duration("duration", time.Minute, "duration of the load test, 0 runs until SIGINT or SIGTERM")
+	loadgenReadingRate := loadgenCmd.Uint("reading-rate", 1000, "Number of milliseconds between each reading of the random, flapping and garbage devices")
+	loadgenJitter := loadgenCmd.Float64("jitter", 0.2, "fraction the reading and reconnect intervals vary by, e.g. 0.2 is ±20%")
+	loadgenProfiles := loadgenCmd.String("profiles", device.LoadRandom+"=100", "mix of the device profiles as comma separated profile=weight, the profiles are random, slow, too-slow, flapping and garbage, e.g. random=90,flapping=5,garbage=5")
+	loadgenFirstSerial := loadgenCmd.Uint64("first-serial", 35000000000000, "14 digit serial of the IMEI of the first device, the next devices have the next serials and every IMEI ends with its Luhn check digit")
+	loadgenProtocol := loadgenCmd.Uint("protocol", 1, "version of the thermomatic protocol spoken by the devices, 1 or 2")
+	loadgenTLS := loadgenCmd.Bool("tls", false, "connect to the server over TLS")
+	loadgenCA := loadgenCmd.String("ca", "", "PEM file with the certificates trusted to verify the server, the system roots when empty")
+	loadgenCert := loadgenCmd.String("cert", "", "PEM file with the client certificate and its key of each device, for mutual TLS. {imei} is replaced by the IMEI of the device, which must be the common name of its certificate, e.g. certs/{imei}.pem")
+	loadgenSecret := loadgenCmd.String("secret", "", "secret of every device, used to answer the login challenge of servers requiring authentication")
+	loadgenCredentials := loadgenCmd.String("credentials", "", "file with the secret of each device, one 'imei secret' line per device like the server one. The devices it does not list use -secret")
+	loadgenSeed := loadgenCmd.Int64("seed", 0, "seed of the jitter and of the garbage, the current time when 0")
+	loadgenLogLevel := loadgenCmd.String("log-level", "warn", "minimum level of the logged records: debug, info, warn or error")
+	loadgenLogFormat := loadgenCmd.String("log-format", "logfmt", "encoding of the logged records: logfmt or json")
 
 	if len(os.Args) < 2 {
-		fmt.Println("server or client subcommand is required")
+		fmt.Println("server, client or loadgen subcommand is required")
 		os.Exit(1)
 	}
 
@@ -47,9 +104,54 @@ func initCommandLineInterface(handleServerCmd serverHandler, handleClientCmd cli
 
 			serverCmd.Usage()
 		}
-		handleServerCmd(*serverPort, *serverHTTPPort, *serverMaxClients)
+		if err := setupLogging(*serverLogLevel, *serverLogFormat); err != nil {
+			fmt.Println(err)
+			serverCmd.Usage()
+			os.Exit(1)
+		}
+		loginPolicy, err := server.ParseLoginPolicy(*serverLoginPolicy)
+		if err != nil {
+			fmt.Println(err)
+			serverCmd.Usage()
+			os.Exit(1)
+		}
+		handleServerCmd(server.Config{
+			Port:            *serverPort,
+			HTTPPort:        *serverHTTPPort,
+			MaxClients:      *serverMaxClients,
+			LoginPolicy:     loginPolicy,
+			Sinks:           serverSinks,
+			ShutdownTimeout: *serverShutdownTimeout,
+			DataDir:         *serverDataDir,
+			TLSCertFile:     *serverTLSCert,
+			TLSKeyFile:      *serverTLSKey,
+			TLSClientCAFile: *serverTLSClientCA,
+			CredentialsFile: *serverCredentials,
+			InventoryFile:   *serverInventory,
+			RulesFile:       *serverRules,
+			AlertsFile:      *serverAlerts,
+			GeofencesFile:   *serverGeofences,
+			SessionHistory:  *serverSessionHistory,
+			SessionsFile:    *serverSessionsFile,
+			Limits: server.ConnLimits{
+				MaxConnsPerIP:    *serverMaxConnsPerIP,
+				MaxPendingLogins: *serverMaxPendingLogins,
+				AcceptRate:       *serverAcceptRate,
+				AcceptBurst:      *serverAcceptBurst,
+				BanThreshold:     *serverBanThreshold,
+				BanWindow:        *serverBanWindow,
+				BanDuration:      *serverBanDuration,
+			},
+			RetentionAge:   *serverRetentionAge,
+			RetentionBytes: *serverRetentionBytes,
+		})
 	case "client":
 		clientCmd.Parse(os.Args[2:])
+		if err := setupLogging(*clientLogLevel, *clientLogFormat); err != nil {
+			fmt.Println(err)
+			clientCmd.Usage()
+			os.Exit(1)
+		}
 		if *clientServerAddress == "" {
 			panic("Please use -server-address=host:port to connect ")
 		}
@@ -61,7 +163,70 @@ func initCommandLineInterface(handleServerCmd serverHandler, handleClientCmd cli
 		if *clientType == "" {
 			panic("-type is required, it could be random, slow or too-slow")
 		}
-		handleClientCmd(clientServerAddress, clientImei, clientType, clientNumReadings, clientReadingRate)
+		cfg := device.SimulatorConfig{
+			ServerAddress: *clientServerAddress,
+			IMEI:          *clientImei,
+			NumReadings:   *clientNumReadings,
+			ReadingRate:   time.Duration(*clientReadingRate) * time.Millisecond,
+			Protocol:      *clientProtocol,
+			Secret:        *clientSecret,
+		}
+		if *clientTLS || *clientCert != "" || *clientCA != "" {
+			tlsConfig, err := device.LoadClientTLSConfig(*clientCert, *clientCA)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			cfg.TLS = tlsConfig
+		}
+		handleClientCmd(*clientType, cfg)
+
+	case "loadgen":
+		loadgenCmd.Parse(os.Args[2:])
+		if err := setupLogging(*loadgenLogLevel, *loadgenLogFormat); err != nil {
+			fmt.Println(err)
+			loadgenCmd.Usage()
+			os.Exit(1)
+		}
+		mix, err := device.ParseLoadMix(*loadgenProfiles)
+		if err != nil {
+			fmt.Println(err)
+			loadgenCmd.Usage()
+			os.Exit(1)
+		}
+		cfg := device.LoadConfig{
+			ServerAddress: *loadgenServerAddress,
+			Devices:       *loadgenDevices,
+			RampUp:        *loadgenRampUp,
+			Duration:      *loadgenDuration,
+			ReadingRate:   time.Duration(*loadgenReadingRate) * time.Millisecond,
+			Jitter:        *loadgenJitter,
+			Mix:           mix,
+			FirstSerial:   *loadgenFirstSerial,
+			Protocol:      *loadgenProtocol,
+			Seed:          *loadgenSeed,
+		}
+		if *loadgenTLS || *loadgenCert != "" || *loadgenCA != "" {
+			tlsConfig, err := device.LoadClientTLSConfig("", *loadgenCA)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			cfg.TLS = tlsConfig
+			cfg.CertFile = *loadgenCert
+		}
+		if *loadgenSecret != "" {
+			cfg.Secret = []byte(*loadgenSecret)
+		}
+		if *loadgenCredentials != "" {
+			secrets, err := server.LoadCredentials(*loadgenCredentials)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			cfg.Secrets = secrets
+		}
+		handleLoadgenCmd(cfg)
 
 	default:
 		flag.PrintDefaults()
@@ -69,22 +234,73 @@ func initCommandLineInterface(handleServerCmd serverHandler, handleClientCmd cli
 	}
 }
 
-func serverCommandHandler(port uint, httpPort uint, serverMaxClients uint) {
+func serverCommandHandler(cfg server.Config) {
 
-	server.Start(port, httpPort, serverMaxClients)
+	if err := server.Start(cfg); err != nil {
+		logging.Error("starting server", logging.F("err", err))
+		os.Exit(1)
+	}
+}
+
+// setupLogging makes the default logger write the records of level or above
+// to stderr, encoded in format.
+func setupLogging(level, format string) error {
+	l, err := logging.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	f, err := logging.ParseFormat(format)
+	if err != nil {
+		return err
+	}
+	logging.SetDefault(logging.New(os.Stderr, l, f))
+	return nil
+}
+
+// sinkFlags collects every -sink flag of the server subcommand
+type sinkFlags []server.SinkConfig
+
+func (s *sinkFlags) String() string {
+	specs := make([]string, len(*s))
+	for i, cfg := range *s {
+		specs[i] = cfg.String()
+	}
+	return strings.Join(specs, " ")
+}
+
+func (s *sinkFlags) Set(spec string) error {
+	cfg, err := server.ParseSinkConfig(spec)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, cfg)
+	return nil
+}
+
+// loadgenCommandHandler runs the load test until its duration elapses, or
+// until SIGINT or SIGTERM, and prints its report.
+func loadgenCommandHandler(cfg device.LoadConfig) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := device.RunLoad(ctx, cfg)
+	if err != nil {
+		logging.Error("running load test", logging.F("err", err))
+		os.Exit(1)
+	}
+	fmt.Print(report)
 }
 
-func clientCommandHandler(clientServerAddress *string, clientImei *string, clientType *string, numReadings *uint, readingRateInMilliSeconds *uint) {
+func clientCommandHandler(clientType string, cfg device.SimulatorConfig) {
 
-	switch *clientType {
+	switch clientType {
 	case "random":
-		device.Randomatic(clientServerAddress, clientImei, numReadings, readingRateInMilliSeconds)
+		device.Randomatic(cfg)
 	case "slow":
-		device.Slowmatic(clientServerAddress, clientImei, numReadings)
+		device.Slowmatic(cfg)
 	case "too-slow":
-		device.TooSlowToPlayWithGrownups(clientServerAddress, clientImei, numReadings)
+		device.TooSlowToPlayWithGrownups(cfg)
 	default:
-		panic(fmt.Sprintf("unknown clientType %s", *clientType))
+		panic(fmt.Sprintf("unknown clientType %s", clientType))
 	}
 
 }
@@ -6,14 +6,28 @@
 #      scripts/client.sh  <options>
 #
 #   the following options are available:
+#      -ca string
+#             PEM file with the certificates trusted to verify the server, the system roots when empty
+#      -cert string
+#             PEM file with the client certificate and its key, for mutual TLS. Its common name must be the IMEI
 #      -imei string
 #             Device IMEI number
+#      -log-format string
+#             encoding of the logged records: logfmt or json (default "logfmt")
+#      -log-level string
+#             minimum level of the logged records: debug, info, warn or error (default "info")
+#      -protocol uint
+#             version of the thermomatic protocol spoken by the client, 1 or 2 (default 1)
 #      -readings uint
 #             Number of automatic readings the automated client will send,  if equals 0  it sends an infite number of readings (default 5)
 #      -reading-rate uint
 #             Number of milliseconds between each reading (default 25)
+#      -secret string
+#             secret of the device, used to answer the login challenge of servers requiring authentication
 #      -server-address string
 #             Address (host:port) of the Thermomatic server (default "localhost:1337")
+#      -tls
+#             connect to the server over TLS
 #      -type string
 #             Automated simulated client type, it could be random, slow, too slow  (default "random")
 #  
@@ -0,0 +1,49 @@
+#!/usr/bin/env bash
+#
+#  runs a load test with a fleet of simulated thermomatic devices in a single
+#  process, and prints its report
+#
+#   usage
+#      scripts/loadgen.sh  <options>
+#
+#   the following options are available:
+#      -ca string
+#             PEM file with the certificates trusted to verify the server, the system roots when empty
+#      -cert string
+#             PEM file with the client certificate and its key of each device, for mutual TLS. {imei} is replaced by the IMEI of the device, which must be the common name of its certificate, e.g. certs/{imei}.pem
+#      -credentials string
+#             file with the secret of each device, one 'imei secret' line per device like the server one. The devices it does not list use -secret
+#      -devices int
+#             number of simulated devices (default 100)
+#      -duration duration
+#             duration of the load test, 0 runs until SIGINT or SIGTERM (default 1m0s)
+#      -first-serial uint
+#             14 digit serial of the IMEI of the first device, the next devices have the next serials and every IMEI ends with its Luhn check digit (default 35000000000000)
+#      -jitter float
+#             fraction the reading and reconnect intervals vary by, e.g. 0.2 is ±20% (default 0.2)
+#      -log-format string
+#             encoding of the logged records: logfmt or json (default "logfmt")
+#      -log-level string
+#             minimum level of the logged records: debug, info, warn or error (default "warn")
+#      -profiles string
+#             mix of the device profiles as comma separated profile=weight, the profiles are random, slow, too-slow, flapping and garbage, e.g. random=90,flapping=5,garbage=5 (default "random=100")
+#      -protocol uint
+#             version of the thermomatic protocol spoken by the devices, 1 or 2 (default 1)
+#      -ramp-up float
+#             devices started per second, 0 starts them all at once (default 50)
+#      -reading-rate uint
+#             Number of milliseconds between each reading of the random, flapping and garbage devices (default 1000)
+#      -secret string
+#             secret of every device, used to answer the login challenge of servers requiring authentication
+#      -seed int
+#             seed of the jitter and of the garbage, the current time when 0
+#      -server-address string
+#             Address (host:port) of the Thermomatic server (default "localhost:1337")
+#      -tls
+#             connect to the server over TLS
+#
+#   e.g. 2000 devices, 10% of them misbehaving, for 5 minutes
+#      scripts/loadgen.sh -devices=2000 -ramp-up=200 -duration=5m -profiles=random=90,flapping=4,slow=2,too-slow=2,garbage=2
+set -euo pipefail
+
+go run main.go loadgen "$@" 2>loadgen.log
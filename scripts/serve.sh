@@ -7,12 +7,69 @@
 #
 #   the following options are available:
 # 
+#        -accept-burst uint
+#                device connections accepted at once when -accept-rate is set (default 100)
+#        -accept-rate float
+#                device connections accepted per second, 0 means no limit
+#        -alerts string
+#                JSON file with the alert rules, on temperature, battery level, offline devices and geofences, and the webhooks
+#                alerts are POSTed to. No alert is raised when empty
+#        -ban-duration duration
+#                how long an IP is banned (default 5m0s)
+#        -ban-threshold uint
+#                offenses within -ban-window that ban an IP, exceeding -max-conns-per-ip and closing a connection
+#                without logging in are offenses. 0 disables bans
+#        -ban-window duration
+#                window where the offenses of an IP are counted (default 1m0s)
+#        -credentials string
+#                file with the secret of every device, one 'imei secret' line per device. Devices must authenticate with their secret when it is set
+#        -data-dir string
+#                directory where readings are persisted, they are not persisted when empty
+#        -geofences string
+#                JSON file with the circle and polygon geofences of devices and inventory sites, devices entering or exiting
+#                them are logged. It is created by the /geofences endpoints when missing. Positions are not tracked when empty
 #        -http-port uint
 #                port number to listen for HTTP connections used mainly for healthchecks (default 80)
+#        -inventory string
+#                JSON file listing the devices allowed to log in with their name, site, owner and state (allowed, denied or quarantined).
+#                Any device may log in when empty. It is reloaded on SIGHUP or when it changes
+#        -log-format string
+#                encoding of the logged records: logfmt or json (default "logfmt")
+#        -log-level string
+#                minimum level of the logged records: debug, info, warn or error (default "info")
+#        -login-policy string
+#                what to do when a device logs in with the IMEI of a connected device: reject-new, replace-old or allow-both (default "reject-new")
 #        -max-clients uint
 #                maximun number of active client connections  using the thermomatic protocol (default 1000)
+#        -max-conns-per-ip uint
+#                maximum number of open device connections from the same IP, 0 means no limit
+#        -max-pending-logins uint
+#                maximum number of device connections which did not log in yet, 0 means no limit (default 1024)
 #        -port uint
-#                port number to listen for TCP connections of clients implementing the  thermomatic protocol (default 1337)# 
+#                port number to listen for TCP connections of clients implementing the  thermomatic protocol (default 1337)
+#        -retention-age duration
+#                how long persisted readings are kept, 0 keeps them forever
+#        -retention-bytes int
+#                maximum size in bytes of the persisted readings of each device, 0 means no limit
+#        -rules string
+#                JSON file with the validation rules of the readings, default ones and per device overrides of the field ranges
+#                and the maximum temperature jump. The ranges of the protocol spec are used when empty
+#        -session-history int
+#                number of finished sessions kept per device, served by /devices/:imei/sessions and /devices/:imei/uptime (default 64)
+#        -sessions-file string
+#                file where finished sessions are persisted as JSON lines, they are only kept in memory when empty
+#        -shutdown-timeout duration
+#                maximum time to wait for connected devices, and then for HTTP requests, to finish on SIGINT or SIGTERM (default 10s)
+#        -sink value
+#                output sink for valid readings, it could be repeated. Format kind[:key=value,...]
+#                where kind is stdout, file or unix (default stdout)
+#        -tls-cert string
+#                PEM certificate of the device listener, devices connect over plain TCP when empty. It is reloaded when it changes
+#        -tls-client-ca string
+#                PEM certificates used to verify device certificates, it turns mutual TLS on. Certificates must be issued to the IMEI as common name
+#        -tls-key string
+#                PEM private key of the -tls-cert certificate
+#
 set -euo pipefail
 
 go run main.go server "$@"  > server-output.txt 2>server.log